@@ -2,12 +2,18 @@ package app
 
 import (
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/endpoint"
 	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/signals"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/k3s-io/kine/pkg/valuestore"
 	"github.com/k3s-io/kine/pkg/version"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -17,6 +23,12 @@ var (
 	config                 endpoint.Config
 	metricsConfig          metrics.Config
 	metricsIgnoreTLSConfig bool
+	metricsEnableAdmin     bool
+	columnTypes            cli.StringSlice
+	sniCertificates        cli.StringSlice
+	compactExclude         cli.StringSlice
+	lowPriorityPrefixes    cli.StringSlice
+	slowSQLRedactPrefixes  = cli.NewStringSlice(metrics.SlowSQLRedactPrefixes...)
 )
 
 func New() *cli.App {
@@ -37,6 +49,12 @@ func New() *cli.App {
 			Destination: &config.Endpoint,
 			EnvVars:     []string{"KINE_ENDPOINT"},
 		},
+		&cli.StringFlag{
+			Name:        "compact-endpoint",
+			Usage:       "Storage endpoint used for compaction, allowing compaction to use separate credentials or resource limits. Must use the same scheme as the storage endpoint. Default is to use the storage endpoint.",
+			Destination: &config.CompactEndpoint,
+			EnvVars:     []string{"KINE_COMPACT_ENDPOINT"},
+		},
 		&cli.StringFlag{
 			Name:        "ca-file",
 			Usage:       "CA cert for DB connection",
@@ -69,9 +87,23 @@ func New() *cli.App {
 			Value:       "plain",
 			EnvVars:     []string{"KINE_LOG_FORMAT"},
 		},
+		&cli.StringFlag{
+			Name:        "request-id-header",
+			Usage:       "gRPC request metadata key to read client-supplied request ids from. Request ids are included in logs for the request, and a new id is generated if the client does not supply one.",
+			Destination: &config.RequestIDHeader,
+			Value:       endpoint.DefaultRequestIDHeader,
+			EnvVars:     []string{"KINE_REQUEST_ID_HEADER"},
+		},
+		&cli.DurationFlag{
+			Name:        "idempotency-window",
+			Usage:       "Duration for which the results of write requests carrying the kine-idempotency-key request metadata are held, so that retries with the same key return the original result instead of being applied again. Results are held in memory, so only retries served by the same kine instance are deduplicated. Set to 0 to disable. Default is 5m.",
+			Destination: &config.IdempotencyWindow,
+			Value:       5 * time.Minute,
+			EnvVars:     []string{"KINE_IDEMPOTENCY_WINDOW"},
+		},
 		&cli.StringFlag{
 			Name:        "metrics-bind-address",
-			Usage:       "The address the metric endpoint binds to. Default :8080, set 0 to disable metrics serving.",
+			Usage:       "The address the metric and /health endpoints bind to. Default :8080, set 0 to disable metrics serving.",
 			Destination: &metricsConfig.ServerAddress,
 			Value:       ":8080",
 			EnvVars:     []string{"KINE_METRICS_BIND_ADDRESS"},
@@ -88,6 +120,12 @@ func New() *cli.App {
 			Destination: &config.ServerTLSConfig.KeyFile,
 			EnvVars:     []string{"KINE_SERVER_KEY_FILE"},
 		},
+		&cli.StringSliceFlag{
+			Name:        "server-sni-cert",
+			Usage:       "Certificate and key for etcd connection, in the form cert-file:key-file, served instead of the server certificate to clients that request a server name that it is valid for. May be specified multiple times; the first matching certificate is served. Requires --server-cert-file and --server-key-file.",
+			Destination: &sniCertificates,
+			EnvVars:     []string{"KINE_SERVER_SNI_CERT"},
+		},
 		&cli.StringFlag{
 			Name:        "trusted-ca-file",
 			Usage:       "CA certificate for verifying client certificates",
@@ -115,6 +153,37 @@ func New() *cli.App {
 			Value:       0,
 			EnvVars:     []string{"KINE_DATASTORE_CONNECTION_MAX_LIFETIME"},
 		},
+		&cli.IntFlag{
+			Name:        "datastore-statement-affinity",
+			Usage:       "Number of pools to split datastore connections across, with each statement routed to the same pool while it has connections available, to improve prepared statement reuse. Connection limits are divided between pools; statements spill over to other pools when their own is fully in use. If value <= 1, affinity is disabled.",
+			Destination: &config.ConnectionPoolConfig.StatementAffinity,
+			Value:       0,
+			EnvVars:     []string{"KINE_DATASTORE_STATEMENT_AFFINITY"},
+		},
+		&cli.BoolFlag{
+			Name:        "datastore-validate-connections",
+			Usage:       "Run a driver-specific validation query on datastore connections before they are reused, replacing connections on which the query fails. This detects half-open connections at the cost of an extra round-trip per use.",
+			Destination: &config.ConnectionPoolConfig.ValidateConnections,
+			EnvVars:     []string{"KINE_DATASTORE_VALIDATE_CONNECTIONS"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "datastore-column-type",
+			Usage:       "Column type to use in place of the default when creating the datastore table, in the form column=type. May be specified multiple times. Only types known to be safe for the datastore driver are accepted.",
+			Destination: &columnTypes,
+			EnvVars:     []string{"KINE_DATASTORE_COLUMN_TYPE"},
+		},
+		&cli.BoolFlag{
+			Name:        "datastore-rebuild-missing-indexes",
+			Usage:       "Recreate any expected datastore indexes that are found to be missing at startup. Missing indexes are always logged. Default is false.",
+			Destination: &config.RebuildMissingIndexes,
+			EnvVars:     []string{"KINE_DATASTORE_REBUILD_MISSING_INDEXES"},
+		},
+		&cli.BoolFlag{
+			Name:        "datastore-disable-schema-migrations",
+			Usage:       "Do not create or migrate the datastore schema at startup; instead, fail if the expected schema and schema version are not already present. Default is false.",
+			Destination: &config.DisableSchemaMigrations,
+			EnvVars:     []string{"KINE_DATASTORE_DISABLE_SCHEMA_MIGRATIONS"},
+		},
 		&cli.DurationFlag{
 			Name:        "slow-sql-threshold",
 			Usage:       "The duration which SQL executed longer than will be logged at level info. Default 1s, set <= 0 to disable slow SQL log.",
@@ -129,12 +198,49 @@ func New() *cli.App {
 			Value:       5 * time.Second,
 			EnvVars:     []string{"KINE_SLOW_SQL_WARNING_THRESHOLD"},
 		},
+		&cli.BoolFlag{
+			Name:        "sql-acquire-tracing",
+			Usage:       "Record the time that each SQL statement waits for a connection from the pool in kine_sql_acquire_time_seconds, separately from the time spent running it in kine_sql_time_seconds. Waits longer than --slow-sql-threshold are logged. Statements in transactions are not traced. Default is false.",
+			Destination: &config.AcquireTracing,
+			EnvVars:     []string{"KINE_SQL_ACQUIRE_TRACING"},
+		},
+		&cli.BoolFlag{
+			Name:        "slow-sql-log-args",
+			Usage:       "Include bind arguments in the slow SQL log. Values written to keys under a redacted prefix are never logged. Default is false.",
+			Destination: &metrics.SlowSQLLogArgs,
+			EnvVars:     []string{"KINE_SLOW_SQL_LOG_ARGS"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "slow-sql-redact-prefix",
+			Usage:       "Key prefix whose values are redacted when logging bind arguments. May be specified multiple times. Default is /registry/secrets/.",
+			Destination: slowSQLRedactPrefixes,
+			EnvVars:     []string{"KINE_SLOW_SQL_REDACT_PREFIX"},
+		},
+		&cli.StringFlag{
+			Name:        "slow-sql-redact-mode",
+			Usage:       "How redacted values are logged: 'hash' logs a truncated SHA-256 hash, 'elide' logs only the length. Default is hash.",
+			Destination: &metrics.SlowSQLRedactMode,
+			Value:       util.RedactHash,
+			EnvVars:     []string{"KINE_SLOW_SQL_REDACT_MODE"},
+		},
 		&cli.BoolFlag{
 			Name:        "metrics-enable-profiling",
 			Usage:       "Enable net/http/pprof handlers on the metrics bind address. Default is false.",
 			Destination: &metricsConfig.EnableProfiling,
 			EnvVars:     []string{"KINE_METRICS_ENABLE_PROFILING"},
 		},
+		&cli.BoolFlag{
+			Name:        "metrics-enable-admin",
+			Usage:       "Enable runtime administration handlers under /admin/ on the metrics bind address. Requests that change state are only served on a loopback bind address, or over TLS to clients presenting a certificate signed by --trusted-ca-file. Default is false.",
+			Destination: &metricsEnableAdmin,
+			EnvVars:     []string{"KINE_METRICS_ENABLE_ADMIN"},
+		},
+		&cli.IntFlag{
+			Name:        "metrics-prefix-depth",
+			Usage:       "Number of key path segments to group keys by for per-prefix write and key count metrics. For example, a depth of 2 groups /registry/pods/ns/name under /registry/pods. Default is 0 (disabled).",
+			Destination: &config.PrefixMetricsDepth,
+			EnvVars:     []string{"KINE_METRICS_PREFIX_DEPTH"},
+		},
 		&cli.BoolFlag{
 			Name:        "metrics-ignore-tls-config",
 			Usage:       "Ignore TLS config for metrics server. Default is false.",
@@ -177,6 +283,18 @@ func New() *cli.App {
 			Value:       5 * time.Second,
 			EnvVars:     []string{"KINE_COMPACT_TIMEOUT"},
 		},
+		&cli.DurationFlag{
+			Name:        "read-timeout",
+			Usage:       "Timeout for each datastore read, such as a list or count. A shorter client deadline is still respected. Default is 0 (no timeout).",
+			Destination: &config.ReadTimeout,
+			EnvVars:     []string{"KINE_READ_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "write-timeout",
+			Usage:       "Timeout for each datastore write. This may be longer than the read timeout, so that writes tolerate more backend latency than reads. A shorter client deadline is still respected. Default is 0 (no timeout).",
+			Destination: &config.WriteTimeout,
+			EnvVars:     []string{"KINE_WRITE_TIMEOUT"},
+		},
 		&cli.Int64Flag{
 			Name:        "compact-min-retain",
 			Usage:       "Minimum number of revisions to retain when compacting. Default is 1000.",
@@ -191,6 +309,57 @@ func New() *cli.App {
 			Value:       1000,
 			EnvVars:     []string{"KINE_COMPACT_BATCH_SIZE"},
 		},
+		&cli.Int64Flag{
+			Name:        "compact-burst-threshold",
+			Usage:       "Compaction backlog, in revisions, above which compaction runs back-to-back at startup until caught up. Default is 0 (disabled).",
+			Destination: &config.CompactBurstThreshold,
+			Value:       0,
+			EnvVars:     []string{"KINE_COMPACT_BURST_THRESHOLD"},
+		},
+		&cli.BoolFlag{
+			Name:        "compact-verify",
+			Usage:       "Verify after each compaction transaction that no current key was removed and that the compact revision is consistent with the remaining rows. Violations are logged and counted in the kine_compact_verify_total metric. Each verification scans the table. Default is false.",
+			Destination: &config.CompactVerify,
+			EnvVars:     []string{"KINE_COMPACT_VERIFY"},
+		},
+		&cli.Int64Flag{
+			Name:        "compact-analyze-threshold",
+			Usage:       "Number of rows that compaction must delete before the datastore's optimizer statistics are refreshed with ANALYZE. Default is 0 (disabled).",
+			Destination: &config.CompactAnalyzeThreshold,
+			Value:       0,
+			EnvVars:     []string{"KINE_COMPACT_ANALYZE_THRESHOLD"},
+		},
+		&cli.DurationFlag{
+			Name:        "compact-analyze-interval",
+			Usage:       "Minimum time between refreshes of the datastore's optimizer statistics after compaction. Default is 1h.",
+			Destination: &config.CompactAnalyzeInterval,
+			Value:       time.Hour,
+			EnvVars:     []string{"KINE_COMPACT_ANALYZE_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:        "compact-min-interval",
+			Usage:       "Minimum time between the end of one compaction and the start of the next. Compactions triggered within this time, automatically or on demand, are skipped. Default is 0 (no minimum).",
+			Destination: &config.CompactMinInterval,
+			EnvVars:     []string{"KINE_COMPACT_MIN_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:        "compact-manual-bypass",
+			Usage:       "Always run compactions requested on demand, even within --compact-min-interval. Default is false.",
+			Destination: &config.CompactManualBypass,
+			EnvVars:     []string{"KINE_COMPACT_MANUAL_BYPASS"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "compact-exclude",
+			Usage:       "Key whose history is never compacted, or a prefix ending in / excluding all keys under it, so that reads of the key at compacted revisions are served. May be specified multiple times.",
+			Destination: &compactExclude,
+			EnvVars:     []string{"KINE_COMPACT_EXCLUDE"},
+		},
+		&cli.BoolFlag{
+			Name:        "elide-noop-updates",
+			Usage:       "Skip writing updates that change neither the value nor the lease of a key, and report the key's existing revision instead. Such updates are not seen by watchers. Only supported by SQL datastores. Default is false.",
+			Destination: &config.ElideNoopUpdates,
+			EnvVars:     []string{"KINE_ELIDE_NOOP_UPDATES"},
+		},
 		&cli.Int64Flag{
 			Name:        "poll-batch-size",
 			Usage:       "Number of revisions to poll in a single batch. Default is 500.",
@@ -198,16 +367,190 @@ func New() *cli.App {
 			Value:       500,
 			EnvVars:     []string{"KINE_POLL_BATCH_SIZE"},
 		},
+		&cli.IntFlag{
+			Name:        "watch-history-size",
+			Usage:       "Number of recent events to hold in memory, so that watches starting at a recent revision can be caught up without querying the datastore. Default is 0 (disabled).",
+			Destination: &config.WatchHistorySize,
+			Value:       0,
+			EnvVars:     []string{"KINE_WATCH_HISTORY_SIZE"},
+		},
+		&cli.Int64Flag{
+			Name:        "watch-history-window",
+			Usage:       "Number of most recent revisions for which the watch history holds every event. Older events are dropped from the history once a later event for the same key is held, so that frequent updates to a few keys do not fill it. Default is 0 (disabled).",
+			Destination: &config.WatchHistoryWindow,
+			Value:       0,
+			EnvVars:     []string{"KINE_WATCH_HISTORY_WINDOW"},
+		},
+		&cli.Int64Flag{
+			Name:        "watch-prefetch",
+			Usage:       "Number of revisions to read ahead while writes are sustained: instead of querying for new events on each write, the poll loop briefly waits for this many writes so that they are read by a single query. Default is 0 (disabled).",
+			Destination: &config.WatchPrefetch,
+			Value:       0,
+			EnvVars:     []string{"KINE_WATCH_PREFETCH"},
+		},
+		&cli.BoolFlag{
+			Name:        "watch-shared-delivery",
+			Usage:       "Filter each batch of polled events once per watched prefix and deliver the same batch to every watch on that prefix, instead of filtering it separately for each watch. Reduces CPU use when many clients watch the same prefix. A watch that falls behind is closed. Default is false.",
+			Destination: &config.WatchSharedDelivery,
+			EnvVars:     []string{"KINE_WATCH_SHARED_DELIVERY"},
+		},
+		&cli.Int64Flag{
+			Name:        "watch-max-lag",
+			Usage:       "Maximum number of revisions that a watch may fall behind the current revision before it is cancelled, so that slow clients re-establish their watch instead of accumulating a backlog. Events up to the revision at which the watch was created are not counted. Default is 0 (unlimited).",
+			Destination: &config.MaxWatchLag,
+			EnvVars:     []string{"KINE_WATCH_MAX_LAG"},
+		},
+		&cli.BoolFlag{
+			Name:        "watch-verify-order",
+			Usage:       "Check that each watch receives events from the datastore in strictly increasing revision order, logging and counting any violations. Intended for debugging; adds overhead to every watch.",
+			Destination: &config.VerifyWatchOrder,
+			EnvVars:     []string{"KINE_WATCH_VERIFY_ORDER"},
+		},
+		&cli.StringFlag{
+			Name:        "event-bridge-sink",
+			Usage:       "URL of an HTTP endpoint (http://, https://), NATS subject (nats://host:port/subject), or Kafka topic (kafka://broker1:port,broker2:port/topic) to publish all key changes to as CloudEvents. Kafka sinks accept tls, ca-file, cert-file, key-file and sasl query parameters, and resume from the last published revision on restart. Default is disabled.",
+			Destination: &config.EventBridge.Sink,
+			EnvVars:     []string{"KINE_EVENT_BRIDGE_SINK"},
+		},
+		&cli.IntFlag{
+			Name:        "event-bridge-buffer-size",
+			Usage:       "Maximum number of events to buffer while the event bridge sink is unavailable. The oldest events are dropped when the buffer is full, except for Kafka sinks, which wait for room instead. Default is 1000.",
+			Destination: &config.EventBridge.BufferSize,
+			Value:       1000,
+			EnvVars:     []string{"KINE_EVENT_BRIDGE_BUFFER_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:        "standby-endpoint",
+			Usage:       "Storage endpoint of a warm standby datastore. All keys are copied to it at startup, and all later key changes are replicated to it asynchronously, so that it can be used as a failover target; writes are not blocked if it is unavailable. Default is disabled.",
+			Destination: &config.Standby.Endpoint,
+			EnvVars:     []string{"KINE_STANDBY_ENDPOINT"},
+		},
+		&cli.IntFlag{
+			Name:        "standby-buffer-size",
+			Usage:       "Maximum number of key changes to buffer while the standby datastore is unavailable or falling behind. When the buffer is full, all keys are copied to the standby again once it catches up. Default is 1000.",
+			Destination: &config.Standby.BufferSize,
+			Value:       1000,
+			EnvVars:     []string{"KINE_STANDBY_BUFFER_SIZE"},
+		},
+		&cli.Int64Flag{
+			Name:        "range-page-size",
+			Usage:       "Number of keys to read from the datastore at a time when serving list requests without a limit, or with a limit larger than this value. Set to 0 to read all keys in a single query. Default is 10000.",
+			Destination: &config.RangePageSize,
+			Value:       10000,
+			EnvVars:     []string{"KINE_RANGE_PAGE_SIZE"},
+		},
+		&cli.Int64Flag{
+			Name:        "max-unbounded-range-keys",
+			Usage:       "Maximum number of keys that a range request without a limit may cover. Larger requests are rejected unless the client sets the kine-allow-unbounded-range request metadata to true. Default is 0 (no maximum).",
+			Destination: &config.MaxUnboundedRangeKeys,
+			EnvVars:     []string{"KINE_MAX_UNBOUNDED_RANGE_KEYS"},
+		},
+		&cli.IntFlag{
+			Name:        "max-txn-ops",
+			Usage:       "Maximum number of compares, and of operations in each branch, of a single Txn request. Larger requests are rejected with etcd's too many operations error. Set to -1 for no maximum. Default is 128, as in etcd.",
+			Destination: &config.MaxTxnOps,
+			Value:       server.DefaultMaxTxnOps,
+			EnvVars:     []string{"KINE_MAX_TXN_OPS"},
+		},
+		&cli.IntFlag{
+			Name:        "max-high-priority-requests",
+			Usage:       "Maximum number of high priority requests in progress at once; further requests wait for one to complete. Writes and single key reads are high priority, unless the client sets the kine-priority request metadata to low. Default is 0 (unlimited).",
+			Destination: &config.MaxHighPriorityRequests,
+			EnvVars:     []string{"KINE_MAX_HIGH_PRIORITY_REQUESTS"},
+		},
+		&cli.IntFlag{
+			Name:        "max-low-priority-requests",
+			Usage:       "Maximum number of low priority requests in progress at once; further requests wait for one to complete, without delaying high priority requests. Lists and requests for keys under --low-priority-prefix are low priority, unless the client sets the kine-priority request metadata to high. Default is 0 (unlimited).",
+			Destination: &config.MaxLowPriorityRequests,
+			EnvVars:     []string{"KINE_MAX_LOW_PRIORITY_REQUESTS"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "low-priority-prefix",
+			Usage:       "Key prefix whose requests are low priority. May be specified multiple times.",
+			Destination: &lowPriorityPrefixes,
+			EnvVars:     []string{"KINE_LOW_PRIORITY_PREFIX"},
+		},
+		&cli.Int64Flag{
+			Name:        "revision-floor",
+			Usage:       "Minimum revision to assign to new writes. If the current revision is lower at startup, it is advanced to this value. Use after restoring a datastore from backup to ensure that clients never observe a revision lower than one they have already seen. Default is 0 (disabled).",
+			Destination: &config.RevisionFloor,
+			EnvVars:     []string{"KINE_REVISION_FLOOR"},
+		},
+		&cli.Int64Flag{
+			Name:        "revision-block-size",
+			Usage:       "Number of revisions to reserve at a time for assignment to new writes, instead of using the database's auto-increment id. Reduces contention on the id generator under high write concurrency; all servers sharing a datastore should use the same setting. Default is 0 (disabled).",
+			Destination: &config.RevisionBlockSize,
+			EnvVars:     []string{"KINE_REVISION_BLOCK_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:        "revision-mark-interval",
+			Usage:       "Interval at which to record the current revision outside the kine table. At startup, new writes are assigned revisions above the recorded revision, so that revisions do not go backwards if the kine table is truncated or recreated. Revisions written since the last record may still be reused; combine with --revision-floor to cover them. Default is 0 (disabled).",
+			Destination: &config.RevisionMarkInterval,
+			EnvVars:     []string{"KINE_REVISION_MARK_INTERVAL"},
+		},
+		&cli.Int64Flag{
+			Name:        "partition-size",
+			Usage:       "Number of revisions per partition when range-partitioning the kine table by id. Only supported by PostgreSQL. Partitions are created ahead of the current revision, and partitions below the compact revision are dropped once compaction has left them empty. Only applies when the kine table is created; an existing table is not partitioned. Default is 0 (disabled).",
+			Destination: &config.PartitionSize,
+			EnvVars:     []string{"KINE_PARTITION_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:        "connection-backoff",
+			Usage:       "Maximum delay applied to new datastore statements while the datastore is rejecting connections because too many are open. The delay starts at 100ms and doubles with each rejection, until a statement succeeds. Set to 0 to disable. Default is 5s.",
+			Destination: &config.ConnectionBackoff,
+			Value:       generic.DefaultConnBackoff,
+			EnvVars:     []string{"KINE_CONNECTION_BACKOFF"},
+		},
+		&cli.StringFlag{
+			Name:        "external-value-store",
+			Usage:       "URL of an object store in which to store large values, keeping only a pointer in the datastore. Only S3-compatible stores are supported, in the form s3://bucket/prefix?region=region&endpoint=url; credentials are read from the AWS environment variables, the shared credentials file, or an instance or task role. Default is none (all values stored in the datastore).",
+			Destination: &config.ExternalValueStore,
+			EnvVars:     []string{"KINE_EXTERNAL_VALUE_STORE"},
+		},
+		&cli.IntFlag{
+			Name:        "external-value-threshold",
+			Usage:       "Size in bytes above which values are stored in the external value store.",
+			Destination: &config.ExternalValueThreshold,
+			Value:       valuestore.DefaultThreshold,
+			EnvVars:     []string{"KINE_EXTERNAL_VALUE_THRESHOLD"},
+		},
+		&cli.BoolFlag{
+			Name:        "audit-log",
+			Usage:       "Record an audit record in the kine_audit table for each write, with the revision, key, operation, time, and the common name of the client's verified TLS certificate. Records are written in the same transaction as the write. Cannot be combined with --revision-block-size.",
+			Destination: &config.AuditLog,
+			EnvVars:     []string{"KINE_AUDIT_LOG"},
+		},
+		&cli.BoolFlag{
+			Name:        "validate-sql",
+			Usage:       "Prepare each of the driver's SQL statements against the datastore at startup, without executing them, and fail to start if the datastore cannot parse one of them.",
+			Destination: &config.ValidateStatements,
+			EnvVars:     []string{"KINE_VALIDATE_SQL"},
+		},
 		&cli.BoolFlag{
 			Name:    "debug",
 			EnvVars: []string{"KINE_DEBUG"},
 		},
 	}
 	app.Action = run
+	app.Commands = []*cli.Command{
+		{
+			Name:      "compact",
+			Usage:     "Compact the datastore and exit, without starting the server. Datastore options must be given before the command.",
+			UsageText: "kine [global options] compact [--revision value]",
+			Flags: []cli.Flag{
+				&cli.Int64Flag{
+					Name:  "revision",
+					Usage: "Revision to compact to. The configured minimum number of revisions is always retained. Default is the current revision.",
+				},
+			},
+			Action: compact,
+		},
+	}
 	return app
 }
 
-func run(c *cli.Context) (rerr error) {
+// setup applies the global logging and SQL options, and completes the endpoint config.
+func setup(c *cli.Context) error {
 	if config.LogFormat == "plain" {
 		logrus.SetFormatter(&logrus.TextFormatter{
 			FullTimestamp:   true,
@@ -229,6 +572,33 @@ func run(c *cli.Context) (rerr error) {
 		logrus.SetLevel(logrus.TraceLevel)
 	}
 
+	ct, err := generic.ParseColumnTypes(columnTypes.Value())
+	if err != nil {
+		return err
+	}
+	config.ColumnTypes = ct
+	config.CompactExclude = compactExclude.Value()
+	config.LowPriorityPrefixes = lowPriorityPrefixes.Value()
+
+	if config.ServerTLSConfig.SNICertificates, err = tls.ParseKeyPairs(sniCertificates.Value()); err != nil {
+		return err
+	}
+	if len(config.ServerTLSConfig.SNICertificates) > 0 && (config.ServerTLSConfig.CertFile == "" || config.ServerTLSConfig.KeyFile == "") {
+		return fmt.Errorf("server-sni-cert requires server-cert-file and server-key-file")
+	}
+
+	if metrics.SlowSQLRedactMode != util.RedactHash && metrics.SlowSQLRedactMode != util.RedactElide {
+		return fmt.Errorf("invalid slow-sql-redact-mode: %s", metrics.SlowSQLRedactMode)
+	}
+	metrics.SlowSQLRedactPrefixes = slowSQLRedactPrefixes.Value()
+	return nil
+}
+
+func run(c *cli.Context) (rerr error) {
+	if err := setup(c); err != nil {
+		return err
+	}
+
 	ctx := signals.SetupSignalContext()
 
 	if !metricsIgnoreTLSConfig {
@@ -237,6 +607,16 @@ func run(c *cli.Context) (rerr error) {
 	config.MetricsRegisterer = metrics.Registry
 	metrics.RegisterCoreCollectors()
 
+	if metricsEnableAdmin {
+		adminMux := http.NewServeMux()
+		config.AdminMux = adminMux
+		metricsConfig.AdminHandler = adminMux
+	}
+
+	healthMux := http.NewServeMux()
+	config.HealthMux = healthMux
+	metricsConfig.HealthHandler = healthMux
+
 	config.WaitGroup = &sync.WaitGroup{}
 	_, err := endpoint.Listen(ctx, config)
 	if err != nil {
@@ -257,6 +637,22 @@ func run(c *cli.Context) (rerr error) {
 	return nil
 }
 
+// compact compacts the datastore once and exits.
+func compact(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+
+	ctx := signals.SetupSignalContext()
+	config.WaitGroup = &sync.WaitGroup{}
+	rev, err := endpoint.Compact(ctx, config, c.Int64("revision"))
+	if err != nil {
+		return fmt.Errorf("compaction failed: %w", err)
+	}
+	logrus.Infof("Compacted datastore to revision %d", rev)
+	return nil
+}
+
 // Config returns the endpoint config provided by parsing the provided CLI flags.
 func Config(args []string) endpoint.Config {
 	a := New()
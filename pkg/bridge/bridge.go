@@ -0,0 +1,301 @@
+// Package bridge publishes kine watch events to external systems.
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBufferSize = 1000
+	// watchPrefix is the empty prefix, which watches the whole keyspace, as a watch
+	// from "" with a range_end of \x00 does in etcd
+	watchPrefix   = ""
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+type Config struct {
+	// Sink is the URL that events are published to. http:// and https:// URLs
+	// receive each event as an HTTP POST; nats:// URLs publish each event to the
+	// subject given by the URL path, or "kine.events" if no path is set; kafka://
+	// URLs produce each event to the topic given by the URL path, or "kine.events"
+	// if no path is set, using the comma-separated list of brokers in the URL host.
+	// Kafka TLS is enabled with the tls=true, ca-file, cert-file and key-file query
+	// parameters, and SASL with a username and password in the URL, using the mechanism
+	// in the sasl query parameter: plain (the default), scram-sha-256 or scram-sha-512.
+	Sink string
+	// BufferSize is the maximum number of events held in memory while the sink
+	// is unavailable. When the buffer is full, the oldest events are dropped, unless
+	// the sink is a ResumableSink, in which case the watch waits for room instead.
+	BufferSize int
+	// Source is the CloudEvents source attribute; defaults to "kine".
+	Source string
+}
+
+// Sink publishes encoded events.
+type Sink interface {
+	Publish(ctx context.Context, event *CloudEvent) error
+	Close() error
+}
+
+// ResumableSink is a Sink that can report the revision of the last event it published,
+// so that the bridge resumes from that revision on restart instead of the current
+// revision, and does not drop events when its buffer is full.
+type ResumableSink interface {
+	Sink
+	// LastRevision returns the revision of the last event published, or 0 if none have been.
+	LastRevision(ctx context.Context) (int64, error)
+}
+
+// Start watches the whole keyspace on the backend, and publishes every event
+// to the configured sink as a CloudEvent.
+func Start(ctx context.Context, wg *sync.WaitGroup, backend server.Backend, config Config) error {
+	sink, err := NewSink(config.Sink)
+	if err != nil {
+		return err
+	}
+	startWithSink(ctx, wg, backend, sink, config)
+	return nil
+}
+
+// NewSink returns a Sink for the provided URL.
+func NewSink(sinkURL string) (Sink, error) {
+	scheme, _, err := parseSink(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "http", "https":
+		return newHTTPSink(sinkURL), nil
+	case "nats":
+		return newNATSSink(sinkURL)
+	case "kafka":
+		return newKafkaSink(sinkURL)
+	}
+	return nil, fmt.Errorf("unsupported event bridge sink scheme %q", scheme)
+}
+
+func startWithSink(ctx context.Context, wg *sync.WaitGroup, backend server.Backend, sink Sink, config Config) {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultBufferSize
+	}
+	if config.Source == "" {
+		config.Source = "kine"
+	}
+
+	b := &bridge{
+		backend: backend,
+		sink:    sink,
+		source:  config.Source,
+		buffer:  newRing(config.BufferSize),
+	}
+
+	if _, ok := sink.(ResumableSink); ok {
+		b.resumable = true
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		b.watch(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer sink.Close()
+		b.publish(ctx)
+	}()
+}
+
+type bridge struct {
+	backend   server.Backend
+	sink      Sink
+	source    string
+	buffer    *ring
+	resumable bool
+}
+
+// watch feeds events from the backend into the buffer, restarting the watch
+// from the last seen revision if it is closed.
+func (b *bridge) watch(ctx context.Context) {
+	defer b.buffer.close()
+
+	rev, err := b.startRevision(ctx)
+	for err != nil {
+		logrus.Errorf("Event bridge failed to get starting revision: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		rev, err = b.startRevision(ctx)
+	}
+
+	for ctx.Err() == nil {
+		logrus.Infof("Event bridge watching from revision %d", rev+1)
+		wr := b.backend.Watch(ctx, watchPrefix, rev+1)
+		if wr.CompactRevision != 0 {
+			logrus.Warnf("Event bridge missed events between revision %d and %d due to compaction", rev, wr.CompactRevision)
+			rev = wr.CompactRevision
+			continue
+		}
+		rev = b.forward(ctx, wr.Events, rev)
+		select {
+		case err := <-wr.Errorc:
+			logrus.Errorf("Event bridge watch failed: %v", err)
+		default:
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// startRevision returns the revision to start watching after; this is the last revision
+// published by the sink if it is resumable and has published any events, or the current
+// revision otherwise.
+func (b *bridge) startRevision(ctx context.Context) (int64, error) {
+	current, err := b.backend.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !b.resumable {
+		return current, nil
+	}
+
+	last, err := b.sink.(ResumableSink).LastRevision(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last published revision: %w", err)
+	}
+	switch {
+	case last == 0:
+		return current, nil
+	case last > current:
+		logrus.Warnf("Event bridge last published revision %d is ahead of current revision %d; resuming from current revision", last, current)
+		return current, nil
+	}
+	logrus.Infof("Event bridge resuming after last published revision %d", last)
+	return last, nil
+}
+
+// forward pushes events into the buffer until the channel is closed or the context is done,
+// returning the revision of the last event received.
+func (b *bridge) forward(ctx context.Context, eventsCh <-chan []*server.Event, rev int64) int64 {
+	for {
+		select {
+		case <-ctx.Done():
+			return rev
+		case events, ok := <-eventsCh:
+			if !ok {
+				return rev
+			}
+			for _, event := range events {
+				if event.KV.ModRevision <= rev {
+					continue
+				}
+				rev = event.KV.ModRevision
+				if b.resumable {
+					// wait for room instead of dropping events; if the watch falls too
+					// far behind while waiting, it is closed and restarted from rev.
+					if !b.buffer.wait(ctx, b.toCloudEvent(event)) {
+						return rev
+					}
+				} else if b.buffer.push(b.toCloudEvent(event)) {
+					logrus.Warnf("Event bridge buffer full; dropped oldest event")
+				}
+			}
+		}
+	}
+}
+
+// publish sends buffered events to the sink in order, retrying with backoff
+// while the sink is unavailable.
+func (b *bridge) publish(ctx context.Context) {
+	for {
+		event, ok := b.buffer.peek(ctx)
+		if !ok {
+			return
+		}
+		delay := minRetryDelay
+		for {
+			err := b.sink.Publish(ctx, event)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			logrus.Errorf("Event bridge failed to publish event %s, retrying in %s: %v", event.ID, delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxRetryDelay)
+		}
+		b.buffer.pop(event)
+	}
+}
+
+// CloudEvent is a CloudEvents 1.0 event, in structured JSON mode.
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype,omitempty"`
+	DataBase64      []byte    `json:"data_base64,omitempty"`
+	Revision        int64     `json:"kinerevision"`
+	CreateRevision  int64     `json:"kinecreaterevision"`
+	PrevRevision    int64     `json:"kineprevrevision,omitempty"`
+	Lease           int64     `json:"kinelease,omitempty"`
+}
+
+const (
+	EventTypeCreate = "io.k3s.kine.create"
+	EventTypeUpdate = "io.k3s.kine.update"
+	EventTypeDelete = "io.k3s.kine.delete"
+)
+
+func (b *bridge) toCloudEvent(event *server.Event) *CloudEvent {
+	ce := &CloudEvent{
+		SpecVersion:    "1.0",
+		ID:             strconv.FormatInt(event.KV.ModRevision, 10),
+		Source:         b.source,
+		Type:           EventTypeUpdate,
+		Subject:        event.KV.Key,
+		Time:           time.Now().UTC(),
+		Revision:       event.KV.ModRevision,
+		CreateRevision: event.KV.CreateRevision,
+		Lease:          event.KV.Lease,
+	}
+	if event.PrevKV != nil {
+		ce.PrevRevision = event.PrevKV.ModRevision
+	}
+	switch {
+	case event.Delete:
+		ce.Type = EventTypeDelete
+	case event.Create:
+		ce.Type = EventTypeCreate
+	}
+	if !event.Delete {
+		ce.DataContentType = "application/octet-stream"
+		ce.DataBase64 = event.KV.Value
+	}
+	return ce
+}
+
+func (e *CloudEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
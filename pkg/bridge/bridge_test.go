@@ -0,0 +1,114 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// fakeBackend implements only the backend methods needed by the bridge;
+// calling any other method will panic.
+type fakeBackend struct {
+	server.Backend
+	revision int64
+	events   chan []*server.Event
+	// watches, if set, receives the start revision of each watch
+	watches chan int64
+}
+
+func (b *fakeBackend) CurrentRevision(ctx context.Context) (int64, error) {
+	return b.revision, nil
+}
+
+func (b *fakeBackend) Watch(ctx context.Context, key string, revision int64) server.WatchResult {
+	if b.watches != nil {
+		b.watches <- revision
+	}
+	return server.WatchResult{Events: b.events, Errorc: make(chan error)}
+}
+
+func TestPutPublishesCloudEvent(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	var failures int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// simulate sink downtime for the first attempt
+		if failures == 0 {
+			failures++
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/cloudevents+json; charset=utf-8" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		event := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	backend := &fakeBackend{revision: 1, events: make(chan []*server.Event, 1)}
+	if err := Start(ctx, wg, backend, Config{Sink: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.events <- []*server.Event{{
+		Create: true,
+		KV: &server.KeyValue{
+			Key:            "/registry/foo",
+			Value:          []byte("bar"),
+			CreateRevision: 2,
+			ModRevision:    2,
+		},
+	}}
+
+	select {
+	case event := <-received:
+		expect := map[string]any{
+			"specversion":     "1.0",
+			"id":              "2",
+			"source":          "kine",
+			"type":            EventTypeCreate,
+			"subject":         "/registry/foo",
+			"datacontenttype": "application/octet-stream",
+			"data_base64":     "YmFy",
+			"kinerevision":    float64(2),
+		}
+		for k, v := range expect {
+			if event[k] != v {
+				t.Errorf("expected %s=%v, got %v", k, v, event[k])
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, event["time"].(string)); err != nil {
+			t.Errorf("invalid time: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestRingDropsOldest(t *testing.T) {
+	r := newRing(2)
+	events := []*CloudEvent{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	for i, event := range events {
+		if dropped := r.push(event); dropped != (i == 2) {
+			t.Fatalf("unexpected dropped=%v for event %s", dropped, event.ID)
+		}
+	}
+	event, _ := r.peek(context.Background())
+	if event.ID != "2" {
+		t.Fatalf("expected oldest retained event to be 2, got %s", event.ID)
+	}
+}
@@ -0,0 +1,126 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultKafkaTopic = "kine.events"
+
+	kafkaHeaderContentType = "content-type"
+	kafkaHeaderRevision    = "kine-revision"
+	kafkaHeaderType        = "kine-type"
+)
+
+// kafkaMessage is a message produced to, or read from, a Kafka topic.
+type kafkaMessage struct {
+	Key     []byte
+	Value   []byte
+	Headers []kafkaHeader
+}
+
+type kafkaHeader struct {
+	Key   string
+	Value []byte
+}
+
+// header returns the value of the first header with the given key, or nil if there is none.
+func (m *kafkaMessage) header(key string) []byte {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return h.Value
+		}
+	}
+	return nil
+}
+
+// kafkaProducer produces messages to a Kafka topic, with messages that have the same
+// key written to the same partition.
+type kafkaProducer interface {
+	// Produce writes a message to the topic, and returns once it has been acknowledged
+	// by all in-sync replicas.
+	Produce(ctx context.Context, topic string, msg *kafkaMessage) error
+	// LastMessages returns the last message held by each non-empty partition of the topic.
+	LastMessages(ctx context.Context, topic string) ([]*kafkaMessage, error)
+	Close() error
+}
+
+// kafkaSink produces each event to a Kafka topic as a CloudEvent in structured mode,
+// keyed by the event's key so that all changes to a key are written to the same
+// partition, in revision order. The event's revision and type are also set as message
+// headers, and the revision header is used to resume from the last published revision.
+type kafkaSink struct {
+	producer kafkaProducer
+	topic    string
+}
+
+func newKafkaSink(sinkURL string) (*kafkaSink, error) {
+	_, u, err := parseSink(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("event bridge sink %q does not specify any Kafka brokers", sinkURL)
+	}
+
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" {
+		topic = defaultKafkaTopic
+	}
+	opts, err := kafkaOptions(u)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := newKafkaClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSink{producer: producer, topic: topic}, nil
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, event *CloudEvent) error {
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return s.producer.Produce(ctx, s.topic, &kafkaMessage{
+		Key:   []byte(event.Subject),
+		Value: data,
+		Headers: []kafkaHeader{
+			{Key: kafkaHeaderContentType, Value: []byte("application/cloudevents+json; charset=UTF-8")},
+			{Key: kafkaHeaderRevision, Value: []byte(strconv.FormatInt(event.Revision, 10))},
+			{Key: kafkaHeaderType, Value: []byte(event.Type)},
+		},
+	})
+}
+
+// LastRevision returns the highest revision found in the last message of each partition
+// of the topic, or 0 if no events have been published.
+func (s *kafkaSink) LastRevision(ctx context.Context) (int64, error) {
+	msgs, err := s.producer.LastMessages(ctx, s.topic)
+	if err != nil {
+		return 0, err
+	}
+
+	var rev int64
+	for _, msg := range msgs {
+		value := msg.header(kafkaHeaderRevision)
+		if value == nil {
+			continue
+		}
+		r, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s header %q in topic %s: %w", kafkaHeaderRevision, value, s.topic, err)
+		}
+		rev = max(rev, r)
+	}
+	return rev, nil
+}
+
+func (s *kafkaSink) Close() error {
+	return s.producer.Close()
+}
@@ -0,0 +1,162 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+)
+
+// fakeProducer records produced messages, waiting for a release before acknowledging
+// each one, so that tests can hold the producer back.
+type fakeProducer struct {
+	last     []*kafkaMessage
+	release  chan struct{}
+	produced chan *kafkaMessage
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, topic string, msg *kafkaMessage) error {
+	if topic != "events" {
+		return kerr.UnknownTopicOrPartition
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.release:
+	}
+	p.produced <- msg
+	return nil
+}
+
+func (p *fakeProducer) LastMessages(ctx context.Context, topic string) ([]*kafkaMessage, error) {
+	return p.last, nil
+}
+
+func (p *fakeProducer) Close() error {
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	producer := &fakeProducer{
+		last: []*kafkaMessage{
+			{Headers: []kafkaHeader{{Key: kafkaHeaderRevision, Value: []byte("5")}}},
+			{Headers: []kafkaHeader{{Key: kafkaHeaderRevision, Value: []byte("3")}}},
+		},
+		release:  make(chan struct{}),
+		produced: make(chan *kafkaMessage, 10),
+	}
+	backend := &fakeBackend{
+		revision: 10,
+		events:   make(chan []*server.Event, 1),
+		watches:  make(chan int64, 1),
+	}
+	// a buffer of one event ensures that events are held back rather than dropped
+	// while the producer is not acknowledging them
+	startWithSink(ctx, wg, backend, &kafkaSink{producer: producer, topic: "events"}, Config{BufferSize: 1})
+
+	select {
+	case rev := <-backend.watches:
+		if rev != 6 {
+			t.Fatalf("expected watch to resume after last published revision 5, started at %d", rev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for watch")
+	}
+
+	backend.events <- []*server.Event{
+		{Create: true, KV: &server.KeyValue{Key: "/registry/a", Value: []byte("1"), CreateRevision: 6, ModRevision: 6}},
+		{KV: &server.KeyValue{Key: "/registry/b", Value: []byte("2"), CreateRevision: 4, ModRevision: 7}},
+		{Delete: true, KV: &server.KeyValue{Key: "/registry/a", CreateRevision: 6, ModRevision: 8}},
+	}
+
+	expect := []struct {
+		key       string
+		eventType string
+		revision  string
+		data      []byte
+	}{
+		{"/registry/a", EventTypeCreate, "6", []byte("1")},
+		{"/registry/b", EventTypeUpdate, "7", []byte("2")},
+		{"/registry/a", EventTypeDelete, "8", nil},
+	}
+	for _, e := range expect {
+		producer.release <- struct{}{}
+		var msg *kafkaMessage
+		select {
+		case msg = <-producer.produced:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for revision %s", e.revision)
+		}
+
+		if string(msg.Key) != e.key {
+			t.Errorf("expected key %s for revision %s, got %s", e.key, e.revision, msg.Key)
+		}
+		if rev := string(msg.header(kafkaHeaderRevision)); rev != e.revision {
+			t.Errorf("expected revision header %s, got %s", e.revision, rev)
+		}
+		if eventType := string(msg.header(kafkaHeaderType)); eventType != e.eventType {
+			t.Errorf("expected type header %s for revision %s, got %s", e.eventType, e.revision, eventType)
+		}
+		event := &CloudEvent{}
+		if err := json.Unmarshal(msg.Value, event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Subject != e.key || event.Type != e.eventType || !bytes.Equal(event.DataBase64, e.data) {
+			t.Errorf("unexpected event for revision %s: %+v", e.revision, event)
+		}
+	}
+}
+
+// TestKafkaIntegration publishes events to, and reads them back from, the Kafka topic in
+// the KINE_EVENT_BRIDGE_SINK URL. The topic is created if it does not exist.
+func TestKafkaIntegration(t *testing.T) {
+	sinkURL := os.Getenv("KINE_EVENT_BRIDGE_SINK")
+	if scheme, _, _ := parseSink(sinkURL); scheme != "kafka" {
+		t.Skip("KINE_EVENT_BRIDGE_SINK is not set to a kafka sink")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	sink, err := newKafkaSink(sinkURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	admin := kadm.NewClient(sink.producer.(*kafkaClient).client)
+	if _, err := admin.CreateTopic(ctx, 3, -1, nil, sink.topic); err != nil && !errors.Is(err, kerr.TopicAlreadyExists) {
+		t.Fatal(err)
+	}
+
+	start, err := sink.LastRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 10; i++ {
+		rev := start + i
+		event := &CloudEvent{Subject: fmt.Sprintf("/registry/%d", rev%4), Type: EventTypeUpdate, Revision: rev}
+		if err := sink.Publish(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rev, err := sink.LastRevision(ctx); err != nil {
+		t.Fatal(err)
+	} else if rev != start+10 {
+		t.Fatalf("expected last revision %d, got %d", start+10, rev)
+	}
+}
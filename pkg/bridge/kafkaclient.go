@@ -0,0 +1,171 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	kinetls "github.com/k3s-io/kine/pkg/tls"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const kafkaClientID = "kine"
+
+// kafkaClient produces messages with franz-go. Messages are partitioned by a murmur2 hash
+// of their key, as the Kafka Java client does, and are acknowledged by all in-sync replicas.
+type kafkaClient struct {
+	// opts are the options used to connect to the cluster, which are shared with the
+	// short-lived consumers used to read back the last message of each partition
+	opts   []kgo.Opt
+	client *kgo.Client
+	admin  *kadm.Client
+}
+
+// kafkaOptions returns the options used to connect to the brokers in a kafka:// URL. TLS is
+// enabled by the tls, ca-file, cert-file and key-file query parameters, and SASL by a username
+// and password in the URL, using the mechanism in the sasl query parameter: plain (the
+// default), scram-sha-256 or scram-sha-512.
+func kafkaOptions(u *url.URL) ([]kgo.Opt, error) {
+	query := u.Query()
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(strings.Split(u.Host, ",")...),
+		kgo.ClientID(kafkaClientID),
+		kgo.ProduceRequestTimeout(publishTimeout),
+		kgo.RecordDeliveryTimeout(publishTimeout),
+	}
+
+	enableTLS, _ := strconv.ParseBool(query.Get("tls"))
+	tlsConfig, err := kinetls.Config{
+		CAFile:   query.Get("ca-file"),
+		CertFile: query.Get("cert-file"),
+		KeyFile:  query.Get("key-file"),
+	}.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && enableTLS {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig != nil {
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+
+	if u.User != nil {
+		password, _ := u.User.Password()
+		mechanism, err := kafkaSASL(query.Get("sasl"), u.User.Username(), password)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	return opts, nil
+}
+
+func kafkaSASL(mechanism, user, password string) (sasl.Mechanism, error) {
+	switch strings.ToLower(mechanism) {
+	case "", "plain":
+		return plain.Auth{User: user, Pass: password}.AsMechanism(), nil
+	case "scram-sha-256":
+		return scram.Auth{User: user, Pass: password}.AsSha256Mechanism(), nil
+	case "scram-sha-512":
+		return scram.Auth{User: user, Pass: password}.AsSha512Mechanism(), nil
+	default:
+		return nil, fmt.Errorf("unsupported Kafka SASL mechanism %q", mechanism)
+	}
+}
+
+func newKafkaClient(opts []kgo.Opt) (*kafkaClient, error) {
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaClient{
+		opts:   opts,
+		client: client,
+		admin:  kadm.NewClient(client),
+	}, nil
+}
+
+func (c *kafkaClient) Produce(ctx context.Context, topic string, msg *kafkaMessage) error {
+	record := &kgo.Record{Topic: topic, Key: msg.Key, Value: msg.Value}
+	for _, h := range msg.Headers {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	return c.client.ProduceSync(ctx, record).FirstErr()
+}
+
+// LastMessages reads back the message at the last offset of each non-empty partition. If
+// the last offset of a partition does not hold a message, for example because it is a
+// transaction marker, no message is returned for the partition. This can only cause events
+// to be published again, never skipped.
+func (c *kafkaClient) LastMessages(ctx context.Context, topic string) ([]*kafkaMessage, error) {
+	ends, err := c.admin.ListEndOffsets(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	if err := ends.Error(); err != nil {
+		return nil, err
+	}
+
+	offsets := map[int32]kgo.Offset{}
+	last := map[int32]int64{}
+	ends.Each(func(o kadm.ListedOffset) {
+		if o.Offset > 0 {
+			offsets[o.Partition] = kgo.NewOffset().At(o.Offset - 1)
+			last[o.Partition] = o.Offset - 1
+		}
+	})
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+
+	consumer, err := kgo.NewClient(append([]kgo.Opt{kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{topic: offsets})}, c.opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	pollCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	var msgs []*kafkaMessage
+	for len(last) > 0 {
+		fetches := consumer.PollFetches(pollCtx)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if pollCtx.Err() != nil {
+			break
+		}
+		for _, fe := range fetches.Errors() {
+			return nil, fmt.Errorf("failed to fetch from topic %s partition %d: %w", fe.Topic, fe.Partition, fe.Err)
+		}
+		fetches.EachRecord(func(r *kgo.Record) {
+			if offset, ok := last[r.Partition]; ok && r.Offset >= offset {
+				delete(last, r.Partition)
+				msgs = append(msgs, toKafkaMessage(r))
+			}
+		})
+	}
+	return msgs, nil
+}
+
+func (c *kafkaClient) Close() error {
+	c.client.Close()
+	return nil
+}
+
+func toKafkaMessage(r *kgo.Record) *kafkaMessage {
+	msg := &kafkaMessage{Key: r.Key, Value: r.Value}
+	for _, h := range r.Headers {
+		msg.Headers = append(msg.Headers, kafkaHeader{Key: h.Key, Value: h.Value})
+	}
+	return msg
+}
@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"context"
+	"sync"
+)
+
+// ring is a bounded FIFO of events. When full, pushing a new event drops the
+// oldest event, so that memory use is bounded while the sink is unavailable.
+type ring struct {
+	mu     sync.Mutex
+	events []*CloudEvent
+	size   int
+	closed bool
+	notify chan struct{}
+	popped chan struct{}
+}
+
+func newRing(size int) *ring {
+	return &ring{
+		size:   size,
+		notify: make(chan struct{}, 1),
+		popped: make(chan struct{}, 1),
+	}
+}
+
+// push adds an event to the ring, returning true if an event was dropped to make room.
+func (r *ring) push(event *CloudEvent) (dropped bool) {
+	r.mu.Lock()
+	if len(r.events) >= r.size {
+		r.events = r.events[1:]
+		dropped = true
+	}
+	r.events = append(r.events, event)
+	r.mu.Unlock()
+	r.signal()
+	return dropped
+}
+
+// wait blocks until there is room in the ring, and then adds an event to it.
+// It returns false if the context is done before there is room.
+func (r *ring) wait(ctx context.Context, event *CloudEvent) bool {
+	for {
+		r.mu.Lock()
+		if len(r.events) < r.size {
+			r.events = append(r.events, event)
+			r.mu.Unlock()
+			r.signal()
+			return true
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-r.popped:
+		}
+	}
+}
+
+// peek blocks until an event is available and returns it without removing it.
+// It returns false if the context is done, or the ring is closed and empty.
+func (r *ring) peek(ctx context.Context) (*CloudEvent, bool) {
+	for {
+		r.mu.Lock()
+		if len(r.events) > 0 {
+			event := r.events[0]
+			r.mu.Unlock()
+			return event, true
+		}
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-r.notify:
+		}
+	}
+}
+
+// pop removes the event from the head of the ring, if it has not already been
+// dropped to make room for newer events.
+func (r *ring) pop(event *CloudEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) > 0 && r.events[0] == event {
+		r.events[0] = nil
+		r.events = r.events[1:]
+		select {
+		case r.popped <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *ring) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *ring) signal() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
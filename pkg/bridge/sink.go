@@ -0,0 +1,122 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultNATSSubject = "kine.events"
+	publishTimeout     = 10 * time.Second
+)
+
+func parseSink(sinkURL string) (scheme string, u *url.URL, err error) {
+	u, err = url.Parse(sinkURL)
+	if err != nil {
+		return "", nil, err
+	}
+	return u.Scheme, u, nil
+}
+
+// httpSink POSTs each event to a URL, using the CloudEvents structured content mode.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(sinkURL string) *httpSink {
+	return &httpSink{
+		url:    sinkURL,
+		client: &http.Client{Timeout: publishTimeout},
+	}
+}
+
+func (s *httpSink) Publish(ctx context.Context, event *CloudEvent) error {
+	body, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sink returned status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// natsSink publishes each event to a NATS subject.
+type natsSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func newNATSSink(sinkURL string) (*natsSink, error) {
+	_, u, err := parseSink(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := strings.Trim(u.Path, "/")
+	if subject == "" {
+		subject = defaultNATSSubject
+	}
+	u.Path = ""
+
+	nc, err := nats.Connect(u.String(), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return nil, err
+	}
+	return &natsSink{nc: nc, subject: subject}, nil
+}
+
+func (s *natsSink) Publish(ctx context.Context, event *CloudEvent) error {
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if !s.nc.IsConnected() {
+		return fmt.Errorf("not connected to %s", s.nc.ConnectedUrlRedacted())
+	}
+
+	msg := nats.NewMsg(s.subject)
+	msg.Header.Set("Content-Type", "application/cloudevents+json")
+	msg.Data = data
+	if err := s.nc.PublishMsg(msg); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	return s.nc.FlushWithContext(ctx)
+}
+
+func (s *natsSink) Close() error {
+	s.nc.Close()
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/k3s-io/kine/pkg/valuestore"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -13,6 +14,8 @@ type Config struct {
 	Endpoint              string
 	Scheme                string
 	DataSourceName        string
+	CompactEndpoint       string
+	CompactDataSourceName string
 	ConnectionPoolConfig  generic.ConnectionPoolConfig
 	BackendTLSConfig      tls.Config
 	CompactInterval       time.Duration
@@ -20,5 +23,64 @@ type Config struct {
 	CompactTimeout        time.Duration
 	CompactMinRetain      int64
 	CompactBatchSize      int64
+	CompactBurstThreshold int64
 	PollBatchSize         int64
+	WatchHistorySize      int
+	// WatchHistoryWindow is the number of most recent revisions for which the watch history
+	// holds every event; older events are dropped once superseded.
+	WatchHistoryWindow int64
+	// WatchPrefetch is the number of revisions that the poll loop waits to be notified of
+	// before querying, while writes are sustained.
+	WatchPrefetch int64
+	// WatchSharedDelivery enables filtering polled events once per watched prefix, and sharing
+	// the result between all watches on that prefix.
+	WatchSharedDelivery bool
+	// ReadTimeout and WriteTimeout limit the time taken by each read and each append.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// CompactAnalyzeThreshold is the number of rows that compaction must delete before the
+	// datastore's optimizer statistics are refreshed, at most once per CompactAnalyzeInterval.
+	CompactAnalyzeThreshold int64
+	CompactAnalyzeInterval  time.Duration
+	// CompactMinInterval is the minimum time between compactions. Compactions requested on
+	// demand are exempt if CompactManualBypass is set.
+	CompactMinInterval  time.Duration
+	CompactManualBypass bool
+	// CompactExclude lists keys, and prefixes ending in /, whose history is never compacted.
+	CompactExclude []string
+	// CompactVerify enables verification of each compaction transaction after it is committed.
+	CompactVerify         bool
+	ElideNoopUpdates      bool
+	ColumnTypes           generic.ColumnTypes
+	RebuildMissingIndexes bool
+	// DisableSchemaMigrations prevents the driver from creating or migrating the schema,
+	// and instead requires that the current schema already exists.
+	DisableSchemaMigrations bool
+	RevisionFloor           int64
+	// RevisionBlockSize enables assigning revisions from blocks of this size reserved by
+	// each server, instead of by the database's auto-increment id.
+	RevisionBlockSize int64
+	// ConnectionBackoff is the maximum delay applied to new statements while the datastore is
+	// rejecting connections because too many are open.
+	ConnectionBackoff time.Duration
+	// AcquireTracing enables recording the time spent waiting for a connection from the pool
+	// separately from the time spent running each statement.
+	AcquireTracing bool
+	// RevisionMarkInterval enables recording the current revision outside the kine table at this
+	// interval, so that revisions do not go backwards after the table is rebuilt.
+	RevisionMarkInterval time.Duration
+	// PartitionSize enables range-partitioning a newly created kine table by id, with this many
+	// revisions per partition. Only supported by the postgres driver.
+	PartitionSize int64
+	// ExternalValueStore is the URL of an object store in which to store values larger than
+	// ExternalValueThreshold bytes, keeping only a pointer to the object in the datastore.
+	ExternalValueStore     string
+	ExternalValueThreshold int
+	// ExternalValues is used instead of ExternalValueStore, if set.
+	ExternalValues *valuestore.Values
+	// AuditLog enables recording an audit record for each write, in the same transaction.
+	AuditLog bool
+	// ValidateStatements enables preparing each of the dialect's SQL statements at startup,
+	// failing if the database cannot parse one of them.
+	ValidateStatements bool
 }
@@ -0,0 +1,1144 @@
+// Package conformance provides a suite of tests of the behavior that kine expects of every
+// backend, so that a driver can check that it behaves the same as the existing drivers.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// OpenFunc returns a started backend to be used by a single test. A backend may be shared with
+// other tests, as each test only writes keys under its own prefix. Automatic compaction should
+// be disabled, so that compact requests are performed immediately.
+type OpenFunc func(t *testing.T) server.Backend
+
+var prefixID atomic.Int64
+
+// RunSuite runs the conformance suite as subtests of t, against backends returned by open.
+// Tests of optional interfaces are skipped for backends that do not implement them.
+func RunSuite(t *testing.T, open OpenFunc) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, backend server.Backend, prefix string)
+	}{
+		{"Create", testCreate},
+		{"Get", testGet},
+		{"Update", testUpdate},
+		{"Delete", testDelete},
+		{"List", testList},
+		{"Count", testCount},
+		{"Watch", testWatch},
+		{"Compact", testCompact},
+		{"Lease", testLease},
+		{"LeaseExpiry", testLeaseExpiry},
+		{"EmptyValue", testEmptyValue},
+		{"Recreate", testRecreate},
+		{"GetDeleted", testGetDeleted},
+		{"FutureRevision", testFutureRevision},
+		{"BoundedRange", testBoundedRange},
+		{"ListPaged", testListPaged},
+		{"DeletePrefix", testDeletePrefix},
+		{"MinRevision", testMinRevision},
+		{"CountSerializable", testCountSerializable},
+		{"KeyMetadata", testKeyMetadata},
+		{"Rename", testRename},
+		{"Snapshot", testSnapshot},
+		{"Delta", testDelta},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefix := fmt.Sprintf("/conformance-%d-%d/%s/", time.Now().UnixNano(), prefixID.Add(1), strings.ToLower(test.name))
+			test.f(t, open(t), prefix)
+		})
+	}
+}
+
+func testCreate(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	rev, err := backend.Create(ctx, key, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev <= 0 {
+		t.Fatalf("expected a positive revision, got %d", rev)
+	}
+	if _, err := backend.Create(ctx, key, []byte("b"), 0); err != server.ErrKeyExists {
+		t.Fatalf("expected %v creating an existing key, got %v", server.ErrKeyExists, err)
+	}
+
+	next, err := backend.Create(ctx, prefix+"b", []byte("b"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= rev {
+		t.Fatalf("expected revision after %d, got %d", rev, next)
+	}
+}
+
+func testGet(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev, err := backend.Create(ctx, key, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateRev, _, ok, err := backend.Update(ctx, key, []byte("b"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+	}
+
+	_, kv, err := backend.Get(ctx, key, "", 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || kv.Key != key || string(kv.Value) != "b" || kv.CreateRevision != createRev || kv.ModRevision != updateRev {
+		t.Fatalf("expected %s created at %d and modified at %d with value b, got %#v", key, createRev, updateRev, kv)
+	}
+
+	_, kv, err = backend.Get(ctx, key, "", 1, createRev, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || string(kv.Value) != "a" || kv.ModRevision != createRev {
+		t.Fatalf("expected value a at revision %d, got %#v", createRev, kv)
+	}
+
+	_, kv, err = backend.Get(ctx, key, "", 1, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || len(kv.Value) != 0 {
+		t.Fatalf("expected %s without its value, got %#v", key, kv)
+	}
+
+	_, kv, err = backend.Get(ctx, prefix+"missing", "", 1, 0, false)
+	if err != nil || kv != nil {
+		t.Fatalf("expected missing key to not be found, got kv=%#v err=%v", kv, err)
+	}
+}
+
+func testUpdate(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev, err := backend.Create(ctx, key, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, kv, ok, err := backend.Update(ctx, key, []byte("b"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+	}
+	if rev <= createRev || kv.ModRevision != rev || kv.CreateRevision != createRev || string(kv.Value) != "b" {
+		t.Fatalf("unexpected updated key at revision %d: %#v", rev, kv)
+	}
+
+	// an update at a stale revision fails, and returns the current key
+	_, kv, ok, err = backend.Update(ctx, key, []byte("c"), createRev, 0)
+	if err != nil || ok {
+		t.Fatalf("expected update at stale revision %d to fail, got ok=%v err=%v", createRev, ok, err)
+	}
+	if kv == nil || string(kv.Value) != "b" || kv.ModRevision != rev {
+		t.Fatalf("expected current key at revision %d, got %#v", rev, kv)
+	}
+
+	if _, _, ok, err := backend.Update(ctx, prefix+"missing", []byte("a"), createRev, 0); err != nil || ok {
+		t.Fatalf("expected update of missing key to fail, got ok=%v err=%v", ok, err)
+	}
+}
+
+func testDelete(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev, err := backend.Create(ctx, key, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateRev, _, ok, err := backend.Update(ctx, key, []byte("b"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+	}
+
+	// a delete at a stale revision fails, and returns the current key
+	_, kv, ok, err := backend.Delete(ctx, key, createRev)
+	if err != nil || ok {
+		t.Fatalf("expected delete at stale revision %d to fail, got ok=%v err=%v", createRev, ok, err)
+	}
+	if kv == nil || kv.ModRevision != updateRev || string(kv.Value) != "b" {
+		t.Fatalf("expected current key at revision %d, got %#v", updateRev, kv)
+	}
+	if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv == nil {
+		t.Fatalf("expected %s to still exist, got kv=%#v err=%v", key, kv, err)
+	}
+
+	rev, kv, ok, err := backend.Delete(ctx, key, updateRev)
+	if err != nil || !ok {
+		t.Fatalf("failed to delete %s: ok=%v err=%v", key, ok, err)
+	}
+	if rev <= updateRev || kv == nil || string(kv.Value) != "b" {
+		t.Fatalf("expected deleted key with value b after revision %d, got rev=%d kv=%#v", updateRev, rev, kv)
+	}
+	if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv != nil {
+		t.Fatalf("expected %s to be deleted, got kv=%#v err=%v", key, kv, err)
+	}
+	if _, kv, err := backend.Get(ctx, key, "", 1, updateRev, false); err != nil || kv == nil {
+		t.Fatalf("expected %s to exist at revision %d, got kv=%#v err=%v", key, updateRev, kv, err)
+	}
+
+	// the key can be created again once deleted
+	if _, err := backend.Create(ctx, key, []byte("c"), 0); err != nil {
+		t.Fatalf("failed to create deleted key: %v", err)
+	}
+}
+
+func testList(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	names := []string{"a", "b", "c", "d"}
+
+	var rev int64
+	for _, name := range names {
+		var err error
+		if rev, err = backend.Create(ctx, prefix+name, []byte(name), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Create(ctx, strings.TrimSuffix(prefix, "/")+"-other/a", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := backend.Delete(ctx, prefix+"d", rev); err != nil || !ok {
+		t.Fatalf("failed to delete %sd: ok=%v err=%v", prefix, ok, err)
+	}
+
+	list := func(startKey string, limit, revision int64) string {
+		t.Helper()
+		_, kvs, err := backend.List(ctx, prefix, startKey, limit, revision, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(kvs))
+		for _, kv := range kvs {
+			if got = append(got, strings.TrimPrefix(kv.Key, prefix)); string(kv.Value) != got[len(got)-1] {
+				t.Fatalf("expected value of %s to be its name, got %q", kv.Key, kv.Value)
+			}
+		}
+		return strings.Join(got, " ")
+	}
+
+	for _, test := range []struct {
+		startKey string
+		limit    int64
+		revision int64
+		want     string
+	}{
+		{"", 0, 0, "a b c"},
+		{"", 2, 0, "a b"},
+		{prefix + "b", 0, 0, "b c"},
+		{"", 0, rev, "a b c d"},
+		{"", 0, rev - 1, "a b c"},
+	} {
+		if got := list(test.startKey, test.limit, test.revision); got != test.want {
+			t.Errorf("list start=%q limit=%d revision=%d: expected %q, got %q", test.startKey, test.limit, test.revision, test.want, got)
+		}
+	}
+}
+
+func testCount(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+
+	var rev int64
+	for _, name := range []string{"a", "b", "c"} {
+		var err error
+		if rev, err = backend.Create(ctx, prefix+name, []byte(name), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok, err := backend.Delete(ctx, prefix+"c", rev); err != nil || !ok {
+		t.Fatalf("failed to delete %sc: ok=%v err=%v", prefix, ok, err)
+	}
+
+	for _, test := range []struct {
+		startKey string
+		revision int64
+		want     int64
+	}{
+		{"", 0, 2},
+		{prefix + "b", 0, 1},
+		{"", rev, 3},
+	} {
+		_, count, err := backend.Count(ctx, prefix, test.startKey, test.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != test.want {
+			t.Errorf("count start=%q revision=%d: expected %d, got %d", test.startKey, test.revision, test.want, count)
+		}
+	}
+}
+
+func testWatch(t *testing.T, backend server.Backend, prefix string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := prefix + "a"
+
+	createRev, err := backend.Create(ctx, key, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr := backend.Watch(ctx, prefix, createRev)
+	if wr.CompactRevision != 0 {
+		t.Fatalf("expected watch at revision %d to start, got compact revision %d", createRev, wr.CompactRevision)
+	}
+
+	updateRev, _, ok, err := backend.Update(ctx, key, []byte("b"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+	}
+	deleteRev, _, ok, err := backend.Delete(ctx, key, updateRev)
+	if err != nil || !ok {
+		t.Fatalf("failed to delete %s: ok=%v err=%v", key, ok, err)
+	}
+
+	var events []*server.Event
+	timeout := time.After(10 * time.Second)
+	for len(events) < 3 {
+		select {
+		case batch, ok := <-wr.Events:
+			if !ok {
+				t.Fatalf("watch closed after %d events", len(events))
+			}
+			events = append(events, batch...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for watch events, got %d", len(events))
+		}
+	}
+
+	if e := events[0]; !e.Create || e.Delete || e.KV.ModRevision != createRev || string(e.KV.Value) != "a" {
+		t.Errorf("expected create at revision %d, got %#v", createRev, e)
+	}
+	if e := events[1]; e.Create || e.Delete || e.KV.ModRevision != updateRev || string(e.KV.Value) != "b" || e.PrevKV == nil || string(e.PrevKV.Value) != "a" {
+		t.Errorf("expected update at revision %d, got %#v", updateRev, e)
+	}
+	if e := events[2]; !e.Delete || e.KV.ModRevision != deleteRev || e.KV.Key != key {
+		t.Errorf("expected delete at revision %d, got %#v", deleteRev, e)
+	}
+}
+
+func testCompact(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	rev, err := backend.Create(ctx, key, []byte("0"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstRev := rev
+	for i := 1; i <= 3; i++ {
+		var ok bool
+		if rev, _, ok, err = backend.Update(ctx, key, []byte(fmt.Sprint(i)), rev, 0); err != nil || !ok {
+			t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+		}
+	}
+
+	if _, err := backend.Compact(ctx, rev-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := backend.List(ctx, prefix, "", 0, firstRev, false); err != server.ErrCompacted {
+		t.Fatalf("expected %v listing at compacted revision %d, got %v", server.ErrCompacted, firstRev, err)
+	}
+	if wr := backend.Watch(ctx, prefix, firstRev); wr.CompactRevision == 0 {
+		t.Fatalf("expected watch at compacted revision %d to fail", firstRev)
+	}
+
+	// the latest value of a key is never compacted
+	_, kv, err := backend.Get(ctx, key, "", 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || string(kv.Value) != "3" || kv.ModRevision != rev {
+		t.Fatalf("expected latest value of %s to be retained, got %#v", key, kv)
+	}
+}
+
+func testLease(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	rev, err := backend.Create(ctx, key, []byte("a"), 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv == nil || kv.Lease != 3600 {
+		t.Fatalf("expected %s with lease 3600, got kv=%#v err=%v", key, kv, err)
+	}
+
+	// the lease is replaced by the lease of an update
+	if _, _, ok, err := backend.Update(ctx, key, []byte("b"), rev, 0); err != nil || !ok {
+		t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+	}
+	if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv == nil || kv.Lease != 0 {
+		t.Fatalf("expected %s without a lease, got kv=%#v err=%v", key, kv, err)
+	}
+}
+
+func testLeaseExpiry(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	expired, moved, detached := prefix+"expired", prefix+"moved", prefix+"detached"
+
+	// leases are identified by their TTL in seconds
+	for _, key := range []string{expired, moved, detached} {
+		if _, err := backend.Create(ctx, key, []byte("v"), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leases := map[string]int64{moved: 3600, detached: 0}
+	for key, lease := range leases {
+		_, kv, err := backend.Get(ctx, key, "", 1, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, kv, ok, err := backend.Update(ctx, key, kv.Value, kv.ModRevision, lease); err != nil || !ok {
+			t.Fatalf("failed to update lease of %s: ok=%v err=%v", key, ok, err)
+		} else if kv.Lease != lease {
+			t.Fatalf("expected updated %s to have lease %d, got %d", key, lease, kv.Lease)
+		}
+	}
+
+	// once the key left on the original lease has expired, the reassigned and detached keys
+	// must remain, with their new leases
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, kv, err := backend.Get(ctx, expired, "", 1, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s to expire", expired)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for key, lease := range leases {
+		_, kv, err := backend.Get(ctx, key, "", 1, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv == nil || kv.Lease != lease {
+			t.Fatalf("expected %s to remain with lease %d after its original lease expired, got %#v", key, lease, kv)
+		}
+	}
+}
+
+func testEmptyValue(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	rev, err := backend.Create(ctx, key, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _, _, err = backend.Update(ctx, key, []byte("a"), rev, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := backend.Update(ctx, key, nil, rev, 0); err != nil || !ok {
+		t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+	}
+	if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv == nil || len(kv.Value) != 0 {
+		t.Fatalf("expected %s with an empty value, got kv=%#v err=%v", key, kv, err)
+	}
+}
+
+func testRecreate(t *testing.T, backend server.Backend, prefix string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := prefix + "a"
+
+	firstRev, err := backend.Create(ctx, key, []byte("1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr := backend.Watch(ctx, prefix, firstRev+1)
+	if _, _, ok, err := backend.Delete(ctx, key, firstRev); err != nil || !ok {
+		t.Fatalf("failed to delete %s: ok=%v err=%v", key, ok, err)
+	}
+	secondRev, err := backend.Create(ctx, key, []byte("2"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateRev, _, ok, err := backend.Update(ctx, key, []byte("3"), secondRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("failed to update %s: ok=%v err=%v", key, ok, err)
+	}
+
+	// the recreated key, and updates to it, carry the revision of the second create
+	if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv == nil || kv.CreateRevision != secondRev || kv.ModRevision != updateRev {
+		t.Fatalf("expected %s created at revision %d and modified at %d, got kv=%#v err=%v", key, secondRev, updateRev, kv, err)
+	}
+
+	var events []*server.Event
+	timeout := time.After(10 * time.Second)
+	for len(events) < 3 {
+		select {
+		case batch, ok := <-wr.Events:
+			if !ok {
+				t.Fatalf("watch closed after %d events", len(events))
+			}
+			events = append(events, batch...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for watch events, got %d", len(events))
+		}
+	}
+	if e := events[0]; !e.Delete || e.KV.CreateRevision != firstRev {
+		t.Errorf("expected delete of key created at revision %d, got %#v", firstRev, e)
+	}
+	if e := events[1]; !e.Create || e.KV.CreateRevision != secondRev || e.KV.ModRevision != secondRev {
+		t.Errorf("expected create at revision %d, got %#v", secondRev, e.KV)
+	}
+	if e := events[2]; e.Create || e.KV.CreateRevision != secondRev || e.KV.ModRevision != updateRev {
+		t.Errorf("expected update at revision %d of key created at %d, got %#v", updateRev, secondRev, e.KV)
+	}
+}
+
+func testGetDeleted(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "deleted"
+
+	createRev, err := backend.Create(ctx, key, []byte("v1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes to other keys between the create and delete of the key
+	otherRev, err := backend.Create(ctx, prefix+"other", []byte("v"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteRev, _, ok, err := backend.Delete(ctx, key, createRev)
+	if err != nil || !ok {
+		t.Fatalf("failed to delete %s: ok=%v err=%v", key, ok, err)
+	}
+	afterRev, err := backend.Create(ctx, prefix+"other2", []byte("v"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recreateRev, err := backend.Create(ctx, key, []byte("v2"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		revision int64
+		modRev   int64
+		value    string
+	}{
+		{"at create", createRev, createRev, "v1"},
+		{"before delete", otherRev, createRev, "v1"},
+		{"at delete", deleteRev, 0, ""},
+		{"after delete", afterRev, 0, ""},
+		{"at recreate", recreateRev, recreateRev, "v2"},
+	} {
+		for _, keysOnly := range []bool{false, true} {
+			_, kv, err := backend.Get(ctx, key, "", 1, test.revision, keysOnly)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if test.modRev == 0 {
+				if kv != nil {
+					t.Errorf("%s: expected %s to be absent at revision %d, got %#v", test.name, key, test.revision, kv)
+				}
+				continue
+			}
+			if kv == nil || kv.ModRevision != test.modRev || (!keysOnly && string(kv.Value) != test.value) {
+				t.Errorf("%s: expected %s at revision %d to be modified at %d, got %#v", test.name, key, test.revision, test.modRev, kv)
+			}
+		}
+	}
+}
+
+func testFutureRevision(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	kv := server.New(backend, "unix", 0, "")
+	key := prefix + "a"
+	end := strings.TrimSuffix(prefix, "/") + "0"
+
+	rev, err := backend.Create(ctx, key, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, r := range map[string]*etcdserverpb.RangeRequest{
+		"get":         {Key: []byte(key)},
+		"list":        {Key: []byte(prefix), RangeEnd: []byte(end)},
+		"count":       {Key: []byte(prefix), RangeEnd: []byte(end), CountOnly: true},
+		"range":       {Key: []byte(key), RangeEnd: []byte(prefix + "b")},
+		"count range": {Key: []byte(key), RangeEnd: []byte(prefix + "b"), CountOnly: true},
+	} {
+		r.Revision = rev + 1
+		if _, err := kv.Range(ctx, r); err != server.ErrFutureRev {
+			t.Errorf("%s: expected %v at revision %d, got %v", name, server.ErrFutureRev, rev+1, err)
+		}
+		r.Revision = rev
+		if _, err := kv.Range(ctx, r); err != nil {
+			t.Errorf("%s: expected no error at current revision %d, got %v", name, rev, err)
+		}
+	}
+}
+
+func testBoundedRange(t *testing.T, backend server.Backend, prefix string) {
+	if _, ok := backend.(server.RangeLister); !ok {
+		t.Skip("backend does not list arbitrary key ranges")
+	}
+	ctx := context.Background()
+	for _, name := range []string{"key0", "key1", "key10", "key5", "key8", "key9", "key99", "kez1", "key/5"} {
+		if _, err := backend.Create(ctx, prefix+name, []byte(name), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kv := server.New(backend, "unix", 0, "")
+	want := []string{"key1", "key10", "key5", "key8"}
+	r := &etcdserverpb.RangeRequest{Key: []byte(prefix + "key1"), RangeEnd: []byte(prefix + "key9")}
+
+	resp, err := kv.Range(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		got = append(got, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+	if !slices.Equal(got, want) || resp.Count != int64(len(want)) {
+		t.Fatalf("expected keys %v, got %v (count %d)", want, got, resp.Count)
+	}
+
+	r.Limit = 2
+	if resp, err = kv.Range(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 2 || !resp.More || resp.Count != int64(len(want)) {
+		t.Fatalf("expected 2 of %d keys with more, got %d keys (count %d, more %v)", len(want), len(resp.Kvs), resp.Count, resp.More)
+	}
+
+	r.Limit = 0
+	r.CountOnly = true
+	if resp, err = kv.Range(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != int64(len(want)) {
+		t.Fatalf("expected count %d, got %d", len(want), resp.Count)
+	}
+}
+
+func testListPaged(t *testing.T, backend server.Backend, prefix string) {
+	ctx := context.Background()
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("%s%02d", prefix, i)
+		if _, err := backend.Create(ctx, key, []byte(key), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kv := server.New(backend, "unix", 0, "")
+	kv.SetRangePaging(10, 0)
+
+	resp, err := kv.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte(prefix), RangeEnd: []byte(strings.TrimSuffix(prefix, "/") + "0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 25 || resp.More {
+		t.Fatalf("expected 25 keys, got %d (more %v)", len(resp.Kvs), resp.More)
+	}
+	for i, kv := range resp.Kvs {
+		if key := fmt.Sprintf("%s%02d", prefix, i); string(kv.Key) != key {
+			t.Fatalf("expected key %s at %d, got %s", key, i, kv.Key)
+		}
+	}
+}
+
+func testDeletePrefix(t *testing.T, backend server.Backend, prefix string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	keys := []string{prefix + "a/1", prefix + "a/2", prefix + "a/3", prefix + "a/4", prefix + "a/5"}
+	var rev int64
+	for _, key := range append(slices.Clone(keys), prefix+"b/1") {
+		var err error
+		if rev, err = backend.Create(ctx, key, []byte(key), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wr := backend.Watch(ctx, prefix+"a/", rev+1)
+
+	kv := server.New(backend, "unix", 0, "")
+	result, err := kv.DeletePrefix(ctx, prefix+"a/", 2, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Revision != rev || result.Deleted != int64(len(keys)) || result.Skipped != 0 {
+		t.Fatalf("expected %d keys deleted as of revision %d, got %#v", len(keys), rev, result)
+	}
+
+	if _, kvs, err := backend.List(ctx, prefix+"a/", "", 0, 0, true); err != nil || len(kvs) != 0 {
+		t.Fatalf("expected no keys under %sa/, got kvs=%v err=%v", prefix, kvs, err)
+	}
+	if _, kv, err := backend.Get(ctx, prefix+"b/1", "", 1, 0, false); err != nil || kv == nil {
+		t.Fatalf("expected %sb/1 to be unchanged, got kv=%#v err=%v", prefix, kv, err)
+	}
+
+	var events []*server.Event
+	timeout := time.After(10 * time.Second)
+	for len(events) < len(keys) {
+		select {
+		case batch, ok := <-wr.Events:
+			if !ok {
+				t.Fatalf("watch closed after %d events", len(events))
+			}
+			events = append(events, batch...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for delete events, got %d", len(events))
+		}
+	}
+	for i, event := range events {
+		if !event.Delete || event.KV.Key != keys[i] {
+			t.Fatalf("expected delete of %s, got %#v", keys[i], event)
+		}
+	}
+}
+
+func testMinRevision(t *testing.T, backend server.Backend, prefix string) {
+	m, ok := backend.(server.MinRevisioner)
+	if !ok {
+		t.Skip("backend does not report its minimum revision")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := prefix + "a"
+
+	rev, err := backend.Create(ctx, key, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minRev, err := m.MinRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minRev > rev {
+		t.Fatalf("expected min revision at or before %d, got %d", rev, minRev)
+	}
+
+	for i := 0; i < 5; i++ {
+		if rev, _, _, err = backend.Update(ctx, key, []byte("a"), rev, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Compact(ctx, rev-1); err != nil {
+		t.Fatal(err)
+	}
+	if minRev, err = m.MinRevision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if minRev != rev {
+		t.Fatalf("expected min revision %d after compacting to %d, got %d", rev, rev-1, minRev)
+	}
+
+	if wr := backend.Watch(ctx, key, minRev-1); wr.CompactRevision != minRev-1 {
+		t.Fatalf("expected watch before min revision to be compacted at %d, got %d", minRev-1, wr.CompactRevision)
+	}
+	if wr := backend.Watch(ctx, key, minRev); wr.CompactRevision != 0 {
+		t.Fatalf("expected watch from min revision to succeed, got compact revision %d", wr.CompactRevision)
+	}
+}
+
+func testCountSerializable(t *testing.T, backend server.Backend, prefix string) {
+	sc, ok := backend.(server.SerializableCounter)
+	if !ok {
+		t.Skip("backend does not support serializable counts")
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("%s%02d", prefix, i)
+		rev, err := backend.Create(ctx, key, []byte("v"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch i % 3 {
+		case 1:
+			_, _, _, err = backend.Update(ctx, key, []byte("v2"), rev, 0)
+		case 2:
+			_, _, _, err = backend.Delete(ctx, key, rev)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// recreate a deleted key, so that it has history both before and after the deletion
+	if _, err := backend.Create(ctx, prefix+"02", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, startKey := range []string{prefix, prefix + "05"} {
+		rev, count, err := backend.Count(ctx, prefix, startKey, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srev, scount, err := sc.CountSerializable(ctx, prefix, startKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scount != count || srev != rev {
+			t.Fatalf("expected serializable count %d at revision %d from %s, got %d at revision %d", count, rev, startKey, scount, srev)
+		}
+	}
+}
+
+func testKeyMetadata(t *testing.T, backend server.Backend, prefix string) {
+	store, ok := backend.(server.KeyMetadataStore)
+	if !ok {
+		t.Skip("backend does not store key metadata")
+	}
+	ctx := context.Background()
+
+	for _, name := range []string{"a/x", "a/y", "a_b", "ab/z"} {
+		if _, err := backend.Create(ctx, prefix+name, []byte(name), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetKeyMetadata(ctx, prefix+"missing", map[string]string{"owner": "a"}); !errors.Is(err, server.ErrKeyNotFound) {
+		t.Fatalf("expected %v for missing key, got %v", server.ErrKeyNotFound, err)
+	}
+	if err := store.SetKeyMetadata(ctx, prefix+"a/x", map[string]string{"": "a"}); !errors.Is(err, server.ErrInvalidKeyMetadata) {
+		t.Fatalf("expected %v for empty name, got %v", server.ErrInvalidKeyMetadata, err)
+	}
+
+	for name, metadata := range map[string]map[string]string{
+		"a/x":  {"owner": "scheduler", "policy": "keep"},
+		"a/y":  {"owner": "controller"},
+		"a_b":  {"owner": "scheduler"},
+		"ab/z": {"owner": "scheduler"},
+	} {
+		if err := store.SetKeyMetadata(ctx, prefix+name, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// replacing metadata drops names that are no longer set
+	if err := store.SetKeyMetadata(ctx, prefix+"a/y", map[string]string{"policy": "expire"}); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := store.GetKeyMetadata(ctx, prefix+"a/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"owner": "scheduler", "policy": "keep"}; !reflect.DeepEqual(metadata, want) {
+		t.Fatalf("expected metadata %v, got %v", want, metadata)
+	}
+
+	listed, err := store.ListKeyMetadata(ctx, prefix+"a/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		prefix + "a/x": {"owner": "scheduler", "policy": "keep"},
+		prefix + "a/y": {"policy": "expire"},
+	}
+	if !reflect.DeepEqual(listed, want) {
+		t.Fatalf("expected listed metadata %v, got %v", want, listed)
+	}
+
+	listed, err = store.ListKeyMetadata(ctx, prefix+"a/", map[string]string{"owner": "scheduler"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]map[string]string{
+		prefix + "a/x": {"owner": "scheduler", "policy": "keep"},
+	}
+	if !reflect.DeepEqual(listed, want) {
+		t.Fatalf("expected filtered metadata %v, got %v", want, listed)
+	}
+
+	// metadata is not versioned, and does not change the keys or their values
+	if current, err := backend.CurrentRevision(ctx); err != nil || current != rev {
+		t.Fatalf("expected revision to remain %d after setting metadata, got %d: %v", rev, current, err)
+	}
+	_, kvs, err := backend.List(ctx, prefix+"a/", "", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || string(kvs[0].Value) != "a/x" || string(kvs[1].Value) != "a/y" {
+		t.Fatalf("unexpected keys listed after setting metadata: %v", kvs)
+	}
+}
+
+func testRename(t *testing.T, backend server.Backend, prefix string) {
+	renamer, ok := backend.(server.Renamer)
+	if !ok {
+		t.Skip("backend does not rename keys")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b, c := prefix+"a", prefix+"b", prefix+"c"
+
+	createRev, err := backend.Create(ctx, a, []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRev, err := backend.Create(ctx, c, []byte("c"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr := backend.Watch(ctx, prefix, otherRev+1)
+
+	// renaming onto an existing key fails, and leaves both keys unchanged
+	if _, _, _, err := renamer.Rename(ctx, a, c, 0); err != server.ErrKeyExists {
+		t.Fatalf("expected %v renaming onto an existing key, got %v", server.ErrKeyExists, err)
+	}
+	// renaming at a stale revision is skipped
+	if _, _, renamed, err := renamer.Rename(ctx, a, b, otherRev); err != nil || renamed {
+		t.Fatalf("expected rename at stale revision %d to be skipped, got renamed=%v err=%v", otherRev, renamed, err)
+	}
+	for key, value := range map[string]string{a: "a", c: "c"} {
+		if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv == nil || string(kv.Value) != value {
+			t.Fatalf("expected %s to be unchanged, got kv=%#v err=%v", key, kv, err)
+		}
+	}
+
+	rev, kv, renamed, err := renamer.Rename(ctx, a, b, createRev)
+	if err != nil || !renamed {
+		t.Fatalf("failed to rename %s: renamed=%v err=%v", a, renamed, err)
+	}
+	if kv.Key != b || string(kv.Value) != "a" || kv.ModRevision != rev || kv.CreateRevision != rev {
+		t.Fatalf("unexpected renamed key: %#v", kv)
+	}
+	if _, kv, err := backend.Get(ctx, a, "", 1, 0, false); err != nil || kv != nil {
+		t.Fatalf("expected %s to be deleted, got kv=%#v err=%v", a, kv, err)
+	}
+	if _, kv, err := backend.Get(ctx, b, "", 1, 0, false); err != nil || kv == nil || string(kv.Value) != "a" {
+		t.Fatalf("expected %s to have the value of %s, got kv=%#v err=%v", b, a, kv, err)
+	}
+
+	// watchers see the delete of the old key followed by the create of the new key
+	var events []*server.Event
+	timeout := time.After(10 * time.Second)
+	for len(events) < 2 {
+		select {
+		case batch, ok := <-wr.Events:
+			if !ok {
+				t.Fatalf("watch closed after %d events", len(events))
+			}
+			events = append(events, batch...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for rename events, got %d", len(events))
+		}
+	}
+	if e := events[0]; !e.Delete || e.KV.Key != a || e.KV.ModRevision != rev-1 {
+		t.Fatalf("expected delete of %s at revision %d, got %#v", a, rev-1, e)
+	}
+	if e := events[1]; !e.Create || e.KV.Key != b || string(e.KV.Value) != "a" || e.KV.ModRevision != rev {
+		t.Fatalf("expected create of %s at revision %d, got %#v", b, rev, e)
+	}
+}
+
+func testSnapshot(t *testing.T, backend server.Backend, prefix string) {
+	snapshotter, ok := backend.(server.Snapshotter)
+	if !ok {
+		t.Skip("backend does not take snapshots")
+	}
+	// enough keys that the snapshot is read in more than one page
+	const keys = 1500
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < keys; i++ {
+		if _, err := backend.Create(ctx, fmt.Sprintf("%s%04d", prefix, i), []byte("0"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// keys are updated, deleted and created while the snapshot is read
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ctx.Err() == nil; i++ {
+			key := fmt.Sprintf("%s%04d", prefix, i%keys)
+			_, kv, err := backend.Get(ctx, key, "", 1, 0, false)
+			if err != nil {
+				return
+			}
+			if kv == nil {
+				backend.Create(ctx, key, []byte("0"), 0)
+			} else if i%3 == 0 {
+				backend.Delete(ctx, key, kv.ModRevision)
+			} else {
+				backend.Update(ctx, key, []byte(fmt.Sprint(i)), kv.ModRevision, 0)
+			}
+		}
+	}()
+
+	snapshot := map[string]*server.KeyValue{}
+	rev, err := snapshotter.Snapshot(ctx, func(kv *server.KeyValue) error {
+		if _, ok := snapshot[kv.Key]; ok {
+			return fmt.Errorf("duplicate key %s", kv.Key)
+		}
+		if strings.HasPrefix(kv.Key, prefix) {
+			snapshot[kv.Key] = kv
+		}
+		// give the writer time to make changes between pages
+		time.Sleep(100 * time.Microsecond)
+		return nil
+	})
+	cancel()
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot holds exactly the keys that were current at its revision
+	_, kvs, err := backend.List(context.Background(), prefix, "", 0, rev, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != len(snapshot) {
+		t.Fatalf("expected %d keys at revision %d, got %d", len(kvs), rev, len(snapshot))
+	}
+	for _, kv := range kvs {
+		got, ok := snapshot[kv.Key]
+		if !ok || got.ModRevision != kv.ModRevision || string(got.Value) != string(kv.Value) {
+			t.Fatalf("expected %s at revision %d to be %#v, got %#v", kv.Key, rev, kv, got)
+		}
+	}
+	if current, err := backend.CurrentRevision(context.Background()); err != nil || current <= rev {
+		t.Fatalf("expected writes after the snapshot revision %d, got current revision %d err=%v", rev, current, err)
+	}
+}
+
+func testDelta(t *testing.T, backend server.Backend, prefix string) {
+	deltaer, ok := backend.(server.Deltaer)
+	if !ok {
+		t.Skip("backend does not compute deltas")
+	}
+	ctx := context.Background()
+
+	revs := map[string]int64{}
+	create := func(name string) {
+		rev, err := backend.Create(ctx, prefix+name, []byte("0"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs[name] = rev
+	}
+	update := func(name string, value string) {
+		rev, _, _, err := backend.Update(ctx, prefix+name, []byte(value), revs[name], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs[name] = rev
+	}
+	del := func(name string) {
+		if _, _, _, err := backend.Delete(ctx, prefix+name, revs[name]); err != nil {
+			t.Fatal(err)
+		}
+		delete(revs, name)
+	}
+	state := func(rev int64) map[string]string {
+		_, kvs, err := backend.List(ctx, prefix, "", 0, rev, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]string{}
+		for _, kv := range kvs {
+			result[kv.Key] = string(kv.Value)
+		}
+		return result
+	}
+
+	for _, name := range []string{"unchanged", "updated", "deleted", "recreated"} {
+		create(name)
+	}
+	from, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough updates that the events are read in more than one page
+	for i := 1; i <= 1200; i++ {
+		update("updated", fmt.Sprint(i))
+	}
+	del("deleted")
+	del("recreated")
+	create("recreated")
+	create("created")
+	create("transient")
+	del("transient")
+	to, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changes after the end of the delta are not included
+	update("unchanged", "after")
+
+	delta := map[string]*server.Event{}
+	if err := deltaer.Delta(ctx, from, to, func(event *server.Event) error {
+		if strings.HasPrefix(event.KV.Key, prefix) {
+			delta[event.KV.Key] = event
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct{ create, delete bool }{
+		prefix + "updated":   {},
+		prefix + "deleted":   {delete: true},
+		prefix + "recreated": {},
+		prefix + "created":   {create: true},
+	}
+	if len(delta) != len(expected) {
+		t.Fatalf("expected delta of %d keys, got %v", len(expected), slices.Sorted(maps.Keys(delta)))
+	}
+	for key, e := range expected {
+		if event, ok := delta[key]; !ok || event.Create != e.create || event.Delete != e.delete {
+			t.Fatalf("expected %s in delta with create=%v delete=%v, got %#v", key, e.create, e.delete, event)
+		}
+	}
+
+	if prev := delta[prefix+"updated"].PrevKV; prev == nil || string(prev.Value) != "0" {
+		t.Fatalf("expected the previous state of %supdated to be its value at revision %d, got %#v", prefix, from, prev)
+	}
+
+	// applying the delta to the state at from gives the state at to
+	applied := state(from)
+	for key, event := range delta {
+		if event.Delete {
+			delete(applied, key)
+		} else {
+			applied[key] = string(event.KV.Value)
+		}
+	}
+	if want := state(to); !maps.Equal(applied, want) {
+		t.Fatalf("expected delta applied to revision %d to give %v, got %v", from, want, applied)
+	}
+}
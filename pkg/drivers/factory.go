@@ -3,21 +3,35 @@ package drivers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
 
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/util"
+	"github.com/k3s-io/kine/pkg/valuestore"
 )
 
 var ErrUnknownDriver = errors.New("unknown driver")
 
 func New(ctx context.Context, wg *sync.WaitGroup, cfg *Config) (leaderElect bool, backend server.Backend, err error) {
+	if err := parseCompactEndpoint(cfg); err != nil {
+		return false, nil, err
+	}
+	if cfg.ExternalValues == nil && cfg.ExternalValueStore != "" {
+		if cfg.ExternalValues, err = valuestore.New(cfg.ExternalValueStore, cfg.ExternalValueThreshold); err != nil {
+			return false, nil, err
+		}
+	}
+
 	if cfg.Endpoint == "" {
 		driver := GetDefault()
 		if driver == nil {
 			return false, nil, errors.New("no default driver found")
 		}
+		if err := checkFeatures(defaultScheme, cfg); err != nil {
+			return false, nil, err
+		}
 		return driver(ctx, wg, cfg)
 	}
 
@@ -31,6 +45,9 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *Config) (leaderElect bool
 	if !ok {
 		return false, nil, ErrUnknownDriver
 	}
+	if err := checkFeatures(cfg.Scheme, cfg); err != nil {
+		return false, nil, err
+	}
 	return driver(ctx, wg, cfg)
 }
 
@@ -42,3 +59,25 @@ func validateDSNuri(str string) error {
 	}
 	return errors.New("invalid datastore endpoint; endpoint should be a DSN URI in the format <scheme>://<authority>")
 }
+
+// parseCompactEndpoint sets the compact data source name from the compact endpoint, if one is configured.
+// The compact endpoint must use the same scheme as the main endpoint.
+func parseCompactEndpoint(cfg *Config) error {
+	if cfg.CompactEndpoint == "" {
+		return nil
+	}
+	if err := validateDSNuri(cfg.CompactEndpoint); err != nil {
+		return fmt.Errorf("invalid compact endpoint: %w", err)
+	}
+
+	endpointScheme := defaultScheme
+	if cfg.Endpoint != "" {
+		endpointScheme, _ = util.SchemeAndAddress(cfg.Endpoint)
+	}
+	scheme, dataSourceName := util.SchemeAndAddress(cfg.CompactEndpoint)
+	if scheme != endpointScheme {
+		return errors.New("compact endpoint must use the same scheme as the datastore endpoint")
+	}
+	cfg.CompactDataSourceName = dataSourceName
+	return nil
+}
@@ -0,0 +1,119 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+var ErrUnsupportedFeature = errors.New("unsupported feature")
+
+// Feature is an optional datastore feature that only some drivers support, named by the flag
+// that enables it.
+type Feature string
+
+const (
+	FeatureCompactEndpoint     Feature = "compact-endpoint"
+	FeatureCompactExclude      Feature = "compact-exclude"
+	FeatureCompactVerify       Feature = "compact-verify"
+	FeatureElideNoopUpdates    Feature = "elide-noop-updates"
+	FeatureRevisionFloor       Feature = "revision-floor"
+	FeatureRevisionBlockSize   Feature = "revision-block-size"
+	FeatureRevisionMark        Feature = "revision-mark-interval"
+	FeatureExternalValues      Feature = "external-value-store"
+	FeatureAuditLog            Feature = "audit-log"
+	FeatureValidateStatements  Feature = "validate-sql"
+	FeatureAcquireTracing      Feature = "sql-acquire-tracing"
+	FeaturePartitioning        Feature = "partition-size"
+	FeatureReadTimeout         Feature = "read-timeout"
+	FeatureWriteTimeout        Feature = "write-timeout"
+	FeatureWatchPrefetch       Feature = "watch-prefetch"
+	FeatureWatchHistoryWindow  Feature = "watch-history-window"
+	FeatureWatchSharedDelivery Feature = "watch-shared-delivery"
+	FeatureCompactMinInterval  Feature = "compact-min-interval"
+	FeatureCompactAnalyze      Feature = "compact-analyze-threshold"
+	FeatureDisableMigrations   Feature = "datastore-disable-schema-migrations"
+	FeatureColumnTypes         Feature = "datastore-column-type"
+	FeatureRebuildIndexes      Feature = "datastore-rebuild-missing-indexes"
+	FeatureConnectionBackoff   Feature = "connection-backoff"
+)
+
+// SQLFeatures are the features supported by all drivers built on the generic SQL dialect.
+var SQLFeatures = []Feature{
+	FeatureCompactEndpoint,
+	FeatureCompactExclude,
+	FeatureCompactVerify,
+	FeatureElideNoopUpdates,
+	FeatureRevisionFloor,
+	FeatureRevisionBlockSize,
+	FeatureRevisionMark,
+	FeatureExternalValues,
+	FeatureAuditLog,
+	FeatureValidateStatements,
+	FeatureAcquireTracing,
+	FeatureReadTimeout,
+	FeatureWriteTimeout,
+	FeatureWatchPrefetch,
+	FeatureWatchHistoryWindow,
+	FeatureWatchSharedDelivery,
+	FeatureCompactMinInterval,
+	FeatureCompactAnalyze,
+	FeatureDisableMigrations,
+	FeatureColumnTypes,
+	FeatureRebuildIndexes,
+	FeatureConnectionBackoff,
+}
+
+// enabledFeatures returns the optional features that the config enables, in the order listed.
+// The connection backoff is only counted as enabled if it differs from its default, so that the
+// default does not prevent the use of drivers without connection backoff.
+func enabledFeatures(cfg *Config) []Feature {
+	var features []Feature
+	for _, f := range []struct {
+		feature Feature
+		enabled bool
+	}{
+		{FeatureCompactEndpoint, cfg.CompactEndpoint != ""},
+		{FeatureCompactExclude, len(cfg.CompactExclude) > 0},
+		{FeatureCompactVerify, cfg.CompactVerify},
+		{FeatureElideNoopUpdates, cfg.ElideNoopUpdates},
+		{FeatureRevisionFloor, cfg.RevisionFloor > 0},
+		{FeatureRevisionBlockSize, cfg.RevisionBlockSize > 0},
+		{FeatureRevisionMark, cfg.RevisionMarkInterval > 0},
+		{FeatureExternalValues, cfg.ExternalValueStore != "" || cfg.ExternalValues != nil},
+		{FeatureAuditLog, cfg.AuditLog},
+		{FeatureValidateStatements, cfg.ValidateStatements},
+		{FeatureAcquireTracing, cfg.AcquireTracing},
+		{FeaturePartitioning, cfg.PartitionSize > 0},
+		{FeatureReadTimeout, cfg.ReadTimeout > 0},
+		{FeatureWriteTimeout, cfg.WriteTimeout > 0},
+		{FeatureWatchPrefetch, cfg.WatchPrefetch > 0},
+		{FeatureWatchHistoryWindow, cfg.WatchHistoryWindow > 0},
+		{FeatureWatchSharedDelivery, cfg.WatchSharedDelivery},
+		{FeatureCompactMinInterval, cfg.CompactMinInterval > 0},
+		{FeatureCompactAnalyze, cfg.CompactAnalyzeThreshold > 0},
+		{FeatureDisableMigrations, cfg.DisableSchemaMigrations},
+		{FeatureColumnTypes, len(cfg.ColumnTypes) > 0},
+		{FeatureRebuildIndexes, cfg.RebuildMissingIndexes},
+		{FeatureConnectionBackoff, cfg.ConnectionBackoff > 0 && cfg.ConnectionBackoff != generic.DefaultConnBackoff},
+	} {
+		if f.enabled {
+			features = append(features, f.feature)
+		}
+	}
+	return features
+}
+
+// checkFeatures returns an error naming the first feature enabled by the config that the driver
+// for the given scheme does not support.
+func checkFeatures(scheme string, cfg *Config) error {
+	supported := Features(scheme)
+	for _, feature := range enabledFeatures(cfg) {
+		if !slices.Contains(supported, feature) {
+			return fmt.Errorf("%w: the %s datastore driver does not support --%s", ErrUnsupportedFeature, scheme, feature)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestUnsupportedFeature(t *testing.T) {
+	created := false
+	constructor := func(ctx context.Context, wg *sync.WaitGroup, cfg *Config) (bool, server.Backend, error) {
+		created = true
+		return false, nil, nil
+	}
+	Register("features-test", constructor)
+	RegisterFeatures("features-test", FeatureAuditLog)
+	defer func() {
+		delete(driverRegistry, "features-test")
+		delete(featureRegistry, "features-test")
+	}()
+
+	ctx := context.Background()
+	wg := &sync.WaitGroup{}
+	_, _, err := New(ctx, wg, &Config{Endpoint: "features-test://", AuditLog: true, PartitionSize: 10})
+	if !errors.Is(err, ErrUnsupportedFeature) || !strings.Contains(err.Error(), "features-test datastore driver does not support --partition-size") {
+		t.Fatalf("expected %v naming --partition-size, got %v", ErrUnsupportedFeature, err)
+	}
+	if created {
+		t.Fatal("expected driver not to be created with an unsupported feature enabled")
+	}
+
+	if _, _, err := New(ctx, wg, &Config{Endpoint: "features-test://", AuditLog: true}); err != nil {
+		t.Fatalf("expected supported feature to be accepted, got %v", err)
+	}
+	if !created {
+		t.Fatal("expected driver to be created")
+	}
+}
+
+func TestUnsupportedSQLOptions(t *testing.T) {
+	Register("features-test", func(ctx context.Context, wg *sync.WaitGroup, cfg *Config) (bool, server.Backend, error) {
+		return false, nil, nil
+	})
+	defer delete(driverRegistry, "features-test")
+
+	ctx := context.Background()
+	wg := &sync.WaitGroup{}
+	for _, test := range []struct {
+		feature Feature
+		cfg     Config
+	}{
+		{FeatureReadTimeout, Config{ReadTimeout: time.Second}},
+		{FeatureWriteTimeout, Config{WriteTimeout: time.Second}},
+		{FeatureWatchPrefetch, Config{WatchPrefetch: 10}},
+		{FeatureWatchHistoryWindow, Config{WatchHistoryWindow: 10}},
+		{FeatureWatchSharedDelivery, Config{WatchSharedDelivery: true}},
+		{FeatureCompactMinInterval, Config{CompactMinInterval: time.Minute}},
+		{FeatureCompactAnalyze, Config{CompactAnalyzeThreshold: 1000}},
+		{FeatureDisableMigrations, Config{DisableSchemaMigrations: true}},
+		{FeatureColumnTypes, Config{ColumnTypes: generic.ColumnTypes{"value": "BYTEA"}}},
+		{FeatureRebuildIndexes, Config{RebuildMissingIndexes: true}},
+		{FeatureConnectionBackoff, Config{ConnectionBackoff: time.Minute}},
+	} {
+		test.cfg.Endpoint = "features-test://"
+		if _, _, err := New(ctx, wg, &test.cfg); !errors.Is(err, ErrUnsupportedFeature) || !strings.Contains(err.Error(), "--"+string(test.feature)) {
+			t.Errorf("expected %v naming --%s, got %v", ErrUnsupportedFeature, test.feature, err)
+		}
+	}
+
+	// the default connection backoff does not need to be disabled for drivers without it
+	if _, _, err := New(ctx, wg, &Config{Endpoint: "features-test://", ConnectionBackoff: generic.DefaultConnBackoff}); err != nil {
+		t.Fatalf("expected default connection backoff to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/util"
+)
+
+// sqlConn is implemented by both a connection pool and a single connection acquired from it.
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// SetAcquireTracing enables acquiring a connection from the pool before running each statement
+// outside of a transaction, so that the time spent waiting for a connection is recorded in
+// kine_sql_acquire_time_seconds, and excluded from kine_sql_time_seconds. This must be called
+// before the backend is started.
+func (d *Generic) SetAcquireTracing(enabled bool) {
+	d.acquireTracing = enabled
+}
+
+// acquire returns the connection pool to run a statement on, and a function to call once the
+// statement has been run. If acquire tracing is enabled, a connection is acquired from the pool
+// instead, recording the time spent waiting for it, and is returned to the pool once the
+// statement's rows, if any, have been closed.
+func (d *Generic) acquire(ctx context.Context, sql string) (sqlConn, func(), error) {
+	db := d.conn(sql)
+	if !d.acquireTracing {
+		return db, func() {}, nil
+	}
+	start := time.Now()
+	conn, err := db.Conn(ctx)
+	metrics.ObserveSQLAcquire(ctx, start, util.Stripped(sql))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() {
+		// Close blocks until rows read from the connection are closed, which is after the
+		// statement has returned them
+		go conn.Close()
+	}, nil
+}
@@ -0,0 +1,96 @@
+package generic
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// openAffinity returns the set of connection pools that statements are spread
+// across. When statement affinity is enabled, additional pools are opened
+// alongside the primary pool, and each statement is consistently routed to the
+// same pool. Drivers that cache prepared statements per connection (such as
+// pgx) will then find a statement already prepared on most connections it is
+// run on, instead of preparing it again on every connection in a large pool.
+func openAffinity(db *sql.DB, driverName, dataSourceName string, connPoolConfig ConnectionPoolConfig) ([]*sql.DB, error) {
+	dbs := []*sql.DB{db}
+	for i := 1; i < connPoolConfig.StatementAffinity; i++ {
+		adb, err := openAndTest(driverName, dataSourceName, connPoolConfig.validationQuery())
+		if err != nil {
+			for _, db := range dbs[1:] {
+				db.Close()
+			}
+			return nil, err
+		}
+		dbs = append(dbs, adb)
+	}
+	return dbs, nil
+}
+
+// affinityPoolConfig divides the connection limits evenly across n pools, so
+// that the total number of connections stays within the configured limits. Statements
+// are not limited to their own pool's share; see conn.
+func affinityPoolConfig(connPoolConfig ConnectionPoolConfig, n int) ConnectionPoolConfig {
+	if connPoolConfig.MaxIdle > 0 {
+		connPoolConfig.MaxIdle = max(1, connPoolConfig.MaxIdle/n)
+	}
+	if connPoolConfig.MaxOpen > 0 {
+		connPoolConfig.MaxOpen = max(1, connPoolConfig.MaxOpen/n)
+	}
+	return connPoolConfig
+}
+
+func affinityDBName(i int) string {
+	if i == 0 {
+		return "kine"
+	}
+	return fmt.Sprintf("kine-affinity-%d", i)
+}
+
+// conn returns the connection pool that should be used to run the given statement.
+// Each statement is routed to the same pool while that pool has a connection available.
+// Once all of the pool's connections are in use, the statement spills over to the pool
+// with the most connections available, so that frequently run statements can use the
+// full connection limit instead of only their own pool's share of it.
+// Transactions always use the primary pool.
+func (d *Generic) conn(sql string) *sql.DB {
+	if len(d.affinity) < 2 {
+		return d.DB
+	}
+	h := fnv.New64a()
+	h.Write([]byte(sql))
+	preferred := d.affinity[jumpHash(h.Sum64(), len(d.affinity))]
+
+	best, bestAvailable := preferred, available(preferred.Stats())
+	if bestAvailable > 0 {
+		return preferred
+	}
+	for _, db := range d.affinity {
+		if a := available(db.Stats()); a > bestAvailable {
+			best, bestAvailable = db, a
+		}
+	}
+	return best
+}
+
+// available returns the number of connections that a pool can hand out without waiting.
+// Pools without a limit on open connections can always open another connection.
+func available(stats sql.DBStats) int {
+	if stats.MaxOpenConnections <= 0 {
+		return math.MaxInt
+	}
+	return stats.MaxOpenConnections - stats.InUse
+}
+
+// jumpHash implements the Lamping-Veach jump consistent hash, mapping key to one
+// of n buckets.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,118 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestJumpHash(t *testing.T) {
+	for n := 1; n <= 8; n++ {
+		counts := make([]int, n)
+		for key := uint64(0); key < 10000; key++ {
+			b := jumpHash(key, n)
+			if b < 0 || b >= n {
+				t.Fatalf("bucket %d out of range for n=%d", b, n)
+			}
+			if b != jumpHash(key, n) {
+				t.Fatalf("bucket for key %d is not stable", key)
+			}
+			// growing the number of buckets should only ever move keys to the new bucket
+			if n > 1 {
+				if prev := jumpHash(key, n-1); b != prev && b != n-1 {
+					t.Fatalf("key %d moved from bucket %d to %d when growing to n=%d", key, prev, b, n)
+				}
+			}
+			counts[b]++
+		}
+		for b, c := range counts {
+			if c < 10000/n/2 {
+				t.Fatalf("bucket %d of %d is underused: %d keys", b, n, c)
+			}
+		}
+	}
+}
+
+func init() {
+	sql.Register("kine-affinity-test", &validateDriver{})
+}
+
+func TestAffinitySpillover(t *testing.T) {
+	ctx := context.Background()
+	d := &Generic{}
+	for range 2 {
+		db, err := sql.Open("kine-affinity-test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+		d.affinity = append(d.affinity, db)
+	}
+	d.DB = d.affinity[0]
+
+	const stmt = "SELECT 1"
+	preferred := d.conn(stmt)
+	if d.conn(stmt) != preferred {
+		t.Fatal("expected statement to be routed to the same pool")
+	}
+
+	// once the preferred pool's only connection is in use, the statement spills over
+	// to the other pool instead of waiting
+	conn, err := preferred.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.conn(stmt) == preferred {
+		t.Fatal("expected statement to spill over from the saturated pool")
+	}
+	conn.Close()
+	if d.conn(stmt) != preferred {
+		t.Fatal("expected statement to return to its pool once a connection is available")
+	}
+}
+
+// BenchmarkStatementAffinity simulates per-connection prepared statement caches
+// with connection churn, and reports the fraction of statement executions that
+// found the statement already prepared on the connection.
+func BenchmarkStatementAffinity(b *testing.B) {
+	const (
+		maxOpen    = 32
+		statements = 24
+		lifetime   = 200 // uses before a connection is replaced
+	)
+	for _, affinity := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("affinity=%d", affinity), func(b *testing.B) {
+			pools := make([][]map[int]bool, affinity)
+			uses := make([][]int, affinity)
+			perPool := max(1, maxOpen/affinity)
+			for i := range pools {
+				pools[i] = make([]map[int]bool, perPool)
+				uses[i] = make([]int, perPool)
+				for j := range pools[i] {
+					pools[i][j] = map[int]bool{}
+				}
+			}
+
+			r := rand.New(rand.NewSource(1))
+			hits := 0
+			for i := 0; i < b.N; i++ {
+				stmt := r.Intn(statements)
+				p := jumpHash(uint64(stmt), affinity)
+				c := r.Intn(perPool)
+				if pools[p][c][stmt] {
+					hits++
+				} else {
+					pools[p][c][stmt] = true
+				}
+				if uses[p][c]++; uses[p][c] >= lifetime {
+					pools[p][c] = map[int]bool{}
+					uses[p][c] = 0
+				}
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "prepare-hits/op")
+		})
+	}
+}
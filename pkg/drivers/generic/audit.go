@@ -0,0 +1,94 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Rican7/retry/backoff"
+	"github.com/Rican7/retry/strategy"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations recorded in the audit log.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// SetAuditLog enables recording an audit record in the kine_audit table for each row inserted,
+// with the revision, key, operation, the principal that made the request, and the time. The
+// record is inserted in the same transaction as the row, so that a row is never written without
+// its audit record. Audit logging cannot be combined with revision block allocation. This must
+// be called before the backend is started.
+func (d *Generic) SetAuditLog(enabled bool) error {
+	if enabled && d.revisions != nil {
+		return errors.New("audit log cannot be enabled along with revision block allocation")
+	}
+	if enabled {
+		logrus.Infof("Recording audit log of datastore writes")
+	}
+	d.audit = enabled
+	return nil
+}
+
+func auditOperation(cVal, dVal int) string {
+	switch {
+	case cVal != 0:
+		return AuditCreate
+	case dVal != 0:
+		return AuditDelete
+	default:
+		return AuditUpdate
+	}
+}
+
+// insertAudited inserts a row and its audit record in a single transaction.
+func (d *Generic) insertAudited(ctx context.Context, key string, cVal, dVal int, createRevision, previousRevision, ttl int64, value, prevValue []byte) (id int64, err error) {
+	if d.LockWrites {
+		d.Lock()
+		defer d.Unlock()
+	}
+
+	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
+	for i := uint(0); i < 20; i++ {
+		id, err = d.insertAuditedOnce(ctx, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		if err != nil && d.InsertRetry != nil && d.InsertRetry(err) {
+			logrus.Warnf("retriable insert error for key %v: %v", key, err)
+			metrics.InsertErrorsTotal.WithLabelValues("true").Inc()
+			wait(i)
+			continue
+		}
+		if err != nil {
+			metrics.InsertErrorsTotal.WithLabelValues("false").Inc()
+		}
+		return id, err
+	}
+	return id, err
+}
+
+func (d *Generic) insertAuditedOnce(ctx context.Context, key string, cVal, dVal int, createRevision, previousRevision, ttl int64, value, prevValue []byte) (id int64, err error) {
+	principal := util.Principal(ctx)
+	operation := auditOperation(cVal, dVal)
+	util.RequestLogger(ctx).Tracef("AUDITED INSERT %s %s by %q", operation, key, principal)
+	startTime := time.Now()
+	defer func() {
+		metrics.ObserveSQL(ctx, startTime, d.ErrCode(err), util.Stripped(d.InsertAuditSQL), []any{key, operation, principal})
+		d.observeConnErr(err)
+	}()
+
+	d.waitConnBackoff(ctx)
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if id, err = d.insertTx(ctx, tx, 0, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
@@ -0,0 +1,140 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Rican7/retry/backoff"
+	"github.com/Rican7/retry/strategy"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// InsertAll inserts rows in a single transaction, in order, and returns their revisions. Either
+// all of the rows are inserted, or none are.
+func (d *Generic) InsertAll(ctx context.Context, rows []server.InsertRow) (ids []int64, err error) {
+	if d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = d.TranslateErr(err)
+			}
+		}()
+	}
+
+	if d.LockWrites {
+		d.Lock()
+		defer d.Unlock()
+	}
+
+	var stale bool
+	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
+	for i := uint(0); i < 20; i++ {
+		ids, err = d.insertAllOnce(ctx, rows, stale)
+		if errors.Is(err, errRevisionStale) {
+			logrus.Debugf("Revisions for %d rows were filled or are not greater than the current revision, retrying", len(rows))
+			stale = true
+			continue
+		}
+		if err != nil && d.InsertRetry != nil && d.InsertRetry(err) {
+			logrus.Warnf("retriable insert error for %d rows: %v", len(rows), err)
+			metrics.InsertErrorsTotal.WithLabelValues("true").Inc()
+			wait(i)
+			continue
+		}
+		if err != nil {
+			metrics.InsertErrorsTotal.WithLabelValues("false").Inc()
+		}
+		return ids, err
+	}
+	return ids, err
+}
+
+// insertAllOnce makes a single attempt to insert rows. If revisions are assigned by the revision
+// allocator, they are allocated before the transaction is started, and errRevisionStale is
+// returned if any of them has been filled or is not greater than the current revision.
+func (d *Generic) insertAllOnce(ctx context.Context, rows []server.InsertRow, stale bool) (ids []int64, err error) {
+	util.RequestLogger(ctx).Tracef("INSERT ALL %d rows", len(rows))
+	startTime := time.Now()
+	defer func() {
+		metrics.ObserveSQL(ctx, startTime, d.ErrCode(err), util.Stripped(d.InsertSQL), []any{len(rows)})
+		d.observeConnErr(err)
+	}()
+
+	revs := make([]int64, len(rows))
+	if d.revisions != nil {
+		if revs, err = d.revisions.allocateAll(ctx, len(rows), stale); err != nil {
+			return nil, err
+		}
+	}
+
+	d.waitConnBackoff(ctx)
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for i, row := range rows {
+		cVal, dVal := 0, 0
+		if row.Create {
+			cVal = 1
+		}
+		if row.Delete {
+			dVal = 1
+		}
+		id, err := d.insertTx(ctx, tx, revs[i], row.Key, cVal, dVal, row.CreateRevision, row.PreviousRevision, row.Lease, row.Value, row.PrevValue)
+		if err != nil && revs[i] != 0 && !errors.Is(err, errRevisionStale) {
+			// the transaction may no longer be usable, so check whether the revision was filled
+			// once it has been rolled back
+			tx.Rollback()
+			var exists int
+			if rerr := d.queryRow(ctx, d.RevisionExistsSQL, revs[i]).Scan(&exists); rerr == nil {
+				return nil, errRevisionStale
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, tx.Commit()
+}
+
+// insertTx inserts a row within a transaction, along with its audit record if the audit log is
+// enabled, and returns its revision. If revision is not zero, the row is inserted with that
+// revision, and errRevisionStale is returned if it is not greater than the current revision.
+func (d *Generic) insertTx(ctx context.Context, tx *sql.Tx, revision int64, key string, cVal, dVal int, createRevision, previousRevision, ttl int64, value, prevValue []byte) (id int64, err error) {
+	if revision != 0 {
+		result, err := tx.ExecContext(ctx, d.InsertRevisionSQL, revision, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue, revision)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if n != 1 {
+			return 0, errRevisionStale
+		}
+		id = revision
+	} else if d.LastInsertID {
+		result, err := tx.ExecContext(ctx, d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		if err != nil {
+			return 0, err
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return 0, err
+		}
+	} else if err := tx.QueryRowContext(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	if d.audit {
+		if _, err := tx.ExecContext(ctx, d.InsertAuditSQL, id, key, auditOperation(cVal, dVal), util.Principal(ctx), time.Now().UnixMilli()); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,52 @@
+package generic
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ColumnTypes maps kine table column names to SQL types that should be used
+// in place of the driver's default column type when creating the table.
+type ColumnTypes map[string]string
+
+// ParseColumnTypes parses a list of column=type overrides, as provided on the command line.
+func ParseColumnTypes(overrides []string) (ColumnTypes, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	columnTypes := ColumnTypes{}
+	for _, override := range overrides {
+		column, columnType, ok := strings.Cut(override, "=")
+		column = strings.TrimSpace(column)
+		columnType = strings.TrimSpace(columnType)
+		if !ok || column == "" || columnType == "" {
+			return nil, fmt.Errorf("invalid column type override %q: must be in the form column=type", override)
+		}
+		columnTypes[column] = columnType
+	}
+	return columnTypes, nil
+}
+
+// ApplyColumnTypes replaces column type definitions in a CREATE TABLE statement
+// with the provided overrides. Only columns and types present in the allowed set
+// may be overridden; types are compared case-insensitively.
+func ApplyColumnTypes(stmt string, overrides ColumnTypes, allowed map[string][]string) (string, error) {
+	for column, columnType := range overrides {
+		i := slices.IndexFunc(allowed[column], func(t string) bool { return strings.EqualFold(t, columnType) })
+		if i < 0 {
+			if len(allowed[column]) == 0 {
+				return "", fmt.Errorf("column type override not supported for column %q", column)
+			}
+			return "", fmt.Errorf("unsupported type %q for column %q: must be one of %s", columnType, column, strings.Join(allowed[column], ", "))
+		}
+
+		re := regexp.MustCompile(`(?m)^(\s*` + regexp.QuoteMeta(column) + `\s+)[^,\n]*?(,?)[ \t]*$`)
+		if !re.MatchString(stmt) {
+			return "", fmt.Errorf("column %q not found in table definition", column)
+		}
+		stmt = re.ReplaceAllString(stmt, "${1}"+allowed[column][i]+"${2}")
+	}
+	return stmt, nil
+}
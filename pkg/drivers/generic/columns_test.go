@@ -0,0 +1,54 @@
+package generic
+
+import (
+	"strings"
+	"testing"
+)
+
+const testTableSQL = `CREATE TABLE IF NOT EXISTS kine
+	(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name INTEGER,
+		lease INTEGER,
+		value MEDIUMBLOB,
+		old_value MEDIUMBLOB
+	)`
+
+var testAllowedColumnTypes = map[string][]string{
+	"value":     {"MEDIUMBLOB", "LONGBLOB"},
+	"old_value": {"MEDIUMBLOB", "LONGBLOB"},
+}
+
+func TestApplyColumnTypes(t *testing.T) {
+	overrides, err := ParseColumnTypes([]string{"value=longblob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := ApplyColumnTypes(testTableSQL, overrides, testAllowedColumnTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmt, "\t\tvalue LONGBLOB,\n") {
+		t.Fatalf("expected overridden value column type in DDL:\n%s", stmt)
+	}
+	if !strings.Contains(stmt, "\t\told_value MEDIUMBLOB\n") {
+		t.Fatalf("expected default old_value column type in DDL:\n%s", stmt)
+	}
+}
+
+func TestApplyColumnTypesValidation(t *testing.T) {
+	for _, override := range []string{"value=TEXT", "id=BIGINT", "value=LONGBLOB; DROP TABLE kine"} {
+		overrides, err := ParseColumnTypes([]string{override})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ApplyColumnTypes(testTableSQL, overrides, testAllowedColumnTypes); err == nil {
+			t.Fatalf("expected error for override %q", override)
+		}
+	}
+
+	if _, err := ParseColumnTypes([]string{"value"}); err == nil {
+		t.Fatal("expected error for override without type")
+	}
+}
@@ -0,0 +1,113 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// compactExcludeKey is the name of the kine_meta row that holds the keys that were excluded
+// from compaction when the datastore was last compacted.
+const compactExcludeKey = "compact_exclude"
+
+// likeEscaper escapes the LIKE wildcards in a key, using the ^ escape character.
+var likeEscaper = strings.NewReplacer(`^`, `^^`, `%`, `^%`, `_`, `^_`)
+
+// SetCompactExclude configures keys whose history is never compacted. Each entry is either an
+// exact key, or a prefix ending in / that matches all keys under it. Rows of excluded keys are
+// kept by compaction, so that the log can serve reads of them below the compact revision. This
+// must be called after the driver has set its compaction statements.
+func (d *Generic) SetCompactExclude(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	logrus.Infof("Excluding %d keys and prefixes from compaction", len(keys))
+
+	for _, key := range keys {
+		pattern := likeEscaper.Replace(key)
+		if strings.HasSuffix(key, "/") {
+			pattern += "%"
+		}
+		d.compactExclude = append(d.compactExclude, pattern)
+	}
+	d.compactExcludeSet = strings.Join(slices.Sorted(slices.Values(d.compactExclude)), "\n")
+	// every compaction statement ends with a condition on the row to be deleted, kv
+	d.CompactSQL += d.compactExcludeSQL(4)
+	d.CompactValuesSQL += d.compactExcludeSQL(4)
+	d.CompactableSQL += d.compactExcludeSQL(2)
+}
+
+// compactExcludeSQL returns the conditions excluding rows from compaction, for a statement
+// that already has the given number of parameters.
+func (d *Generic) compactExcludeSQL(params int) string {
+	var sb strings.Builder
+	for i := range d.compactExclude {
+		param := d.paramCharacter
+		if d.numbered {
+			param += strconv.Itoa(params + i + 1)
+		}
+		fmt.Fprintf(&sb, " AND kv.name NOT LIKE %s ESCAPE '^'", param)
+	}
+	return sb.String()
+}
+
+// compactArgs returns the arguments for a compaction statement, followed by the patterns of
+// keys excluded from compaction.
+func (d *Generic) compactArgs(args ...any) []any {
+	for _, pattern := range d.compactExclude {
+		args = append(args, pattern)
+	}
+	return args
+}
+
+// compactStart returns the revision after which to scan for rows to compact, given that the
+// datastore has already been compacted to start. Rows written up to start were skipped, rather
+// than deleted, if their keys were excluded from compaction at the time; if the excluded keys
+// have changed since the last compaction, all rows are scanned again so that the rows of keys
+// no longer excluded are deleted. True is returned if the excluded keys have changed, in which
+// case they must be recorded once the compaction is complete.
+func (t *Tx) compactStart(ctx context.Context, start int64) (int64, bool, error) {
+	recorded, err := t.recordedCompactExclude(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	if recorded == nil || *recorded == t.d.compactExcludeSet {
+		return start, recorded == nil && t.d.compactExcludeSet != "", nil
+	}
+	logrus.Infof("COMPACT keys excluded from compaction have changed; scanning all rows")
+	return 0, true, nil
+}
+
+// recordedCompactExclude returns the keys excluded from compaction when the datastore was last
+// compacted, or nil if they have never been recorded.
+func (t *Tx) recordedCompactExclude(ctx context.Context) (*string, error) {
+	var recorded string
+	err := t.queryRow(ctx, t.d.GetMetaSQL, compactExcludeKey).Scan(&recorded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &recorded, nil
+}
+
+// recordCompactExclude records the keys currently excluded from compaction.
+func (t *Tx) recordCompactExclude(ctx context.Context) error {
+	recorded, err := t.recordedCompactExclude(ctx)
+	if err != nil {
+		return err
+	}
+	if recorded == nil {
+		_, err = t.execute(ctx, t.d.InsertMetaSQL, compactExcludeKey, t.d.compactExcludeSet)
+		return err
+	}
+	_, err = t.execute(ctx, t.d.UpdateMetaSQL, t.d.compactExcludeSet, compactExcludeKey, *recorded)
+	return err
+}
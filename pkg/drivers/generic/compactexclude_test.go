@@ -0,0 +1,22 @@
+package generic
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetCompactExclude(t *testing.T) {
+	d := &Generic{paramCharacter: "$", numbered: true, CompactSQL: "DELETE ... WHERE kv.id = ks.id", CompactableSQL: "SELECT ... kv.id IN (...)"}
+	d.SetCompactExclude([]string{"/config/", "/a_b%"})
+
+	if !strings.HasSuffix(d.CompactSQL, " AND kv.name NOT LIKE $5 ESCAPE '^' AND kv.name NOT LIKE $6 ESCAPE '^'") {
+		t.Errorf("expected exclusions to follow the 4 compaction parameters, got %q", d.CompactSQL)
+	}
+	if !strings.HasSuffix(d.CompactableSQL, " AND kv.name NOT LIKE $3 ESCAPE '^' AND kv.name NOT LIKE $4 ESCAPE '^'") {
+		t.Errorf("expected exclusions to follow the 2 count parameters, got %q", d.CompactableSQL)
+	}
+	if args := d.compactArgs(int64(1), int64(2)); !reflect.DeepEqual(args, []any{int64(1), int64(2), "/config/%", "/a^_b^%"}) {
+		t.Errorf("unexpected compaction arguments %v", args)
+	}
+}
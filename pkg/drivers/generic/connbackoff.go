@@ -0,0 +1,93 @@
+package generic
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// connBackoffMin is the initial delay applied to statements once the database rejects a
+// connection because too many are open. The delay doubles with each further rejection.
+const connBackoffMin = 100 * time.Millisecond
+
+// DefaultConnBackoff is the default maximum delay applied to statements while the database is
+// rejecting connections because too many are open.
+const DefaultConnBackoff = 5 * time.Second
+
+// connBackoff delays new statements while the database is rejecting connections because too
+// many are open, so that kine does not add to the load with immediate retries. The delay is
+// cleared by the first statement that succeeds.
+type connBackoff struct {
+	max   time.Duration
+	until atomic.Int64
+
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+// SetConnBackoff sets the maximum delay applied to statements while the database is rejecting
+// connections because too many are open. A maximum of zero or less disables the delay. This must
+// be called before the backend is started.
+func (d *Generic) SetConnBackoff(max time.Duration) {
+	d.connBackoff.max = max
+}
+
+// observeConnErr counts and logs err if it is a connection error, as observeConnErr does, and
+// updates the backoff applied to later statements.
+func (d *Generic) observeConnErr(err error) {
+	if err == nil {
+		d.connBackoff.reset()
+		return
+	}
+	if observeConnErr(err, d.classifyConnErr) == ConnErrTooManyConnections {
+		d.connBackoff.extend()
+	}
+}
+
+// waitConnBackoff blocks until the backoff has elapsed, or the context is done, in which case the
+// statement that follows fails with the context's error.
+func (d *Generic) waitConnBackoff(ctx context.Context) {
+	d.connBackoff.wait(ctx)
+}
+
+func (b *connBackoff) extend() {
+	if b.max <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.delay = min(max(b.delay*2, connBackoffMin), b.max)
+	b.until.Store(time.Now().Add(b.delay).UnixNano())
+	logrus.Warnf("Database has too many connections; delaying new statements for %s", b.delay)
+}
+
+func (b *connBackoff) reset() {
+	if b.until.Load() == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.delay != 0 {
+		logrus.Infof("Database is accepting connections again")
+	}
+	b.delay = 0
+	b.until.Store(0)
+}
+
+func (b *connBackoff) wait(ctx context.Context) {
+	remaining := time.Until(time.Unix(0, b.until.Load()))
+	if remaining <= 0 {
+		return
+	}
+	metrics.ConnectionBackoffTotal.Inc()
+	t := time.NewTimer(remaining)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,74 @@
+package generic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Connection error classes reported by ClassifyConnErr.
+const (
+	ConnErrAuth               = "auth"
+	ConnErrUnreachable        = "unreachable"
+	ConnErrTimeout            = "timeout"
+	ConnErrTooManyConnections = "too_many_connections"
+	ConnErrTLS                = "tls"
+)
+
+// ClassifyConnErr returns the connection error class of a driver-specific error,
+// or an empty string if the error is not recognized by the driver.
+type ClassifyConnErr func(error) string
+
+// classifyConnErr returns the connection error class of err, using the driver's
+// classification if it recognizes the error, and otherwise checking for network,
+// timeout, and TLS errors common to all drivers. It returns an empty string if err
+// is not a connection error.
+func classifyConnErr(err error, classify ClassifyConnErr) string {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return ""
+	}
+	if classify != nil {
+		if class := classify(err); class != "" {
+			return class
+		}
+	}
+
+	var (
+		recordHeaderErr tls.RecordHeaderError
+		certErr         *tls.CertificateVerificationError
+		unknownAuthErr  x509.UnknownAuthorityError
+		hostnameErr     x509.HostnameError
+		netErr          net.Error
+		opErr           *net.OpError
+		dnsErr          *net.DNSError
+	)
+	switch {
+	case errors.As(err, &recordHeaderErr), errors.As(err, &certErr), errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return ConnErrTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ConnErrTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ConnErrTimeout
+	case errors.As(err, &dnsErr), errors.As(err, &opErr):
+		return ConnErrUnreachable
+	}
+	return ""
+}
+
+// observeConnErr counts and logs err if it is a connection error, and returns
+// its class, or an empty string if it is not a connection error.
+func observeConnErr(err error, classify ClassifyConnErr) string {
+	class := classifyConnErr(err, classify)
+	if class == "" {
+		return ""
+	}
+	metrics.ConnectionErrorsTotal.WithLabelValues(class).Inc()
+	logrus.WithField("class", class).Errorf("Database connection error: %v", err)
+	return class
+}
@@ -0,0 +1,93 @@
+package generic
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyConnErr(t *testing.T) {
+	driverErr := errors.New("driver: too many clients")
+	classify := func(err error) string {
+		if errors.Is(err, driverErr) {
+			return ConnErrTooManyConnections
+		}
+		return ""
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"canceled", context.Canceled, ""},
+		{"query error", errors.New("syntax error at or near \"SELEC\""), ""},
+		{"driver", fmt.Errorf("ping: %w", driverErr), ConnErrTooManyConnections},
+		{"deadline", context.DeadlineExceeded, ConnErrTimeout},
+		{"io timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, ConnErrTimeout},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connect: connection refused")}, ConnErrUnreachable},
+		{"dns", &net.DNSError{Err: "no such host", Name: "db.example.com", IsNotFound: true}, ConnErrUnreachable},
+		{"tls", fmt.Errorf("failed to connect: %w", x509.UnknownAuthorityError{}), ConnErrTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyConnErr(tt.err, classify); got != tt.want {
+				t.Errorf("classifyConnErr(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnBackoff(t *testing.T) {
+	ctx := context.Background()
+	tooMany := errors.New("driver: too many clients")
+	d := &Generic{classifyConnErr: func(err error) string {
+		if errors.Is(err, tooMany) {
+			return ConnErrTooManyConnections
+		}
+		return ""
+	}}
+	d.SetConnBackoff(150 * time.Millisecond)
+	waited := testutil.ToFloat64(metrics.ConnectionBackoffTotal)
+
+	elapsed := func() time.Duration {
+		start := time.Now()
+		d.waitConnBackoff(ctx)
+		return time.Since(start)
+	}
+
+	// other errors do not delay statements
+	d.observeConnErr(errors.New("syntax error"))
+	if e := elapsed(); e >= connBackoffMin {
+		t.Fatalf("expected no delay after a query error, waited %s", e)
+	}
+
+	// too many connections delays the next statement, doubling up to the maximum
+	d.observeConnErr(tooMany)
+	if e := elapsed(); e < connBackoffMin {
+		t.Fatalf("expected delay of at least %s, waited %s", connBackoffMin, e)
+	}
+	d.observeConnErr(tooMany)
+	if e := elapsed(); e < 150*time.Millisecond {
+		t.Fatalf("expected delay of at least 150ms, waited %s", e)
+	}
+	if n := testutil.ToFloat64(metrics.ConnectionBackoffTotal) - waited; n != 2 {
+		t.Fatalf("expected 2 delayed statements to be counted, got %v", n)
+	}
+
+	// a successful statement clears the delay
+	d.observeConnErr(tooMany)
+	d.observeConnErr(nil)
+	if e := elapsed(); e >= connBackoffMin {
+		t.Fatalf("expected no delay after a successful statement, waited %s", e)
+	}
+}
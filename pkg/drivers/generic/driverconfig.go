@@ -0,0 +1,66 @@
+package generic
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// DriverConfig returns the connection pool limits and dialect settings that are in
+// effect, as opposed to those that were requested. The maximum number of open
+// connections is read from each pool, while other limits are recorded when they are
+// applied, as database/sql does not report them.
+func (d *Generic) DriverConfig() *server.DriverConfig {
+	config := &server.DriverConfig{
+		Driver:            d.driverName,
+		DataSourceName:    d.dataSourceName,
+		ValidationQuery:   d.validationQuery,
+		FillRetryDuration: d.FillRetryDuration.String(),
+		LockWrites:        d.LockWrites,
+		LastInsertID:      d.LastInsertID,
+		AuditLog:          d.audit,
+	}
+	if d.revisions != nil {
+		config.RevisionBlockSize = d.revisions.blockSize
+	}
+	for i, db := range d.affinity {
+		config.Pools = append(config.Pools, server.PoolConfig{
+			Name:        affinityDBName(i),
+			MaxOpen:     db.Stats().MaxOpenConnections,
+			MaxIdle:     d.poolConfig.MaxIdle,
+			MaxLifetime: d.poolConfig.MaxLifetime.String(),
+		})
+	}
+	if d.CompactDB != nil {
+		config.CompactPool = &server.PoolConfig{
+			Name:        "kine-compact",
+			MaxOpen:     d.CompactDB.Stats().MaxOpenConnections,
+			MaxIdle:     1,
+			MaxLifetime: "0s",
+		}
+	}
+	return config
+}
+
+// PoolStats returns the current use of each connection pool.
+func (d *Generic) PoolStats() []server.PoolStats {
+	var pools []server.PoolStats
+	for i, db := range d.affinity {
+		pools = append(pools, poolStats(affinityDBName(i), db.Stats()))
+	}
+	if d.CompactDB != nil {
+		pools = append(pools, poolStats("kine-compact", d.CompactDB.Stats()))
+	}
+	return pools
+}
+
+func poolStats(name string, stats sql.DBStats) server.PoolStats {
+	return server.PoolStats{
+		Name:         name,
+		Open:         stats.OpenConnections,
+		InUse:        stats.InUse,
+		Idle:         stats.Idle,
+		WaitCount:    stats.WaitCount,
+		WaitDuration: stats.WaitDuration.String(),
+	}
+}
@@ -0,0 +1,69 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// When a managed database fails over to a standby, statements in progress on the old primary
+// fail with a connection error, and it is not known whether they were applied. Reads are simply
+// retried, as the connection pool replaces the lost connections with connections to the new
+// primary. Inserts are only retried once it has been verified that the row was not written, by
+// looking for it by the name and previous revision that are unique to each row; retrying without
+// checking could write the same change twice, or report a conflict with the change itself.
+const (
+	maxFailoverAttempts = 5
+	failoverRetryDelay  = 200 * time.Millisecond
+)
+
+// isFailover returns true if err indicates that the connection to the database was lost while
+// a statement was in progress, or that the database is no longer the primary.
+func (d *Generic) isFailover(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if d.Failover != nil && d.Failover(err) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || classifyConnErr(err, d.classifyConnErr) == ConnErrUnreachable
+}
+
+// retryFailover returns true if a statement that failed with err should be attempted again,
+// after waiting for the database to fail over.
+func (d *Generic) retryFailover(ctx context.Context, err error, attempt int) bool {
+	if attempt+1 >= maxFailoverAttempts || ctx.Err() != nil || !d.isFailover(err) {
+		return false
+	}
+	logrus.Warnf("Retrying statement after possible database failover (attempt %d): %v", attempt+1, err)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Duration(attempt+1) * failoverRetryDelay):
+		return true
+	}
+}
+
+// findInserted returns the id of the row written by an insert that failed with a failover
+// error, if the insert was applied before the connection was lost.
+func (d *Generic) findInserted(ctx context.Context, key string, cVal, dVal int, previousRevision int64, value []byte) (int64, bool, error) {
+	var (
+		id               int64
+		created, deleted int
+		stored           []byte
+	)
+	err := d.queryRow(ctx, d.FindInsertedSQL, key, previousRevision).Scan(&id, &created, &deleted, &stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	// a row written by a concurrent change to the key is left to fail the retried insert
+	// on the unique index, as any other conflicting change would
+	return id, created == cVal && deleted == dVal && bytes.Equal(stored, value), nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/util"
+	"github.com/k3s-io/kine/pkg/valuestore"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
@@ -70,9 +71,20 @@ type ErrCode func(error) string
 type SubstituteFunc func(string) string
 
 type ConnectionPoolConfig struct {
-	MaxIdle     int           // zero means defaultMaxIdleConns; negative means 0
-	MaxOpen     int           // <= 0 means unlimited
-	MaxLifetime time.Duration // maximum amount of time a connection may be reused
+	MaxIdle           int           // zero means defaultMaxIdleConns; negative means 0
+	MaxOpen           int           // <= 0 means unlimited
+	MaxLifetime       time.Duration // maximum amount of time a connection may be reused
+	StatementAffinity int           // number of statement-affine pools to split connections across; <= 1 means disabled
+	// ValidateConnections enables running ValidationQuery on connections before they are reused from
+	// the pool; connections on which the query fails are discarded and replaced.
+	ValidateConnections bool
+	// ValidationQuery is the query used to validate connections. Drivers whose databases do not
+	// accept the default of "SELECT 1" should set this before calling Open.
+	ValidationQuery string
+	// ClassifyConnErr maps driver-specific errors to a connection error class, so that
+	// connection failures can be counted and logged consistently across drivers. Drivers
+	// should set this before calling Open.
+	ClassifyConnErr ClassifyConnErr
 }
 
 type Generic struct {
@@ -81,6 +93,13 @@ type Generic struct {
 	LockWrites              bool
 	LastInsertID            bool
 	DB                      *sql.DB
+	CompactDB               *sql.DB
+	affinity                []*sql.DB
+	driverName              string
+	dataSourceName          string
+	poolConfig              ConnectionPoolConfig
+	validationQuery         string
+	classifyConnErr         ClassifyConnErr
 	GetCurrentSQL           string
 	GetCurrentValSQL        string
 	ListRevisionStartSQL    string
@@ -89,21 +108,57 @@ type Generic struct {
 	GetRevisionAfterValSQL  string
 	CountCurrentSQL         string
 	CountRevisionSQL        string
+	CountCurrentKeysSQL     string
+	ListRangeCurrentSQL     string
+	ListRangeCurrentValSQL  string
+	ListRangeRevisionSQL    string
+	ListRangeRevisionValSQL string
+	CountRangeCurrentSQL    string
+	CountRangeRevisionSQL   string
 	AfterOldValSQL          string
 	DeleteSQL               string
 	CompactSQL              string
+	CompactValuesSQL        string
+	LiveDigestSQL           string
+	CompactableSQL          string
 	UpdateCompactSQL        string
 	PostCompactSQL          string
+	AnalyzeSQL              string
 	InsertSQL               string
 	FillSQL                 string
+	InsertRevisionSQL       string
+	RevisionExistsSQL       string
+	FindInsertedSQL         string
+	InsertAuditSQL          string
+	GetMetaSQL              string
+	InsertMetaSQL           string
+	UpdateMetaSQL           string
+	SetSequenceSQL          string
 	InsertLastInsertIDSQL   string
 	GetSizeSQL              string
+	StatsSQL                string
+	GetKeyMetadataSQL       string
+	ListKeyMetadataSQL      string
+	DeleteKeyMetadataSQL    string
+	InsertKeyMetadataSQL    string
 	Retry                   ErrRetry
 	InsertRetry             ErrRetry
-	TranslateErr            TranslateErr
-	TranslateStartKeyFunc   SubstituteFunc
-	ErrCode                 ErrCode
-	FillRetryDuration       time.Duration
+	// Failover reports driver-specific errors that indicate that the connection was lost to a
+	// database failover, in addition to the connection errors recognized for all drivers.
+	Failover              ErrRetry
+	TranslateErr          TranslateErr
+	TranslateStartKeyFunc SubstituteFunc
+	ErrCode               ErrCode
+	FillRetryDuration     time.Duration
+	PostCompactFunc       func(ctx context.Context) error
+	revisions             *revisionAllocator
+	audit                 bool
+	paramCharacter        string
+	numbered              bool
+	compactExclude        []string
+	compactExcludeSet     string
+	connBackoff           connBackoff
+	acquireTracing        bool
 }
 
 func q(sql, param string, numbered bool) string {
@@ -123,17 +178,14 @@ func q(sql, param string, numbered bool) string {
 }
 
 func (d *Generic) Migrate(ctx context.Context) {
-	var (
-		count     = 0
-		countKV   = d.queryRow(ctx, "SELECT COUNT(*) FROM key_value")
-		countKine = d.queryRow(ctx, "SELECT COUNT(*) FROM kine")
-	)
-
-	if err := countKV.Scan(&count); err != nil || count == 0 {
+	// Each row must be scanned, as an unscanned row holds its connection and
+	// read snapshot open, which blocks WAL checkpoints on some drivers.
+	count := 0
+	if err := d.queryRow(ctx, "SELECT COUNT(*) FROM key_value").Scan(&count); err != nil || count == 0 {
 		return
 	}
 
-	if err := countKine.Scan(&count); err != nil || count != 0 {
+	if err := d.queryRow(ctx, "SELECT COUNT(*) FROM kine").Scan(&count); err != nil || count != 0 {
 		return
 	}
 
@@ -148,7 +200,40 @@ func (d *Generic) Migrate(ctx context.Context) {
 	}
 }
 
-func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB, driverName string) {
+// SetRevisionFloor ensures that newly assigned revisions are greater than the
+// provided floor. If the current revision is lower, a gap record is inserted at
+// the floor revision, which advances the id sequence past it. Drivers where an
+// explicit id does not advance the sequence must also set SetSequenceSQL.
+// This must be called before the backend is started.
+func (d *Generic) SetRevisionFloor(ctx context.Context, floor int64) error {
+	if floor <= 0 {
+		return nil
+	}
+
+	// the table may be empty, in which case the current revision is NULL
+	var rev sql.NullInt64
+	if err := d.queryRow(ctx, revSQL).Scan(&rev); err != nil {
+		return err
+	}
+	if rev.Int64 >= floor {
+		return nil
+	}
+
+	logrus.Infof("Raising current revision %d to configured revision floor %d", rev.Int64, floor)
+	if err := d.Fill(ctx, floor); err != nil {
+		return err
+	}
+	if d.SetSequenceSQL != "" {
+		if _, err := d.execute(ctx, d.SetSequenceSQL, floor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureConnectionPooling applies the connection pool limits to db, and returns the
+// limits that were applied after defaulting.
+func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB, driverName string) ConnectionPoolConfig {
 	// behavior copied from database/sql - zero means defaultMaxIdleConns; negative means 0
 	if connPoolConfig.MaxIdle < 0 {
 		connPoolConfig.MaxIdle = 0
@@ -160,24 +245,66 @@ func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB,
 	db.SetMaxIdleConns(connPoolConfig.MaxIdle)
 	db.SetMaxOpenConns(connPoolConfig.MaxOpen)
 	db.SetConnMaxLifetime(connPoolConfig.MaxLifetime)
+	if query := connPoolConfig.validationQuery(); query != "" {
+		logrus.Infof("Validating %s database connections before reuse with query: %s", driverName, query)
+	}
+	return connPoolConfig
 }
 
-func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+func openAndTest(driverName, dataSourceName, validationQuery string) (*sql.DB, error) {
+	var (
+		db  *sql.DB
+		err error
+	)
+	if validationQuery != "" {
+		db, err = openValidated(driverName, dataSourceName, validationQuery)
+	} else {
+		db, err = sql.Open(driverName, dataSourceName)
+	}
 	if err != nil {
-		return nil, err
+		return nil, util.RedactError(err, dataSourceName)
 	}
 
 	for i := 0; i < 3; i++ {
 		if err := db.Ping(); err != nil {
 			db.Close()
-			return nil, err
+			return nil, util.RedactError(err, dataSourceName)
 		}
 	}
 
 	return db, nil
 }
 
+// OpenCompact opens a separate single-connection pool that is used for compaction
+// transactions instead of the main pool, so that compaction can be run with
+// different credentials or database resource limits than the hot path.
+func (d *Generic) OpenCompact(ctx context.Context, wg *sync.WaitGroup, driverName, dataSourceName string, metricsRegisterer prometheus.Registerer) error {
+	db, err := openAndTest(driverName, dataSourceName, d.validationQuery)
+	if err != nil {
+		observeConnErr(err, d.classifyConnErr)
+		return fmt.Errorf("open compact connection: %w", err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		if err := db.Close(); err != nil {
+			logrus.Errorf("Failed to close compact database: %v", err)
+		}
+	}()
+
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	if metricsRegisterer != nil {
+		metricsRegisterer.MustRegister(collectors.NewDBStatsCollector(db, "kine-compact"))
+	}
+
+	logrus.Infof("Using separate connection for compaction")
+	d.CompactDB = db
+	return nil
+}
+
 func Open(ctx context.Context, wg *sync.WaitGroup, driverName, dataSourceName string, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
 	var (
 		db  *sql.DB
@@ -185,12 +312,14 @@ func Open(ctx context.Context, wg *sync.WaitGroup, driverName, dataSourceName st
 	)
 
 	for i := 0; i < 300; i++ {
-		db, err = openAndTest(driverName, dataSourceName)
+		db, err = openAndTest(driverName, dataSourceName, connPoolConfig.validationQuery())
 		if err == nil {
 			break
 		}
 
-		logrus.Errorf("Failed to ping database connection: %v", err)
+		if observeConnErr(err, connPoolConfig.ClassifyConnErr) == "" {
+			logrus.Errorf("Failed to ping database connection: %v", err)
+		}
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
@@ -198,24 +327,49 @@ func Open(ctx context.Context, wg *sync.WaitGroup, driverName, dataSourceName st
 		}
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
+	var poolConfig ConnectionPoolConfig
+	dbs, err := openAffinity(db, driverName, dataSourceName, connPoolConfig)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
 		logrus.Infof("Closing database connections...")
-		if err := db.Close(); err != nil {
-			logrus.Errorf("Failed to close database: %v", err)
+		for _, db := range dbs {
+			if err := db.Close(); err != nil {
+				logrus.Errorf("Failed to close database: %v", err)
+			}
 		}
 	}()
 
-	configureConnectionPooling(connPoolConfig, db, driverName)
-
-	if metricsRegisterer != nil {
-		metricsRegisterer.MustRegister(collectors.NewDBStatsCollector(db, "kine"))
+	if len(dbs) > 1 {
+		connPoolConfig = affinityPoolConfig(connPoolConfig, len(dbs))
+	}
+	for i, db := range dbs {
+		poolConfig = configureConnectionPooling(connPoolConfig, db, driverName)
+		if metricsRegisterer != nil {
+			metricsRegisterer.MustRegister(collectors.NewDBStatsCollector(db, affinityDBName(i)))
+		}
 	}
 
 	return &Generic{
-		DB: db,
+		DB:              db,
+		affinity:        dbs,
+		driverName:      driverName,
+		dataSourceName:  util.RedactDataSourceName(dataSourceName),
+		poolConfig:      poolConfig,
+		validationQuery: connPoolConfig.validationQuery(),
+		classifyConnErr: connPoolConfig.ClassifyConnErr,
+		paramCharacter:  paramCharacter,
+		numbered:        numbered,
 
 		GetCurrentSQL:           q(fmt.Sprintf(listSQL, "AND mkv.name >= ?"), paramCharacter, numbered),
 		GetCurrentValSQL:        q(fmt.Sprintf(listValSQL, "AND mkv.name >= ?"), paramCharacter, numbered),
@@ -236,6 +390,37 @@ func Open(ctx context.Context, wg *sync.WaitGroup, driverName, dataSourceName st
 				%s
 			) c`, revSQL, fmt.Sprintf(listSQL, "AND mkv.name >= ? AND mkv.id <= ?")), paramCharacter, numbered),
 
+		CountCurrentKeysSQL: q(`
+			SELECT COUNT(*)
+			FROM kine AS kv
+			WHERE
+				kv.name LIKE ? ESCAPE '^' AND
+				kv.name >= ? AND
+				kv.deleted = 0 AND
+				NOT EXISTS (
+					SELECT 1
+					FROM kine AS nkv
+					WHERE
+						nkv.name = kv.name AND
+						nkv.id > kv.id)`, paramCharacter, numbered),
+
+		ListRangeCurrentSQL:     q(fmt.Sprintf(listSQL, "AND mkv.name >= ? AND mkv.name < ?"), paramCharacter, numbered),
+		ListRangeCurrentValSQL:  q(fmt.Sprintf(listValSQL, "AND mkv.name >= ? AND mkv.name < ?"), paramCharacter, numbered),
+		ListRangeRevisionSQL:    q(fmt.Sprintf(listSQL, "AND mkv.name >= ? AND mkv.name < ? AND mkv.id <= ?"), paramCharacter, numbered),
+		ListRangeRevisionValSQL: q(fmt.Sprintf(listValSQL, "AND mkv.name >= ? AND mkv.name < ? AND mkv.id <= ?"), paramCharacter, numbered),
+
+		CountRangeCurrentSQL: q(fmt.Sprintf(`
+			SELECT (%s), COUNT(c.theid)
+			FROM (
+				%s
+			) c`, revSQL, fmt.Sprintf(listSQL, "AND mkv.name >= ? AND mkv.name < ?")), paramCharacter, numbered),
+
+		CountRangeRevisionSQL: q(fmt.Sprintf(`
+			SELECT (%s), COUNT(c.theid)
+			FROM (
+				%s
+			) c`, revSQL, fmt.Sprintf(listSQL, "AND mkv.name >= ? AND mkv.name < ? AND mkv.id <= ?")), paramCharacter, numbered),
+
 		AfterOldValSQL: q(fmt.Sprintf(`
 			SELECT (%s), (%s), %s
 			FROM kine AS kv
@@ -248,6 +433,64 @@ func Open(ctx context.Context, wg *sync.WaitGroup, driverName, dataSourceName st
 			DELETE FROM kine AS kv
 			WHERE kv.id = ?`, paramCharacter, numbered),
 
+		// Compaction statements only scan rows written after the revision already compacted to
+		// (kp.id > ?), so rows that an earlier compaction skipped are never reconsidered. Rows
+		// are only skipped if their key is excluded from compaction, so Tx.Compact scans from
+		// the first row instead whenever the excluded keys change.
+		CompactValuesSQL: q(fmt.Sprintf(`
+			SELECT kv.value, kv.old_value
+			FROM kine AS kv
+			WHERE
+				kv.id IN (
+					SELECT kp.prev_revision AS id
+					FROM kine AS kp
+					WHERE
+						kp.name != 'compact_rev_key' AND
+						kp.prev_revision != 0 AND
+						kp.id > ? AND
+						kp.id <= ?
+					UNION
+					SELECT kd.id AS id
+					FROM kine AS kd
+					WHERE
+						kd.deleted != 0 AND
+						kd.id > ? AND
+						kd.id <= ?
+				) AND
+				(LENGTH(kv.value) <= %[1]d OR LENGTH(kv.old_value) <= %[1]d)`, valuestore.MaxPointerLength), paramCharacter, numbered),
+
+		LiveDigestSQL: q(`
+			SELECT COUNT(kv.id), COALESCE(SUM(kv.id), 0)
+			FROM kine AS kv
+			JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM kine AS mkv
+				WHERE
+					mkv.name != 'compact_rev_key' AND
+					mkv.id <= ?
+				GROUP BY mkv.name) AS maxkv
+				ON maxkv.id = kv.id
+			WHERE kv.deleted = 0`, paramCharacter, numbered),
+
+		CompactableSQL: q(`
+			SELECT COUNT(kv.id)
+			FROM kine AS kv
+			WHERE
+				kv.id IN (
+					SELECT kp.prev_revision AS id
+					FROM kine AS kp
+					WHERE
+						kp.name != 'compact_rev_key' AND
+						kp.prev_revision != 0 AND
+						kp.id <= ?
+					UNION
+					SELECT kd.id AS id
+					FROM kine AS kd
+					WHERE
+						kd.deleted != 0 AND
+						kd.id <= ?
+				)`, paramCharacter, numbered),
+
 		UpdateCompactSQL: q(`
 			UPDATE kine
 			SET prev_revision = ?
@@ -261,25 +504,107 @@ func Open(ctx context.Context, wg *sync.WaitGroup, driverName, dataSourceName st
 
 		FillSQL: q(`INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
 			values(?, ?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
+
+		InsertRevisionSQL: q(`INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+			SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?
+			FROM (`+revSQL+`) AS c
+			WHERE c.id IS NULL OR c.id < ?`, paramCharacter, numbered),
+
+		InsertAuditSQL: q(`INSERT INTO kine_audit(revision, name, operation, principal, created_at) VALUES(?, ?, ?, ?, ?)`, paramCharacter, numbered),
+
+		FindInsertedSQL: q(`SELECT id, created, deleted, value FROM kine WHERE name = ? AND prev_revision = ?`, paramCharacter, numbered),
+
+		RevisionExistsSQL: q(`SELECT 1 FROM kine WHERE id = ?`, paramCharacter, numbered),
+
+		GetMetaSQL: q(`SELECT value FROM kine_meta WHERE name = ?`, paramCharacter, numbered),
+
+		InsertMetaSQL: q(`INSERT INTO kine_meta(name, value) VALUES(?, ?)`, paramCharacter, numbered),
+
+		UpdateMetaSQL: q(`UPDATE kine_meta SET value = ? WHERE name = ? AND value = ?`, paramCharacter, numbered),
+
+		GetKeyMetadataSQL: q(`
+			SELECT meta_key, meta_value
+			FROM kine_key_metadata
+			WHERE name = ?`, paramCharacter, numbered),
+
+		ListKeyMetadataSQL: q(`
+			SELECT name, meta_key, meta_value
+			FROM kine_key_metadata
+			WHERE name LIKE ? ESCAPE '^'
+			ORDER BY name`, paramCharacter, numbered),
+
+		DeleteKeyMetadataSQL: q(`
+			DELETE FROM kine_key_metadata
+			WHERE name = ?`, paramCharacter, numbered),
+
+		InsertKeyMetadataSQL: q(`INSERT INTO kine_key_metadata(name, meta_key, meta_value)
+			values(?, ?, ?)`, paramCharacter, numbered),
+
+		StatsSQL: `
+			SELECT
+				COUNT(*),
+				COALESCE(SUM(CASE WHEN kv.deleted = 0 THEN 0 ELSE 1 END), 0),
+				COUNT(DISTINCT kv.name),
+				COALESCE(SUM(CASE WHEN kv.deleted = 0 THEN LENGTH(kv.value) ELSE 0 END), 0)
+			FROM kine AS kv
+			WHERE kv.name != 'compact_rev_key'`,
 	}, err
 }
 
+// query runs a query, retrying it if the connection is lost to a database failover.
+// It must only be used for reads.
 func (d *Generic) query(ctx context.Context, sql string, args ...any) (result *sql.Rows, err error) {
-	logrus.Tracef("QUERY %v : %s", util.Summarize(args), util.Stripped(sql))
+	for i := 0; ; i++ {
+		result, err = d.queryOnce(ctx, sql, args...)
+		if !d.retryFailover(ctx, err, i) {
+			return result, err
+		}
+	}
+}
+
+func (d *Generic) queryOnce(ctx context.Context, sql string, args ...any) (result *sql.Rows, err error) {
+	util.RequestLogger(ctx).Tracef("QUERY %v : %s", util.Summarize(args), util.Stripped(sql))
+	d.waitConnBackoff(ctx)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
+		metrics.ObserveSQL(ctx, startTime, d.ErrCode(err), util.Stripped(sql), args)
+		d.observeConnErr(err)
 	}()
-	return d.DB.QueryContext(ctx, sql, args...)
+	conn, release, err := d.acquire(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	startTime = time.Now()
+	return conn.QueryContext(ctx, sql, args...)
 }
 
+// queryRow runs a query that returns a single row, retrying it if the connection is lost to a
+// database failover. It must only be used for reads.
 func (d *Generic) queryRow(ctx context.Context, sql string, args ...any) (result *sql.Row) {
-	logrus.Tracef("QUERY ROW %v : %s", util.Summarize(args), util.Stripped(sql))
+	for i := 0; ; i++ {
+		result = d.queryRowOnce(ctx, sql, args...)
+		if !d.retryFailover(ctx, result.Err(), i) {
+			return result
+		}
+	}
+}
+
+func (d *Generic) queryRowOnce(ctx context.Context, sql string, args ...any) (result *sql.Row) {
+	util.RequestLogger(ctx).Tracef("QUERY ROW %v : %s", util.Summarize(args), util.Stripped(sql))
+	d.waitConnBackoff(ctx)
+	conn, release, err := d.acquire(ctx, sql)
+	if err != nil {
+		// a row cannot hold an error of its own, so the statement is left to report it
+		conn, release = d.conn(sql), func() {}
+	}
+	defer release()
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(result.Err()), util.Stripped(sql), args)
+		metrics.ObserveSQL(ctx, startTime, d.ErrCode(result.Err()), util.Stripped(sql), args)
+		d.observeConnErr(result.Err())
 	}()
-	return d.DB.QueryRowContext(ctx, sql, args...)
+	return conn.QueryRowContext(ctx, sql, args...)
 }
 
 func (d *Generic) execute(ctx context.Context, sql string, args ...any) (result sql.Result, err error) {
@@ -290,10 +615,19 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...any) (result
 
 	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
 	for i := uint(0); i < 20; i++ {
-		logrus.Tracef("EXEC (try: %d) %v : %s", i, util.Summarize(args), util.Stripped(sql))
+		util.RequestLogger(ctx).Tracef("EXEC (try: %d) %v : %s", i, util.Summarize(args), util.Stripped(sql))
+		d.waitConnBackoff(ctx)
+		var conn sqlConn
+		var release func()
+		if conn, release, err = d.acquire(ctx, sql); err != nil {
+			d.observeConnErr(err)
+			return nil, err
+		}
 		startTime := time.Now()
-		result, err = d.DB.ExecContext(ctx, sql, args...)
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
+		result, err = conn.ExecContext(ctx, sql, args...)
+		release()
+		metrics.ObserveSQL(ctx, startTime, d.ErrCode(err), util.Stripped(sql), args)
+		d.observeConnErr(err)
 		if err != nil && d.Retry != nil && d.Retry(err) {
 			wait(i)
 			continue
@@ -304,13 +638,15 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...any) (result
 }
 
 func (d *Generic) GetCompactRevision(ctx context.Context) (int64, error) {
-	var id int64
+	// the revision is NULL if the compact_rev_key row has not yet been created, which is
+	// the same as not having compacted
+	var id sql.NullInt64
 	row := d.queryRow(ctx, compactRevSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
-	return id, err
+	return id.Int64, err
 }
 
 func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error {
@@ -319,19 +655,49 @@ func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error
 	return err
 }
 
-func (d *Generic) Compact(ctx context.Context, revision int64) (int64, error) {
-	logrus.Tracef("COMPACT %v", revision)
-	res, err := d.execute(ctx, d.CompactSQL, revision, revision)
+func (d *Generic) Compact(ctx context.Context, start, revision int64) (int64, error) {
+	logrus.Tracef("COMPACT %v %v", start, revision)
+	res, err := d.execute(ctx, d.CompactSQL, d.compactArgs(start, revision, start, revision)...)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
+// LiveDigest returns the number of keys whose latest row as of the given revision is not a
+// deletion, and the sum of the revisions of those rows. Compaction to the revision or below
+// must not change either.
+func (d *Generic) LiveDigest(ctx context.Context, revision int64) (count, sum int64, err error) {
+	err = d.queryRow(ctx, d.LiveDigestSQL, revision).Scan(&count, &sum)
+	return count, sum, err
+}
+
+// CountCompactable returns the number of rows that compaction to the given revision would delete.
+func (d *Generic) CountCompactable(ctx context.Context, revision int64) (count int64, err error) {
+	err = d.queryRow(ctx, d.CompactableSQL, d.compactArgs(revision, revision)...).Scan(&count)
+	return count, err
+}
+
+// PostCompact runs the driver's cleanup after a compaction: PostCompactSQL, and then
+// PostCompactFunc, if either is set.
 func (d *Generic) PostCompact(ctx context.Context) error {
 	logrus.Trace("POSTCOMPACT")
 	if d.PostCompactSQL != "" {
-		_, err := d.execute(ctx, d.PostCompactSQL)
+		if _, err := d.execute(ctx, d.PostCompactSQL); err != nil {
+			return err
+		}
+	}
+	if d.PostCompactFunc != nil {
+		return d.PostCompactFunc(ctx)
+	}
+	return nil
+}
+
+// Analyze refreshes the optimizer statistics of the kine table, if the driver supports it.
+func (d *Generic) Analyze(ctx context.Context) error {
+	logrus.Trace("ANALYZE")
+	if d.AnalyzeSQL != "" {
+		_, err := d.execute(ctx, d.AnalyzeSQL)
 		return err
 	}
 	return nil
@@ -403,6 +769,58 @@ func (d *Generic) Count(ctx context.Context, prefix, startKey string, revision i
 	return rev.Int64, id, err
 }
 
+// CountCurrentKeys counts the current keys without also selecting the current revision.
+// Each key is counted if its latest row is not a deletion, which can be determined
+// from the name and id index without grouping all rows by name.
+func (d *Generic) CountCurrentKeys(ctx context.Context, prefix, startKey string) (int64, error) {
+	var count int64
+	row := d.queryRow(ctx, d.CountCurrentKeysSQL, prefix, startKey)
+	err := row.Scan(&count)
+	return count, err
+}
+
+// ListRange lists keys in the range [startKey, endKey). The prefix should match all
+// keys in the range, and is used to allow the database to make use of the name index.
+func (d *Generic) ListRange(ctx context.Context, prefix, startKey, endKey string, limit, revision int64, includeDeleted, keysOnly bool) (*sql.Rows, error) {
+	var sql string
+	args := []any{prefix, startKey, endKey}
+	if revision == 0 {
+		if keysOnly {
+			sql = d.ListRangeCurrentSQL
+		} else {
+			sql = d.ListRangeCurrentValSQL
+		}
+	} else {
+		if keysOnly {
+			sql = d.ListRangeRevisionSQL
+		} else {
+			sql = d.ListRangeRevisionValSQL
+		}
+		args = append(args, revision)
+	}
+	if limit > 0 {
+		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	}
+	return d.query(ctx, sql, append(args, includeDeleted)...)
+}
+
+// CountRange counts keys in the range [startKey, endKey).
+func (d *Generic) CountRange(ctx context.Context, prefix, startKey, endKey string, revision int64) (int64, int64, error) {
+	var (
+		rev sql.NullInt64
+		id  int64
+		row *sql.Row
+	)
+
+	if revision == 0 {
+		row = d.queryRow(ctx, d.CountRangeCurrentSQL, prefix, startKey, endKey, false)
+	} else {
+		row = d.queryRow(ctx, d.CountRangeRevisionSQL, prefix, startKey, endKey, revision, false)
+	}
+	err := row.Scan(&rev, &id)
+	return rev.Int64, id, err
+}
+
 func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
 	row := d.queryRow(ctx, revSQL)
@@ -449,6 +867,33 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 		dVal = 1
 	}
 
+	for i := 0; ; i++ {
+		id, err = d.insert(ctx, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		if !d.isFailover(err) {
+			return id, err
+		}
+		insertedID, inserted, ferr := d.findInserted(ctx, key, cVal, dVal, previousRevision, value)
+		if ferr != nil {
+			return id, err
+		}
+		if inserted {
+			logrus.Warnf("Insert for key %v was applied before the connection was lost: %v", key, err)
+			return insertedID, nil
+		}
+		if !d.retryFailover(ctx, err, i) {
+			return id, err
+		}
+	}
+}
+
+func (d *Generic) insert(ctx context.Context, key string, cVal, dVal int, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
+	if d.audit {
+		return d.insertAudited(ctx, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+	}
+	if d.revisions != nil {
+		return d.insertAllocated(ctx, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+	}
+
 	if d.LastInsertID {
 		row, err := d.execute(ctx, d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
 		if err != nil {
@@ -464,7 +909,7 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 	// duplicate key error to the client.
 	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
 	for i := uint(0); i < 20; i++ {
-		row := d.queryRow(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		row := d.queryRowOnce(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
 		err = row.Scan(&id)
 
 		if err != nil && d.InsertRetry != nil && d.InsertRetry(err) {
@@ -496,6 +941,24 @@ func (d *Generic) GetSize(ctx context.Context) (int64, error) {
 	return size, nil
 }
 
+// GetStats returns aggregate row and value size statistics, excluding the compact
+// revision record.
+func (d *Generic) GetStats(ctx context.Context) (*server.StorageStats, error) {
+	stats := &server.StorageStats{}
+	row := d.queryRow(ctx, d.StatsSQL)
+	if err := row.Scan(&stats.Rows, &stats.DeletedRows, &stats.Keys, &stats.ValueBytes); err != nil {
+		return nil, err
+	}
+	stats.LiveRows = stats.Rows - stats.DeletedRows
+	if stats.LiveRows > 0 {
+		stats.AverageValueBytes = float64(stats.ValueBytes) / float64(stats.LiveRows)
+	}
+	if stats.Keys > 0 {
+		stats.RevisionsPerKey = float64(stats.Rows) / float64(stats.Keys)
+	}
+	return stats, nil
+}
+
 func (d *Generic) FillRetryDelay(ctx context.Context) {
 	time.Sleep(d.FillRetryDuration)
 }
@@ -0,0 +1,46 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+var createIndexRegexp = regexp.MustCompile(`(?i)^\s*CREATE\s+(?:UNIQUE\s+)?INDEX\s+(?:IF\s+NOT\s+EXISTS\s+)?(\w+)\s+ON\s`)
+
+// VerifyIndexes checks that each index created by the schema statements exists.
+// existsSQL must return a row if the index named by its single parameter exists.
+// Missing indexes are logged, and recreated if rebuild is true.
+func VerifyIndexes(ctx context.Context, db *sql.DB, schema []string, existsSQL string, rebuild bool) error {
+	for _, stmt := range schema {
+		m := createIndexRegexp.FindStringSubmatch(stmt)
+		if m == nil {
+			continue
+		}
+		name := m[1]
+
+		var exists int
+		err := db.QueryRowContext(ctx, existsSQL, name).Scan(&exists)
+		if err == nil {
+			continue
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		if !rebuild {
+			logrus.Warnf("Database index %s is missing; query performance may be degraded", name)
+			continue
+		}
+
+		logrus.Warnf("Database index %s is missing, recreating it...", name)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+		logrus.Infof("Recreated database index %s", name)
+	}
+	return nil
+}
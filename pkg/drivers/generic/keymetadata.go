@@ -0,0 +1,102 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+)
+
+// Limits on the size of key metadata names and values, matching the column sizes of the
+// kine_key_metadata table on databases that require them.
+const (
+	maxKeyMetadataNameLength  = 63
+	maxKeyMetadataValueLength = 255
+)
+
+// SetKeyMetadata replaces the metadata of a key. The existing metadata is deleted and the new
+// metadata inserted in a single database transaction, so that readers see either all or none
+// of the new metadata.
+func (d *Generic) SetKeyMetadata(ctx context.Context, key string, metadata map[string]string) (err error) {
+	for name, value := range metadata {
+		if name == "" || len(name) > maxKeyMetadataNameLength {
+			return fmt.Errorf("%w: name %q must be between 1 and %d bytes", server.ErrInvalidKeyMetadata, name, maxKeyMetadataNameLength)
+		}
+		if len(value) > maxKeyMetadataValueLength {
+			return fmt.Errorf("%w: value of %q must not be longer than %d bytes", server.ErrInvalidKeyMetadata, name, maxKeyMetadataValueLength)
+		}
+	}
+
+	if d.LockWrites {
+		d.Lock()
+		defer d.Unlock()
+	}
+
+	util.RequestLogger(ctx).Tracef("SET KEY METADATA %s : %d entries", key, len(metadata))
+	startTime := time.Now()
+	defer func() {
+		metrics.ObserveSQL(ctx, startTime, d.ErrCode(err), util.Stripped(d.InsertKeyMetadataSQL), []any{key})
+		d.observeConnErr(err)
+	}()
+
+	d.waitConnBackoff(ctx)
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, d.DeleteKeyMetadataSQL, key); err != nil {
+		return err
+	}
+	for name, value := range metadata {
+		if _, err := tx.ExecContext(ctx, d.InsertKeyMetadataSQL, key, name, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *Generic) GetKeyMetadata(ctx context.Context, key string) (map[string]string, error) {
+	rows, err := d.query(ctx, d.GetKeyMetadataSQL, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		metadata[name] = value
+	}
+	return metadata, rows.Err()
+}
+
+// ListKeyMetadata returns the metadata of all keys matching prefix that have metadata. As with
+// List, the prefix is matched with LIKE, using ^ as the escape character.
+func (d *Generic) ListKeyMetadata(ctx context.Context, prefix string) (map[string]map[string]string, error) {
+	rows, err := d.query(ctx, d.ListKeyMetadataSQL, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[string]map[string]string{}
+	for rows.Next() {
+		var key, name, value string
+		if err := rows.Scan(&key, &name, &value); err != nil {
+			return nil, err
+		}
+		if result[key] == nil {
+			result[key] = map[string]string{}
+		}
+		result[key][name] = value
+	}
+	return result, rows.Err()
+}
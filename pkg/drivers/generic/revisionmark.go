@@ -0,0 +1,125 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Rican7/retry/backoff"
+	"github.com/Rican7/retry/strategy"
+	"github.com/sirupsen/logrus"
+)
+
+// revisionMarkKey is the name of the kine_meta row that holds the highest revision recorded by
+// any server. It is kept outside the kine table, so that it survives the table being truncated
+// or recreated.
+const revisionMarkKey = "revision_mark"
+
+// SetRevisionMark enables recording the current revision in kine_meta at startup and every
+// interval. At startup, newly assigned revisions are first raised above the recorded revision,
+// as with SetRevisionFloor, so that revisions seen by clients do not go backwards if the kine
+// table has been rebuilt. Revisions written since the revision was last recorded may be reused
+// after a rebuild; a revision floor can be configured as well to cover them. An interval of zero
+// or less disables recording. This must be called before the backend is started.
+func (d *Generic) SetRevisionMark(ctx context.Context, wg *sync.WaitGroup, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+
+	var recorded string
+	err := d.queryRow(ctx, d.GetMetaSQL, revisionMarkKey).Scan(&recorded)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if recorded != "" {
+		mark, err := strconv.ParseInt(recorded, 10, 64)
+		if err != nil {
+			return err
+		}
+		if err := d.SetRevisionFloor(ctx, mark); err != nil {
+			return err
+		}
+	}
+	if err := d.recordRevisionMark(ctx); err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if err := d.recordRevisionMark(ctx); err != nil && ctx.Err() == nil {
+				logrus.Warnf("Failed to record revision high-water mark: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// recordRevisionMark records the current revision in kine_meta, unless a higher revision has
+// already been recorded. Attempts that lose a race with another server are retried with backoff,
+// up to maxRevisionAttempts times.
+func (d *Generic) recordRevisionMark(ctx context.Context) error {
+	var rev sql.NullInt64
+	if err := d.queryRow(ctx, revSQL).Scan(&rev); err != nil {
+		return err
+	}
+
+	var lastErr error
+	wait := strategy.Backoff(backoff.Linear(10 * time.Millisecond))
+	for i := uint(0); i < maxRevisionAttempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if i > 0 {
+			wait(i)
+		}
+
+		var recorded string
+		err := d.queryRow(ctx, d.GetMetaSQL, revisionMarkKey).Scan(&recorded)
+		if errors.Is(err, sql.ErrNoRows) {
+			// another server may record the key concurrently, in which case this insert fails
+			// and the recorded value is compared on the next attempt
+			if _, err := d.execute(ctx, d.InsertMetaSQL, revisionMarkKey, strconv.FormatInt(rev.Int64, 10)); err != nil {
+				logrus.Debugf("Failed to record %s, retrying: %v", revisionMarkKey, err)
+				lastErr = err
+				continue
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		mark, err := strconv.ParseInt(recorded, 10, 64)
+		if err != nil {
+			return err
+		}
+		if mark >= rev.Int64 {
+			return nil
+		}
+
+		result, err := d.execute(ctx, d.UpdateMetaSQL, strconv.FormatInt(rev.Int64, 10), revisionMarkKey, recorded)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 1 {
+			logrus.Debugf("Recorded revision high-water mark %d", rev.Int64)
+			return nil
+		}
+		// another server recorded a revision concurrently
+		lastErr = errors.New("recorded concurrently by another server")
+	}
+	return fmt.Errorf("failed to record %s: %w", revisionMarkKey, lastErr)
+}
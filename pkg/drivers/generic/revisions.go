@@ -0,0 +1,187 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Rican7/retry/backoff"
+	"github.com/Rican7/retry/strategy"
+	"github.com/sirupsen/logrus"
+)
+
+// revisionBlockKey is the name of the kine_meta row that holds the highest revision reserved
+// by any revision allocator.
+const revisionBlockKey = "revision_block"
+
+// errRevisionStale is returned when a revision assigned by the revision allocator has been filled
+// as a gap, or is not greater than the current revision, so that another revision must be tried.
+var errRevisionStale = errors.New("revision is not greater than the current revision")
+
+// maxRevisionAttempts limits the number of revisions that an insert will try before giving up.
+const maxRevisionAttempts = 20
+
+// revisionAllocator assigns revisions from blocks of ids reserved in the datastore (hi/lo), so
+// that concurrent writers do not contend on the database's id generator. Blocks are reserved by
+// compare-and-swap on the highest reserved revision, so the blocks held by different servers
+// never overlap, and each new block starts above every revision already written.
+type revisionAllocator struct {
+	sync.Mutex
+	d         *Generic
+	blockSize int64
+	next, hi  int64
+}
+
+// SetRevisionBlockSize enables assigning revisions from blocks of the given size reserved by this
+// server, instead of by the database's auto-increment id. Revisions remain globally monotonic, as
+// a row is only inserted if its revision is greater than the current revision; revisions skipped
+// for that reason, or left unused in a block, are filled as gaps. All servers sharing a datastore
+// should use the same strategy. This must be called before the backend is started.
+func (d *Generic) SetRevisionBlockSize(size int64) {
+	if size <= 0 {
+		d.revisions = nil
+		return
+	}
+	logrus.Infof("Assigning revisions from reserved blocks of %d", size)
+	d.revisions = &revisionAllocator{d: d, blockSize: size}
+}
+
+// allocate returns the next revision to try. If stale is set, the previous revision was found
+// to be at or below the current revision, so the revision returned is above the current revision.
+func (a *revisionAllocator) allocate(ctx context.Context, stale bool) (int64, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if stale {
+		var rev sql.NullInt64
+		if err := a.d.queryRow(ctx, revSQL).Scan(&rev); err != nil {
+			return 0, err
+		}
+		a.next = max(a.next, rev.Int64+1)
+	}
+	if a.next == 0 || a.next > a.hi {
+		if err := a.reserve(ctx); err != nil {
+			return 0, err
+		}
+	}
+	id := a.next
+	a.next++
+	return id, nil
+}
+
+// allocateAll returns n ascending revisions to try, as allocate does, so that rows inserted in a
+// single transaction do not need to reserve a block while the transaction is open.
+func (a *revisionAllocator) allocateAll(ctx context.Context, n int, stale bool) ([]int64, error) {
+	ids := make([]int64, 0, n)
+	for range n {
+		id, err := a.allocate(ctx, stale)
+		if err != nil {
+			return nil, err
+		}
+		stale = false
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// reserve reserves a new block of revisions above both the highest revision reserved by any
+// server, and the current revision. Attempts that lose a race with another server are retried
+// with backoff, up to maxRevisionAttempts times.
+func (a *revisionAllocator) reserve(ctx context.Context) error {
+	wait := strategy.Backoff(backoff.Linear(10 * time.Millisecond))
+	for i := uint(0); i < maxRevisionAttempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if i > 0 {
+			wait(i)
+		}
+
+		var reserved string
+		err := a.d.queryRow(ctx, a.d.GetMetaSQL, revisionBlockKey).Scan(&reserved)
+		if errors.Is(err, sql.ErrNoRows) {
+			// another server may record the key concurrently, in which case this insert fails
+			// and the recorded value is read on the next attempt
+			if _, err := a.d.execute(ctx, a.d.InsertMetaSQL, revisionBlockKey, "0"); err != nil {
+				logrus.Debugf("Failed to record %s, retrying: %v", revisionBlockKey, err)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		hi, err := strconv.ParseInt(reserved, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		var rev sql.NullInt64
+		if err := a.d.queryRow(ctx, revSQL).Scan(&rev); err != nil {
+			return err
+		}
+		lo := max(hi, rev.Int64) + 1
+		hi = lo + a.blockSize - 1
+
+		result, err := a.d.execute(ctx, a.d.UpdateMetaSQL, strconv.FormatInt(hi, 10), revisionBlockKey, reserved)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// another server reserved a block concurrently
+			continue
+		}
+
+		// keep the id sequence ahead of the reserved revisions, on drivers where inserting an
+		// explicit id does not advance it
+		if a.d.SetSequenceSQL != "" {
+			if _, err := a.d.execute(ctx, a.d.SetSequenceSQL, hi); err != nil {
+				return err
+			}
+		}
+		logrus.Debugf("Reserved revisions %d to %d", lo, hi)
+		a.next, a.hi = lo, hi
+		return nil
+	}
+	return errors.New("failed to reserve a block of revisions")
+}
+
+// insertAllocated inserts a row with a revision assigned by the revision allocator. Another
+// revision is tried if the revision has been filled as a gap, or is not greater than the current
+// revision; in either case the next revision is assigned above the current revision.
+func (d *Generic) insertAllocated(ctx context.Context, key string, cVal, dVal int, createRevision, previousRevision, ttl int64, value, prevValue []byte) (int64, error) {
+	var stale bool
+	for i := 0; i < maxRevisionAttempts; i++ {
+		id, err := d.revisions.allocate(ctx, stale)
+		if err != nil {
+			return 0, err
+		}
+
+		result, err := d.execute(ctx, d.InsertRevisionSQL, id, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue, id)
+		if err != nil {
+			if d.isFailover(err) {
+				// the caller checks whether the row was written before trying again
+				return 0, err
+			}
+			var exists int
+			if rerr := d.queryRow(ctx, d.RevisionExistsSQL, id).Scan(&exists); rerr != nil {
+				// the insert did not fail because the revision was filled
+				return 0, err
+			}
+			logrus.Debugf("Revision %d for key %s was filled, retrying", id, key)
+			stale = true
+			continue
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if n == 1 {
+			return id, nil
+		}
+		logrus.Debugf("Revision %d for key %s is not greater than the current revision, retrying", id, key)
+		stale = true
+	}
+	return 0, errors.New("failed to assign a revision")
+}
@@ -0,0 +1,77 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SchemaVersion is the version of the schema created by the drivers. It must be
+// incremented whenever the schema is changed in a way that is incompatible with
+// earlier versions of kine.
+const SchemaVersion = 1
+
+const schemaVersionKey = "schema_version"
+
+var (
+	ErrSchemaVersionMismatch = errors.New("schema version mismatch")
+	ErrSchemaNotReady        = errors.New("schema not ready")
+)
+
+// CheckSchemaVersion records the current schema version in the metadata table if
+// no version has been recorded, and returns ErrSchemaVersionMismatch if a different
+// version has been recorded. getSQL must return the value for the name given as its
+// single parameter; setSQL must insert the name and value given as its parameters.
+func CheckSchemaVersion(ctx context.Context, db *sql.DB, getSQL, setSQL string) error {
+	var version string
+	err := db.QueryRowContext(ctx, getSQL, schemaVersionKey).Scan(&version)
+	if err == sql.ErrNoRows {
+		logrus.Infof("Recording datastore schema version %d", SchemaVersion)
+		if _, err = db.ExecContext(ctx, setSQL, schemaVersionKey, strconv.Itoa(SchemaVersion)); err == nil {
+			return nil
+		}
+		// another server may have recorded the version concurrently
+		err = db.QueryRowContext(ctx, getSQL, schemaVersionKey).Scan(&version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read datastore schema version: %w", err)
+	}
+
+	if version != strconv.Itoa(SchemaVersion) {
+		return fmt.Errorf("%w: datastore schema version is %s, but this version of kine requires schema version %d", ErrSchemaVersionMismatch, version, SchemaVersion)
+	}
+	return nil
+}
+
+// ValidateSchema checks, without making any changes to the datastore, that the current schema
+// version has been recorded and that each index created by the schema statements exists. It is
+// used in place of creating and migrating the schema when schema migrations are disabled, and
+// returns ErrSchemaNotReady or ErrSchemaVersionMismatch if the schema is missing or out of date.
+func ValidateSchema(ctx context.Context, db *sql.DB, schema []string, existsSQL, getSQL string) error {
+	var version string
+	if err := db.QueryRowContext(ctx, getSQL, schemaVersionKey).Scan(&version); err != nil {
+		return fmt.Errorf("%w: failed to read datastore schema version, and schema migrations are disabled: %v", ErrSchemaNotReady, err)
+	}
+	if version != strconv.Itoa(SchemaVersion) {
+		return fmt.Errorf("%w: datastore schema version is %s, but this version of kine requires schema version %d, and schema migrations are disabled", ErrSchemaVersionMismatch, version, SchemaVersion)
+	}
+
+	for _, stmt := range schema {
+		m := createIndexRegexp.FindStringSubmatch(stmt)
+		if m == nil {
+			continue
+		}
+		var exists int
+		if err := db.QueryRowContext(ctx, existsSQL, m[1]).Scan(&exists); err == sql.ErrNoRows {
+			return fmt.Errorf("%w: database index %s is missing, and schema migrations are disabled", ErrSchemaNotReady, m[1])
+		} else if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Database schema version %d is up to date; schema migrations are disabled", SchemaVersion)
+	return nil
+}
@@ -0,0 +1,46 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Statements returns the SQL statements that the dialect runs, keyed by field name (such as
+// GetCurrentSQL or DeleteSQL), as populated by the driver after placeholder rewriting.
+// Statements that the driver does not set are omitted.
+func (d *Generic) Statements() map[string]string {
+	statements := map[string]string{}
+	v := reflect.ValueOf(d).Elem()
+	for _, field := range reflect.VisibleFields(v.Type()) {
+		if !field.IsExported() || field.Type.Kind() != reflect.String || !strings.HasSuffix(field.Name, "SQL") {
+			continue
+		}
+		if sql := v.FieldByIndex(field.Index).String(); sql != "" {
+			statements[field.Name] = sql
+		}
+	}
+	return statements
+}
+
+// ValidateStatements prepares each of the dialect's statements without executing it, so that a
+// statement that the database cannot parse fails at startup, rather than when it is first run.
+// The returned error names the invalid statement. This must be called after the schema is set up.
+func (d *Generic) ValidateStatements(ctx context.Context) error {
+	statements := d.Statements()
+	names := slices.Sorted(maps.Keys(statements))
+	for _, name := range names {
+		stmt, err := d.DB.PrepareContext(ctx, statements[name])
+		if err != nil {
+			return fmt.Errorf("invalid SQL statement %s: %w", name, err)
+		}
+		stmt.Close()
+	}
+	logrus.Infof("Validated %d SQL statements", len(names))
+	return nil
+}
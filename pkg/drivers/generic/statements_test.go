@@ -0,0 +1,24 @@
+package generic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatements(t *testing.T) {
+	d := &Generic{
+		paramCharacter: "$",
+		numbered:       true,
+		GetCurrentSQL:  q("SELECT ... WHERE kv.name LIKE ? AND kv.name >= ?", "$", true),
+		DeleteSQL:      q("DELETE FROM kine AS kv WHERE kv.id = ?", "$", true),
+	}
+
+	// statements that are not set are omitted
+	expected := map[string]string{
+		"GetCurrentSQL": "SELECT ... WHERE kv.name LIKE $1 AND kv.name >= $2",
+		"DeleteSQL":     "DELETE FROM kine AS kv WHERE kv.id = $1",
+	}
+	if statements := d.Statements(); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("expected statements %v, got %v", expected, statements)
+	}
+}
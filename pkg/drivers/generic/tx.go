@@ -3,6 +3,7 @@ package generic
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/metrics"
@@ -19,9 +20,17 @@ type Tx struct {
 	d *Generic
 }
 
+// BeginTx starts a transaction. Transactions are only used for compaction, so
+// they are started on the compact connection if one has been opened.
 func (d *Generic) BeginTx(ctx context.Context, opts *sql.TxOptions) (server.Transaction, error) {
 	logrus.Tracef("TX BEGIN")
-	x, err := d.DB.BeginTx(ctx, opts)
+	db := d.DB
+	if d.CompactDB != nil {
+		db = d.CompactDB
+	}
+	d.waitConnBackoff(ctx)
+	x, err := db.BeginTx(ctx, opts)
+	d.observeConnErr(err)
 	if err != nil {
 		return nil, err
 	}
@@ -56,30 +65,82 @@ func (t *Tx) MustRollback() {
 }
 
 func (t *Tx) GetCompactRevision(ctx context.Context) (int64, error) {
-	var id int64
+	var id sql.NullInt64
 	row := t.queryRow(ctx, compactRevSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
-	return id, err
+	return id.Int64, err
 }
 
+// SetCompactRevision records the compact revision. An error is returned if the compact_rev_key
+// row does not exist, as the compaction would otherwise not be recorded.
 func (t *Tx) SetCompactRevision(ctx context.Context, revision int64) error {
 	logrus.Tracef("TX SETCOMPACTREVISION %v", revision)
-	_, err := t.execute(ctx, t.d.UpdateCompactSQL, revision)
-	return err
+	res, err := t.execute(ctx, t.d.UpdateCompactSQL, revision)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errors.New("compact_rev_key row does not exist")
+	}
+	return nil
 }
 
-func (t *Tx) Compact(ctx context.Context, revision int64) (int64, error) {
-	logrus.Tracef("TX COMPACT %v", revision)
-	res, err := t.execute(ctx, t.d.CompactSQL, revision, revision)
+// Compact deletes the rows that are no longer needed once compacted to revision, given that
+// the datastore has already been compacted to start. Only rows written after start are
+// scanned to find them, so that the cost of each batch does not grow with the size of the table;
+// rows up to start are only scanned again if the keys excluded from compaction have changed.
+func (t *Tx) Compact(ctx context.Context, start, revision int64) (int64, error) {
+	start, changed, err := t.compactStart(ctx, start)
 	if err != nil {
 		return 0, err
 	}
+	logrus.Tracef("TX COMPACT %v %v", start, revision)
+	res, err := t.execute(ctx, t.d.CompactSQL, t.d.compactArgs(start, revision, start, revision)...)
+	if err != nil {
+		return 0, err
+	}
+	if changed {
+		if err := t.recordCompactExclude(ctx); err != nil {
+			return 0, err
+		}
+	}
 	return res.RowsAffected()
 }
 
+// CompactValues returns the stored values and previous values of rows that Compact would delete,
+// if they may be pointers to externally stored values. Shorter values may also be returned.
+func (t *Tx) CompactValues(ctx context.Context, start, revision int64) ([][]byte, error) {
+	start, _, err := t.compactStart(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Tracef("TX COMPACTVALUES %v %v", start, revision)
+	rows, err := t.query(ctx, t.d.CompactValuesSQL, t.d.compactArgs(start, revision, start, revision)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values [][]byte
+	for rows.Next() {
+		var value, prevValue []byte
+		if err := rows.Scan(&value, &prevValue); err != nil {
+			return nil, err
+		}
+		values = append(values, value, prevValue)
+	}
+	return values, rows.Err()
+}
+
+func (t *Tx) LiveDigest(ctx context.Context, revision int64) (count, sum int64, err error) {
+	logrus.Tracef("TX LIVEDIGEST %v", revision)
+	err = t.queryRow(ctx, t.d.LiveDigestSQL, revision).Scan(&count, &sum)
+	return count, sum, err
+}
+
 func (t *Tx) DeleteRevision(ctx context.Context, revision int64) error {
 	logrus.Tracef("TX DELETEREVISION %v", revision)
 	_, err := t.execute(ctx, t.d.DeleteSQL, revision)
@@ -97,28 +158,28 @@ func (t *Tx) CurrentRevision(ctx context.Context) (int64, error) {
 }
 
 func (t *Tx) query(ctx context.Context, sql string, args ...any) (result *sql.Rows, err error) {
-	logrus.Tracef("TX QUERY %v : %s", util.Summarize(args), util.Stripped(sql))
+	util.RequestLogger(ctx).Tracef("TX QUERY %v : %s", util.Summarize(args), util.Stripped(sql))
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		metrics.ObserveSQL(ctx, startTime, t.d.ErrCode(err), util.Stripped(sql), args)
 	}()
 	return t.x.QueryContext(ctx, sql, args...)
 }
 
 func (t *Tx) queryRow(ctx context.Context, sql string, args ...any) (result *sql.Row) {
-	logrus.Tracef("TX QUERY ROW %v : %s", util.Summarize(args), util.Stripped(sql))
+	util.RequestLogger(ctx).Tracef("TX QUERY ROW %v : %s", util.Summarize(args), util.Stripped(sql))
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(result.Err()), util.Stripped(sql), args)
+		metrics.ObserveSQL(ctx, startTime, t.d.ErrCode(result.Err()), util.Stripped(sql), args)
 	}()
 	return t.x.QueryRowContext(ctx, sql, args...)
 }
 
 func (t *Tx) execute(ctx context.Context, sql string, args ...any) (result sql.Result, err error) {
-	logrus.Tracef("TX EXEC %v : %s", util.Summarize(args), util.Stripped(sql))
+	util.RequestLogger(ctx).Tracef("TX EXEC %v : %s", util.Summarize(args), util.Stripped(sql))
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		metrics.ObserveSQL(ctx, startTime, t.d.ErrCode(err), util.Stripped(sql), args)
 	}()
 	return t.x.ExecContext(ctx, sql, args...)
 }
@@ -0,0 +1,183 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultValidationQuery is used to validate connections when the driver does not
+// provide its own validation query.
+const defaultValidationQuery = "SELECT 1"
+
+// validationQuery returns the query used to validate pooled connections before
+// they are reused, or an empty string if connection validation is disabled.
+func (c ConnectionPoolConfig) validationQuery() string {
+	if !c.ValidateConnections {
+		return ""
+	}
+	if c.ValidationQuery != "" {
+		return c.ValidationQuery
+	}
+	return defaultValidationQuery
+}
+
+// openValidated opens a database whose connections run validationQuery before
+// being reused from the pool. A connection on which the query fails is reported
+// to database/sql as bad, so that it is discarded and replaced by a new connection.
+func openValidated(driverName, dataSourceName, validationQuery string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+
+	var connector driver.Connector
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dataSourceName); err != nil {
+			return nil, err
+		}
+	} else {
+		connector = &dsnConnector{driver: drv, dsn: dataSourceName}
+	}
+	return sql.OpenDB(&validatingConnector{Connector: connector, query: validationQuery}), nil
+}
+
+// dsnConnector adapts a driver that does not implement driver.DriverContext.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type validatingConnector struct {
+	driver.Connector
+	query string
+}
+
+func (c *validatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &validatingConn{Conn: conn, query: c.query}, nil
+}
+
+// validatingConn wraps a driver connection, running the validation query when
+// database/sql resets the session before reusing the connection. All optional
+// driver interfaces are passed through to the wrapped connection, or report
+// driver.ErrSkip so that database/sql falls back to its default behavior.
+type validatingConn struct {
+	driver.Conn
+	query string
+}
+
+var (
+	_ driver.ConnPrepareContext = (*validatingConn)(nil)
+	_ driver.ConnBeginTx        = (*validatingConn)(nil)
+	_ driver.ExecerContext      = (*validatingConn)(nil)
+	_ driver.QueryerContext     = (*validatingConn)(nil)
+	_ driver.Pinger             = (*validatingConn)(nil)
+	_ driver.NamedValueChecker  = (*validatingConn)(nil)
+	_ driver.SessionResetter    = (*validatingConn)(nil)
+	_ driver.Validator          = (*validatingConn)(nil)
+)
+
+func (c *validatingConn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.Conn.(driver.SessionResetter); ok {
+		if err := sr.ResetSession(ctx); err != nil {
+			return err
+		}
+	}
+	if err := c.validate(ctx); err != nil {
+		logrus.Warnf("Discarding datastore connection that failed validation: %v", err)
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *validatingConn) validate(ctx context.Context) error {
+	rows, err := c.QueryContext(ctx, c.query, nil)
+	if errors.Is(err, driver.ErrSkip) {
+		var stmt driver.Stmt
+		if stmt, err = c.PrepareContext(ctx, c.query); err != nil {
+			return err
+		}
+		defer stmt.Close()
+		if sq, ok := stmt.(driver.StmtQueryContext); ok {
+			rows, err = sq.QueryContext(ctx, nil)
+		} else {
+			rows, err = stmt.Query(nil) //nolint:staticcheck
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func (c *validatingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return pc.PrepareContext(ctx, query)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Prepare(query)
+}
+
+func (c *validatingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bt, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bt.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		return nil, errors.New("driver does not support non-default transaction options")
+	}
+	return c.Begin() //nolint:staticcheck
+}
+
+func (c *validatingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *validatingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *validatingConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *validatingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *validatingConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// validateDriver is a minimal database driver whose connections can be broken,
+// causing the validation query to fail.
+type validateDriver struct {
+	sync.Mutex
+	conns []*validateConn
+}
+
+func (d *validateDriver) Open(name string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	c := &validateConn{}
+	d.conns = append(d.conns, c)
+	return c, nil
+}
+
+// validateConn implements only the connection methods needed to run queries;
+// calling any other method will panic.
+type validateConn struct {
+	driver.Conn
+	broken bool
+	closed bool
+}
+
+func (c *validateConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.broken {
+		return nil, errors.New("connection reset by peer")
+	}
+	return &emptyRows{}, nil
+}
+
+func (c *validateConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+type emptyRows struct{}
+
+func (r *emptyRows) Columns() []string              { return nil }
+func (r *emptyRows) Close() error                   { return nil }
+func (r *emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+var testValidateDriver = &validateDriver{}
+
+func init() {
+	sql.Register("kine-validate-test", testValidateDriver)
+}
+
+func TestValidateConnections(t *testing.T) {
+	ctx := context.Background()
+	db, err := openAndTest("kine-validate-test", "", ConnectionPoolConfig{ValidateConnections: true}.validationQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	query := func() {
+		rows, err := db.QueryContext(ctx, "SELECT name FROM kine")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+
+	query()
+	if n := len(testValidateDriver.conns); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	// break the pooled connection; the next query must discard it and use a new connection
+	first := testValidateDriver.conns[0]
+	first.broken = true
+	query()
+
+	if n := len(testValidateDriver.conns); n != 2 {
+		t.Fatalf("expected broken connection to be replaced, got %d connections", n)
+	}
+	if !first.closed {
+		t.Fatal("expected broken connection to be closed")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	cryptotls "crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,7 +33,7 @@ var (
 		`CREATE TABLE IF NOT EXISTS kine
 			(
 				id BIGINT UNSIGNED AUTO_INCREMENT,
-				name VARCHAR(630) CHARACTER SET ascii,
+				name VARCHAR(630) CHARACTER SET ascii COLLATE ascii_bin,
 				created INTEGER,
 				deleted INTEGER,
 				create_revision BIGINT UNSIGNED,
@@ -47,13 +49,54 @@ var (
 		`CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`,
 		`CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
 	}
+	// metaSchema is created separately from the kine table schema, as it may be
+	// missing from databases created by earlier versions of kine.
+	metaSchema = `CREATE TABLE IF NOT EXISTS kine_meta
+			(
+				name VARCHAR(64) CHARACTER SET ascii,
+				value VARCHAR(255),
+				PRIMARY KEY (name)
+			);`
+	// keyMetadataSchema is created separately from the kine table schema, for the same reason.
+	keyMetadataSchema = `CREATE TABLE IF NOT EXISTS kine_key_metadata
+			(
+				name VARCHAR(630) CHARACTER SET ascii COLLATE ascii_bin,
+				meta_key VARCHAR(63) CHARACTER SET ascii,
+				meta_value VARCHAR(255),
+				PRIMARY KEY (name, meta_key)
+			);`
+	// auditSchema is created separately from the kine table schema, for the same reason.
+	auditSchema = `CREATE TABLE IF NOT EXISTS kine_audit
+			(
+				revision BIGINT UNSIGNED,
+				name VARCHAR(630) CHARACTER SET ascii COLLATE ascii_bin,
+				operation VARCHAR(16) CHARACTER SET ascii,
+				principal VARCHAR(255),
+				created_at BIGINT,
+				PRIMARY KEY (revision)
+			);`
 	schemaMigrations = []string{
 		`ALTER TABLE kine MODIFY COLUMN id BIGINT UNSIGNED AUTO_INCREMENT, MODIFY COLUMN create_revision BIGINT UNSIGNED, MODIFY COLUMN prev_revision BIGINT UNSIGNED`,
-		// Creating an empty migration to ensure that postgresql and mysql migrations match up
-		// with each other for a give value of KINE_SCHEMA_MIGRATION env var
-		``,
+		// The binary collation compares names byte by byte, as etcd does; the default collation
+		// of the ascii character set is case-insensitive. This matches the postgresql migration
+		// to the "C" collation, so that migrations match up for a given KINE_SCHEMA_MIGRATION.
+		`ALTER TABLE kine MODIFY COLUMN name VARCHAR(630) CHARACTER SET ascii COLLATE ascii_bin`,
+	}
+	createDB       = "CREATE DATABASE IF NOT EXISTS `%s`;"
+	getMetaSQL     = "SELECT value FROM kine_meta WHERE name = ?"
+	setMetaSQL     = "INSERT INTO kine_meta(name, value) VALUES(?, ?)"
+	indexExistsSQL = "SELECT 1 FROM information_schema.STATISTICS WHERE table_schema = DATABASE() AND table_name = 'kine' AND index_name = ? LIMIT 1"
+	// columnTypes lists the column types that may be used in place of the default
+	// types when creating the kine table.
+	columnTypes = map[string][]string{
+		"created":         {"INTEGER", "BIGINT"},
+		"deleted":         {"INTEGER", "BIGINT"},
+		"lease":           {"INTEGER", "BIGINT"},
+		"create_revision": {"BIGINT UNSIGNED", "BIGINT"},
+		"prev_revision":   {"BIGINT UNSIGNED", "BIGINT"},
+		"value":           {"MEDIUMBLOB", "LONGBLOB"},
+		"old_value":       {"MEDIUMBLOB", "LONGBLOB"},
 	}
-	createDB = "CREATE DATABASE IF NOT EXISTS `%s`;"
 )
 
 func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
@@ -66,15 +109,23 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 		tlsConfig.MinVersion = cryptotls.VersionTLS11
 	}
 
+	schema := slices.Clone(schema)
+	if schema[0], err = generic.ApplyColumnTypes(schema[0], cfg.ColumnTypes, columnTypes); err != nil {
+		return false, nil, err
+	}
+
 	parsedDSN, err := prepareDSN(cfg.DataSourceName, tlsConfig)
 	if err != nil {
-		return false, nil, err
+		return false, nil, util.RedactError(err, cfg.DataSourceName)
 	}
 
-	if err := createDBIfNotExist(parsedDSN); err != nil {
-		return false, nil, err
+	if !cfg.DisableSchemaMigrations {
+		if err := createDBIfNotExist(parsedDSN); err != nil {
+			return false, nil, util.RedactError(err, parsedDSN)
+		}
 	}
 
+	cfg.ConnectionPoolConfig.ClassifyConnErr = classifyConnErr
 	dialect, err := generic.Open(ctx, wg, "mysql", parsedDSN, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer)
 	if err != nil {
 		return false, nil, err
@@ -93,15 +144,19 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 			WHERE
 				kp.name != 'compact_rev_key' AND
 				kp.prev_revision != 0 AND
+				kp.id > ? AND
 				kp.id <= ?
 			UNION
 			SELECT kd.id AS id
 			FROM kine AS kd
 			WHERE
 				kd.deleted != 0 AND
+				kd.id > ? AND
 				kd.id <= ?
 		) AS ks
 		ON kv.id = ks.id`
+	dialect.AnalyzeSQL = `ANALYZE TABLE kine`
+	dialect.Failover = isFailover
 	dialect.TranslateErr = func(err error) error {
 		if err, ok := err.(*mysql.MySQLError); ok && err.Number == 1062 {
 			return server.ErrKeyExists
@@ -124,15 +179,68 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 		}
 		return startKey
 	}
-	if err := setup(dialect.DB); err != nil {
+	if cfg.DisableSchemaMigrations {
+		if err := generic.ValidateSchema(ctx, dialect.DB, schema, indexExistsSQL, getMetaSQL); err != nil {
+			return false, nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, schema); err != nil {
+			return false, nil, err
+		}
+		if err := generic.VerifyIndexes(ctx, dialect.DB, schema, indexExistsSQL, cfg.RebuildMissingIndexes); err != nil {
+			return false, nil, err
+		}
+
+		if err := generic.CheckSchemaVersion(ctx, dialect.DB, getMetaSQL, setMetaSQL); err != nil {
+			return false, nil, err
+		}
+		dialect.Migrate(context.Background())
+	}
+	dialect.SetConnBackoff(cfg.ConnectionBackoff)
+	dialect.SetAcquireTracing(cfg.AcquireTracing)
+	dialect.SetRevisionBlockSize(cfg.RevisionBlockSize)
+	dialect.SetCompactExclude(cfg.CompactExclude)
+	if err := dialect.SetAuditLog(cfg.AuditLog); err != nil {
 		return false, nil, err
 	}
-
-	dialect.Migrate(context.Background())
-	return true, logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), nil
+	if err := dialect.SetRevisionFloor(ctx, cfg.RevisionFloor); err != nil {
+		return false, nil, err
+	}
+	if err := dialect.SetRevisionMark(ctx, wg, cfg.RevisionMarkInterval); err != nil {
+		return false, nil, err
+	}
+	if cfg.ValidateStatements {
+		if err := dialect.ValidateStatements(ctx); err != nil {
+			return false, nil, err
+		}
+	}
+	if cfg.CompactDataSourceName != "" {
+		compactDSN, err := prepareDSN(cfg.CompactDataSourceName, tlsConfig)
+		if err != nil {
+			return false, nil, err
+		}
+		if err := dialect.OpenCompact(ctx, wg, "mysql", compactDSN, cfg.MetricsRegisterer); err != nil {
+			return false, nil, err
+		}
+	}
+	log := sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)
+	log.SetExternalValues(cfg.ExternalValues)
+	log.SetCompactBurstThreshold(cfg.CompactBurstThreshold)
+	log.SetCompactExclude(cfg.CompactExclude)
+	log.SetWatchHistorySize(cfg.WatchHistorySize)
+	log.SetWatchPrefetch(cfg.WatchPrefetch)
+	log.SetWatchSharedDelivery(cfg.WatchSharedDelivery)
+	log.SetWatchHistoryWindow(cfg.WatchHistoryWindow)
+	log.SetQueryTimeouts(cfg.ReadTimeout, cfg.WriteTimeout)
+	log.SetCompactVerify(cfg.CompactVerify)
+	log.SetCompactAnalyze(cfg.CompactAnalyzeThreshold, cfg.CompactAnalyzeInterval)
+	log.SetCompactMinInterval(cfg.CompactMinInterval, cfg.CompactManualBypass)
+	backend := logstructured.New(log)
+	backend.SetElideNoopUpdates(cfg.ElideNoopUpdates)
+	return true, backend, nil
 }
 
-func setup(db *sql.DB) error {
+func setup(db *sql.DB, schema []string) error {
 	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
 	var exists bool
 	err := db.QueryRow("SELECT 1 FROM information_schema.TABLES WHERE table_schema = DATABASE() AND table_name = ?", "kine").Scan(&exists)
@@ -143,14 +251,19 @@ func setup(db *sql.DB) error {
 	if !exists {
 		for _, stmt := range schema {
 			logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-			if _, err := db.Exec(stmt); err != nil {
-				if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
-					return err
-				}
+			if err := execSetup(db, stmt); err != nil {
+				return err
 			}
 		}
 	}
 
+	for _, stmt := range []string{metaSchema, keyMetadataSchema, auditSchema} {
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if err := execSetup(db, stmt); err != nil {
+			return err
+		}
+	}
+
 	// Run enabled schama migrations.
 	// Note that the schema created by the `schema` var is always the latest revision;
 	// migrations should handle deltas between prior schema versions.
@@ -163,10 +276,8 @@ func setup(db *sql.DB) error {
 			continue
 		}
 		logrus.Tracef("SETUP EXEC MIGRATION %d: %v", i, util.Stripped(stmt))
-		if _, err := db.Exec(stmt); err != nil {
-			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
-				return err
-			}
+		if err := execSetup(db, stmt); err != nil {
+			return err
 		}
 	}
 
@@ -174,6 +285,59 @@ func setup(db *sql.DB) error {
 	return nil
 }
 
+// execSetup executes a setup or migration statement. A table or index that already exists is
+// logged and skipped, so that a partially applied setup or migration can be run again.
+func execSetup(db *sql.DB, stmt string) error {
+	if _, err := db.Exec(stmt); err != nil {
+		if !isAlreadyExists(err) {
+			return err
+		}
+		logrus.Infof("Database object already exists, continuing: %v", err)
+	}
+	return nil
+}
+
+// isAlreadyExists returns true if the error indicates that the table or index
+// being created already exists, as happens when multiple replicas create the
+// schema concurrently.
+func isAlreadyExists(err error) bool {
+	if err, ok := err.(*mysql.MySQLError); ok {
+		// ER_TABLE_EXISTS_ERROR, ER_DUP_KEYNAME
+		return err.Number == 1050 || err.Number == 1061
+	}
+	return false
+}
+
+// classifyConnErr maps mysql connection errors to a generic connection error class.
+func classifyConnErr(err error) string {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1044, 1045: // ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR
+			return generic.ConnErrAuth
+		case 1040, 1203: // ER_CON_COUNT_ERROR, ER_TOO_MANY_USER_CONNECTIONS
+			return generic.ConnErrTooManyConnections
+		}
+	}
+	return ""
+}
+
+// isFailover returns true if the error indicates that the connection was lost, or that the
+// server has been made read-only, as happens to the old primary when a replica is promoted.
+func isFailover(err error) bool {
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1053, 1290, 1836, 1927: // ER_SERVER_SHUTDOWN, ER_OPTION_PREVENTS_STATEMENT, ER_READ_ONLY_MODE, ER_CONNECTION_KILLED
+			return true
+		}
+	}
+	return false
+}
+
 func createDBIfNotExist(dataSourceName string) error {
 	config, err := mysql.ParseDSN(dataSourceName)
 	if err != nil {
@@ -190,7 +354,7 @@ func createDBIfNotExist(dataSourceName string) error {
 	var exists bool
 	err = db.QueryRow("SELECT 1 FROM information_schema.SCHEMATA WHERE schema_name = ?", dbName).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
-		logrus.Warnf("failed to check existence of database %s, going to attempt create: %v", dbName, err)
+		logrus.Warnf("failed to check existence of database %s, going to attempt create: %v", dbName, util.RedactError(err, dataSourceName))
 	}
 
 	if !exists {
@@ -244,4 +408,5 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 
 func init() {
 	drivers.Register("mysql", New)
+	drivers.RegisterFeatures("mysql", drivers.SQLFeatures...)
 }
@@ -0,0 +1,119 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/conformance"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// newTestBackend returns a started backend on the MySQL server given by KINE_ENDPOINT, and
+// skips the test if KINE_ENDPOINT is not set to a mysql endpoint.
+func newTestBackend(t *testing.T, cfg *drivers.Config) server.Backend {
+	scheme, dataSourceName := util.SchemeAndAddress(os.Getenv("KINE_ENDPOINT"))
+	if scheme != "mysql" {
+		t.Skip("KINE_ENDPOINT is not set to a mysql endpoint")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	cfg.DataSourceName = dataSourceName
+	if cfg.CompactInterval == 0 {
+		cfg.CompactInterval = time.Hour
+	}
+	cfg.CompactTimeout = time.Second
+	cfg.CompactBatchSize = 1000
+	cfg.PollBatchSize = 500
+	_, backend, err := New(ctx, wg, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// TestConformance runs the driver conformance suite. It requires a MySQL server, and is
+// skipped unless KINE_ENDPOINT is set to a mysql endpoint.
+func TestConformance(t *testing.T) {
+	conformance.RunSuite(t, func(t *testing.T) server.Backend {
+		return newTestBackend(t, &drivers.Config{CompactInterval: -1})
+	})
+}
+
+// TestKeyByteOrder checks that keys are compared byte by byte, as etcd does, rather than by
+// the case-insensitive default collation. It requires a MySQL server, and is skipped unless
+// KINE_ENDPOINT is set to a mysql endpoint.
+func TestKeyByteOrder(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t, &drivers.Config{})
+
+	prefix := fmt.Sprintf("/order-%d/", time.Now().UnixNano())
+	for _, name := range []string{"b", "B", "a", "A", "_", "~"} {
+		if _, err := backend.Create(ctx, prefix+name, []byte(name), 0); err != nil {
+			t.Fatalf("failed to create %s: %v", prefix+name, err)
+		}
+	}
+
+	_, kvs, err := backend.List(ctx, prefix, "", 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, kv := range kvs {
+		names = append(names, strings.TrimPrefix(kv.Key, prefix))
+	}
+	if got, expected := strings.Join(names, " "), "A B _ a b ~"; got != expected {
+		t.Fatalf("expected keys in byte order %q, got %q", expected, got)
+	}
+
+	_, kv, err := backend.Get(ctx, prefix+"a", "", 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || string(kv.Value) != "a" {
+		t.Fatalf("expected exact match for %s, got %#v", prefix+"a", kv)
+	}
+}
+
+// TestConnectErrorRedacted checks that the password is masked in the error and log
+// entries from a failed connection.
+func TestConnectErrorRedacted(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	_, _, err := New(ctx, wg, &drivers.Config{DataSourceName: "kine:s3cret@tcp(127.0.0.1:1)/kine"})
+	if err == nil {
+		t.Fatal("expected connecting to a closed port to fail")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("expected password to be redacted from error, got %q", err)
+	}
+	for _, entry := range hook.AllEntries() {
+		if line, _ := entry.String(); strings.Contains(line, "s3cret") {
+			t.Errorf("expected password to be redacted from log, got %q", line)
+		}
+	}
+}
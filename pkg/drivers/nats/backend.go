@@ -407,6 +407,9 @@ func (b *Backend) List(ctx context.Context, prefix, startKey string, limit, maxR
 			return b.kv.BucketRevision(), nil, err
 		}
 
+		if keysOnly {
+			nd.KV.Value = nil
+		}
 		kvs = append(kvs, nd.KV)
 	}
 
@@ -562,10 +565,15 @@ func (b *Backend) Compact(ctx context.Context, revision int64) (int64, error) {
 	if targetCompactRev > compactRev+1 {
 		compactValue := server.EncodeVersion(compactVers+1, []byte(strconv.FormatInt(targetCompactRev, 10)))
 
-		_, _, _, err := b.Update(ctx, compactRevAPI, compactValue, int64(nd.KV.ModRevision), 0)
+		_, _, updated, err := b.Update(ctx, compactRevAPI, compactValue, int64(nd.KV.ModRevision), 0)
 		if err != nil {
 			return currRev, err
 		}
+		// apply the compact revision now, instead of when the compaction watcher sees the
+		// update, so that reads made once Compact returns see the compaction
+		if updated {
+			b.kv.advanceCompactRev(targetCompactRev)
+		}
 	}
 
 	return currRev, nil
@@ -605,6 +613,7 @@ func (b *Backend) compactWatcher() {
 	w, err := b.kv.Watch(b.ctx, compactRevAPI, 0)
 	if err != nil {
 		b.l.Errorf("Failed to configure watch for compact revision: %v", err)
+		return
 	}
 	defer w.Stop()
 
@@ -635,7 +644,7 @@ func (b *Backend) compactWatcher() {
 				old := b.kv.compactRev.Load()
 
 				if rev > 0 {
-					swapped := b.kv.compactRev.CompareAndSwap(old, rev)
+					swapped := b.kv.advanceCompactRev(rev)
 					b.l.Debugf("compact revision updated: old=%d, new=%d, swapped=%v", old, rev, swapped)
 				}
 			}
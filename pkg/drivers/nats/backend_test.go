@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers/conformance"
 	kserver "github.com/k3s-io/kine/pkg/server"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats-server/v2/test"
@@ -367,17 +368,17 @@ func TestBackend_List(t *testing.T) {
 	rev, ents, err = b.List(ctx, prefix("/"), "", 4, 0, false)
 	noErr(t, err)
 	expEqual(t, baseRev+7, rev)
-	expEqual(t, 7, len(ents)) // expect full list
+	expEqual(t, 4, len(ents))
 	expSortedKeys(t, ents)
-	expEqualKeys(t, []string{prefix("/a"), prefix("/a/b"), prefix("/a/b/c"), prefix("/b"), prefix("/c"), prefix("/d/a"), prefix("/d/b")}, ents)
+	expEqualKeys(t, []string{prefix("/a"), prefix("/a/b"), prefix("/a/b/c"), prefix("/b")}, ents)
 
 	// List the keys with a limit after some start key.
 	rev, ents, err = b.List(ctx, prefix("/"), prefix("/b"), 2, 0, false)
 	noErr(t, err)
 	expEqual(t, baseRev+7, rev)
-	expEqual(t, 4, len(ents))
+	expEqual(t, 2, len(ents))
 	expSortedKeys(t, ents)
-	expEqualKeys(t, []string{prefix("/b"), prefix("/c"), prefix("/d/a"), prefix("/d/b")}, ents)
+	expEqualKeys(t, []string{prefix("/b"), prefix("/c")}, ents)
 
 	// List the keys after some start key with slash prefix
 	rev, ents, err = b.List(ctx, prefix("/"), prefix("/c"), 0, 0, false)
@@ -441,3 +442,18 @@ func TestBackend_Watch(t *testing.T) {
 
 	expEqual(t, 2, len(events))
 }
+
+func TestConformance(t *testing.T) {
+	conformance.RunSuite(t, func(t *testing.T) kserver.Backend {
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		ns, nc, b := setupBackend(ctx, wg, t)
+		t.Cleanup(func() {
+			cancel()
+			wg.Wait()
+			nc.Drain()
+			ns.Shutdown()
+		})
+		return b
+	})
+}
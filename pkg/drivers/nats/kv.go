@@ -326,9 +326,10 @@ func (e *KeyValue) Watch(ctx context.Context, keys string, startRev int64) (KeyW
 	// Everything but the last token will be treated as a filter
 	// on the watcher. The last token will used as a deliver-time filter.
 
+	// an empty keys watches the whole keyspace, without a subject filter
 	filter := keys
 
-	if !strings.HasSuffix(filter, "/") {
+	if filter != "" && !strings.HasSuffix(filter, "/") {
 		idx := strings.LastIndexByte(filter, '/')
 		if idx > -1 {
 			filter = keys[:idx+1]
@@ -402,7 +403,9 @@ func (e *KeyValue) Watch(ctx context.Context, keys string, startRev int64) (KeyW
 		cfg.OptStartSeq = uint64(startRev)
 	}
 	cfg.DeliverPolicy = dp
-	cfg.FilterSubjects = append(cfg.FilterSubjects, filter)
+	if filter != "" {
+		cfg.FilterSubjects = append(cfg.FilterSubjects, filter)
+	}
 
 	con, err := e.js.OrderedConsumer(ctx, fmt.Sprintf("KV_%s", e.nkv.Bucket()), cfg)
 	if err != nil {
@@ -466,11 +469,6 @@ func (e *KeyValue) List(ctx context.Context, prefix, startKey string, limit, rev
 
 	e.btm.RLock()
 	for {
-		// KINE pagination logic relies on checking if response is > limit
-		// if limit > 0 && len(matches) == int(limit) {
-		// break
-		// }
-
 		k := it.Key()
 
 		if exact && k != seekKey {
@@ -496,6 +494,9 @@ func (e *KeyValue) List(ctx context.Context, prefix, startKey string, limit, rev
 
 	var entries []jetstream.KeyValueEntry
 	for _, m := range matches {
+		if limit > 0 && int64(len(entries)) == limit {
+			break
+		}
 		valueEntry, err := e.getRevision(ctx, m.key, int64(m.seq))
 		if err != nil {
 			if errors.Is(err, jetstream.ErrKeyNotFound) {
@@ -510,6 +511,19 @@ func (e *KeyValue) List(ctx context.Context, prefix, startKey string, limit, rev
 	return entries, nil
 }
 
+// advanceCompactRev raises the compact revision to rev, unless it is already later.
+func (e *KeyValue) advanceCompactRev(rev int64) bool {
+	for {
+		old := e.compactRev.Load()
+		if rev <= old {
+			return false
+		}
+		if e.compactRev.CompareAndSwap(old, rev) {
+			return true
+		}
+	}
+}
+
 func (e *KeyValue) Count(ctx context.Context, prefix, startKey string, revision int64) (int64, error) {
 	matches, err := e.getListOps(prefix, startKey, revision)
 	if err != nil {
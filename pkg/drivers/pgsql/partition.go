@@ -0,0 +1,230 @@
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// partitionsAhead is the number of partitions created above the one holding the current revision
+	partitionsAhead = 2
+	// partitionMaintenanceInterval is how often partitions are created ahead of the current revision
+	partitionMaintenanceInterval = 10 * time.Second
+	partitionPrefix              = "kine_p"
+)
+
+var (
+	// The unique index on (name, prev_revision) that guards against conflicting writes cannot be
+	// created on a partitioned table, as it does not include the partition key. Instead, each
+	// (name, prev_revision) pair is recorded in a separate table with the same constraint, by a
+	// trigger on the kine table.
+	partitionGuardSchema = []string{
+		`CREATE TABLE IF NOT EXISTS kine_prev_revision
+			(
+				name text COLLATE "C",
+				prev_revision BIGINT,
+				UNIQUE (name, prev_revision)
+			);`,
+		`CREATE OR REPLACE FUNCTION kine_prev_revision_guard() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP <> 'INSERT' THEN
+					DELETE FROM kine_prev_revision WHERE name = OLD.name AND prev_revision IS NOT DISTINCT FROM OLD.prev_revision;
+				END IF;
+				IF TG_OP <> 'DELETE' THEN
+					INSERT INTO kine_prev_revision(name, prev_revision) VALUES (NEW.name, NEW.prev_revision);
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER kine_prev_revision_guard AFTER INSERT OR UPDATE OR DELETE ON kine
+			FOR EACH ROW EXECUTE FUNCTION kine_prev_revision_guard()`,
+		// rows outside of the ranges of the id partitions, such as those inserted by a
+		// revision floor far above the current revision, are held by the default partition
+		`CREATE TABLE IF NOT EXISTS kine_default PARTITION OF kine DEFAULT`,
+	}
+	tableKindSQL          = `SELECT relkind::text FROM pg_class WHERE oid = to_regclass('kine')`
+	partitionHighWaterSQL = `SELECT GREATEST((SELECT last_value FROM kine_id_seq), (SELECT COALESCE(MAX(id), 0) FROM kine))`
+	listPartitionsSQL     = `SELECT c.relname FROM pg_inherits AS i JOIN pg_class AS c ON c.oid = i.inhrelid WHERE i.inhparent = 'kine'::regclass`
+	createPartitionSQL    = `CREATE TABLE IF NOT EXISTS %s PARTITION OF kine FOR VALUES FROM (%d) TO (%d)`
+)
+
+// partitionSchema returns the schema with the kine table range-partitioned by id.
+func partitionSchema(schema []string) []string {
+	result := []string{strings.TrimSuffix(strings.TrimSpace(schema[0]), ";") + " PARTITION BY RANGE (id)"}
+	for _, stmt := range schema[1:] {
+		if !strings.Contains(stmt, "kine_name_prev_revision_uindex") {
+			result = append(result, stmt)
+		}
+	}
+	return append(result, partitionGuardSchema...)
+}
+
+// isPrimaryKey reports whether a constraint is the primary key of the kine table, or of one of
+// its partitions.
+func isPrimaryKey(constraint string) bool {
+	if constraint == "kine_pkey" || constraint == "kine_default_pkey" {
+		return true
+	}
+	name, ok := strings.CutSuffix(constraint, "_pkey")
+	if !ok {
+		return false
+	}
+	suffix, ok := strings.CutPrefix(name, partitionPrefix)
+	if !ok {
+		return false
+	}
+	_, err := strconv.ParseInt(suffix, 10, 64)
+	return err == nil
+}
+
+// tableKind reports whether the kine table exists, and whether it is partitioned.
+func tableKind(ctx context.Context, db *sql.DB) (exists, partitioned bool, err error) {
+	var kind string
+	if err := db.QueryRowContext(ctx, tableKindSQL).Scan(&kind); err == sql.ErrNoRows {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	return true, kind == "p", nil
+}
+
+// partitioner maintains the partitions of a kine table that is range-partitioned by id. Each
+// partition holds size revisions, and is named by the index of its range.
+type partitioner struct {
+	dialect *generic.Generic
+	size    int64
+}
+
+// name returns the name of the partition with the given index, which holds the revisions from
+// n*size up to but not including (n+1)*size.
+func (p *partitioner) name(n int64) string {
+	return partitionPrefix + strconv.FormatInt(n, 10)
+}
+
+// partitions returns the indexes of the existing id partitions, in ascending order.
+func (p *partitioner) partitions(ctx context.Context) ([]int64, error) {
+	rows, err := p.dialect.DB.QueryContext(ctx, listPartitionsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int64
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if suffix, ok := strings.CutPrefix(name, partitionPrefix); ok {
+			if n, err := strconv.ParseInt(suffix, 10, 64); err == nil {
+				result = append(result, n)
+			}
+		}
+	}
+	slices.Sort(result)
+	return result, rows.Err()
+}
+
+// ensure creates the partition holding the current revision, and partitionsAhead partitions
+// above it. A partition whose range overlaps rows already held by the default partition cannot
+// be created; that range continues to be held by the default partition.
+func (p *partitioner) ensure(ctx context.Context) error {
+	var highWater int64
+	if err := p.dialect.DB.QueryRowContext(ctx, partitionHighWaterSQL).Scan(&highWater); err != nil {
+		return err
+	}
+	first := highWater / p.size
+	for n := first; n <= first+partitionsAhead; n++ {
+		stmt := fmt.Sprintf(createPartitionSQL, p.name(n), n*p.size, (n+1)*p.size)
+		if _, err := p.dialect.DB.ExecContext(ctx, stmt); err != nil && !isAlreadyExists(err) {
+			logrus.Warnf("Failed to create partition %s: %v", p.name(n), err)
+		}
+	}
+	return nil
+}
+
+// dropCompacted drops partitions whose range is entirely at or below the compact revision, and
+// that compaction has left empty. Dropping a partition releases its storage at once, instead
+// of waiting for the deleted rows to be vacuumed. Partitions holding keys that have not been
+// updated since are retained.
+func (p *partitioner) dropCompacted(ctx context.Context) error {
+	compactRev, err := p.dialect.GetCompactRevision(ctx)
+	if err != nil {
+		return err
+	}
+	partitions, err := p.partitions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, n := range partitions {
+		if (n+1)*p.size > compactRev+1 {
+			break
+		}
+		if err := p.drop(ctx, p.name(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop drops a partition, if it is empty.
+func (p *partitioner) drop(ctx context.Context, name string) error {
+	tx, err := p.dialect.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a busy partition is left for the next compaction, rather than blocking writes
+	if _, err := tx.ExecContext(ctx, `SET LOCAL lock_timeout = '1s'`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`LOCK TABLE %s IN ACCESS EXCLUSIVE MODE`, name)); err != nil {
+		return err
+	}
+	var empty bool
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT NOT EXISTS (SELECT 1 FROM %s)`, name)).Scan(&empty); err != nil {
+		return err
+	}
+	if !empty {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s`, name)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logrus.Infof("COMPACT dropped empty partition %s", name)
+	return nil
+}
+
+// start creates partitions ahead of the current revision at partitionMaintenanceInterval,
+// until the context is cancelled.
+func (p *partitioner) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(partitionMaintenanceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.ensure(ctx); err != nil && ctx.Err() == nil {
+					logrus.Errorf("Failed to create partitions: %v", err)
+				}
+			}
+		}
+	}()
+}
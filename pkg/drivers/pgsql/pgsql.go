@@ -3,10 +3,12 @@ package pgsql
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -50,6 +52,26 @@ var (
 		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
 		`CREATE INDEX IF NOT EXISTS kine_list_query_index on kine(name, id DESC, deleted)`,
+		`CREATE TABLE IF NOT EXISTS kine_meta
+			(
+				name text PRIMARY KEY,
+				value text
+			);`,
+		`CREATE TABLE IF NOT EXISTS kine_key_metadata
+			(
+				name text COLLATE "C",
+				meta_key text,
+				meta_value text,
+				PRIMARY KEY (name, meta_key)
+			);`,
+		`CREATE TABLE IF NOT EXISTS kine_audit
+			(
+				revision bigint PRIMARY KEY,
+				name text COLLATE "C",
+				operation text,
+				principal text,
+				created_at bigint
+			);`,
 	}
 	schemaMigrations = []string{
 		`ALTER TABLE kine ALTER COLUMN id SET DATA TYPE BIGINT, ALTER COLUMN create_revision SET DATA TYPE BIGINT, ALTER COLUMN prev_revision SET DATA TYPE BIGINT; ALTER SEQUENCE kine_id_seq AS BIGINT`,
@@ -57,19 +79,39 @@ var (
 		// queries use the index.
 		`ALTER TABLE kine ALTER COLUMN name SET DATA TYPE TEXT COLLATE "C" USING name::TEXT COLLATE "C"`,
 	}
-	createDB = `CREATE DATABASE "%s";`
+	createDB       = `CREATE DATABASE "%s";`
+	getMetaSQL     = `SELECT value FROM kine_meta WHERE name = $1`
+	setMetaSQL     = `INSERT INTO kine_meta(name, value) VALUES($1, $2)`
+	indexExistsSQL = `SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND tablename = 'kine' AND indexname = $1`
+	// columnTypes lists the column types that may be used in place of the default
+	// types when creating the kine table.
+	columnTypes = map[string][]string{
+		"created":   {"INTEGER", "BIGINT"},
+		"deleted":   {"INTEGER", "BIGINT"},
+		"lease":     {"INTEGER", "BIGINT"},
+		"value":     {"bytea"},
+		"old_value": {"bytea"},
+	}
 )
 
 func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
 	parsedDSN, err := prepareDSN(cfg.DataSourceName, cfg.BackendTLSConfig)
 	if err != nil {
-		return false, nil, err
+		return false, nil, util.RedactError(err, cfg.DataSourceName)
 	}
 
-	if err := createDBIfNotExist(parsedDSN); err != nil {
+	schema := slices.Clone(schema)
+	if schema[0], err = generic.ApplyColumnTypes(schema[0], cfg.ColumnTypes, columnTypes); err != nil {
 		return false, nil, err
 	}
 
+	if !cfg.DisableSchemaMigrations {
+		if err := createDBIfNotExist(parsedDSN); err != nil {
+			return false, nil, util.RedactError(err, parsedDSN)
+		}
+	}
+
+	cfg.ConnectionPoolConfig.ClassifyConnErr = classifyConnErr
 	dialect, err := generic.Open(ctx, wg, "pgx", parsedDSN, cfg.ConnectionPoolConfig, "$", true, cfg.MetricsRegisterer)
 	if err != nil {
 		return false, nil, err
@@ -122,15 +164,18 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 			WHERE
 				kp.name != 'compact_rev_key' AND
 				kp.prev_revision != 0 AND
-				kp.id <= $1
+				kp.id > $1 AND
+				kp.id <= $2
 			UNION
 			SELECT kd.id AS id
 			FROM kine AS kd
 			WHERE
 				kd.deleted != 0 AND
-				kd.id <= $2
+				kd.id > $3 AND
+				kd.id <= $4
 		) AS ks
 		WHERE kv.id = ks.id`
+	dialect.AnalyzeSQL = `ANALYZE kine`
 	dialect.GetCurrentSQL = q(fmt.Sprintf(listSQL, "AND kv.name >= ?"))
 	dialect.GetCurrentValSQL = q(fmt.Sprintf(listValSQL, "AND kv.name >= ?"))
 	dialect.ListRevisionStartSQL = q(fmt.Sprintf(listSQL, "AND kv.id <= ?"))
@@ -139,13 +184,26 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 	dialect.GetRevisionAfterValSQL = q(fmt.Sprintf(listValSQL, "AND kv.name >= ? AND kv.id <= ?"))
 	dialect.CountCurrentSQL = q(fmt.Sprintf(countSQL, "AND kv.name >= ?"))
 	dialect.CountRevisionSQL = q(fmt.Sprintf(countSQL, "AND kv.name >= ? AND kv.id <= ?"))
+	dialect.SetSequenceSQL = `SELECT setval('kine_id_seq', GREATEST($1, last_value)) FROM kine_id_seq`
+	// the types of parameters in a select list are not inferred from the insert columns
+	dialect.InsertRevisionSQL = `INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		SELECT $1::bigint, $2::text, $3::integer, $4::integer, $5::bigint, $6::bigint, $7::integer, $8::bytea, $9::bytea
+		FROM (SELECT MAX(rkv.id) AS id FROM kine AS rkv) AS c
+		WHERE c.id IS NULL OR c.id < $10::bigint`
+	dialect.ListRangeCurrentSQL = q(fmt.Sprintf(listSQL, "AND kv.name >= ? AND kv.name < ?"))
+	dialect.ListRangeCurrentValSQL = q(fmt.Sprintf(listValSQL, "AND kv.name >= ? AND kv.name < ?"))
+	dialect.ListRangeRevisionSQL = q(fmt.Sprintf(listSQL, "AND kv.name >= ? AND kv.name < ? AND kv.id <= ?"))
+	dialect.ListRangeRevisionValSQL = q(fmt.Sprintf(listValSQL, "AND kv.name >= ? AND kv.name < ? AND kv.id <= ?"))
+	dialect.CountRangeCurrentSQL = q(fmt.Sprintf(countSQL, "AND kv.name >= ? AND kv.name < ?"))
+	dialect.CountRangeRevisionSQL = q(fmt.Sprintf(countSQL, "AND kv.name >= ? AND kv.name < ? AND kv.id <= ?"))
 	dialect.FillRetryDuration = time.Millisecond + 5
 	dialect.InsertRetry = func(err error) bool {
-		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation && err.ConstraintName == "kine_pkey" {
+		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation && isPrimaryKey(err.ConstraintName) {
 			return true
 		}
 		return false
 	}
+	dialect.Failover = isFailover
 	dialect.TranslateErr = func(err error) error {
 		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation {
 			return server.ErrKeyExists
@@ -168,15 +226,88 @@ func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, se
 		}
 		return startKey
 	}
-	if err := setup(dialect.DB); err != nil {
-		return false, nil, err
+	var partitions *partitioner
+	if cfg.PartitionSize > 0 {
+		exists, partitioned, err := tableKind(ctx, dialect.DB)
+		if err != nil {
+			return false, nil, err
+		}
+		if exists && !partitioned {
+			logrus.Warnf("The kine table already exists and is not partitioned; partition-size is ignored")
+		} else {
+			schema = partitionSchema(schema)
+			partitions = &partitioner{dialect: dialect, size: cfg.PartitionSize}
+		}
 	}
+	if cfg.DisableSchemaMigrations {
+		if err := generic.ValidateSchema(ctx, dialect.DB, schema, indexExistsSQL, getMetaSQL); err != nil {
+			return false, nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, schema); err != nil {
+			return false, nil, err
+		}
+		if err := generic.VerifyIndexes(ctx, dialect.DB, schema, indexExistsSQL, cfg.RebuildMissingIndexes); err != nil {
+			return false, nil, err
+		}
 
-	dialect.Migrate(context.Background())
-	return true, logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), nil
+		if err := generic.CheckSchemaVersion(ctx, dialect.DB, getMetaSQL, setMetaSQL); err != nil {
+			return false, nil, err
+		}
+		dialect.Migrate(context.Background())
+	}
+	dialect.SetConnBackoff(cfg.ConnectionBackoff)
+	dialect.SetAcquireTracing(cfg.AcquireTracing)
+	dialect.SetRevisionBlockSize(cfg.RevisionBlockSize)
+	dialect.SetCompactExclude(cfg.CompactExclude)
+	if err := dialect.SetAuditLog(cfg.AuditLog); err != nil {
+		return false, nil, err
+	}
+	if err := dialect.SetRevisionFloor(ctx, cfg.RevisionFloor); err != nil {
+		return false, nil, err
+	}
+	if err := dialect.SetRevisionMark(ctx, wg, cfg.RevisionMarkInterval); err != nil {
+		return false, nil, err
+	}
+	if cfg.ValidateStatements {
+		if err := dialect.ValidateStatements(ctx); err != nil {
+			return false, nil, err
+		}
+	}
+	if partitions != nil {
+		if err := partitions.ensure(ctx); err != nil {
+			return false, nil, err
+		}
+		partitions.start(ctx, wg)
+		dialect.PostCompactFunc = partitions.dropCompacted
+	}
+	if cfg.CompactDataSourceName != "" {
+		compactDSN, err := prepareDSN(cfg.CompactDataSourceName, cfg.BackendTLSConfig)
+		if err != nil {
+			return false, nil, err
+		}
+		if err := dialect.OpenCompact(ctx, wg, "pgx", compactDSN, cfg.MetricsRegisterer); err != nil {
+			return false, nil, err
+		}
+	}
+	log := sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)
+	log.SetExternalValues(cfg.ExternalValues)
+	log.SetCompactBurstThreshold(cfg.CompactBurstThreshold)
+	log.SetCompactExclude(cfg.CompactExclude)
+	log.SetWatchHistorySize(cfg.WatchHistorySize)
+	log.SetWatchPrefetch(cfg.WatchPrefetch)
+	log.SetWatchSharedDelivery(cfg.WatchSharedDelivery)
+	log.SetWatchHistoryWindow(cfg.WatchHistoryWindow)
+	log.SetQueryTimeouts(cfg.ReadTimeout, cfg.WriteTimeout)
+	log.SetCompactVerify(cfg.CompactVerify)
+	log.SetCompactAnalyze(cfg.CompactAnalyzeThreshold, cfg.CompactAnalyzeInterval)
+	log.SetCompactMinInterval(cfg.CompactMinInterval, cfg.CompactManualBypass)
+	backend := logstructured.New(log)
+	backend.SetElideNoopUpdates(cfg.ElideNoopUpdates)
+	return true, backend, nil
 }
 
-func setup(db *sql.DB) error {
+func setup(db *sql.DB, schema []string) error {
 	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
 	var version string
 	collationSupported := true
@@ -192,7 +323,7 @@ func setup(db *sql.DB) error {
 		if !collationSupported {
 			stmt = strings.ReplaceAll(stmt, ` COLLATE "C"`, "")
 		}
-		if _, err := db.Exec(stmt); err != nil {
+		if err := execSetup(db, stmt); err != nil {
 			return err
 		}
 	}
@@ -212,7 +343,7 @@ func setup(db *sql.DB) error {
 			continue
 		}
 		logrus.Tracef("SETUP EXEC MIGRATION %d: %v", i, util.Stripped(stmt))
-		if _, err := db.Exec(stmt); err != nil {
+		if err := execSetup(db, stmt); err != nil {
 			return err
 		}
 	}
@@ -221,6 +352,66 @@ func setup(db *sql.DB) error {
 	return nil
 }
 
+// execSetup executes a setup or migration statement. A table, index or other object that
+// already exists is logged and skipped, so that a partially applied setup or migration can be
+// run again.
+func execSetup(db *sql.DB, stmt string) error {
+	if _, err := db.Exec(stmt); err != nil {
+		if !isAlreadyExists(err) {
+			return err
+		}
+		logrus.Infof("Database object already exists, continuing: %v", err)
+	}
+	return nil
+}
+
+// isAlreadyExists returns true if the error indicates that the table or index
+// being created already exists. CREATE ... IF NOT EXISTS is not safe against
+// concurrent execution, so when multiple replicas create the schema at the same
+// time, all but one may fail with a duplicate object error, or a unique violation
+// on the system catalog.
+func isAlreadyExists(err error) bool {
+	if err, ok := err.(*pgconn.PgError); ok {
+		switch err.Code {
+		case pgerrcode.DuplicateTable, pgerrcode.DuplicateObject:
+			return true
+		case pgerrcode.UniqueViolation:
+			return err.ConstraintName == "pg_type_typname_nsp_index" || err.ConstraintName == "pg_class_relname_nsp_index"
+		}
+	}
+	return false
+}
+
+// classifyConnErr maps postgres connection errors, which may be wrapped in a
+// pgconn.ConnectError, to a generic connection error class.
+func classifyConnErr(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgerrcode.InvalidPassword, pgerrcode.InvalidAuthorizationSpecification:
+			return generic.ConnErrAuth
+		case pgerrcode.TooManyConnections:
+			return generic.ConnErrTooManyConnections
+		case pgerrcode.CannotConnectNow, pgerrcode.AdminShutdown, pgerrcode.CrashShutdown:
+			return generic.ConnErrUnreachable
+		}
+	}
+	return ""
+}
+
+// isFailover returns true if the error indicates that the connection was lost, or that the
+// server has been demoted to a read-only standby.
+func isFailover(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgerrcode.ReadOnlySQLTransaction, pgerrcode.ConnectionException, pgerrcode.ConnectionFailure:
+			return true
+		}
+	}
+	return false
+}
+
 func createDBIfNotExist(dataSourceName string) error {
 	u, err := util.ParseURL(dataSourceName)
 	if err != nil {
@@ -231,7 +422,7 @@ func createDBIfNotExist(dataSourceName string) error {
 	u.Path = "/postgres"
 	db, err := sql.Open("pgx", u.String())
 	if err != nil {
-		logrus.Warnf("failed to ensure existence of database %s: unable to connect to default postgres database: %v", dbName, err)
+		logrus.Warnf("failed to ensure existence of database %s: unable to connect to default postgres database: %v", dbName, util.RedactError(err, u.String()))
 		return nil
 	}
 	defer db.Close()
@@ -239,14 +430,14 @@ func createDBIfNotExist(dataSourceName string) error {
 	var exists bool
 	err = db.QueryRow("SELECT 1 FROM pg_database WHERE datname = $1", dbName).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
-		logrus.Warnf("failed to check existence of database %s, going to attempt create: %v", dbName, err)
+		logrus.Warnf("failed to check existence of database %s, going to attempt create: %v", dbName, util.RedactError(err, u.String()))
 	}
 
 	if !exists {
 		stmt := fmt.Sprintf(createDB, dbName)
 		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
 		if _, err = db.Exec(stmt); err != nil {
-			logrus.Warnf("failed to create database %s: %v", dbName, err)
+			logrus.Warnf("failed to create database %s: %v", dbName, util.RedactError(err, u.String()))
 		} else {
 			logrus.Tracef("created database: %s", dbName)
 		}
@@ -314,4 +505,7 @@ func prepareDSN(dataSourceName string, tlsInfo tls.Config) (string, error) {
 func init() {
 	drivers.Register("postgres", New)
 	drivers.Register("postgresql", New)
+	features := append(slices.Clone(drivers.SQLFeatures), drivers.FeaturePartitioning)
+	drivers.RegisterFeatures("postgres", features...)
+	drivers.RegisterFeatures("postgresql", features...)
 }
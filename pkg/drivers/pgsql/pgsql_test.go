@@ -0,0 +1,277 @@
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/conformance"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestConformance runs the driver conformance suite. It requires a PostgreSQL server, and is
+// skipped unless KINE_ENDPOINT is set to a postgres endpoint.
+func TestConformance(t *testing.T) {
+	scheme, dataSourceName := util.SchemeAndAddress(os.Getenv("KINE_ENDPOINT"))
+	if scheme != "postgres" && scheme != "postgresql" {
+		t.Skip("KINE_ENDPOINT is not set to a postgres endpoint")
+	}
+
+	conformance.RunSuite(t, func(t *testing.T) server.Backend {
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		t.Cleanup(func() {
+			cancel()
+			wg.Wait()
+		})
+
+		cfg := &drivers.Config{
+			DataSourceName:   dataSourceName,
+			CompactInterval:  -1,
+			CompactTimeout:   time.Second,
+			CompactBatchSize: 1000,
+			PollBatchSize:    500,
+		}
+		_, backend, err := New(ctx, wg, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	})
+}
+
+// TestPartitions checks that a partitioned kine table has partitions created ahead of the
+// current revision, and that compaction drops partitions that it has left empty. It requires a
+// PostgreSQL server, and is skipped unless KINE_ENDPOINT is set to a postgres endpoint.
+func TestPartitions(t *testing.T) {
+	scheme, dataSourceName := util.SchemeAndAddress(os.Getenv("KINE_ENDPOINT"))
+	if scheme != "postgres" && scheme != "postgresql" {
+		t.Skip("KINE_ENDPOINT is not set to a postgres endpoint")
+	}
+
+	// a separate database is used, so that the kine table is created partitioned
+	u, err := url.Parse("postgres://" + dataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Path = "/kine_partitions"
+	dataSourceName = strings.TrimPrefix(u.String(), "postgres://")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	const size = 10
+	_, backend, err := New(ctx, wg, &drivers.Config{
+		DataSourceName:   dataSourceName,
+		CompactInterval:  -1,
+		CompactTimeout:   time.Second,
+		CompactBatchSize: 1000,
+		PollBatchSize:    500,
+		PartitionSize:    size,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dsn, err := prepareDSN(dataSourceName, tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialect, err := generic.Open(ctx, wg, "pgx", dsn, generic.ConnectionPoolConfig{}, "$", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &partitioner{dialect: dialect, size: size}
+
+	// update a single key until the revision has advanced through several partitions
+	key := fmt.Sprintf("/partitions/%d", time.Now().UnixNano())
+	firstRev, err := backend.Create(ctx, key, []byte("v"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := firstRev
+	for i := 0; i < 3*size; i++ {
+		if rev, _, _, err = backend.Update(ctx, key, []byte("v"), rev, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.ensure(ctx); err != nil {
+		t.Fatal(err)
+	}
+	partitions, err := p.partitions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := rev / size; n <= rev/size+partitionsAhead; n++ {
+		if !slices.Contains(partitions, n) {
+			t.Fatalf("expected partition %d ahead of revision %d to exist, got %v", n, rev, partitions)
+		}
+	}
+
+	// the partition above the first revision only holds revisions of the key superseded by later
+	// updates, and is dropped once they are compacted
+	dropped := firstRev/size + 1
+	if !slices.Contains(partitions, dropped) {
+		t.Fatalf("expected partition %d to exist before compaction, got %v", dropped, partitions)
+	}
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if partitions, err = p.partitions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(partitions, dropped) {
+		t.Fatalf("expected partition %d to be dropped after compacting to %d, got %v", dropped, rev, partitions)
+	}
+	if !slices.Contains(partitions, rev/size) {
+		t.Fatalf("expected partition %d holding the current revision to be retained, got %v", rev/size, partitions)
+	}
+
+	// the key is still readable, and conflicting updates are still rejected
+	if _, kv, err := backend.Get(ctx, key, "", 0, 0, false); err != nil || kv == nil || kv.ModRevision != rev {
+		t.Fatalf("expected %s at revision %d, got %v, %v", key, rev, kv, err)
+	}
+	if _, _, ok, err := backend.Update(ctx, key, []byte("v"), firstRev, 0); err != nil || ok {
+		t.Fatalf("expected update at stale revision %d to fail, got ok=%v, err=%v", firstRev, ok, err)
+	}
+}
+
+// TestSetupRerun checks that setup completes when a migration creates an index that already
+// exists, as after a partially applied migration. It requires a PostgreSQL server, and is
+// skipped unless KINE_ENDPOINT is set to a postgres endpoint.
+func TestSetupRerun(t *testing.T) {
+	scheme, dataSourceName := util.SchemeAndAddress(os.Getenv("KINE_ENDPOINT"))
+	if scheme != "postgres" && scheme != "postgresql" {
+		t.Skip("KINE_ENDPOINT is not set to a postgres endpoint")
+	}
+
+	dsn, err := prepareDSN(dataSourceName, tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createDBIfNotExist(dsn); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := setup(db, schema); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := schemaMigrations
+	defer func() { schemaMigrations = migrations }()
+	schemaMigrations = append(slices.Clone(migrations), `CREATE INDEX kine_name_index ON kine (name)`)
+	t.Setenv("KINE_SCHEMA_MIGRATION", strconv.Itoa(len(schemaMigrations)))
+	for range 2 {
+		if err := setup(db, schema); err != nil {
+			t.Fatalf("expected setup to skip the existing index, got %v", err)
+		}
+	}
+}
+
+func TestIsAlreadyExists(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"duplicate table", &pgconn.PgError{Code: pgerrcode.DuplicateTable}, true},
+		{"duplicate object", &pgconn.PgError{Code: pgerrcode.DuplicateObject}, true},
+		{"concurrent create", &pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: "pg_class_relname_nsp_index"}, true},
+		{"unique violation", &pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: "kine_pkey"}, false},
+		{"undefined table", &pgconn.PgError{Code: pgerrcode.UndefinedTable}, false},
+		{"other", errors.New("unexpected EOF"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAlreadyExists(tt.err); got != tt.want {
+				t.Errorf("isAlreadyExists(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyConnErr(t *testing.T) {
+	pgErr := func(code string) error {
+		return fmt.Errorf("failed to connect to `user=kine database=kine`: %w", &pgconn.PgError{Severity: "FATAL", Code: code})
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"invalid password", pgErr(pgerrcode.InvalidPassword), generic.ConnErrAuth},
+		{"no pg_hba entry", pgErr(pgerrcode.InvalidAuthorizationSpecification), generic.ConnErrAuth},
+		{"too many clients", pgErr(pgerrcode.TooManyConnections), generic.ConnErrTooManyConnections},
+		{"starting up", pgErr(pgerrcode.CannotConnectNow), generic.ConnErrUnreachable},
+		{"admin shutdown", pgErr(pgerrcode.AdminShutdown), generic.ConnErrUnreachable},
+		{"unique violation", pgErr(pgerrcode.UniqueViolation), ""},
+		{"other", errors.New("unexpected EOF"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyConnErr(tt.err); got != tt.want {
+				t.Errorf("classifyConnErr(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConnectErrorRedacted checks that the password is masked in the error and log
+// entries from a failed connection, and from a connection string that cannot be parsed.
+func TestConnectErrorRedacted(t *testing.T) {
+	for _, dataSourceName := range []string{
+		"kine:s3cret@127.0.0.1:1/kine?sslmode=disable",
+		"kine:s3cret@127.0.0.1:bad/kine",
+	} {
+		hook := test.NewGlobal()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		wg := &sync.WaitGroup{}
+
+		_, _, err := New(ctx, wg, &drivers.Config{DataSourceName: dataSourceName})
+		cancel()
+		wg.Wait()
+		if err == nil {
+			t.Fatalf("expected connecting to %q to fail", dataSourceName)
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("expected password to be redacted from error, got %q", err)
+		}
+		for _, entry := range hook.AllEntries() {
+			if line, _ := entry.String(); strings.Contains(line, "s3cret") {
+				t.Errorf("expected password to be redacted from log, got %q", line)
+			}
+		}
+		hook.Reset()
+	}
+}
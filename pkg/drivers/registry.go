@@ -11,6 +11,7 @@ import (
 type Constructor func(ctx context.Context, wg *sync.WaitGroup, cfg *Config) (leaderElect bool, backend server.Backend, err error)
 
 var driverRegistry = map[string]Constructor{}
+var featureRegistry = map[string][]Feature{}
 var defaultScheme string
 
 // Register registers a constructor for the given scheme
@@ -18,6 +19,17 @@ func Register(scheme string, constructor Constructor) {
 	driverRegistry[scheme] = constructor
 }
 
+// RegisterFeatures records the optional features supported by the driver for the given scheme.
+// Enabling any other optional feature fails when the driver is created.
+func RegisterFeatures(scheme string, features ...Feature) {
+	featureRegistry[scheme] = features
+}
+
+// Features returns the optional features supported by the driver for the given scheme.
+func Features(scheme string) []Feature {
+	return featureRegistry[scheme]
+}
+
 // SetDefault sets the default driver scheme
 // The default driver is used when an endpoint is not specified
 func SetDefault(scheme string) {
@@ -1,5 +1,3 @@
-//go:build cgo
-
 package sqlite
 
 import (
@@ -7,8 +5,10 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
@@ -16,8 +16,8 @@ import (
 	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/util"
-	"github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
+	modernc "modernc.org/sqlite"
 )
 
 var (
@@ -40,16 +40,47 @@ var (
 		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
 		`CREATE INDEX IF NOT EXISTS kine_id_compact_rev_key_with_prev_revision_index ON kine(id, name, prev_revision) WHERE name != 'compact_rev_key' AND prev_revision != 0`,
+		`CREATE TABLE IF NOT EXISTS kine_meta
+			(
+				name TEXT PRIMARY KEY,
+				value TEXT
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_key_metadata
+			(
+				name TEXT,
+				meta_key TEXT,
+				meta_value TEXT,
+				PRIMARY KEY (name, meta_key)
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_audit
+			(
+				revision INTEGER PRIMARY KEY,
+				name TEXT,
+				operation TEXT,
+				principal TEXT,
+				created_at INTEGER
+			)`,
+	}
+	getMetaSQL     = `SELECT value FROM kine_meta WHERE name = ?`
+	setMetaSQL     = `INSERT INTO kine_meta(name, value) VALUES(?, ?)`
+	indexExistsSQL = `SELECT 1 FROM sqlite_master WHERE type = 'index' AND tbl_name = 'kine' AND name = ?`
+	// columnTypes lists the column types that may be used in place of the default
+	// types when creating the kine table.
+	columnTypes = map[string][]string{
+		"created":         {"INTEGER", "BIGINT"},
+		"deleted":         {"INTEGER", "BIGINT"},
+		"lease":           {"INTEGER", "BIGINT"},
+		"create_revision": {"INTEGER", "BIGINT"},
+		"prev_revision":   {"INTEGER", "BIGINT"},
+		"value":           {"BLOB"},
+		"old_value":       {"BLOB"},
 	}
 )
 
-func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
-	backend, _, err := NewVariant(ctx, wg, "sqlite3", cfg, false)
-	return false, backend, err
-}
-
-func NewWithLitestream(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
-	backend, _, err := NewVariant(ctx, wg, "litestream", cfg, true)
+// NewPureGo returns a backend using the pure-Go modernc.org/sqlite driver,
+// which does not require cgo.
+func NewPureGo(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
+	backend, _, err := NewVariant(ctx, wg, "sqlite", cfg, false)
 	return false, backend, err
 }
 
@@ -60,6 +91,15 @@ func NewVariant(ctx context.Context, wg *sync.WaitGroup, driverName string, cfg
 			return nil, nil, err
 		}
 		dataSourceName = "./db/state.db?_journal=WAL&cache=shared&_busy_timeout=30000&_txlock=immediate"
+		if driverName == "sqlite" {
+			dataSourceName = "./db/state.db?_pragma=journal_mode(WAL)&_pragma=busy_timeout(30000)&_txlock=immediate"
+		}
+	}
+
+	schema := slices.Clone(schema)
+	var err error
+	if schema[0], err = generic.ApplyColumnTypes(schema[0], cfg.ColumnTypes, columnTypes); err != nil {
+		return nil, nil, err
 	}
 
 	noCompactCheckpoint := strings.Contains(dataSourceName, "_kine_disable_compact_wal_checkpoint")
@@ -71,6 +111,7 @@ func NewVariant(ctx context.Context, wg *sync.WaitGroup, driverName string, cfg
 		noAutoCheckpoint = true
 	}
 
+	cfg.ConnectionPoolConfig.ClassifyConnErr = classifyConnErr
 	dialect, err := generic.Open(ctx, wg, driverName, dataSourceName, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer)
 	if err != nil {
 		return nil, nil, err
@@ -87,12 +128,14 @@ func NewVariant(ctx context.Context, wg *sync.WaitGroup, driverName string, cfg
 				WHERE
 					kp.name != 'compact_rev_key' AND
 					kp.prev_revision != 0 AND
+					kp.id > ? AND
 					kp.id <= ?
 				UNION
 				SELECT kd.id AS id
 				FROM kine AS kd
 				WHERE
 					kd.deleted != 0 AND
+					kd.id > ? AND
 					kd.id <= ?
 			)`
 	if noCompactCheckpoint {
@@ -100,8 +143,9 @@ func NewVariant(ctx context.Context, wg *sync.WaitGroup, driverName string, cfg
 	} else {
 		dialect.PostCompactSQL = `PRAGMA wal_checkpoint(FULL)`
 	}
+	dialect.AnalyzeSQL = `ANALYZE kine`
 	dialect.TranslateErr = func(err error) error {
-		if err, ok := err.(sqlite3.Error); ok && err.ExtendedCode == sqlite3.ErrConstraintUnique {
+		if code, ok := extendedCode(err); ok && code == errConstraintUnique {
 			return server.ErrKeyExists
 		}
 		return err
@@ -110,24 +154,77 @@ func NewVariant(ctx context.Context, wg *sync.WaitGroup, driverName string, cfg
 		if err == nil {
 			return ""
 		}
-		if err, ok := err.(sqlite3.Error); ok {
-			return fmt.Sprint(err.ExtendedCode)
+		if code, ok := extendedCode(err); ok {
+			return fmt.Sprint(code)
 		}
 		return err.Error()
 	}
 
-	if err := setup(dialect.DB, noCompactCheckpoint, noAutoCheckpoint); err != nil {
-		return nil, nil, fmt.Errorf("setup db: %w", err)
-	}
+	if cfg.DisableSchemaMigrations {
+		// only the non-DDL statements run by setup are applied
+		if err := setup(dialect.DB, nil, noCompactCheckpoint, noAutoCheckpoint); err != nil {
+			return nil, nil, fmt.Errorf("setup db: %w", err)
+		}
+		if err := generic.ValidateSchema(ctx, dialect.DB, schema, indexExistsSQL, getMetaSQL); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, schema, noCompactCheckpoint, noAutoCheckpoint); err != nil {
+			return nil, nil, fmt.Errorf("setup db: %w", err)
+		}
+		if err := generic.VerifyIndexes(ctx, dialect.DB, schema, indexExistsSQL, cfg.RebuildMissingIndexes); err != nil {
+			return nil, nil, fmt.Errorf("verify indexes: %w", err)
+		}
 
-	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), dialect, nil
+		if err := generic.CheckSchemaVersion(ctx, dialect.DB, getMetaSQL, setMetaSQL); err != nil {
+			return nil, nil, err
+		}
+		dialect.Migrate(context.Background())
+	}
+	dialect.SetConnBackoff(cfg.ConnectionBackoff)
+	dialect.SetAcquireTracing(cfg.AcquireTracing)
+	dialect.SetRevisionBlockSize(cfg.RevisionBlockSize)
+	dialect.SetCompactExclude(cfg.CompactExclude)
+	if err := dialect.SetAuditLog(cfg.AuditLog); err != nil {
+		return nil, nil, err
+	}
+	if err := dialect.SetRevisionFloor(ctx, cfg.RevisionFloor); err != nil {
+		return nil, nil, err
+	}
+	if err := dialect.SetRevisionMark(ctx, wg, cfg.RevisionMarkInterval); err != nil {
+		return nil, nil, err
+	}
+	if cfg.ValidateStatements {
+		if err := dialect.ValidateStatements(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cfg.CompactDataSourceName != "" {
+		if err := dialect.OpenCompact(ctx, wg, driverName, cfg.CompactDataSourceName, cfg.MetricsRegisterer); err != nil {
+			return nil, nil, err
+		}
+	}
+	log := sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)
+	log.SetExternalValues(cfg.ExternalValues)
+	log.SetCompactBurstThreshold(cfg.CompactBurstThreshold)
+	log.SetCompactExclude(cfg.CompactExclude)
+	log.SetWatchHistorySize(cfg.WatchHistorySize)
+	log.SetWatchPrefetch(cfg.WatchPrefetch)
+	log.SetWatchSharedDelivery(cfg.WatchSharedDelivery)
+	log.SetWatchHistoryWindow(cfg.WatchHistoryWindow)
+	log.SetQueryTimeouts(cfg.ReadTimeout, cfg.WriteTimeout)
+	log.SetCompactVerify(cfg.CompactVerify)
+	log.SetCompactAnalyze(cfg.CompactAnalyzeThreshold, cfg.CompactAnalyzeInterval)
+	log.SetCompactMinInterval(cfg.CompactMinInterval, cfg.CompactManualBypass)
+	backend := logstructured.New(log)
+	backend.SetElideNoopUpdates(cfg.ElideNoopUpdates)
+	return backend, dialect, nil
 }
 
-func setup(db *sql.DB, noCheckpointing, noAutoCheckpoint bool) error {
+func setup(db *sql.DB, schema []string, noCheckpointing, noAutoCheckpoint bool) error {
 	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
 
-	schema := append([]string{}, schema...)
+	schema = append([]string{}, schema...)
 	if !noCheckpointing {
 		schema = append(schema, `PRAGMA wal_checkpoint(TRUNCATE)`)
 	}
@@ -138,8 +235,7 @@ func setup(db *sql.DB, noCheckpointing, noAutoCheckpoint bool) error {
 
 	for _, stmt := range schema {
 		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-		_, err := db.Exec(stmt)
-		if err != nil {
+		if err := execSetup(db, stmt); err != nil {
 			return err
 		}
 	}
@@ -148,14 +244,70 @@ func setup(db *sql.DB, noCheckpointing, noAutoCheckpoint bool) error {
 	return nil
 }
 
+const (
+	setupBusyRetries    = 10
+	setupBusyRetryDelay = 100 * time.Millisecond
+)
+
+// execSetup executes a setup statement, retrying if the database is busy. When
+// multiple processes set up the same database at once, SQLite may report that the
+// database is busy without waiting for the busy timeout, for example when a
+// statement's read transaction cannot be upgraded to a write transaction.
+func execSetup(db *sql.DB, stmt string) error {
+	var err error
+	for i := 0; i < setupBusyRetries; i++ {
+		if _, err = db.Exec(stmt); err == nil || !isBusy(err) {
+			return err
+		}
+		time.Sleep(setupBusyRetryDelay)
+	}
+	return err
+}
+
+// errBusy is SQLITE_BUSY, the primary result code for busy errors.
+const errBusy = 5
+
+func isBusy(err error) bool {
+	code, ok := extendedCode(err)
+	return ok && code&0xff == errBusy
+}
+
+// SQLITE_CANTOPEN and SQLITE_AUTH primary result codes.
+const (
+	errCantOpen = 14
+	errAuth     = 23
+)
+
+// classifyConnErr maps sqlite errors opening the database to a generic
+// connection error class.
+func classifyConnErr(err error) string {
+	code, ok := extendedCode(err)
+	if !ok {
+		return ""
+	}
+	switch code & 0xff {
+	case errCantOpen:
+		return generic.ConnErrUnreachable
+	case errAuth:
+		return generic.ConnErrAuth
+	}
+	return ""
+}
+
+// errConstraintUnique is SQLITE_CONSTRAINT_UNIQUE, which both drivers
+// report as the extended result code for unique index violations.
+const errConstraintUnique = 2067
+
+// extendedCode returns the SQLite extended result code carried by an error
+// from either the cgo or the pure-Go driver.
+func extendedCode(err error) (int, bool) {
+	if err, ok := err.(*modernc.Error); ok {
+		return err.Code(), true
+	}
+	return cgoExtendedCode(err)
+}
+
 func init() {
-	sql.Register("litestream", &sqlite3.SQLiteDriver{
-		ConnectHook: func(conn *sqlite3.SQLiteConn) (err error) {
-			return conn.SetFileControlInt("main", sqlite3.SQLITE_FCNTL_PERSIST_WAL, 1)
-		},
-	})
-
-	drivers.Register("sqlite", New)
-	drivers.Register("litestream", NewWithLitestream)
-	drivers.SetDefault("sqlite")
+	drivers.Register("sqlite-nocgo", NewPureGo)
+	drivers.RegisterFeatures("sqlite-nocgo", drivers.SQLFeatures...)
 }
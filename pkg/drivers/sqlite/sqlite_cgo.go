@@ -0,0 +1,44 @@
+//go:build cgo
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/mattn/go-sqlite3"
+)
+
+func New(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
+	backend, _, err := NewVariant(ctx, wg, "sqlite3", cfg, false)
+	return false, backend, err
+}
+
+func NewWithLitestream(ctx context.Context, wg *sync.WaitGroup, cfg *drivers.Config) (bool, server.Backend, error) {
+	backend, _, err := NewVariant(ctx, wg, "litestream", cfg, true)
+	return false, backend, err
+}
+
+func cgoExtendedCode(err error) (int, bool) {
+	if err, ok := err.(sqlite3.Error); ok {
+		return int(err.ExtendedCode), true
+	}
+	return 0, false
+}
+
+func init() {
+	sql.Register("litestream", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) (err error) {
+			return conn.SetFileControlInt("main", sqlite3.SQLITE_FCNTL_PERSIST_WAL, 1)
+		},
+	})
+
+	drivers.Register("sqlite", New)
+	drivers.Register("litestream", NewWithLitestream)
+	drivers.RegisterFeatures("sqlite", drivers.SQLFeatures...)
+	drivers.RegisterFeatures("litestream", drivers.SQLFeatures...)
+	drivers.SetDefault("sqlite")
+}
@@ -0,0 +1,7 @@
+//go:build cgo
+
+package sqlite
+
+func init() {
+	testDrivers = append(testDrivers, "sqlite3")
+}
@@ -3,31 +3,16 @@
 package sqlite
 
 import (
-	"context"
-	"database/sql"
-	"errors"
-	"sync"
-
 	"github.com/k3s-io/kine/pkg/drivers"
-	"github.com/k3s-io/kine/pkg/drivers/generic"
-	"github.com/k3s-io/kine/pkg/server"
 )
 
-var errNoCgo = errors.New("this binary is built without CGO, sqlite is disabled")
-
-func New(_ context.Context, _ *sync.WaitGroup, _ *drivers.Config) (bool, server.Backend, error) {
-	return false, nil, errNoCgo
-}
-
-func NewVariant(_ context.Context, _ *sync.WaitGroup, _ string, cfg *drivers.Config) (server.Backend, *generic.Generic, error) {
-	return nil, nil, errNoCgo
-}
-
-func setup(db *sql.DB) error {
-	return errNoCgo
+func cgoExtendedCode(err error) (int, bool) {
+	return 0, false
 }
 
 func init() {
-	drivers.Register("sqlite", New)
+	// Without cgo, the sqlite driver falls back to the pure-Go implementation.
+	drivers.Register("sqlite", NewPureGo)
+	drivers.RegisterFeatures("sqlite", drivers.SQLFeatures...)
 	drivers.SetDefault("sqlite")
 }
@@ -0,0 +1,1511 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/conformance"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/k3s-io/kine/pkg/valuestore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// testDrivers lists the database/sql drivers the tests are run against.
+// The cgo driver is added when it is available.
+var testDrivers = []string{"sqlite"}
+
+// forEachDriver runs f as a subtest for each test driver.
+func forEachDriver(t *testing.T, f func(t *testing.T, driverName string)) {
+	for _, driverName := range testDrivers {
+		t.Run(driverName, func(t *testing.T) {
+			f(t, driverName)
+		})
+	}
+}
+
+func testDataSourceName(t testing.TB, driverName string) string {
+	dataSourceName := filepath.Join(t.TempDir(), "state.db")
+	if driverName == "sqlite" {
+		return dataSourceName + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(30000)&_txlock=immediate"
+	}
+	return dataSourceName + "?_journal=WAL&cache=shared&_busy_timeout=30000&_txlock=immediate"
+}
+
+func TestConcurrentSetup(t *testing.T) {
+	forEachDriver(t, testConcurrentSetup)
+}
+
+func testConcurrentSetup(t *testing.T, driverName string) {
+	dataSourceName := testDataSourceName(t, driverName)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		db, err := sql.Open(driverName, dataSourceName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = setup(db, schema, true, false)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("setup %d failed: %v", i, err)
+		}
+	}
+
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'kine'`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 1 {
+		t.Fatalf("expected 1 kine table, got %d", tables)
+	}
+}
+
+func TestVerifyIndexesRebuildsMissing(t *testing.T) {
+	forEachDriver(t, testVerifyIndexesRebuildsMissing)
+}
+
+func testVerifyIndexesRebuildsMissing(t *testing.T, driverName string) {
+	db, err := sql.Open(driverName, filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := setup(db, schema, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DROP INDEX kine_name_id_index`); err != nil {
+		t.Fatal(err)
+	}
+
+	indexExists := func() bool {
+		var exists int
+		err := db.QueryRow(indexExistsSQL, "kine_name_id_index").Scan(&exists)
+		if err != nil && err != sql.ErrNoRows {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	if err := generic.VerifyIndexes(context.Background(), db, schema, indexExistsSQL, false); err != nil {
+		t.Fatal(err)
+	}
+	if indexExists() {
+		t.Fatal("expected index to remain missing when rebuild is disabled")
+	}
+
+	if err := generic.VerifyIndexes(context.Background(), db, schema, indexExistsSQL, true); err != nil {
+		t.Fatal(err)
+	}
+	if !indexExists() {
+		t.Fatal("expected missing index to be recreated")
+	}
+}
+
+func newTestBackend(t *testing.T, driverName string) server.Backend {
+	return newTestBackendWithConfig(t, driverName, &drivers.Config{})
+}
+
+func newTestBackendWithConfig(t testing.TB, driverName string, cfg *drivers.Config) server.Backend {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	if cfg.DataSourceName == "" {
+		cfg.DataSourceName = testDataSourceName(t, driverName)
+	}
+	if cfg.CompactInterval == 0 {
+		cfg.CompactInterval = time.Hour
+	}
+	cfg.CompactTimeout = time.Second
+	cfg.CompactBatchSize = 1000
+	cfg.PollBatchSize = 500
+
+	backend, _, err := NewVariant(ctx, wg, driverName, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestConformance(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driverName string) {
+		conformance.RunSuite(t, func(t *testing.T) server.Backend {
+			return newTestBackendWithConfig(t, driverName, &drivers.Config{CompactInterval: -1})
+		})
+	})
+}
+
+func TestRevisionFloor(t *testing.T) {
+	forEachDriver(t, testRevisionFloor)
+}
+
+func testRevisionFloor(t *testing.T, driverName string) {
+	ctx := context.Background()
+	backend := newTestBackendWithConfig(t, driverName, &drivers.Config{RevisionFloor: 1000})
+
+	rev, err := backend.Create(ctx, "/a", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev <= 1000 {
+		t.Fatalf("expected revision after floor 1000, got %d", rev)
+	}
+}
+
+func TestRevisionMark(t *testing.T) {
+	forEachDriver(t, testRevisionMark)
+}
+
+func testRevisionMark(t *testing.T, driverName string) {
+	ctx := context.Background()
+	dataSourceName := testDataSourceName(t, driverName)
+	start := func() (server.Backend, *generic.Generic, func()) {
+		ctx, cancel := context.WithCancel(ctx)
+		wg := &sync.WaitGroup{}
+		stop := func() {
+			cancel()
+			wg.Wait()
+		}
+		cfg := &drivers.Config{
+			DataSourceName:       dataSourceName,
+			CompactInterval:      time.Hour,
+			CompactTimeout:       time.Second,
+			CompactBatchSize:     1000,
+			PollBatchSize:        500,
+			RevisionMarkInterval: time.Hour,
+		}
+		backend, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.Start(ctx); err != nil {
+			stop()
+			t.Fatal(err)
+		}
+		return backend, dialect, stop
+	}
+
+	backend, _, stop := start()
+	var rev int64
+	for _, key := range []string{"/a", "/b", "/c"} {
+		var err error
+		if rev, err = backend.Create(ctx, key, []byte(key), 0); err != nil {
+			stop()
+			t.Fatal(err)
+		}
+	}
+	stop()
+
+	// the revision is recorded at startup; simulate the kine table being rebuilt afterwards
+	_, dialect, stop := start()
+	if _, err := dialect.DB.ExecContext(ctx, "DROP TABLE kine"); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	stop()
+
+	backend, _, stop = start()
+	defer stop()
+	newRev, err := backend.Create(ctx, "/d", []byte("d"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newRev <= rev {
+		t.Fatalf("expected revision after recorded revision %d, got %d", rev, newRev)
+	}
+}
+
+func TestRevisionMarkFailure(t *testing.T) {
+	forEachDriver(t, testRevisionMarkFailure)
+}
+
+func testRevisionMarkFailure(t *testing.T, driverName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	cfg := &drivers.Config{}
+	newTestBackendWithConfig(t, driverName, cfg)
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TRIGGER reject_revision_mark BEFORE INSERT ON kine_meta WHEN NEW.name = 'revision_mark'
+		BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	// if the revision can never be recorded, startup fails instead of retrying forever
+	cfg.RevisionMarkInterval = time.Hour
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := NewVariant(ctx, wg, driverName, cfg, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected startup to fail when the revision mark cannot be recorded")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for startup to fail")
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	forEachDriver(t, testStorageStats)
+}
+
+func testStorageStats(t *testing.T, driverName string) {
+	ctx := context.Background()
+	backend := newTestBackend(t, driverName)
+
+	rev, err := backend.Create(ctx, "/a", []byte("aaaa"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := backend.Update(ctx, "/a", []byte("aaaaaa"), rev, 0); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err = backend.Create(ctx, "/b", []byte("bb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := backend.Delete(ctx, "/b", rev); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := backend.(server.StatsReporter).StorageStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the backend creates /registry/health with a 17 byte value on startup
+	expected := server.StorageStats{
+		Rows:              5,
+		LiveRows:          4,
+		DeletedRows:       1,
+		Keys:              3,
+		ValueBytes:        29,
+		AverageValueBytes: 29.0 / 4,
+		RevisionsPerKey:   5.0 / 3,
+	}
+	if *stats != expected {
+		t.Fatalf("expected stats %+v, got %+v", expected, *stats)
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	forEachDriver(t, testEmptyValue)
+}
+
+func testEmptyValue(t *testing.T, driverName string) {
+	ctx := context.Background()
+	cfg := &drivers.Config{}
+	backend := newTestBackendWithConfig(t, driverName, cfg)
+
+	rev, err := backend.Create(ctx, "/a", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _, _, err = backend.Update(ctx, "/a", []byte("a"), rev, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := backend.Update(ctx, "/a", nil, rev, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the conformance suite checks that empty values are read back; check how they are stored
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var nulls int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM kine WHERE name = '/a' AND value IS NULL`).Scan(&nulls); err != nil {
+		t.Fatal(err)
+	}
+	if nulls != 0 {
+		t.Fatalf("expected empty values to be stored as empty blobs, found %d NULL values", nulls)
+	}
+}
+
+func TestReservedKey(t *testing.T) {
+	forEachDriver(t, testReservedKey)
+}
+
+func testReservedKey(t *testing.T, driverName string) {
+	ctx := context.Background()
+	cfg := &drivers.Config{}
+	backend := newTestBackendWithConfig(t, driverName, cfg)
+	kv := server.New(backend, "", 0, "")
+
+	// puts are redirected to a substitute key, and do not touch the internal compaction state
+	if _, err := kv.Put(ctx, &etcdserverpb.PutRequest{Key: []byte("compact_rev_key"), Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Create(ctx, "/a", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	compactRev, err := backend.(server.Compactor).CompactTo(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var rows int
+	var prevRevision int64
+	if err := db.QueryRow(`SELECT COUNT(*), MAX(prev_revision) FROM kine WHERE name = 'compact_rev_key'`).Scan(&rows, &prevRevision); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 || prevRevision != compactRev {
+		t.Fatalf("expected a single compact_rev_key row at compact revision %d, got %d rows at revision %d", compactRev, rows, prevRevision)
+	}
+}
+
+func TestCompactConnection(t *testing.T) {
+	forEachDriver(t, testCompactConnection)
+}
+
+func testCompactConnection(t *testing.T, driverName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	dataSourceName := testDataSourceName(t, driverName)
+	cfg := &drivers.Config{
+		DataSourceName:        dataSourceName,
+		CompactDataSourceName: dataSourceName,
+		// disable automatic compaction, so that compact requests are performed immediately
+		CompactInterval:  -1,
+		CompactTimeout:   time.Second,
+		CompactBatchSize: 1000,
+		PollBatchSize:    500,
+	}
+	backend, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if dialect.CompactDB == nil || dialect.CompactDB == dialect.DB {
+		t.Fatal("expected separate compact connection")
+	}
+
+	rev, err := backend.Create(ctx, "/a", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func() {
+		t.Helper()
+		if rev, _, _, err = backend.Update(ctx, "/a", []byte("a"), rev, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compactRevision := func() int64 {
+		t.Helper()
+		compactRev, err := dialect.GetCompactRevision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return compactRev
+	}
+
+	update()
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if compactRev := compactRevision(); compactRev != rev {
+		t.Fatalf("expected compaction to revision %d, got %d", rev, compactRev)
+	}
+
+	// with the compact connection closed, compaction fails while other requests succeed
+	dialect.CompactDB.Close()
+	compactedRev := rev
+	update()
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if compactRev := compactRevision(); compactRev != compactedRev {
+		t.Fatalf("expected compaction to fail on closed compact connection, compacted to %d", compactRev)
+	}
+}
+
+func TestSchemaVersionMismatch(t *testing.T) {
+	forEachDriver(t, testSchemaVersionMismatch)
+}
+
+func testSchemaVersionMismatch(t *testing.T, driverName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	cfg := &drivers.Config{DataSourceName: testDataSourceName(t, driverName)}
+	_, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version string
+	if err := dialect.DB.QueryRow(getMetaSQL, "schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != fmt.Sprint(generic.SchemaVersion) {
+		t.Fatalf("expected schema version %d to be recorded, got %s", generic.SchemaVersion, version)
+	}
+
+	if _, _, err := NewVariant(ctx, wg, driverName, cfg, false); err != nil {
+		t.Fatalf("expected matching schema version to be accepted, got %v", err)
+	}
+
+	if _, err := dialect.DB.Exec(`UPDATE kine_meta SET value = '999' WHERE name = 'schema_version'`); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = NewVariant(ctx, wg, driverName, cfg, false)
+	if !errors.Is(err, generic.ErrSchemaVersionMismatch) {
+		t.Fatalf("expected schema version mismatch error, got %v", err)
+	}
+}
+
+func TestDisableSchemaMigrations(t *testing.T) {
+	forEachDriver(t, testDisableSchemaMigrations)
+}
+
+func testDisableSchemaMigrations(t *testing.T, driverName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	dataSourceName := testDataSourceName(t, driverName)
+	cfg := &drivers.Config{DataSourceName: dataSourceName, DisableSchemaMigrations: true}
+	_, _, err := NewVariant(ctx, wg, driverName, cfg, false)
+	if !errors.Is(err, generic.ErrSchemaNotReady) {
+		t.Fatalf("expected schema not ready error for empty database, got %v", err)
+	}
+
+	// create the schema, then remove an index so that the schema is out of date
+	_, dialect, err := NewVariant(ctx, wg, driverName, &drivers.Config{DataSourceName: dataSourceName}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewVariant(ctx, wg, driverName, cfg, false); err != nil {
+		t.Fatalf("expected current schema to be accepted, got %v", err)
+	}
+	if _, err := dialect.DB.Exec(`DROP INDEX kine_name_index`); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = NewVariant(ctx, wg, driverName, cfg, false)
+	if !errors.Is(err, generic.ErrSchemaNotReady) {
+		t.Fatalf("expected schema not ready error for missing index, got %v", err)
+	}
+	var count int
+	if err := dialect.DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'kine_name_index'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("expected missing index not to be recreated with schema migrations disabled")
+	}
+}
+
+func TestDriverConfig(t *testing.T) {
+	forEachDriver(t, testDriverConfig)
+}
+
+func testDriverConfig(t *testing.T, driverName string) {
+	backend := newTestBackendWithConfig(t, driverName, &drivers.Config{
+		ConnectionPoolConfig: generic.ConnectionPoolConfig{
+			MaxOpen:           8,
+			MaxLifetime:       time.Minute,
+			StatementAffinity: 2,
+		},
+	})
+
+	config := backend.(server.ConfigReporter).DriverConfig()
+	// connection limits are divided across the statement affinity pools, and the
+	// default idle limit is applied to each pool
+	expected := []server.PoolConfig{
+		{Name: "kine", MaxOpen: 4, MaxIdle: 2, MaxLifetime: "1m0s"},
+		{Name: "kine-affinity-1", MaxOpen: 4, MaxIdle: 2, MaxLifetime: "1m0s"},
+	}
+	if !reflect.DeepEqual(config.Pools, expected) {
+		t.Fatalf("expected pools %+v, got %+v", expected, config.Pools)
+	}
+	if config.Driver != driverName || !config.LastInsertID || config.TxIsolation != "Serializable" || config.CompactTimeout != "1s" {
+		t.Fatalf("unexpected driver config %+v", config)
+	}
+}
+
+func TestRevisionBlocks(t *testing.T) {
+	forEachDriver(t, testRevisionBlocks)
+}
+
+func testRevisionBlocks(t *testing.T, driverName string) {
+	ctx := context.Background()
+	// two servers sharing a datastore each reserve their own blocks of revisions
+	cfg := &drivers.Config{RevisionBlockSize: 10}
+	backends := []server.Backend{newTestBackendWithConfig(t, driverName, cfg)}
+	backends = append(backends, newTestBackendWithConfig(t, driverName, &drivers.Config{
+		DataSourceName:    cfg.DataSourceName,
+		RevisionBlockSize: 10,
+	}))
+
+	const writers, writes = 4, 25
+	var wg sync.WaitGroup
+	revs := make([][]int64, writers)
+	errs := make([]error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range writes {
+				// each write alternates between servers, and must be assigned a higher
+				// revision than the write that completed before it
+				rev, err := backends[j%2].Create(ctx, fmt.Sprintf("/blocks/%d/%d", i, j), []byte("v"), 0)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				revs[i] = append(revs[i], rev)
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := map[int64]bool{}
+	for i := range writers {
+		if errs[i] != nil {
+			t.Fatalf("writer %d failed: %v", i, errs[i])
+		}
+		for j, rev := range revs[i] {
+			if j > 0 && rev <= revs[i][j-1] {
+				t.Fatalf("writer %d was assigned revision %d after revision %d", i, rev, revs[i][j-1])
+			}
+			if seen[rev] {
+				t.Fatalf("revision %d was assigned more than once", rev)
+			}
+			seen[rev] = true
+		}
+	}
+
+	_, kvs, err := backends[0].List(ctx, "/blocks/", "", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != writers*writes {
+		t.Fatalf("expected %d keys, got %d", writers*writes, len(kvs))
+	}
+
+	// rows inserted together by a rename are also assigned revisions from a reserved block
+	rev, _, renamed, err := backends[1].(server.Renamer).Rename(ctx, "/blocks/0/0", "/blocks/renamed", 0)
+	if err != nil || !renamed {
+		t.Fatalf("failed to rename key: renamed=%v err=%v", renamed, err)
+	}
+	if seen[rev-1] || seen[rev] {
+		t.Fatalf("rename was assigned revisions %d and %d, which were already in use", rev-1, rev)
+	}
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var reserved int64
+	if err := db.QueryRow(`SELECT value FROM kine_meta WHERE name = 'revision_block'`).Scan(&reserved); err != nil {
+		t.Fatal(err)
+	}
+	if rev > reserved {
+		t.Fatalf("rename was assigned revision %d above the highest reserved revision %d", rev, reserved)
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+	for _, blockSize := range []int64{0, 100} {
+		b.Run(fmt.Sprintf("revision-block-size=%d", blockSize), func(b *testing.B) {
+			ctx := context.Background()
+			backend := newTestBackendWithConfig(b, "sqlite", &drivers.Config{RevisionBlockSize: blockSize})
+
+			var n atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := backend.Create(ctx, fmt.Sprintf("/bench/%d", n.Add(1)), []byte("v"), 0); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCompactBatch compares a compaction batch that scans only the rows written since the
+// last compaction (keyset) with one that scans every row from the start of the table (full), on
+// a table holding many keys that are not compacted.
+func BenchmarkCompactBatch(b *testing.B) {
+	const (
+		keys    = 100000
+		updates = 1000
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	b.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	_, dialect, err := NewVariant(ctx, wg, "sqlite", &drivers.Config{DataSourceName: testDataSourceName(b, "sqlite")}, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// each key is created once, and the batch to be compacted updates the first keys
+	var start int64
+	if err := dialect.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM kine`).Scan(&start); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := dialect.DB.ExecContext(ctx, `
+		INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+		SELECT ? + i, '/bench/' || i, 1, 0, 0, 0, 0, x'76', x'' FROM seq`, keys, start); err != nil {
+		b.Fatal(err)
+	}
+	compactRev := start + keys
+	if _, err := dialect.DB.ExecContext(ctx, `
+		INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+		SELECT ? + i, '/bench/' || i, 0, 0, ? + i, ? + i, 0, x'76', x'76' FROM seq`, updates, compactRev, start, start); err != nil {
+		b.Fatal(err)
+	}
+
+	for name, from := range map[string]int64{"keyset": compactRev, "full": 0} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tx, err := dialect.BeginTx(ctx, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				deleted, err := tx.Compact(ctx, from, compactRev+updates)
+				tx.MustRollback()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if deleted != updates {
+					b.Fatalf("expected %d rows to be deleted, got %d", updates, deleted)
+				}
+			}
+		})
+	}
+}
+
+// memoryStore is an in-memory external value store.
+type memoryStore struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memoryStore) Put(ctx context.Context, name string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.objects[name] = data
+	return nil
+}
+
+func (m *memoryStore) Get(ctx context.Context, name string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	data, ok := m.objects[name]
+	if !ok {
+		return nil, valuestore.ErrNotFound
+	}
+	return data, nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, name string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.objects[name]; !ok {
+		return valuestore.ErrNotFound
+	}
+	delete(m.objects, name)
+	return nil
+}
+
+func (m *memoryStore) len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.objects)
+}
+
+func TestExternalValues(t *testing.T) {
+	forEachDriver(t, testExternalValues)
+}
+
+func testExternalValues(t *testing.T, driverName string) {
+	ctx := context.Background()
+	store := &memoryStore{objects: map[string][]byte{}}
+	cfg := &drivers.Config{
+		DataSourceName: testDataSourceName(t, driverName),
+		// disable automatic compaction, so that compact requests are performed immediately
+		CompactInterval: -1,
+		ExternalValues:  valuestore.NewWithStore(store, "kine", 32),
+	}
+	backend := newTestBackendWithConfig(t, driverName, cfg)
+
+	large := []byte(strings.Repeat("large", 10))
+	rev, err := backend.Create(ctx, "/ext/large", large, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Create(ctx, "/ext/small", []byte("small"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.len(); n != 1 {
+		t.Fatalf("expected 1 external value, got %d", n)
+	}
+
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var stored []byte
+	if err := db.QueryRow(`SELECT value FROM kine WHERE name = '/ext/large'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := valuestore.IsPointer(stored); !ok {
+		t.Fatalf("expected pointer to be stored for large value, got %q", stored)
+	}
+
+	_, kv, err := backend.Get(ctx, "/ext/large", "", 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || !bytes.Equal(kv.Value, large) {
+		t.Fatalf("expected large value from get, got %#v", kv)
+	}
+	_, kvs, err := backend.List(ctx, "/ext/", "", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || !bytes.Equal(kvs[0].Value, large) || string(kvs[1].Value) != "small" {
+		t.Fatalf("expected large and small values from list, got %#v", kvs)
+	}
+
+	updated := []byte(strings.Repeat("updated", 10))
+	rev, _, ok, err := backend.Update(ctx, "/ext/large", updated, rev, 0)
+	if err != nil || !ok {
+		t.Fatalf("failed to update key: %v", err)
+	}
+	_, kv, err = backend.Get(ctx, "/ext/large", "", 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || !bytes.Equal(kv.Value, updated) {
+		t.Fatalf("expected updated value from get, got %#v", kv)
+	}
+	objects := store.len()
+	if _, _, ok, err := backend.Delete(ctx, "/ext/large", rev); err != nil || !ok {
+		t.Fatalf("failed to delete key: %v", err)
+	}
+	// the tombstone references the value already stored for the deleted row
+	if n := store.len(); n != objects {
+		t.Fatalf("expected delete to reuse the stored value, got %d external values instead of %d", n, objects)
+	}
+	var updatedPointer, deletedPointer []byte
+	if err := db.QueryRow(`SELECT value FROM kine WHERE id = ?`, rev).Scan(&updatedPointer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT value FROM kine WHERE name = '/ext/large' AND deleted = 1`).Scan(&deletedPointer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(updatedPointer, deletedPointer) {
+		t.Fatalf("expected tombstone to reference %q, got %q", updatedPointer, deletedPointer)
+	}
+
+	rev, err = backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.len(); n != 0 {
+		t.Fatalf("expected external values to be deleted by compaction, got %d", n)
+	}
+}
+
+// failoverDriver wraps a database driver, failing an insert into the kine table after it has
+// been applied when armed, as if the connection had been lost to a database failover before
+// the result was received.
+type failoverDriver struct {
+	driver.Driver
+	armed atomic.Bool
+}
+
+var failoverDrivers sync.Map
+
+// registerFailoverDriver registers a failover driver wrapping the named driver, and returns
+// the name it is registered as.
+func registerFailoverDriver(t *testing.T, driverName string) (string, *failoverDriver) {
+	name := driverName + "-failover"
+	if d, ok := failoverDrivers.Load(name); ok {
+		return name, d.(*failoverDriver)
+	}
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d := &failoverDriver{Driver: db.Driver()}
+	failoverDrivers.Store(name, d)
+	sql.Register(name, d)
+	return name, d
+}
+
+func (d *failoverDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failoverConn{Conn: conn, d: d}, nil
+}
+
+type failoverConn struct {
+	driver.Conn
+	d *failoverDriver
+}
+
+func (c *failoverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err == nil && strings.HasPrefix(strings.TrimSpace(query), "INSERT INTO kine(") && c.d.armed.CompareAndSwap(true, false) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return result, err
+}
+
+func (c *failoverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *failoverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func TestInsertFailover(t *testing.T) {
+	forEachDriver(t, testInsertFailover)
+}
+
+func testInsertFailover(t *testing.T, driverName string) {
+	ctx := context.Background()
+	failoverName, failover := registerFailoverDriver(t, driverName)
+	cfg := &drivers.Config{DataSourceName: testDataSourceName(t, driverName)}
+	backend := newTestBackendWithConfig(t, failoverName, cfg)
+
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows := func() int {
+		t.Helper()
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM kine WHERE name = '/failover'`).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	failover.armed.Store(true)
+	rev, err := backend.Create(ctx, "/failover", []byte("v1"), 0)
+	if err != nil {
+		t.Fatalf("expected create to succeed after failover, got %v", err)
+	}
+	if failover.armed.Load() {
+		t.Fatal("expected failover to be simulated on create")
+	}
+	if n := rows(); n != 1 {
+		t.Fatalf("expected 1 row after create, got %d", n)
+	}
+
+	failover.armed.Store(true)
+	rev, _, ok, err := backend.Update(ctx, "/failover", []byte("v2"), rev, 0)
+	if err != nil || !ok {
+		t.Fatalf("expected update to succeed after failover, got %v", err)
+	}
+	if n := rows(); n != 2 {
+		t.Fatalf("expected 2 rows after update, got %d", n)
+	}
+
+	_, kv, err := backend.Get(ctx, "/failover", "", 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || kv.ModRevision != rev || string(kv.Value) != "v2" {
+		t.Fatalf("expected updated key at revision %d, got %#v", rev, kv)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachDriver(t, testAuditLog)
+}
+
+func testAuditLog(t *testing.T, driverName string) {
+	ctx := util.WithPrincipal(context.Background(), "system:admin")
+	cfg := &drivers.Config{DataSourceName: testDataSourceName(t, driverName), AuditLog: true}
+	backend := newTestBackendWithConfig(t, driverName, cfg)
+
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	auditRecord := func(revision int64) (string, string, string) {
+		t.Helper()
+		var name, operation, principal string
+		if err := db.QueryRow(`SELECT name, operation, principal FROM kine_audit WHERE revision = ?`, revision).Scan(&name, &operation, &principal); err != nil {
+			t.Fatalf("failed to read audit record for revision %d: %v", revision, err)
+		}
+		return name, operation, principal
+	}
+
+	rev, err := backend.Create(ctx, "/audited", []byte("v1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, operation, principal := auditRecord(rev); name != "/audited" || operation != generic.AuditCreate || principal != "system:admin" {
+		t.Fatalf("unexpected audit record for create: %s %s %s", name, operation, principal)
+	}
+	rev, _, ok, err := backend.Update(ctx, "/audited", []byte("v2"), rev, 0)
+	if err != nil || !ok {
+		t.Fatalf("failed to update key: %v", err)
+	}
+	if name, operation, principal := auditRecord(rev); name != "/audited" || operation != generic.AuditUpdate || principal != "system:admin" {
+		t.Fatalf("unexpected audit record for update: %s %s %s", name, operation, principal)
+	}
+
+	// a write whose audit record cannot be inserted is not applied
+	if _, err := db.Exec(`INSERT INTO kine_audit(revision, name, operation, principal, created_at) VALUES(?, 'conflict', 'update', '', 0)`, rev+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := backend.Update(ctx, "/audited", []byte("v3"), rev, 0); err == nil && ok {
+		t.Fatal("expected update to fail when its audit record cannot be inserted")
+	}
+	_, kv, err := backend.Get(ctx, "/audited", "", 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || kv.ModRevision != rev || string(kv.Value) != "v2" {
+		t.Fatalf("expected key to be unchanged at revision %d, got %#v", rev, kv)
+	}
+}
+
+func TestRenameFailure(t *testing.T) {
+	forEachDriver(t, testRenameFailure)
+}
+
+func testRenameFailure(t *testing.T, driverName string) {
+	ctx := context.Background()
+	cfg := &drivers.Config{DataSourceName: testDataSourceName(t, driverName), AuditLog: true}
+	backend := newTestBackendWithConfig(t, driverName, cfg)
+	renamer := backend.(server.Renamer)
+
+	if _, err := backend.Create(ctx, "/a", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := backend.Create(ctx, "/c", []byte("c"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rename whose create cannot be inserted does not delete the key
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`INSERT INTO kine_audit(revision, name, operation, principal, created_at) VALUES(?, 'conflict', 'create', '', 0)`, rev+2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, renamed, err := renamer.Rename(ctx, "/a", "/b", 0); err == nil && renamed {
+		t.Fatal("expected rename to fail when the create cannot be inserted")
+	}
+	for key, value := range map[string]string{"/a": "a", "/c": "c"} {
+		if _, kv, err := backend.Get(ctx, key, "", 1, 0, false); err != nil || kv == nil || string(kv.Value) != value {
+			t.Fatalf("expected %s to be unchanged, got kv=%#v err=%v", key, kv, err)
+		}
+	}
+	if _, kv, err := backend.Get(ctx, "/b", "", 1, 0, false); err != nil || kv != nil {
+		t.Fatalf("expected /b to not exist, got kv=%#v err=%v", kv, err)
+	}
+}
+
+func TestMissingCompactRevKey(t *testing.T) {
+	forEachDriver(t, testMissingCompactRevKey)
+}
+
+func testMissingCompactRevKey(t *testing.T, driverName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	cfg := &drivers.Config{
+		DataSourceName:   testDataSourceName(t, driverName),
+		CompactInterval:  -1,
+		CompactTimeout:   time.Second,
+		CompactBatchSize: 1000,
+		PollBatchSize:    500,
+	}
+	backend, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a table without the compact_rev_key row has not been compacted
+	if rev, err := dialect.GetCompactRevision(ctx); err != nil || rev != 0 {
+		t.Fatalf("expected compact revision 0 without compact_rev_key, got %d err=%v", rev, err)
+	}
+
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM kine WHERE name = 'compact_rev_key'`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("expected compact_rev_key to be initialized at startup, got %d rows", rows)
+	}
+
+	rev, err := backend.Create(ctx, "/a", []byte("1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, _, _, err = backend.Update(ctx, "/a", []byte("2"), rev, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if compactRev, err := dialect.GetCompactRevision(ctx); err != nil || compactRev != rev {
+		t.Fatalf("expected compact revision %d, got %d err=%v", rev, compactRev, err)
+	}
+	if _, _, err := backend.Get(ctx, "/a", "", 1, rev-1, false); err != server.ErrCompacted {
+		t.Fatalf("expected %v reading a compacted revision, got %v", server.ErrCompacted, err)
+	}
+}
+
+func TestCompactVerify(t *testing.T) {
+	forEachDriver(t, testCompactVerify)
+}
+
+func testCompactVerify(t *testing.T, driverName string) {
+	ctx := context.Background()
+	// disable automatic compaction, so that compact requests are performed immediately
+	cfg := &drivers.Config{DataSourceName: testDataSourceName(t, driverName), CompactInterval: -1, CompactVerify: true}
+	backend := newTestBackendWithConfig(t, driverName, cfg)
+
+	verifications := func(result string) float64 {
+		return testutil.ToFloat64(metrics.CompactVerifyTotal.WithLabelValues(result))
+	}
+	passed, violations := verifications(metrics.ResultSuccess), verifications(metrics.ResultViolation)
+
+	rev, err := backend.Create(ctx, "/a", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func() {
+		t.Helper()
+		if rev, _, _, err = backend.Update(ctx, "/a", []byte("a"), rev, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Create(ctx, "/b", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if verifications(metrics.ResultSuccess) != passed+1 || verifications(metrics.ResultViolation) != violations {
+		t.Fatal("expected verification of a correct compaction to pass")
+	}
+
+	// a trigger removes a current key whenever compaction deletes a row
+	db, err := sql.Open(driverName, cfg.DataSourceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TRIGGER corrupt_compact AFTER DELETE ON kine BEGIN DELETE FROM kine WHERE name = '/b'; END`); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	if verifications(metrics.ResultViolation) != violations+1 {
+		t.Fatal("expected verification of a corrupted compaction to find a violation")
+	}
+}
+
+// TestConnectErrorRedacted checks that the password is masked in the error and log
+// entries from a database that cannot be opened.
+func TestConnectErrorRedacted(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driverName string) {
+		hook := test.NewGlobal()
+		defer hook.Reset()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		wg := &sync.WaitGroup{}
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+
+		dataSourceName := filepath.Join(t.TempDir(), "missing", "state.db") + "?_auth&_auth_user=kine&_auth_pass=s3cret"
+		_, _, err := NewVariant(ctx, wg, driverName, &drivers.Config{DataSourceName: dataSourceName}, false)
+		if err == nil {
+			t.Fatal("expected opening a database in a missing directory to fail")
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("expected password to be redacted from error, got %q", err)
+		}
+		for _, entry := range hook.AllEntries() {
+			if line, _ := entry.String(); strings.Contains(line, "s3cret") {
+				t.Errorf("expected password to be redacted from log, got %q", line)
+			}
+		}
+	})
+}
+
+func TestCompactAnalyze(t *testing.T) {
+	forEachDriver(t, testCompactAnalyze)
+}
+
+func testCompactAnalyze(t *testing.T, driverName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	cfg := &drivers.Config{
+		DataSourceName:          testDataSourceName(t, driverName),
+		CompactInterval:         -1,
+		CompactTimeout:          time.Second,
+		CompactBatchSize:        1000,
+		PollBatchSize:           500,
+		CompactAnalyzeThreshold: 10,
+		CompactAnalyzeInterval:  time.Hour,
+	}
+	backend, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	analyzed := func() bool {
+		var n int
+		if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'sqlite_stat1'`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return false
+		}
+		if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_stat1 WHERE tbl = 'kine'`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n > 0
+	}
+
+	rev, err := backend.Create(ctx, "/a", []byte("0"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactor := backend.(server.Compactor)
+	if _, err := compactor.CompactTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if analyzed() {
+		t.Fatal("expected no statistics before a compaction deleting enough rows")
+	}
+
+	for i := 1; i <= 10; i++ {
+		if rev, _, _, err = backend.Update(ctx, "/a", []byte(fmt.Sprint(i)), rev, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := compactor.CompactTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !analyzed() {
+		t.Fatal("expected statistics to be refreshed after compaction deleted 10 rows")
+	}
+}
+
+func TestCompactExclude(t *testing.T) {
+	forEachDriver(t, testCompactExclude)
+}
+
+func testCompactExclude(t *testing.T, driverName string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	cfg := &drivers.Config{
+		DataSourceName:   testDataSourceName(t, driverName),
+		CompactInterval:  -1,
+		CompactTimeout:   time.Second,
+		CompactBatchSize: 1000,
+		PollBatchSize:    500,
+		CompactExclude:   []string{"/config/", "/boot_strap"},
+	}
+	backend, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the underscore in the excluded key is not a wildcard
+	keys := []string{"/config/a", "/boot_strap", "/bootXstrap", "/other"}
+	created := map[string]int64{}
+	for _, key := range keys {
+		rev, err := backend.Create(ctx, key, []byte("0"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created[key] = rev
+		for i := 1; i < 5; i++ {
+			if rev, _, _, err = backend.Update(ctx, key, []byte(fmt.Sprint(i)), rev, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, _, _, err := backend.Delete(ctx, "/config/a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.(server.Compactor).CompactTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]int{"/config/a": 6, "/boot_strap": 5, "/bootXstrap": 1, "/other": 1} {
+		var rows int
+		if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM kine WHERE name = ?`, key).Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != expected {
+			t.Errorf("expected %d rows for %s after compaction, got %d", expected, key, rows)
+		}
+	}
+	if n, err := dialect.CountCompactable(ctx, 1<<40); err != nil || n != 0 {
+		t.Errorf("expected no compactable rows after compaction, got %d err=%v", n, err)
+	}
+
+	// excluded keys can still be read at compacted revisions
+	if _, kv, err := backend.Get(ctx, "/boot_strap", "", 1, created["/boot_strap"], false); err != nil || kv == nil || string(kv.Value) != "0" {
+		t.Errorf("expected to read /boot_strap at compacted revision, got %v err=%v", kv, err)
+	}
+	if _, kvs, err := backend.List(ctx, "/config/", "", 0, created["/config/a"]+1, false); err != nil || len(kvs) != 1 || string(kvs[0].Value) != "1" {
+		t.Errorf("expected to list /config/ at compacted revision, got %v err=%v", kvs, err)
+	}
+	if _, kvs, err := backend.(server.RangeLister).ListRange(ctx, "/config/", "/config0", 0, created["/config/a"]+2, false); err != nil || len(kvs) != 1 || string(kvs[0].Value) != "2" {
+		t.Errorf("expected to list range /config/ at compacted revision, got %v err=%v", kvs, err)
+	}
+	if _, _, err := backend.Get(ctx, "/bootXstrap", "", 1, created["/bootXstrap"], false); err != server.ErrCompacted {
+		t.Errorf("expected ErrCompacted reading /bootXstrap at compacted revision, got %v", err)
+	}
+	if _, _, err := backend.List(ctx, "/", "", 0, created["/config/a"], false); err != server.ErrCompacted {
+		t.Errorf("expected ErrCompacted listing / at compacted revision, got %v", err)
+	}
+
+	// rows of keys that are no longer excluded are compacted, although they were written
+	// before the last compaction
+	cfg.CompactExclude = []string{"/boot_strap"}
+	backend, dialect, err = NewVariant(ctx, wg, driverName, cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Create(ctx, "/new", []byte("0"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.(server.Compactor).CompactTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]int{"/config/a": 0, "/boot_strap": 5} {
+		var rows int
+		if err := dialect.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM kine WHERE name = ?`, key).Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != expected {
+			t.Errorf("expected %d rows for %s after the excluded keys changed, got %d", expected, key, rows)
+		}
+	}
+}
+
+func TestValidateStatements(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driverName string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+
+		cfg := &drivers.Config{
+			DataSourceName:     testDataSourceName(t, driverName),
+			CompactInterval:    time.Hour,
+			CompactTimeout:     time.Second,
+			CompactBatchSize:   1000,
+			PollBatchSize:      500,
+			AuditLog:           true,
+			CompactExclude:     []string{"/config/"},
+			ValidateStatements: true,
+		}
+		_, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+		if err != nil {
+			t.Fatalf("expected all statements to be valid, got %v", err)
+		}
+
+		dialect.DeleteSQL = `DELETE FORM kine AS kv WHERE kv.id = ?`
+		if err := dialect.ValidateStatements(ctx); err == nil || !strings.Contains(err.Error(), "DeleteSQL") {
+			t.Fatalf("expected error naming DeleteSQL, got %v", err)
+		}
+	})
+}
+
+func TestAcquireTracing(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driverName string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+
+		cfg := &drivers.Config{
+			DataSourceName:   testDataSourceName(t, driverName),
+			CompactInterval:  time.Hour,
+			CompactTimeout:   time.Second,
+			CompactBatchSize: 1000,
+			PollBatchSize:    500,
+			AcquireTracing:   true,
+		}
+		_, dialect, err := NewVariant(ctx, wg, driverName, cfg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialect.DB.SetMaxOpenConns(1)
+
+		histogramSum := func(observer prometheus.Observer) float64 {
+			m := &dto.Metric{}
+			if err := observer.(prometheus.Metric).Write(m); err != nil {
+				t.Fatal(err)
+			}
+			return m.GetHistogram().GetSampleSum()
+		}
+		acquireBefore := histogramSum(metrics.SQLAcquireTime)
+		execBefore := histogramSum(metrics.SQLTime.WithLabelValues(""))
+
+		// saturate the pool by holding its only connection while a statement waits for it;
+		// the connection is held for hold after the statement is known to be waiting
+		const hold = 200 * time.Millisecond
+		conn, err := dialect.DB.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitsBefore := dialect.DB.Stats().WaitCount
+		done := make(chan error, 1)
+		go func() {
+			_, err := dialect.GetCompactRevision(ctx)
+			done <- err
+		}()
+		for dialect.DB.Stats().WaitCount == waitsBefore {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(hold)
+		conn.Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if waited := histogramSum(metrics.SQLAcquireTime) - acquireBefore; waited < hold.Seconds() {
+			t.Errorf("expected at least %v spent acquiring a connection, got %vs", hold, waited)
+		}
+		if executed := histogramSum(metrics.SQLTime.WithLabelValues("")) - execBefore; executed >= hold.Seconds() {
+			t.Errorf("expected time spent waiting for a connection to be excluded from execution time, got %vs", executed)
+		}
+	})
+}
@@ -2,20 +2,24 @@ package endpoint
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"math"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/k3s-io/kine/pkg/bridge"
 	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/standby"
 	"github.com/k3s-io/kine/pkg/tls"
 	"github.com/k3s-io/kine/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,6 +29,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
@@ -33,26 +38,78 @@ const (
 
 	grpcOverheadBytes = 512 * 1024
 	maxSendBytes      = math.MaxInt32
+
+	prefixMetricsInterval = time.Minute
+
+	// DefaultRequestIDHeader is the gRPC metadata key that request ids are read from by default.
+	DefaultRequestIDHeader = "x-request-id"
+	// maxRequestIDLength is the maximum length of a client-supplied request id; longer ids are truncated.
+	maxRequestIDLength = 64
 )
 
 type Config struct {
-	GRPCServer            *grpc.Server
-	WaitGroup             *sync.WaitGroup
-	Listener              string
-	Endpoint              string
-	ConnectionPoolConfig  generic.ConnectionPoolConfig
-	ServerTLSConfig       tls.Config
-	BackendTLSConfig      tls.Config
-	MetricsRegisterer     prometheus.Registerer
-	NotifyInterval        time.Duration
-	EmulatedETCDVersion   string
-	CompactInterval       time.Duration
-	CompactIntervalJitter int
-	CompactTimeout        time.Duration
-	CompactMinRetain      int64
-	CompactBatchSize      int64
-	PollBatchSize         int64
-	LogFormat             string
+	GRPCServer              *grpc.Server
+	UnaryInterceptors       []grpc.UnaryServerInterceptor
+	StreamInterceptors      []grpc.StreamServerInterceptor
+	WaitGroup               *sync.WaitGroup
+	Listener                string
+	Endpoint                string
+	CompactEndpoint         string
+	ConnectionPoolConfig    generic.ConnectionPoolConfig
+	ServerTLSConfig         tls.Config
+	BackendTLSConfig        tls.Config
+	MetricsRegisterer       prometheus.Registerer
+	AdminMux                *http.ServeMux
+	HealthMux               *http.ServeMux
+	NotifyInterval          time.Duration
+	EmulatedETCDVersion     string
+	CompactInterval         time.Duration
+	CompactIntervalJitter   int
+	CompactTimeout          time.Duration
+	CompactMinRetain        int64
+	CompactBatchSize        int64
+	CompactBurstThreshold   int64
+	PollBatchSize           int64
+	ReadTimeout             time.Duration
+	WriteTimeout            time.Duration
+	WatchHistorySize        int
+	WatchHistoryWindow      int64
+	WatchPrefetch           int64
+	WatchSharedDelivery     bool
+	CompactVerify           bool
+	CompactAnalyzeThreshold int64
+	CompactAnalyzeInterval  time.Duration
+	CompactMinInterval      time.Duration
+	CompactManualBypass     bool
+	CompactExclude          []string
+	ElideNoopUpdates        bool
+	LogFormat               string
+	EventBridge             bridge.Config
+	Standby                 standby.Config
+	ColumnTypes             generic.ColumnTypes
+	RebuildMissingIndexes   bool
+	DisableSchemaMigrations bool
+	RangePageSize           int64
+	MaxUnboundedRangeKeys   int64
+	RevisionFloor           int64
+	RevisionBlockSize       int64
+	RevisionMarkInterval    time.Duration
+	PartitionSize           int64
+	ConnectionBackoff       time.Duration
+	AcquireTracing          bool
+	ExternalValueStore      string
+	ExternalValueThreshold  int
+	AuditLog                bool
+	ValidateStatements      bool
+	PrefixMetricsDepth      int
+	RequestIDHeader         string
+	IdempotencyWindow       time.Duration
+	MaxWatchLag             int64
+	VerifyWatchOrder        bool
+	MaxTxnOps               int
+	MaxHighPriorityRequests int
+	MaxLowPriorityRequests  int
+	LowPriorityPrefixes     []string
 }
 
 type ETCDConfig struct {
@@ -70,28 +127,9 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 		}
 	}()
 
-	leaderElect, backend, err := drivers.New(bctx, wg, &drivers.Config{
-		MetricsRegisterer:     config.MetricsRegisterer,
-		Endpoint:              config.Endpoint,
-		BackendTLSConfig:      config.BackendTLSConfig,
-		ConnectionPoolConfig:  config.ConnectionPoolConfig,
-		CompactInterval:       config.CompactInterval,
-		CompactIntervalJitter: config.CompactIntervalJitter,
-		CompactTimeout:        config.CompactTimeout,
-		CompactMinRetain:      config.CompactMinRetain,
-		CompactBatchSize:      config.CompactBatchSize,
-		PollBatchSize:         config.PollBatchSize,
-	})
-
+	leaderElect, backend, err := drivers.New(bctx, wg, driverConfig(config))
 	if err != nil {
-		// Don't print the endpoint string in the error message as it may contain
-		// credentials - but we do want to indicate whether the failure was in the
-		// default or provided value.
-		epType := "default endpoint"
-		if config.Endpoint != "" {
-			epType = "configured endpoint"
-		}
-		return ETCDConfig{}, fmt.Errorf("failed to create driver for %s: %w", epType, err)
+		return ETCDConfig{}, driverError(config, err)
 	}
 
 	if backend == nil {
@@ -107,8 +145,23 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 		config.MetricsRegisterer.MustRegister(
 			metrics.SQLTotal,
 			metrics.SQLTime,
+			metrics.SQLAcquireTime,
 			metrics.CompactTotal,
+			metrics.CompactVerifyTotal,
 			metrics.InsertErrorsTotal,
+			metrics.PollErrorsTotal,
+			metrics.ConnectionErrorsTotal,
+			metrics.ConnectionBackoffTotal,
+			metrics.WatchHistoryTotal,
+			metrics.WatchOrderViolationsTotal,
+			metrics.WatchPrefetchTotal,
+			metrics.PrefixWritesTotal,
+			metrics.PrefixKeys,
+			metrics.LastReadTimestamp,
+			metrics.LastWriteTimestamp,
+			metrics.StandbyLag,
+			metrics.StandbyDroppedTotal,
+			metrics.StandbyResyncTotal,
 		)
 	}
 
@@ -130,9 +183,37 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 		return ETCDConfig{}, fmt.Errorf("starting kine backend: %w", err)
 	}
 
+	if config.EventBridge.Sink != "" {
+		if err := bridge.Start(bctx, wg, backend, config.EventBridge); err != nil {
+			return ETCDConfig{}, fmt.Errorf("starting event bridge: %w", err)
+		}
+	}
+
+	if config.Standby.Endpoint != "" {
+		if err := startStandby(bctx, wg, backend, config); err != nil {
+			return ETCDConfig{}, fmt.Errorf("starting standby replication: %w", err)
+		}
+	}
+
 	// set up GRPC server and register services
 	b := server.New(backend, endpointScheme(config), config.NotifyInterval, config.EmulatedETCDVersion)
+	b.SetRangePaging(config.RangePageSize, maxSendBytes-grpcOverheadBytes)
+	b.SetMaxUnboundedRangeKeys(config.MaxUnboundedRangeKeys)
+	b.SetIdempotencyWindow(config.IdempotencyWindow)
+	b.SetMaxWatchLag(config.MaxWatchLag)
+	b.SetVerifyWatchOrder(config.VerifyWatchOrder)
+	if config.MaxTxnOps != 0 {
+		b.SetMaxTxnOps(config.MaxTxnOps)
+	}
+	b.SetPriorityLimits(config.MaxHighPriorityRequests, config.MaxLowPriorityRequests, config.LowPriorityPrefixes)
+	b.StartPrefixMetrics(bctx, config.PrefixMetricsDepth, prefixMetricsInterval)
 	b.Register(grpcServer)
+	if config.AdminMux != nil {
+		b.RegisterAdmin(config.AdminMux)
+	}
+	if config.HealthMux != nil {
+		b.RegisterHealth(config.HealthMux)
+	}
 
 	// Create raw listener and wrap in cmux for protocol switching
 	listener, err := createListener(bctx, config)
@@ -160,6 +241,114 @@ func Listen(ctx context.Context, config Config) (etcd ETCDConfig, rerr error) {
 	}, nil
 }
 
+// Compact opens the configured backend without serving it, compacts it to the given
+// revision, or to the current revision if revision is zero, and closes it. Automatic
+// compaction is disabled while the backend is open. It returns the revision that
+// the backend has been compacted to.
+func Compact(ctx context.Context, config Config, revision int64) (int64, error) {
+	wg := waitGroup(config)
+	bctx, bcancel := context.WithCancel(ctx)
+	defer func() {
+		bcancel()
+		wg.Wait()
+	}()
+
+	config.CompactInterval = 0
+	_, backend, err := drivers.New(bctx, wg, driverConfig(config))
+	if err != nil {
+		return 0, driverError(config, err)
+	}
+	if backend == nil {
+		return 0, errors.New("compaction is not supported for etcd endpoints")
+	}
+	compactor, ok := backend.(server.Compactor)
+	if !ok {
+		return 0, errors.New("compaction is not supported by the configured backend")
+	}
+
+	if err := backend.Start(bctx); err != nil {
+		return 0, fmt.Errorf("starting kine backend: %w", err)
+	}
+	return compactor.CompactTo(bctx, revision)
+}
+
+// driverConfig returns the driver config for the endpoint config.
+func driverConfig(config Config) *drivers.Config {
+	return &drivers.Config{
+		MetricsRegisterer:       config.MetricsRegisterer,
+		Endpoint:                config.Endpoint,
+		CompactEndpoint:         config.CompactEndpoint,
+		BackendTLSConfig:        config.BackendTLSConfig,
+		ConnectionPoolConfig:    config.ConnectionPoolConfig,
+		CompactInterval:         config.CompactInterval,
+		CompactIntervalJitter:   config.CompactIntervalJitter,
+		CompactTimeout:          config.CompactTimeout,
+		CompactMinRetain:        config.CompactMinRetain,
+		CompactBatchSize:        config.CompactBatchSize,
+		CompactBurstThreshold:   config.CompactBurstThreshold,
+		PollBatchSize:           config.PollBatchSize,
+		ReadTimeout:             config.ReadTimeout,
+		WriteTimeout:            config.WriteTimeout,
+		WatchHistorySize:        config.WatchHistorySize,
+		WatchHistoryWindow:      config.WatchHistoryWindow,
+		WatchPrefetch:           config.WatchPrefetch,
+		WatchSharedDelivery:     config.WatchSharedDelivery,
+		CompactVerify:           config.CompactVerify,
+		CompactAnalyzeThreshold: config.CompactAnalyzeThreshold,
+		CompactAnalyzeInterval:  config.CompactAnalyzeInterval,
+		CompactMinInterval:      config.CompactMinInterval,
+		CompactManualBypass:     config.CompactManualBypass,
+		CompactExclude:          config.CompactExclude,
+		ElideNoopUpdates:        config.ElideNoopUpdates,
+		ColumnTypes:             config.ColumnTypes,
+		RebuildMissingIndexes:   config.RebuildMissingIndexes,
+		DisableSchemaMigrations: config.DisableSchemaMigrations,
+		RevisionFloor:           config.RevisionFloor,
+		RevisionBlockSize:       config.RevisionBlockSize,
+		RevisionMarkInterval:    config.RevisionMarkInterval,
+		PartitionSize:           config.PartitionSize,
+		ConnectionBackoff:       config.ConnectionBackoff,
+		AcquireTracing:          config.AcquireTracing,
+		ExternalValueStore:      config.ExternalValueStore,
+		ExternalValueThreshold:  config.ExternalValueThreshold,
+		AuditLog:                config.AuditLog,
+		ValidateStatements:      config.ValidateStatements,
+	}
+}
+
+// startStandby opens the standby backend, and starts replicating writes from the
+// primary backend to it. Metrics are not registered for the standby, and it does not
+// use the compact endpoint of the primary.
+func startStandby(ctx context.Context, wg *sync.WaitGroup, primary server.Backend, config Config) error {
+	cfg := driverConfig(config)
+	cfg.Endpoint = config.Standby.Endpoint
+	cfg.CompactEndpoint = ""
+	cfg.MetricsRegisterer = nil
+	_, backend, err := drivers.New(ctx, wg, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create driver for standby endpoint: %w", err)
+	}
+	if backend == nil {
+		return errors.New("standby replication is not supported for etcd endpoints")
+	}
+	if err := backend.Start(ctx); err != nil {
+		return fmt.Errorf("starting standby backend: %w", err)
+	}
+	standby.Start(ctx, wg, primary, backend, config.Standby)
+	return nil
+}
+
+// driverError wraps an error creating the driver. The endpoint string is not
+// included in the error message as it may contain credentials - but we do want
+// to indicate whether the failure was in the default or provided value.
+func driverError(config Config, err error) error {
+	epType := "default endpoint"
+	if config.Endpoint != "" {
+		epType = "configured endpoint"
+	}
+	return fmt.Errorf("failed to create driver for %s: %w", epType, err)
+}
+
 // endpointURL returns a URI string suitable for use as a local etcd endpoint.
 // For TCP sockets, it is assumed that the port can be reached via the loopback address.
 func endpointURL(config Config, listener net.Listener) string {
@@ -230,6 +419,8 @@ func waitGroup(config Config) *sync.WaitGroup {
 
 // grpcServer returns either a preconfigured GRPC server, or builds a new GRPC
 // server using upstream keepalive defaults plus the local Server TLS configuration.
+// Interceptors supplied by the embedder are chained after kine's own interceptors;
+// they are ignored if a preconfigured GRPC server is used.
 func grpcServer(config Config) (*grpc.Server, error) {
 	if config.GRPCServer != nil {
 		return config.GRPCServer, nil
@@ -249,12 +440,22 @@ func grpcServer(config Config) (*grpc.Server, error) {
 		grpc.MaxSendMsgSize(maxSendBytes),
 	}
 
+	header := strings.ToLower(config.RequestIDHeader)
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{unaryRequestIDInterceptor(header)}
+	streamInterceptors := []grpc.StreamServerInterceptor{streamRequestIDInterceptor(header)}
 	if logrus.IsLevelEnabled(logrus.TraceLevel) {
-		gopts = append(gopts,
-			grpc.UnaryInterceptor(unaryStatsInterceptor),
-			grpc.StreamInterceptor(streamStatsInterceptor),
-		)
+		unaryInterceptors = append(unaryInterceptors, unaryStatsInterceptor)
+		streamInterceptors = append(streamInterceptors, streamStatsInterceptor)
 	}
+	unaryInterceptors = append(unaryInterceptors, config.UnaryInterceptors...)
+	streamInterceptors = append(streamInterceptors, config.StreamInterceptors...)
+	gopts = append(gopts,
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
 
 	if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
 		tlsConfig, err := config.ServerTLSConfig.ServerConfig()
@@ -268,6 +469,54 @@ func grpcServer(config Config) (*grpc.Server, error) {
 	return grpc.NewServer(gopts...), nil
 }
 
+// requestID returns the request id supplied by the client in the given metadata header,
+// or a newly generated id if the client did not supply one.
+func requestID(ctx context.Context, header string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(header); len(ids) > 0 && ids[0] != "" {
+			id := ids[0]
+			if len(id) > maxRequestIDLength {
+				id = id[:maxRequestIDLength]
+			}
+			return id
+		}
+	}
+	return rand.Text()
+}
+
+// unaryRequestIDInterceptor attaches a request id to the request context, so that it is
+// included in logs for the request, and returns it to the client in the response header.
+func unaryRequestIDInterceptor(header string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		id := requestID(ctx, header)
+		if err := grpc.SetHeader(ctx, metadata.Pairs(header, id)); err != nil {
+			logrus.Debugf("Failed to set request id response header: %v", err)
+		}
+		return handler(util.WithRequestID(ctx, id), req)
+	}
+}
+
+// streamRequestIDInterceptor attaches a request id to the stream context, so that it is
+// included in logs for the stream, and returns it to the client in the response header.
+func streamRequestIDInterceptor(header string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		id := requestID(ss.Context(), header)
+		if err := ss.SetHeader(metadata.Pairs(header, id)); err != nil {
+			logrus.Debugf("Failed to set request id response header: %v", err)
+		}
+		return handler(srv, &requestIDServerStream{ServerStream: ss, ctx: util.WithRequestID(ss.Context(), id)})
+	}
+}
+
+type requestIDServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (r *requestIDServerStream) Context() context.Context {
+	return r.ctx
+}
+
 func unaryStatsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
 	start := time.Now()
 	defer func() {
@@ -0,0 +1,311 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// rangeKVServer implements only Range; calling any other method returns Unimplemented.
+type rangeKVServer struct {
+	etcdserverpb.UnimplementedKVServer
+}
+
+func (*rangeKVServer) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	return &etcdserverpb.RangeResponse{}, nil
+}
+
+func TestUnaryInterceptors(t *testing.T) {
+	var methods []string
+	interceptor := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		methods = append(methods, info.FullMethod)
+		return handler(ctx, req)
+	}
+
+	s, err := grpcServer(Config{UnaryInterceptors: []grpc.UnaryServerInterceptor{interceptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcdserverpb.RegisterKVServer(s, &rangeKVServer{})
+
+	lis := bufconn.Listen(1024 * 1024)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := etcdserverpb.NewKVClient(conn).Range(context.Background(), &etcdserverpb.RangeRequest{Key: []byte("/a")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 1 || methods[0] != "/etcdserverpb.KV/Range" {
+		t.Fatalf("expected interceptor to observe Range, got %v", methods)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	config := Config{
+		Endpoint:         "sqlite://" + filepath.Join(t.TempDir(), "state.db"),
+		CompactTimeout:   5 * time.Second,
+		CompactBatchSize: 100,
+	}
+
+	// withBackend runs f against a started backend, and closes it when f returns
+	withBackend := func(f func(context.Context, server.Backend)) {
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+		_, backend, err := drivers.New(ctx, wg, driverConfig(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		f(ctx, backend)
+	}
+	rows := func() (n int64) {
+		withBackend(func(ctx context.Context, backend server.Backend) {
+			stats, err := backend.(server.StatsReporter).StorageStats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n = stats.Rows
+		})
+		return n
+	}
+
+	withBackend(func(ctx context.Context, backend server.Backend) {
+		rev, err := backend.Create(ctx, "/a", []byte("0"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 10; i++ {
+			if rev, _, _, err = backend.Update(ctx, "/a", []byte{byte('0' + i)}, rev, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	before := rows()
+	rev, err := Compact(context.Background(), config, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev == 0 {
+		t.Fatal("expected compact revision to advance")
+	}
+	if after := rows(); after >= before {
+		t.Fatalf("expected compaction to remove rows, got %d rows before and %d after", before, after)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.TraceLevel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	config := Config{
+		Endpoint:         "sqlite://" + filepath.Join(t.TempDir(), "state.db"),
+		CompactBatchSize: 100,
+	}
+	_, backend, err := drivers.New(ctx, wg, driverConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := grpcServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.New(backend, "unix", 0, "").Register(s)
+
+	lis := bufconn.Listen(1024 * 1024)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := etcdserverpb.NewKVClient(conn)
+
+	// a supplied request id is logged for the range, and returned to the client
+	hook.Reset()
+	var header metadata.MD
+	rctx := metadata.AppendToOutgoingContext(ctx, DefaultRequestIDHeader, "test-request-id")
+	if _, err := client.Range(rctx, &etcdserverpb.RangeRequest{Key: []byte("/registry/health")}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+	if ids := header.Get(DefaultRequestIDHeader); len(ids) != 1 || ids[0] != "test-request-id" {
+		t.Fatalf("expected request id in response header, got %v", ids)
+	}
+	var found bool
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "GET key=/registry/health") {
+			found = true
+			if id := entry.Data["request_id"]; id != "test-request-id" {
+				t.Fatalf("expected range log line to include request id, got %v", id)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected range to be logged")
+	}
+
+	// a request id is generated if the client does not supply one
+	if _, err := client.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/registry/health")}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+	if ids := header.Get(DefaultRequestIDHeader); len(ids) != 1 || ids[0] == "" || ids[0] == "test-request-id" {
+		t.Fatalf("expected generated request id in response header, got %v", ids)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	config := Config{
+		Endpoint:         "sqlite://" + filepath.Join(t.TempDir(), "state.db"),
+		CompactBatchSize: 100,
+	}
+	_, backend, err := drivers.New(ctx, wg, driverConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := grpcServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge := server.New(backend, "unix", 5*time.Second, "")
+	bridge.Register(s)
+	mux := http.NewServeMux()
+	bridge.RegisterAdmin(mux)
+
+	lis := bufconn.Listen(1024 * 1024)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	watch, err := etcdserverpb.NewWatchClient(conn).Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := watch.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+		CreateRequest: &etcdserverpb.WatchCreateRequest{Key: []byte("/watched")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if wr, err := watch.Recv(); err != nil || !wr.Created || wr.Canceled {
+		t.Fatalf("expected watch to be created, got %v, %v", wr, err)
+	}
+
+	if _, err := backend.Create(ctx, "/leased", []byte("v"), 60); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := backend.Create(ctx, "/watched", []byte("v"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wr, err := watch.Recv(); err != nil || len(wr.Events) != 1 {
+		t.Fatalf("expected watch event, got %v, %v", wr, err)
+	}
+	logrus.Errorf("Diagnostics test error")
+
+	// the watch and lease are recorded asynchronously, so poll until the dump includes them
+	var diagnostics server.Diagnostics
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/diagnostics", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected diagnostics status %d: %s", rec.Code, rec.Body)
+		}
+		diagnostics = server.Diagnostics{}
+		if err := json.NewDecoder(rec.Body).Decode(&diagnostics); err != nil {
+			t.Fatal(err)
+		}
+		if len(diagnostics.Watches) == 1 && diagnostics.Watches[0].LastRevision == rev &&
+			diagnostics.Backend != nil && len(diagnostics.Backend.Leases) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for diagnostics to include watch and lease: %+v", diagnostics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if diagnostics.CurrentRevision < rev {
+		t.Fatalf("expected current revision of at least %d, got %d", rev, diagnostics.CurrentRevision)
+	}
+	if watch := diagnostics.Watches[0]; watch.Key != "/watched" {
+		t.Fatalf("unexpected watch: %+v", watch)
+	}
+	if lease := diagnostics.Backend.Leases[0]; lease.Key != "/leased" || lease.Lease != 60 || time.Until(lease.ExpiresAt) <= 0 {
+		t.Fatalf("unexpected lease: %+v", lease)
+	}
+	if len(diagnostics.Backend.Pools) == 0 || diagnostics.Backend.Pools[0].Open == 0 {
+		t.Fatalf("expected open connection pool, got %+v", diagnostics.Backend.Pools)
+	}
+	if diagnostics.DriverConfig == nil || diagnostics.DriverConfig.Driver == "" {
+		t.Fatalf("expected driver config, got %+v", diagnostics.DriverConfig)
+	}
+	if !slices.ContainsFunc(diagnostics.RecentErrors, func(m server.LogMessage) bool { return m.Message == "Diagnostics test error" }) {
+		t.Fatalf("expected recent errors to include logged error, got %+v", diagnostics.RecentErrors)
+	}
+}
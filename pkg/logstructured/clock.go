@@ -0,0 +1,68 @@
+package logstructured
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// clockCheckInterval is how often the wall clock is compared with the monotonic clock
+	clockCheckInterval = 10 * time.Second
+	// clockJumpThreshold is the difference between the wall and monotonic clocks over a
+	// check interval that is reported as a wall-clock jump
+	clockJumpThreshold = time.Second
+)
+
+// leaseClock is the time source for lease expiry. Expiry is measured on the monotonic clock, so
+// that wall-clock jumps neither extend nor shorten leases; the wall clock is only read to detect
+// and log such jumps. It is replaced in tests.
+type leaseClock interface {
+	// Now returns the wall-clock time, without a monotonic reading.
+	Now() time.Time
+	// Monotonic returns the time elapsed on the monotonic clock since an arbitrary fixed point.
+	Monotonic() time.Duration
+}
+
+// systemClock reads the host clocks.
+type systemClock struct {
+	start time.Time
+}
+
+func newSystemClock() systemClock {
+	return systemClock{start: time.Now()}
+}
+
+func (c systemClock) Now() time.Time {
+	return time.Now().Round(0)
+}
+
+func (c systemClock) Monotonic() time.Duration {
+	return time.Since(c.start)
+}
+
+// clockMonitor detects wall-clock jumps by comparing the time elapsed on the wall clock with the
+// time elapsed on the monotonic clock since the previous check.
+type clockMonitor struct {
+	mu   sync.Mutex
+	wall time.Time
+	mono time.Duration
+}
+
+// check returns the difference between the wall and monotonic clocks since the previous check,
+// logging it if it exceeds clockJumpThreshold. A negative jump means the wall clock moved backward.
+func (m *clockMonitor) check(clock leaseClock) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wall, mono := clock.Now(), clock.Monotonic()
+	var jump time.Duration
+	if !m.wall.IsZero() {
+		jump = wall.Sub(m.wall) - (mono - m.mono)
+		if jump.Abs() > clockJumpThreshold {
+			logrus.Warnf("Wall clock jumped by %v; lease expiry uses the monotonic clock and is not affected", jump)
+		}
+	}
+	m.wall, m.mono = wall, mono
+	return jump
+}
@@ -0,0 +1,55 @@
+package logstructured
+
+import (
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// fakeClock is a lease clock whose wall and monotonic readings are advanced independently.
+type fakeClock struct {
+	wall time.Time
+	mono time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.wall
+}
+
+func (c *fakeClock) Monotonic() time.Duration {
+	return c.mono
+}
+
+func TestLeaseClockJump(t *testing.T) {
+	clock := &fakeClock{wall: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), mono: time.Minute}
+	l := New(nil)
+	l.clock = clock
+	l.clockMon.check(clock)
+
+	kv := &server.KeyValue{Key: "/a", Lease: 10, ModRevision: 1}
+	if expires := storeTTLEventKV(&l.ttlMutex, l.ttlKeys, kv, clock.Monotonic()); expires != 10*time.Second {
+		t.Fatalf("expected key to expire in 10s, got %v", expires)
+	}
+	eventKV := loadTTLEventKV(&l.ttlMutex, l.ttlKeys, "/a")
+
+	// the wall clock jumps back an hour while five seconds pass
+	clock.wall = clock.wall.Add(-time.Hour + 5*time.Second)
+	clock.mono += 5 * time.Second
+	if jump := l.clockMon.check(clock); jump != -time.Hour {
+		t.Fatalf("expected a jump of %v, got %v", -time.Hour, jump)
+	}
+	if remaining := l.ttlRemaining(eventKV); remaining != 5*time.Second {
+		t.Fatalf("expected key to expire in 5s, got %v", remaining)
+	}
+
+	// the lease expires once its TTL has elapsed on the monotonic clock
+	clock.wall = clock.wall.Add(5 * time.Second)
+	clock.mono += 5 * time.Second
+	if jump := l.clockMon.check(clock); jump != 0 {
+		t.Fatalf("expected no jump, got %v", jump)
+	}
+	if remaining := l.ttlRemaining(eventKV); remaining > 0 {
+		t.Fatalf("expected key to have expired, got %v remaining", remaining)
+	}
+}
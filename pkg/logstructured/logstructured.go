@@ -1,8 +1,11 @@
 package logstructured
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -11,10 +14,13 @@ import (
 	"k8s.io/client-go/util/workqueue"
 
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
 )
 
 const (
-	retryInterval = 250 * time.Millisecond
+	retryInterval    = 250 * time.Millisecond
+	snapshotPageSize = 1000
+	deltaPageSize    = 1000
 )
 
 type Log interface {
@@ -23,30 +29,82 @@ type Log interface {
 	CurrentRevision(ctx context.Context) (int64, error)
 	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes, keysOnly bool) (int64, server.Events, error)
 	Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error)
+	CountSerializable(ctx context.Context, prefix, startKey string) (int64, int64, error)
+	ListRange(ctx context.Context, startKey, endKey string, limit, revision int64, includeDeletes, keysOnly bool) (int64, server.Events, error)
+	CountRange(ctx context.Context, startKey, endKey string, revision int64) (int64, int64, error)
 	After(ctx context.Context, prefix string, revision, limit int64) (int64, server.Events, error)
+	Backfill(ctx context.Context, prefix string, revision int64, f func(int64, server.Events) error) error
 	Watch(ctx context.Context, prefix string) <-chan server.Events
 	Append(ctx context.Context, event *server.Event) (int64, error)
+	AppendAll(ctx context.Context, events []*server.Event) ([]int64, error)
 	DbSize(ctx context.Context) (int64, error)
+	StorageStats(ctx context.Context) (*server.StorageStats, error)
+	DriverConfig() *server.DriverConfig
+	Statements() map[string]string
+	PoolStats() []server.PoolStats
+	SetKeyMetadata(ctx context.Context, key string, metadata map[string]string) error
+	GetKeyMetadata(ctx context.Context, key string) (map[string]string, error)
+	ListKeyMetadata(ctx context.Context, prefix string) (map[string]map[string]string, error)
 	Compact(ctx context.Context, revision int64) (int64, error)
+	CompactTo(ctx context.Context, revision int64) (int64, error)
 	WaitForSyncTo(revision int64)
+	CompactConfig() (time.Duration, int64)
+	SetCompactInterval(interval time.Duration) error
+	SetCompactBatchSize(batchSize int64) error
+	ValidateCompactConfig(interval time.Duration, batchSize int64) error
 }
 
 type ttlEventKV struct {
 	key         string
+	lease       int64
 	modRevision int64
-	expiredAt   time.Time
+	// expiresAt is the reading of the monotonic lease clock at which the key expires
+	expiresAt time.Duration
 }
 
+// explicit interface check
+var _ server.CompactConfigurer = (*LogStructured)(nil)
+var _ server.RangeLister = (*LogStructured)(nil)
+var _ server.MinRevisioner = (*LogStructured)(nil)
+var _ server.StatsReporter = (*LogStructured)(nil)
+var _ server.SerializableCounter = (*LogStructured)(nil)
+var _ server.Compactor = (*LogStructured)(nil)
+var _ server.ConfigReporter = (*LogStructured)(nil)
+var _ server.StatementReporter = (*LogStructured)(nil)
+var _ server.KeyMetadataStore = (*LogStructured)(nil)
+var _ server.Renamer = (*LogStructured)(nil)
+var _ server.Diagnoser = (*LogStructured)(nil)
+var _ server.Snapshotter = (*LogStructured)(nil)
+var _ server.Deltaer = (*LogStructured)(nil)
+
 type LogStructured struct {
 	log Log
+
+	// ttlMutex guards ttlKeys, the keys with a lease that are waiting to expire
+	ttlMutex sync.RWMutex
+	ttlKeys  map[string]*ttlEventKV
+	clock    leaseClock
+	clockMon clockMonitor
+
+	elideNoopUpdates bool
 }
 
 func New(log Log) *LogStructured {
 	return &LogStructured{
-		log: log,
+		log:     log,
+		ttlKeys: map[string]*ttlEventKV{},
+		clock:   newSystemClock(),
 	}
 }
 
+// SetElideNoopUpdates configures updates that change neither the value nor the lease of a key
+// to succeed without writing a new revision, and to report the key's existing revision. This
+// changes revision semantics, as such updates are not seen by watchers, and must be called
+// before the backend is started.
+func (l *LogStructured) SetElideNoopUpdates(enabled bool) {
+	l.elideNoopUpdates = enabled
+}
+
 func (l *LogStructured) Start(ctx context.Context) error {
 	if err := l.log.Start(ctx); err != nil {
 		return err
@@ -64,7 +122,7 @@ func (l *LogStructured) Start(ctx context.Context) error {
 func (l *LogStructured) Get(ctx context.Context, key, rangeEnd string, limit, revision int64, keysOnly bool) (revRet int64, kvRet *server.KeyValue, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
-		logrus.Tracef("GET %s, rev=%d => rev=%d, kv=%v, err=%v", key, revision, revRet, kvRet != nil, errRet)
+		util.RequestLogger(ctx).Tracef("GET %s, rev=%d => rev=%d, kv=%v, err=%v", key, revision, revRet, kvRet != nil, errRet)
 	}()
 
 	rev, event, err := l.get(ctx, key, rangeEnd, limit, revision, false, keysOnly)
@@ -98,13 +156,17 @@ func (l *LogStructured) adjustRevision(ctx context.Context, rev *int64) {
 func (l *LogStructured) Create(ctx context.Context, key string, value []byte, lease int64) (revRet int64, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
-		logrus.Tracef("CREATE %s, size=%d, lease=%d => rev=%d, err=%v", key, len(value), lease, revRet, errRet)
+		util.RequestLogger(ctx).Tracef("CREATE %s, size=%d, lease=%d => rev=%d, err=%v", key, len(value), lease, revRet, errRet)
 	}()
 
 	rev, prevEvent, err := l.get(ctx, key, "", 1, 0, true, false)
 	if err != nil {
 		return 0, err
 	}
+	// empty values are stored as empty, not NULL
+	if value == nil {
+		value = []byte{}
+	}
 	createEvent := &server.Event{
 		Create: true,
 		KV: &server.KeyValue{
@@ -127,10 +189,15 @@ func (l *LogStructured) Create(ctx context.Context, key string, value []byte, le
 	return revRet, errRet
 }
 
+// Delete deletes a key. If revision is not zero, the key is only deleted if its current
+// mod revision matches; otherwise the current value is returned, and deleted is false.
+// The check is atomic: the deletion record names the revision it replaces, so a
+// concurrent write to the key causes the insert to fail on the unique (name, prev_revision)
+// index, which is also reported as not deleted.
 func (l *LogStructured) Delete(ctx context.Context, key string, revision int64) (revRet int64, kvRet *server.KeyValue, deletedRet bool, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
-		logrus.Tracef("DELETE %s, rev=%d => rev=%d, kv=%v, deleted=%v, err=%v", key, revision, revRet, kvRet != nil, deletedRet, errRet)
+		util.RequestLogger(ctx).Tracef("DELETE %s, rev=%d => rev=%d, kv=%v, deleted=%v, err=%v", key, revision, revRet, kvRet != nil, deletedRet, errRet)
 	}()
 
 	rev, event, err := l.get(ctx, key, "", 1, 0, true, false)
@@ -169,9 +236,79 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 	return rev, event.KV, true, err
 }
 
+// Rename moves a key to a new key that does not exist, by appending a deletion of the key and
+// a creation of the new key with the same value and lease in a single transaction. If revision is
+// not zero, the key is only renamed if its current mod revision matches; otherwise the current
+// value is returned, and renamed is false. ErrKeyExists is returned if the new key exists.
+func (l *LogStructured) Rename(ctx context.Context, key, newKey string, revision int64) (revRet int64, kvRet *server.KeyValue, renamedRet bool, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		util.RequestLogger(ctx).Tracef("RENAME %s => %s, rev=%d => rev=%d, kv=%v, renamed=%v, err=%v", key, newKey, revision, revRet, kvRet != nil, renamedRet, errRet)
+	}()
+
+	rev, event, err := l.get(ctx, key, "", 1, 0, true, false)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if event == nil || event.Delete {
+		return rev, nil, false, nil
+	}
+	if revision != 0 && event.KV.ModRevision != revision {
+		return rev, event.KV, false, nil
+	}
+
+	_, target, err := l.get(ctx, newKey, "", 1, 0, true, false)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	deleteEvent := &server.Event{
+		Delete: true,
+		KV:     event.KV,
+		PrevKV: event.KV,
+	}
+	createEvent := &server.Event{
+		Create: true,
+		KV: &server.KeyValue{
+			Key:   newKey,
+			Value: event.KV.Value,
+			Lease: event.KV.Lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: rev,
+		},
+	}
+	if target != nil {
+		if !target.Delete {
+			return rev, event.KV, false, server.ErrKeyExists
+		}
+		createEvent.PrevKV = target.KV
+	}
+
+	revs, err := l.log.AppendAll(ctx, []*server.Event{deleteEvent, createEvent})
+	if err != nil {
+		// As with Delete, a failed append is assumed to be a UNIQUE constraint error from a
+		// concurrent write to one of the keys.
+		if _, target, latestErr := l.get(ctx, newKey, "", 1, 0, true, false); latestErr == nil && target != nil && !target.Delete {
+			return rev, event.KV, false, server.ErrKeyExists
+		}
+		latestRev, latestEvent, latestErr := l.get(ctx, key, "", 1, 0, true, false)
+		if latestErr != nil || latestEvent == nil || latestEvent.Delete {
+			return rev, event.KV, false, nil
+		}
+		return latestRev, latestEvent.KV, false, nil
+	}
+
+	rev = revs[len(revs)-1]
+	kv := *createEvent.KV
+	kv.CreateRevision = rev
+	kv.ModRevision = rev
+	return rev, &kv, true, nil
+}
+
 func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit, revision int64, keysOnly bool) (revRet int64, kvRet []*server.KeyValue, errRet error) {
 	defer func() {
-		logrus.Tracef("LIST %s, start=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", prefix, startKey, limit, revision, revRet, len(kvRet), errRet)
+		util.RequestLogger(ctx).Tracef("LIST %s, start=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", prefix, startKey, limit, revision, revRet, len(kvRet), errRet)
 	}()
 
 	// It's assumed that when there is a start key that that key exists.
@@ -213,7 +350,7 @@ func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit
 
 func (l *LogStructured) Count(ctx context.Context, prefix, startKey string, revision int64) (revRet int64, count int64, err error) {
 	defer func() {
-		logrus.Tracef("COUNT %s, rev=%d => rev=%d, count=%d, err=%v", prefix, revision, revRet, count, err)
+		util.RequestLogger(ctx).Tracef("COUNT %s, rev=%d => rev=%d, count=%d, err=%v", prefix, revision, revRet, count, err)
 	}()
 	rev, count, err := l.log.Count(ctx, prefix, startKey, revision)
 	if err != nil {
@@ -232,6 +369,182 @@ func (l *LogStructured) Count(ctx context.Context, prefix, startKey string, revi
 	return rev, count, nil
 }
 
+// Diagnostics returns the compact revision, the current use of the connection pools, and the
+// keys with a lease that are waiting to expire.
+func (l *LogStructured) Diagnostics(ctx context.Context) (*server.BackendDiagnostics, error) {
+	compactRev, err := l.log.CompactRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics := &server.BackendDiagnostics{
+		CompactRevision: compactRev,
+		Pools:           l.log.PoolStats(),
+		Leases:          []server.LeaseDiagnostics{},
+	}
+
+	// expiry is reported in wall-clock time, relative to the current reading of the lease clock
+	wall, mono := l.clock.Now(), l.clock.Monotonic()
+	l.ttlMutex.RLock()
+	for _, eventKV := range l.ttlKeys {
+		diagnostics.Leases = append(diagnostics.Leases, server.LeaseDiagnostics{
+			Key:         eventKV.key,
+			Lease:       eventKV.lease,
+			ModRevision: eventKV.modRevision,
+			ExpiresAt:   wall.Add(eventKV.expiresAt - mono),
+		})
+	}
+	l.ttlMutex.RUnlock()
+	slices.SortFunc(diagnostics.Leases, func(a, b server.LeaseDiagnostics) int { return strings.Compare(a.Key, b.Key) })
+	return diagnostics, nil
+}
+
+// Snapshot calls f with each current key as of the current revision, reading a page of keys
+// at a time at that revision.
+func (l *LogStructured) Snapshot(ctx context.Context, f func(kv *server.KeyValue) error) (revRet int64, errRet error) {
+	var count int
+	defer func() {
+		util.RequestLogger(ctx).Tracef("SNAPSHOT => rev=%d, kvs=%d, err=%v", revRet, count, errRet)
+	}()
+
+	rev, err := l.log.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for startKey := ""; ; {
+		_, kvs, err := l.ListRange(ctx, startKey, "", snapshotPageSize, rev, false)
+		if err != nil {
+			return rev, err
+		}
+		for _, kv := range kvs {
+			// the compact revision is tracked internally under this key
+			if kv.Key == "compact_rev_key" {
+				continue
+			}
+			if err := f(kv); err != nil {
+				return rev, err
+			}
+			count++
+		}
+		if len(kvs) < snapshotPageSize {
+			return rev, nil
+		}
+		startKey = kvs[len(kvs)-1].Key + "\x00"
+	}
+}
+
+// Delta calls f with the final state of each key changed after revision from, up to and
+// including revision to. Events are read a page at a time in revision order, and merged per
+// key; only the changed keys are held in memory.
+func (l *LogStructured) Delta(ctx context.Context, from, to int64, f func(event *server.Event) error) (errRet error) {
+	var count int
+	defer func() {
+		util.RequestLogger(ctx).Tracef("DELTA from=%d, to=%d => events=%d, err=%v", from, to, count, errRet)
+	}()
+
+	rev, err := l.log.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if to > rev {
+		return server.ErrFutureRev
+	}
+	compact, err := l.log.CompactRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if from < compact {
+		return server.ErrCompacted
+	}
+
+	changes := map[string]*server.Event{}
+	for cursor := from; cursor < to; {
+		_, events, err := l.log.After(ctx, "%", cursor, deltaPageSize)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if event.KV.ModRevision > to {
+				cursor = to
+				break
+			}
+			cursor = event.KV.ModRevision
+			// the compact revision and gap fill records are not keys
+			if event.KV.Key == "compact_rev_key" || strings.HasPrefix(event.KV.Key, "gap-") {
+				continue
+			}
+			if first, ok := changes[event.KV.Key]; ok {
+				changes[event.KV.Key] = &server.Event{Create: first.Create, Delete: event.Delete, KV: event.KV, PrevKV: first.PrevKV}
+			} else {
+				changes[event.KV.Key] = &server.Event{Create: event.Create, Delete: event.Delete, KV: event.KV, PrevKV: event.PrevKV}
+			}
+		}
+		if len(events) < deltaPageSize {
+			break
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(changes)) {
+		event := changes[key]
+		if event.Create && event.Delete {
+			continue
+		}
+		if err := f(event); err != nil {
+			return err
+		}
+		count++
+	}
+	return nil
+}
+
+func (l *LogStructured) CountSerializable(ctx context.Context, prefix, startKey string) (revRet int64, count int64, err error) {
+	defer func() {
+		util.RequestLogger(ctx).Tracef("COUNT SERIALIZABLE %s => rev=%d, count=%d, err=%v", prefix, revRet, count, err)
+	}()
+	return l.log.CountSerializable(ctx, prefix, startKey)
+}
+
+func (l *LogStructured) ListRange(ctx context.Context, startKey, endKey string, limit, revision int64, keysOnly bool) (revRet int64, kvRet []*server.KeyValue, errRet error) {
+	defer func() {
+		util.RequestLogger(ctx).Tracef("LIST RANGE %s, end=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", startKey, endKey, limit, revision, revRet, len(kvRet), errRet)
+	}()
+
+	rev, events, err := l.log.ListRange(ctx, startKey, endKey, limit, revision, false, keysOnly)
+	if err != nil {
+		return rev, nil, err
+	}
+	if revision == 0 && len(events) == 0 {
+		// if no revision is requested and no events are returned, then get the
+		// current revision and relist, as in List.
+		rev, err = l.log.CurrentRevision(ctx)
+		if err != nil {
+			return rev, nil, err
+		}
+		if rrev, rkvs, rerr := l.ListRange(ctx, startKey, endKey, limit, rev, keysOnly); rerr == nil {
+			return rrev, rkvs, rerr
+		}
+	}
+
+	kvs := make([]*server.KeyValue, 0, len(events))
+	for _, event := range events {
+		kvs = append(kvs, event.KV)
+	}
+	return rev, kvs, nil
+}
+
+func (l *LogStructured) CountRange(ctx context.Context, startKey, endKey string, revision int64) (revRet int64, count int64, err error) {
+	defer func() {
+		util.RequestLogger(ctx).Tracef("COUNT RANGE %s, end=%s, rev=%d => rev=%d, count=%d, err=%v", startKey, endKey, revision, revRet, count, err)
+	}()
+	rev, count, err := l.log.CountRange(ctx, startKey, endKey, revision)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rev == 0 {
+		rev, err = l.log.CurrentRevision(ctx)
+	}
+	return rev, count, err
+}
+
 func (l *LogStructured) Update(ctx context.Context, key string, value []byte, revision, lease int64) (revRet int64, kvRet *server.KeyValue, updateRet bool, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
@@ -239,7 +552,7 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 		if kvRet != nil {
 			kvRev = kvRet.ModRevision
 		}
-		logrus.Tracef("UPDATE %s, value=%d, rev=%d, lease=%v => rev=%d, kvrev=%d, updated=%v, err=%v", key, len(value), revision, lease, revRet, kvRev, updateRet, errRet)
+		util.RequestLogger(ctx).Tracef("UPDATE %s, value=%d, rev=%d, lease=%v => rev=%d, kvrev=%d, updated=%v, err=%v", key, len(value), revision, lease, revRet, kvRev, updateRet, errRet)
 	}()
 
 	rev, event, err := l.get(ctx, key, "", 1, 0, false, false)
@@ -255,6 +568,13 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 		return rev, event.KV, false, nil
 	}
 
+	if l.elideNoopUpdates && event.KV.Lease == lease && bytes.Equal(event.KV.Value, value) {
+		return event.KV.ModRevision, event.KV, true, nil
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
 	updateEvent := &server.Event{
 		KV: &server.KeyValue{
 			Key:            key,
@@ -280,9 +600,12 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 
 func (l *LogStructured) ttl(ctx context.Context) {
 	queue := workqueue.NewTypedDelayingQueue[string]()
-	rwMutex := &sync.RWMutex{}
-	ttlEventKVMap := make(map[string]*ttlEventKV)
+	rwMutex := &l.ttlMutex
+	ttlEventKVMap := l.ttlKeys
 	eventCh := l.ttlEvents(ctx)
+	clockTicker := time.NewTicker(clockCheckInterval)
+	defer clockTicker.Stop()
+	l.clockMon.check(l.clock)
 
 	go func() {
 		for l.handleTTLEvents(ctx, rwMutex, queue, ttlEventKVMap) {
@@ -294,6 +617,8 @@ func (l *LogStructured) ttl(ctx context.Context) {
 		case <-ctx.Done():
 			queue.ShutDown()
 			return
+		case <-clockTicker.C:
+			l.clockMon.check(l.clock)
 		case event, ok := <-eventCh:
 			if !ok {
 				queue.ShutDown()
@@ -305,12 +630,12 @@ func (l *LogStructured) ttl(ctx context.Context) {
 
 			eventKV := loadTTLEventKV(rwMutex, ttlEventKVMap, event.KV.Key)
 			if eventKV == nil {
-				expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV)
+				expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV, l.clock.Monotonic())
 				logrus.Tracef("TTL add event key=%v, modRev=%v, ttl=%v", event.KV.Key, event.KV.ModRevision, expires)
 				queue.AddAfter(event.KV.Key, expires)
 			} else {
 				if event.KV.ModRevision > eventKV.modRevision {
-					expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV)
+					expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV, l.clock.Monotonic())
 					logrus.Tracef("TTL update event key=%v, modRev=%v, ttl=%v", event.KV.Key, event.KV.ModRevision, expires)
 					queue.AddAfter(event.KV.Key, expires)
 				}
@@ -333,7 +658,7 @@ func (l *LogStructured) handleTTLEvents(ctx context.Context, rwMutex *sync.RWMut
 		return true
 	}
 
-	if expires := time.Until(eventKV.expiredAt); expires > 0 {
+	if expires := l.ttlRemaining(eventKV); expires > 0 {
 		logrus.Tracef("TTL has not expired for key=%v, ttl=%v, requeuing", key, expires)
 		queue.AddAfter(key, expires)
 		return true
@@ -353,6 +678,11 @@ func (l *LogStructured) handleTTLEvents(ctx context.Context, rwMutex *sync.RWMut
 	return true
 }
 
+// ttlRemaining returns the time until a key with a lease expires, on the monotonic lease clock.
+func (l *LogStructured) ttlRemaining(eventKV *ttlEventKV) time.Duration {
+	return eventKV.expiresAt - l.clock.Monotonic()
+}
+
 // ttlEvents starts a goroutine to do a ListWatch on the root prefix. First it lists
 // all non-deleted keys with a page size of 1000, then it starts watching at the
 // revision returned by the initial list. Any keys that have a Lease associated with
@@ -403,20 +733,23 @@ func loadTTLEventKV(rwMutex *sync.RWMutex, store map[string]*ttlEventKV, key str
 	return store[key]
 }
 
-func storeTTLEventKV(rwMutex *sync.RWMutex, store map[string]*ttlEventKV, eventKV *server.KeyValue) time.Duration {
+// storeTTLEventKV records the expiry of a key with a lease, given the current reading of the
+// monotonic lease clock, and returns the time until it expires.
+func storeTTLEventKV(rwMutex *sync.RWMutex, store map[string]*ttlEventKV, eventKV *server.KeyValue, now time.Duration) time.Duration {
 	rwMutex.Lock()
 	defer rwMutex.Unlock()
 	expires := time.Duration(eventKV.Lease) * time.Second
 	store[eventKV.Key] = &ttlEventKV{
 		key:         eventKV.Key,
+		lease:       eventKV.Lease,
 		modRevision: eventKV.ModRevision,
-		expiredAt:   time.Now().Add(expires),
+		expiresAt:   now + expires,
 	}
 	return expires
 }
 
 func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64) server.WatchResult {
-	logrus.Tracef("WATCH %s, revision=%d", prefix, revision)
+	util.RequestLogger(ctx).Tracef("WATCH %s, revision=%d", prefix, revision)
 
 	// starting watching right away so we don't miss anything
 	ctx, cancel := context.WithCancel(ctx)
@@ -431,31 +764,50 @@ func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64
 	errc := make(chan error, 1)
 	wr := server.WatchResult{Events: result, Errorc: errc}
 
-	rev, kvs, err := l.log.After(ctx, prefix, revision, 0)
-	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			logrus.Errorf("Failed to list %s for revision %d: %v", prefix, revision, err)
-			if err == server.ErrCompacted {
-				compact, _ := l.log.CompactRevision(ctx)
-				wr.CompactRevision = compact
-				wr.CurrentRevision = rev
-			} else {
+	backfill := true
+	if revision > 0 {
+		compact, err := l.log.CompactRevision(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				util.RequestLogger(ctx).Errorf("Failed to get compact revision for watch on %s: %v", prefix, err)
 				errc <- server.ErrGRPCUnhealthy
 			}
+			backfill = false
+			cancel()
+		} else if revision < compact {
+			rev, _ := l.log.CurrentRevision(ctx)
+			util.RequestLogger(ctx).Errorf("Failed to list %s for revision %d: %v", prefix, revision, server.ErrCompacted)
+			wr.CompactRevision = compact
+			wr.CurrentRevision = rev
+			backfill = false
+			cancel()
 		}
-		cancel()
 	}
 
-	logrus.Tracef("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, rev, len(kvs))
-
 	go func() {
 		lastRevision := revision
-		if len(kvs) > 0 {
-			lastRevision = rev
-		}
-
-		if len(kvs) > 0 {
-			result <- kvs
+		if backfill {
+			var count int
+			err := l.log.Backfill(ctx, prefix, revision, func(rev int64, events server.Events) error {
+				select {
+				case result <- events:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				lastRevision = rev
+				count += len(events)
+				return nil
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				util.RequestLogger(ctx).Errorf("Failed to list %s for revision %d: %v", prefix, revision, err)
+				if err == server.ErrCompacted {
+					errc <- server.ErrCompacted
+				} else {
+					errc <- server.ErrGRPCUnhealthy
+				}
+				cancel()
+			}
+			util.RequestLogger(ctx).Tracef("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, lastRevision, count)
 		}
 
 		// always ensure we fully read the channel
@@ -485,10 +837,88 @@ func (l *LogStructured) CurrentRevision(ctx context.Context) (int64, error) {
 	return l.log.CurrentRevision(ctx)
 }
 
+func (l *LogStructured) MinRevision(ctx context.Context) (int64, error) {
+	compactRev, err := l.log.CompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return compactRev + 1, nil
+}
+
+func (l *LogStructured) StorageStats(ctx context.Context) (*server.StorageStats, error) {
+	return l.log.StorageStats(ctx)
+}
+
+func (l *LogStructured) DriverConfig() *server.DriverConfig {
+	return l.log.DriverConfig()
+}
+
+func (l *LogStructured) Statements() map[string]string {
+	return l.log.Statements()
+}
+
+// SetKeyMetadata replaces the metadata of a key, which must exist. Metadata is stored
+// separately from the key's value, so setting it does not create a new revision.
+func (l *LogStructured) SetKeyMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	_, event, err := l.get(ctx, key, "", 1, 0, false, true)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return server.ErrKeyNotFound
+	}
+	return l.log.SetKeyMetadata(ctx, key, metadata)
+}
+
+func (l *LogStructured) GetKeyMetadata(ctx context.Context, key string) (map[string]string, error) {
+	return l.log.GetKeyMetadata(ctx, key)
+}
+
+// ListKeyMetadata returns the metadata of keys matching prefix, as for List, that include all
+// of the name/value pairs in filter.
+func (l *LogStructured) ListKeyMetadata(ctx context.Context, prefix string, filter map[string]string) (map[string]map[string]string, error) {
+	if strings.HasSuffix(prefix, "/") {
+		prefix += "%"
+	}
+	metadata, err := l.log.ListKeyMetadata(ctx, strings.ReplaceAll(prefix, `_`, `^_`))
+	if err != nil {
+		return nil, err
+	}
+	for key, m := range metadata {
+		for name, value := range filter {
+			if v, ok := m[name]; !ok || v != value {
+				delete(metadata, key)
+				break
+			}
+		}
+	}
+	return metadata, nil
+}
+
 func (l *LogStructured) Compact(ctx context.Context, revision int64) (int64, error) {
 	return l.log.Compact(ctx, revision)
 }
 
+func (l *LogStructured) CompactTo(ctx context.Context, revision int64) (int64, error) {
+	return l.log.CompactTo(ctx, revision)
+}
+
 func (l *LogStructured) WaitForSyncTo(revision int64) {
 	l.log.WaitForSyncTo(revision)
 }
+
+func (l *LogStructured) CompactConfig() (time.Duration, int64) {
+	return l.log.CompactConfig()
+}
+
+func (l *LogStructured) SetCompactInterval(interval time.Duration) error {
+	return l.log.SetCompactInterval(interval)
+}
+
+func (l *LogStructured) SetCompactBatchSize(batchSize int64) error {
+	return l.log.SetCompactBatchSize(batchSize)
+}
+
+func (l *LogStructured) ValidateCompactConfig(interval time.Duration, batchSize int64) error {
+	return l.log.ValidateCompactConfig(interval, batchSize)
+}
@@ -0,0 +1,87 @@
+package logstructured
+
+import (
+	"context"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// memLog is an in-memory log holding the latest event for each key. Calling any method that
+// is not needed to create, get and update keys will panic.
+type memLog struct {
+	Log
+	revision int64
+	events   map[string]*server.Event
+}
+
+func (m *memLog) CurrentRevision(ctx context.Context) (int64, error) {
+	return m.revision, nil
+}
+
+// List returns the latest event for a key; prefixes and revisions are not supported.
+func (m *memLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes, keysOnly bool) (int64, server.Events, error) {
+	if event, ok := m.events[prefix]; ok && (includeDeletes || !event.Delete) {
+		return m.revision, server.Events{event}, nil
+	}
+	return m.revision, nil, nil
+}
+
+func (m *memLog) Append(ctx context.Context, event *server.Event) (int64, error) {
+	m.revision++
+	kv := *event.KV
+	kv.ModRevision = m.revision
+	if event.Create {
+		kv.CreateRevision = m.revision
+	}
+	m.events[kv.Key] = &server.Event{Create: event.Create, Delete: event.Delete, KV: &kv, PrevKV: event.PrevKV}
+	return m.revision, nil
+}
+
+func TestElideNoopUpdates(t *testing.T) {
+	ctx := context.Background()
+	log := &memLog{events: map[string]*server.Event{}}
+	l := New(log)
+	l.SetElideNoopUpdates(true)
+
+	createRev, err := l.Create(ctx, "/a", []byte("v"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// repeated updates with the same value and lease succeed at the existing revision
+	for i := 0; i < 3; i++ {
+		rev, kv, updated, err := l.Update(ctx, "/a", []byte("v"), createRev, 0)
+		if err != nil || !updated {
+			t.Fatalf("failed to update key: updated=%v err=%v", updated, err)
+		}
+		if rev != createRev || kv.ModRevision != createRev {
+			t.Fatalf("expected update to report revision %d, got rev=%d kv=%#v", createRev, rev, kv)
+		}
+	}
+	if log.revision != createRev {
+		t.Fatalf("expected no writes after revision %d, got revision %d", createRev, log.revision)
+	}
+
+	// a changed value or lease is written as usual
+	rev, kv, updated, err := l.Update(ctx, "/a", []byte("w"), createRev, 0)
+	if err != nil || !updated {
+		t.Fatalf("failed to update key: updated=%v err=%v", updated, err)
+	}
+	if rev <= createRev || kv.ModRevision != rev || string(kv.Value) != "w" {
+		t.Fatalf("expected update to a new revision, got rev=%d kv=%#v", rev, kv)
+	}
+	leaseRev, kv, updated, err := l.Update(ctx, "/a", []byte("w"), rev, 60)
+	if err != nil || !updated {
+		t.Fatalf("failed to update key: updated=%v err=%v", updated, err)
+	}
+	if leaseRev <= rev || kv.Lease != 60 {
+		t.Fatalf("expected lease update to a new revision, got rev=%d kv=%#v", leaseRev, kv)
+	}
+
+	// without elision, every update is written
+	l.SetElideNoopUpdates(false)
+	if rev, _, _, err = l.Update(ctx, "/a", []byte("w"), leaseRev, 60); err != nil || rev <= leaseRev {
+		t.Fatalf("expected update to a new revision after %d, got rev=%d err=%v", leaseRev, rev, err)
+	}
+}
@@ -0,0 +1,45 @@
+package sqllog
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetCompactAnalyze enables refreshing the datastore's optimizer statistics after a compaction
+// that deletes at least threshold rows, so that queries are not planned against statistics
+// describing the rows that were removed. Refreshes are run at most once per interval; rows
+// deleted by compactions in between are counted towards the next refresh. A threshold of zero
+// or less disables refreshing. This must be called before the log is started.
+func (s *SQLLog) SetCompactAnalyze(threshold int64, interval time.Duration) {
+	s.compactAnalyzeThreshold = threshold
+	s.compactAnalyzeInterval = interval
+}
+
+// analyzeAfterCompact records the number of rows deleted by a compaction, and refreshes the
+// optimizer statistics once enough rows have been deleted since the last refresh.
+func (s *SQLLog) analyzeAfterCompact(deletedRows int64) {
+	if s.compactAnalyzeThreshold <= 0 {
+		return
+	}
+
+	s.compactAnalyzeMu.Lock()
+	defer s.compactAnalyzeMu.Unlock()
+	s.compactAnalyzeRows += deletedRows
+	if s.compactAnalyzeRows < s.compactAnalyzeThreshold || time.Since(s.compactAnalyzeTime) < s.compactAnalyzeInterval {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.compactTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.d.Analyze(ctx); err != nil {
+		logrus.Errorf("COMPACT failed to refresh statistics after deleting %d rows: %v", s.compactAnalyzeRows, err)
+		return
+	}
+	logrus.Infof("COMPACT refreshed statistics after deleting %d rows in %s", s.compactAnalyzeRows, time.Since(start).Round(time.Millisecond))
+	s.compactAnalyzeRows = 0
+	s.compactAnalyzeTime = start
+}
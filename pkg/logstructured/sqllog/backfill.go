@@ -0,0 +1,150 @@
+package sqllog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Watch backfill reads rows lazily from an open cursor, and hands them off in batches of
+// backfillBatchSize events, so that memory use does not grow with the number of revisions
+// being caught up. A cursor is held open for at most backfillCursorTimeout, so that a slow
+// watcher does not pin a database connection or snapshot indefinitely; when the cursor times
+// out or fails, backfill resumes with a new cursor after the last revision handed off.
+// Backfill fails if backfillMaxRetries consecutive cursors fail without reading any rows.
+const (
+	backfillBatchSize     = 100
+	backfillCursorTimeout = time.Minute
+	backfillMaxRetries    = 5
+)
+
+// Backfill calls f with batches of events matching prefix that have a revision greater than the
+// given revision, in revision order, along with the current revision as of the batch being read.
+// Rows are read from the database as f consumes them; f may block to apply backpressure, and
+// backfill stops if f returns an error. ErrCompacted is returned if the given revision has been
+// compacted before all events after it have been read.
+func (s *SQLLog) Backfill(ctx context.Context, prefix string, revision int64, f func(int64, server.Events) error) error {
+	if revision > 0 {
+		if rev, events, ok := s.history.after(prefix, revision); ok {
+			for len(events) > 0 {
+				n := min(len(events), s.backfillBatchSize)
+				if err := f(rev, events[:n]); err != nil {
+					return err
+				}
+				events = events[n:]
+			}
+			return nil
+		}
+	}
+
+	if isPrefix(prefix) {
+		prefix += "%"
+	}
+
+	last := revision
+	page, err := s.backfillPage(ctx, prefix, revision)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		logrus.Debugf("Resuming watch backfill for %s after revision %d: %v", prefix, last, err)
+	} else {
+		if revision > 0 && revision < page.compact {
+			return server.ErrCompacted
+		}
+		for events := page.events; len(events) > 0; {
+			n := min(len(events), s.backfillBatchSize)
+			if err := f(page.rev, events[:n]); err != nil {
+				return err
+			}
+			last = events[n-1].KV.ModRevision
+			events = events[n:]
+		}
+		if !page.full {
+			return nil
+		}
+	}
+
+	var failures int
+	for {
+		read, err := s.backfillCursor(ctx, prefix, revision, &last, f)
+		var herr handoffError
+		if errors.As(err, &herr) {
+			return herr.error
+		}
+		if err == nil || errors.Is(err, server.ErrCompacted) || ctx.Err() != nil {
+			return err
+		}
+		if read > 0 {
+			failures = 0
+		} else if failures++; failures >= backfillMaxRetries {
+			return err
+		}
+		logrus.Debugf("Resuming watch backfill for %s after revision %d: %v", prefix, last, err)
+	}
+}
+
+// handoffError wraps an error returned by the backfill callback, which ends backfill
+// instead of resuming with a new cursor.
+type handoffError struct {
+	error
+}
+
+// backfillCursor opens a cursor on the events after *last, and hands them off to f in batches,
+// updating *last to the revision of the last event handed off. It returns the number of rows read.
+func (s *SQLLog) backfillCursor(ctx context.Context, prefix string, revision int64, last *int64, f func(int64, server.Events) error) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.backfillCursorTimeout)
+	defer cancel()
+
+	rows, err := s.d.After(ctx, prefix, *last, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		rev, compact int64
+		read         int
+		batch        = make(server.Events, 0, s.backfillBatchSize)
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.loadValues(ctx, batch); err != nil {
+			return err
+		}
+		if err := f(rev, batch); err != nil {
+			return handoffError{err}
+		}
+		*last = batch[len(batch)-1].KV.ModRevision
+		batch = make(server.Events, 0, s.backfillBatchSize)
+		return nil
+	}
+
+	for rows.Next() {
+		event := &server.Event{}
+		if err := scan(rows, &rev, &compact, event, true, true); err != nil {
+			return read, err
+		}
+		if read == 0 && revision > 0 && *last < compact {
+			return read, server.ErrCompacted
+		}
+		read++
+		batch = append(batch, event)
+		if len(batch) >= s.backfillBatchSize {
+			if err := flush(); err != nil {
+				return read, err
+			}
+		}
+	}
+	// events read before a cursor error are still handed off, so that the next cursor
+	// resumes after them
+	if err := flush(); err != nil {
+		return read, err
+	}
+	return read, rows.Err()
+}
@@ -0,0 +1,66 @@
+package sqllog
+
+import (
+	"strings"
+)
+
+// SetCompactExclude configures keys whose history is never compacted, as configured on the
+// dialect: either exact keys, or prefixes ending in / that match all keys under them. Reads
+// limited to excluded keys are served at revisions below the compact revision, instead of
+// failing with ErrCompacted. Only history written while the keys were excluded is available;
+// rows compacted before that are not restored. This must be called before the log is started.
+func (s *SQLLog) SetCompactExclude(keys []string) {
+	s.compactExclude = keys
+}
+
+// excludedKey returns true if key is excluded from compaction.
+func (s *SQLLog) excludedKey(key string) bool {
+	for _, exclude := range s.compactExclude {
+		if key == exclude || (strings.HasSuffix(exclude, "/") && strings.HasPrefix(key, exclude)) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedPattern returns true if all keys matching a List prefix are excluded from compaction.
+// The prefix is a LIKE pattern that is either an exact key, or a prefix followed by %, with
+// underscores escaped.
+func (s *SQLLog) excludedPattern(pattern string) bool {
+	if len(s.compactExclude) == 0 {
+		return false
+	}
+	key, isPrefix := strings.CutSuffix(pattern, "%")
+	if strings.Contains(key, "%") {
+		return false
+	}
+	key = strings.ReplaceAll(key, `^_`, `_`)
+	if !isPrefix {
+		return s.excludedKey(key)
+	}
+	for _, exclude := range s.compactExclude {
+		if strings.HasSuffix(exclude, "/") && strings.HasPrefix(key, exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedRange returns true if all keys in the range [startKey, endKey) are excluded from
+// compaction.
+func (s *SQLLog) excludedRange(startKey, endKey string) bool {
+	if endKey == "" {
+		return false
+	}
+	for _, exclude := range s.compactExclude {
+		if strings.HasSuffix(exclude, "/") {
+			// all keys under the prefix sort before the prefix with its / replaced by 0
+			if strings.HasPrefix(startKey, exclude) && endKey <= exclude[:len(exclude)-1]+"0" {
+				return true
+			}
+		} else if startKey == exclude && endKey == exclude+"\x00" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package sqllog
+
+import (
+	"context"
+	"sync"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"golang.org/x/sync/singleflight"
+)
+
+// Queries made to establish a watch are coalesced, so that a burst of new watches, such as
+// when the apiserver starts its watch caches, does not issue a query per watch. Concurrent
+// reads of the compact or current revision share a single query, and concurrent backfills on
+// the same prefix share a single query for their first page of events, as long as the page
+// starts at or before the revision that each backfill starts from.
+type establishGroup struct {
+	flight singleflight.Group
+
+	mu    sync.Mutex
+	pages map[string][]*backfillPage
+}
+
+// backfillPage is the first page of events after a revision, shared by concurrent backfills.
+type backfillPage struct {
+	revision int64
+	done     chan struct{}
+	rev      int64
+	compact  int64
+	events   server.Events
+	// full is set if the page may not hold all of the events after the revision
+	full bool
+	err  error
+}
+
+// coalesce calls f, unless a call for the same key is already in progress, in which case the
+// result of that call is returned. f is called with a context that is not canceled with ctx,
+// as the result may be shared with other callers.
+func (g *establishGroup) coalesce(ctx context.Context, key string, f func(context.Context) (int64, error)) (int64, error) {
+	ch := g.flight.DoChan(key, func() (any, error) {
+		return f(context.WithoutCancel(ctx))
+	})
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return 0, r.Err
+		}
+		return r.Val.(int64), nil
+	}
+}
+
+// backfillPage returns the first page of events matching prefix with a revision greater than
+// the given revision, sharing the query with any backfill on the same prefix that is in progress
+// from the same or an earlier revision. Events at or below the given revision are not returned.
+func (s *SQLLog) backfillPage(ctx context.Context, prefix string, revision int64) (*backfillPage, error) {
+	g := &s.establish
+	g.mu.Lock()
+	var page *backfillPage
+	for _, p := range g.pages[prefix] {
+		if p.revision <= revision {
+			page = p
+			break
+		}
+	}
+	if page == nil {
+		page = &backfillPage{revision: revision, done: make(chan struct{})}
+		if g.pages == nil {
+			g.pages = map[string][]*backfillPage{}
+		}
+		g.pages[prefix] = append(g.pages[prefix], page)
+		go s.readBackfillPage(context.WithoutCancel(ctx), prefix, page)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-page.done:
+	}
+	if page.err != nil {
+		return nil, page.err
+	}
+
+	events := page.events
+	for len(events) > 0 && events[0].KV.ModRevision <= revision {
+		events = events[1:]
+	}
+	return &backfillPage{
+		revision: revision,
+		rev:      page.rev,
+		compact:  page.compact,
+		events:   events,
+		full:     page.full,
+	}, nil
+}
+
+func (s *SQLLog) readBackfillPage(ctx context.Context, prefix string, page *backfillPage) {
+	defer close(page.done)
+	defer func() {
+		g := &s.establish
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		pages := g.pages[prefix]
+		for i, p := range pages {
+			if p == page {
+				pages = append(pages[:i], pages[i+1:]...)
+				break
+			}
+		}
+		if len(pages) == 0 {
+			delete(g.pages, prefix)
+		} else {
+			g.pages[prefix] = pages
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, s.backfillCursorTimeout)
+	defer cancel()
+
+	rows, err := s.d.After(ctx, prefix, page.revision, int64(s.backfillBatchSize))
+	if err != nil {
+		page.err = err
+		return
+	}
+	page.rev, page.compact, page.events, page.err = RowsToEvents(rows, true, true)
+	if page.err == nil {
+		page.err = s.loadValues(ctx, page.events)
+	}
+	page.full = len(page.events) >= s.backfillBatchSize
+}
@@ -0,0 +1,98 @@
+package sqllog
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// fanout delivers polled events to all watches on a single prefix. Each batch is filtered
+// once for the prefix, and the same filtered batch is sent to every watch, instead of each
+// watch filtering every batch for itself.
+type fanout struct {
+	subs   map[chan server.Events]struct{}
+	cancel context.CancelFunc
+}
+
+// SetWatchSharedDelivery configures watches on the same prefix to share a single subscription
+// to polled events, so that the cost of filtering each batch does not grow with the number of
+// watches on a hot prefix. A watch that does not keep up is closed, as if it were dropped by
+// the broadcaster. This must be called before the log is started.
+func (s *SQLLog) SetWatchSharedDelivery(enabled bool) {
+	s.watchSharedDelivery = enabled
+}
+
+// watchShared returns a channel of events matching prefix, delivered by the fanout for prefix.
+func (s *SQLLog) watchShared(ctx context.Context, prefix string) <-chan server.Events {
+	s.fanoutMu.Lock()
+	defer s.fanoutMu.Unlock()
+
+	f, ok := s.fanouts[prefix]
+	if !ok {
+		fctx, cancel := context.WithCancel(s.ctx)
+		values, err := s.broadcaster.Subscribe(fctx, s.startWatch)
+		if err != nil {
+			cancel()
+			return nil
+		}
+		f = &fanout{subs: map[chan server.Events]struct{}{}, cancel: cancel}
+		if s.fanouts == nil {
+			s.fanouts = map[string]*fanout{}
+		}
+		s.fanouts[prefix] = f
+		go s.deliver(prefix, f, values)
+	}
+
+	res := make(chan server.Events, 100)
+	f.subs[res] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		s.fanoutMu.Lock()
+		defer s.fanoutMu.Unlock()
+		s.unsub(prefix, f, res)
+	}()
+	return res
+}
+
+// deliver sends each batch of events matching prefix to the subscribers of f, until the
+// broadcaster closes its subscription.
+func (s *SQLLog) deliver(prefix string, f *fanout, values <-chan server.Events) {
+	checkPrefix := isPrefix(prefix)
+	for i := range values {
+		events, ok := filter(i, checkPrefix, prefix)
+		if !ok {
+			continue
+		}
+		s.fanoutMu.Lock()
+		for sub := range f.subs {
+			select {
+			case sub <- events:
+			default:
+				// Slow consumer, drop
+				s.unsub(prefix, f, sub)
+			}
+		}
+		s.fanoutMu.Unlock()
+	}
+
+	s.fanoutMu.Lock()
+	defer s.fanoutMu.Unlock()
+	for sub := range f.subs {
+		s.unsub(prefix, f, sub)
+	}
+}
+
+// unsub closes a subscriber of f, and stops f once it has none. The caller must hold fanoutMu.
+func (s *SQLLog) unsub(prefix string, f *fanout, sub chan server.Events) {
+	if _, ok := f.subs[sub]; !ok {
+		return
+	}
+	close(sub)
+	delete(f.subs, sub)
+	if len(f.subs) == 0 {
+		if s.fanouts[prefix] == f {
+			delete(s.fanouts, prefix)
+		}
+		f.cancel()
+	}
+}
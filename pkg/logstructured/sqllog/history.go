@@ -0,0 +1,201 @@
+package sqllog
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// eventHistory holds the most recent events sent to watchers, so that watches
+// starting at a recent revision can be caught up from memory instead of querying
+// the database. It holds every event with a revision greater than start, up to
+// and including end, with the oldest events evicted once more than size are held.
+//
+// If window is set, events more than window revisions older than end are compacted:
+// an event is dropped once a later event for the same key is held, so that churn on
+// a few keys does not fill the history. Watches starting within the window are still
+// served exactly; a watch starting before it is served from memory only if none of
+// the events it would receive have been dropped.
+type eventHistory struct {
+	sync.RWMutex
+	size   int
+	window int64
+	start  int64
+	end    int64
+	events server.Events
+
+	// exact is the revision after which no events have been compacted
+	exact int64
+	// latest is the revision of the latest held event of each key, and superseded the
+	// revision of the latest dropped event of each key, if it is greater than start
+	latest     map[string]int64
+	superseded map[string]int64
+	// stale is set if an event older than exact may have been superseded since it was compacted
+	stale bool
+}
+
+// SetWatchHistorySize configures the number of recent events held in memory, so that watches
+// starting at a recent revision can be caught up without querying the datastore. A size of zero
+// or less disables the history. This must be called before the log is started.
+func (s *SQLLog) SetWatchHistorySize(size int) {
+	s.history.size = size
+}
+
+// SetWatchHistoryWindow configures compaction of the in-memory watch history: events more than
+// window revisions older than the latest polled revision are dropped once superseded by a later
+// event for the same key. A window of zero or less disables compaction. This must be called
+// before the log is started.
+func (s *SQLLog) SetWatchHistoryWindow(window int64) {
+	s.history.window = max(window, 0)
+}
+
+// reset discards all held events, and starts recording from the given revision.
+func (h *eventHistory) reset(revision int64) {
+	h.Lock()
+	defer h.Unlock()
+	h.start = revision
+	h.end = revision
+	h.exact = revision
+	h.events = nil
+	h.latest = nil
+	h.superseded = nil
+	h.stale = false
+}
+
+// append records events polled up to and including the given revision.
+// Revisions without an event, such as gap fills, only advance the end revision.
+func (h *eventHistory) append(events server.Events, revision int64) {
+	if h.size <= 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, events...)
+	h.end = revision
+	if h.window > 0 {
+		if h.latest == nil {
+			h.latest = map[string]int64{}
+			h.superseded = map[string]int64{}
+		}
+		for _, event := range events {
+			if h.latest[event.KV.Key] <= h.exact && h.latest[event.KV.Key] > h.start {
+				h.stale = true
+			}
+			h.latest[event.KV.Key] = event.KV.ModRevision
+		}
+		h.compactWindow()
+	}
+	if n := len(h.events) - h.size; n > 0 {
+		h.evict(n)
+	}
+}
+
+// compactWindow drops events more than window revisions older than end that have been
+// superseded by a later event for the same key.
+func (h *eventHistory) compactWindow() {
+	boundary := max(h.end-h.window, h.exact)
+	if boundary == h.exact && !h.stale {
+		return
+	}
+
+	// unless a compacted event may have been superseded, only events newer than exact are scanned
+	i := 0
+	if !h.stale {
+		i = sort.Search(len(h.events), func(i int) bool { return h.events[i].KV.ModRevision > h.exact })
+	}
+	w := i
+	for ; i < len(h.events) && h.events[i].KV.ModRevision <= boundary; i++ {
+		event := h.events[i]
+		if h.latest[event.KV.Key] > event.KV.ModRevision {
+			h.superseded[event.KV.Key] = max(h.superseded[event.KV.Key], event.KV.ModRevision)
+			continue
+		}
+		h.events[w] = event
+		w++
+	}
+	if w < i {
+		n := copy(h.events[w:], h.events[i:])
+		clear(h.events[w+n:])
+		h.events = h.events[:w+n]
+	}
+	h.exact = boundary
+	h.stale = false
+}
+
+// evict drops the oldest n held events.
+func (h *eventHistory) evict(n int) {
+	h.start = h.events[n-1].KV.ModRevision
+	for _, event := range h.events[:n] {
+		if h.latest[event.KV.Key] == event.KV.ModRevision {
+			delete(h.latest, event.KV.Key)
+		}
+	}
+	h.events = h.events[n:]
+	h.exact = max(h.exact, h.start)
+	// entries at or below start no longer affect which watches can be served, and are
+	// pruned once there are more of them than held events
+	if len(h.superseded) > len(h.events) {
+		for key, revision := range h.superseded {
+			if revision <= h.start {
+				delete(h.superseded, key)
+			}
+		}
+	}
+}
+
+// compact drops events at or below the compact revision, so that watches on
+// compacted revisions are served from the database, which reports them as compacted.
+func (h *eventHistory) compact(revision int64) {
+	h.Lock()
+	defer h.Unlock()
+	if revision <= h.start {
+		return
+	}
+	i := 0
+	for i < len(h.events) && h.events[i].KV.ModRevision <= revision {
+		i++
+	}
+	if i > 0 {
+		h.evict(i)
+	}
+	h.start = revision
+	h.exact = max(h.exact, h.start)
+}
+
+// after returns the held events matching prefix with a revision greater than the
+// given revision, and the revision up to which events are held. It returns false if
+// events after the given revision are not all held in memory.
+func (h *eventHistory) after(prefix string, revision int64) (int64, server.Events, bool) {
+	if h.size <= 0 {
+		return 0, nil, false
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+	if revision < h.start || revision > h.end {
+		metrics.WatchHistoryTotal.WithLabelValues(metrics.ResultMiss).Inc()
+		return 0, nil, false
+	}
+
+	var result server.Events
+	checkPrefix := isPrefix(prefix)
+	for _, event := range h.events {
+		if event.KV.ModRevision <= revision {
+			continue
+		}
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			// an event that the watch would receive was dropped by compaction
+			if revision < h.exact && h.superseded[event.KV.Key] > revision {
+				metrics.WatchHistoryTotal.WithLabelValues(metrics.ResultMiss).Inc()
+				return 0, nil, false
+			}
+			result = append(result, event)
+		}
+	}
+	metrics.WatchHistoryTotal.WithLabelValues(metrics.ResultHit).Inc()
+	return h.end, result, true
+}
@@ -0,0 +1,45 @@
+package sqllog
+
+import (
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+)
+
+// Once writes are sustained, the poll loop reads ahead: instead of querying as soon as it is
+// notified of a new revision, it waits for notification of up to watchPrefetch revisions past
+// those already polled, for at most watchPrefetchDelay, so that they are read by a single query.
+// A window that fills is a hit; one that times out is a miss, and returns the loop to querying
+// on each notification until writes are again sustained.
+const (
+	watchPrefetchActivity = 3
+	watchPrefetchDelay    = 10 * time.Millisecond
+)
+
+// SetWatchPrefetch configures the number of revisions that the poll loop waits to be notified
+// of before querying, while writes are sustained. A size of zero or less disables read-ahead.
+// This must be called before the log is started.
+func (s *SQLLog) SetWatchPrefetch(size int64) {
+	s.watchPrefetch = max(size, 0)
+}
+
+// prefetchWait waits for notification of revisions up to pollRevision plus the prefetch size,
+// given that check has been notified. It returns false if the window timed out, or the log
+// was stopped.
+func (s *SQLLog) prefetchWait(check, pollRevision int64) bool {
+	t := time.NewTimer(s.watchPrefetchDelay)
+	defer t.Stop()
+	for target := pollRevision + s.watchPrefetch; check < target; {
+		select {
+		case <-s.ctx.Done():
+			return false
+		case rev := <-s.notify:
+			check = max(check, rev)
+		case <-t.C:
+			metrics.WatchPrefetchTotal.WithLabelValues(metrics.ResultMiss).Inc()
+			return false
+		}
+	}
+	metrics.WatchPrefetchTotal.WithLabelValues(metrics.ResultHit).Inc()
+	return true
+}
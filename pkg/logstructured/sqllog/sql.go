@@ -1,6 +1,7 @@
 package sqllog
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
@@ -14,11 +15,34 @@ import (
 	"github.com/k3s-io/kine/pkg/broadcaster"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/valuestore"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 const minCompactBatchSize = 100
 
+// txIsolation is the isolation level of compaction transactions.
+const txIsolation = sql.LevelSerializable
+
+// compactBurstInterval is the delay between compactions while catching up on a compaction backlog.
+const compactBurstInterval = 10 * time.Second
+
+// Failed poll queries are retried after a delay that starts at pollRetryMinBackoff
+// and doubles with each consecutive failure, up to pollRetryMaxBackoff.
+const (
+	pollRetryMinBackoff = 100 * time.Millisecond
+	pollRetryMaxBackoff = 5 * time.Second
+)
+
+// Externally stored values are loaded with up to maxValueLoads requests at a time. Loads for a
+// poll are abandoned after pollLoadTimeout, and retried along with the poll query, so that a slow
+// object store delays watches by a bounded amount rather than stalling them.
+const (
+	maxValueLoads   = 16
+	pollLoadTimeout = 10 * time.Second
+)
+
 type SQLLog struct {
 	sync.RWMutex
 
@@ -29,32 +53,84 @@ type SQLLog struct {
 	currentRev            atomic.Int64
 	polledRev             atomic.Int64
 	polled                *sync.Cond
-	compactInterval       time.Duration
+	compactInterval       atomic.Int64
 	compactIntervalJitter int
 	compactTimeout        time.Duration
 	compactMinRetain      int64
-	compactBatchSize      int64
+	compactBatchSize      atomic.Int64
+	compactBurstThreshold int64
+	compactExclude        []string
+	compactBurstInterval  time.Duration
+	compactBursting       atomic.Bool
+	compactReset          chan struct{}
+
+	compactAnalyzeThreshold int64
+	compactAnalyzeInterval  time.Duration
+	compactAnalyzeMu        sync.Mutex
+	compactAnalyzeRows      int64
+	compactAnalyzeTime      time.Time
+
+	compactMinInterval  time.Duration
+	compactManualBypass bool
+	compactRunMu        sync.Mutex
+	compactLastRun      time.Time
+
 	pollBatchSize         int64
+	pollRetryMinBackoff   time.Duration
+	pollRetryMaxBackoff   time.Duration
+	backfillBatchSize     int
+	backfillCursorTimeout time.Duration
+	history               eventHistory
+	watchSharedDelivery   bool
+	fanoutMu              sync.Mutex
+	fanouts               map[string]*fanout
+	establish             establishGroup
+	values                *valuestore.Values
+	watchPrefetch         int64
+	watchPrefetchDelay    time.Duration
+	compactVerify         bool
+	readTimeout           time.Duration
+	writeTimeout          time.Duration
 }
 
 func New(d server.Dialect, compactInterval time.Duration, compactIntervalJitter int, compactTimeout time.Duration, compactMinRetain int64, compactBatchSize int64, pollBatchSize int64) *SQLLog {
 	l := &SQLLog{
 		d:                     d,
 		notify:                make(chan int64, 1024),
-		compactInterval:       compactInterval,
 		compactIntervalJitter: compactIntervalJitter,
 		compactTimeout:        compactTimeout,
 		compactMinRetain:      compactMinRetain,
-		compactBatchSize:      compactBatchSize,
+		compactBurstInterval:  compactBurstInterval,
+		compactReset:          make(chan struct{}, 1),
 		pollBatchSize:         pollBatchSize,
+		pollRetryMinBackoff:   pollRetryMinBackoff,
+		pollRetryMaxBackoff:   pollRetryMaxBackoff,
+		backfillBatchSize:     backfillBatchSize,
+		backfillCursorTimeout: backfillCursorTimeout,
+		watchPrefetchDelay:    watchPrefetchDelay,
 	}
+	l.compactInterval.Store(int64(compactInterval))
+	l.compactBatchSize.Store(compactBatchSize)
 	l.polled = sync.NewCond(l.RLocker())
 	return l
 }
 
+// SetExternalValues enables storing large values externally. This must be called before the
+// log is started.
+func (s *SQLLog) SetExternalValues(values *valuestore.Values) {
+	s.values = values
+}
+
+// SetCompactBurstThreshold configures the compaction backlog, in revisions, above which
+// compaction runs back-to-back at startup until caught up. A threshold of zero or less
+// disables bursting. This must be called before the log is started.
+func (s *SQLLog) SetCompactBurstThreshold(threshold int64) {
+	s.compactBurstThreshold = max(threshold, 0)
+}
+
 func (s *SQLLog) Start(ctx context.Context) error {
-	if s.compactBatchSize < minCompactBatchSize {
-		return fmt.Errorf("compact-batch-size %d too small: must be at least %d", s.compactBatchSize, minCompactBatchSize)
+	if err := validateCompactBatchSize(s.compactBatchSize.Load()); err != nil {
+		return err
 	}
 
 	s.ctx = ctx
@@ -89,7 +165,7 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 		return nil
 	}
 
-	t, err := s.d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	t, err := s.d.BeginTx(ctx, &sql.TxOptions{Isolation: txIsolation})
 	if err != nil {
 		return err
 	}
@@ -124,24 +200,133 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 // In other words, after compaction, it will only contain key revisions set during last interval.
 // Any API call for the older versions of keys will return error.
 // Interval is the time interval between each compaction. The first compaction happens after "interval".
+// The interval is re-read before each wait, so changes made via SetCompactInterval take effect without a restart.
+// If the compaction backlog at startup exceeds the burst threshold, the compactor instead runs
+// immediately and then every compactBurstInterval, compacting up to the current revision, until
+// the backlog has been worked off; it then returns to the normal interval.
 // This logic is directly cribbed from k8s.io/apiserver/pkg/storage/etcd3/compact.go
-func (s *SQLLog) compactor(interval time.Duration) {
-	t := time.NewTicker(interval)
-	defer t.Stop()
+func (s *SQLLog) compactor() {
 	compactRev, _ := s.d.GetCompactRevision(s.ctx)
 	targetCompactRev, _ := s.CurrentRevision(s.ctx)
 
+	if backlog := s.compactBacklog(compactRev, targetCompactRev); s.compactBurstThreshold > 0 && backlog > s.compactBurstThreshold {
+		logrus.Infof("COMPACT backlog of %d revisions exceeds burst threshold %d, catching up", backlog, s.compactBurstThreshold)
+		s.compactBursting.Store(true)
+	}
+
+	t := time.NewTimer(s.compactDelay())
+	defer t.Stop()
+
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
+		case <-s.compactReset:
+			t.Reset(s.compactDelay())
+			continue
 		case <-t.C:
 		}
-		compactRev, targetCompactRev = s.compactIter(compactRev, targetCompactRev)
+		if s.compactBursting.Load() {
+			targetCompactRev, _ = s.CurrentRevision(s.ctx)
+		}
+		compactRev, targetCompactRev, _ = s.compactThrottled(compactRev, targetCompactRev, false)
+		if s.compactBursting.Load() && s.compactBacklog(compactRev, targetCompactRev) <= s.compactBurstThreshold {
+			logrus.Infof("COMPACT backlog caught up, returning to normal compact interval")
+			s.compactBursting.Store(false)
+		}
+		t.Reset(s.compactDelay())
+	}
+}
+
+// compactBacklog returns the number of revisions that are eligible for compaction
+// but have not yet been compacted.
+func (s *SQLLog) compactBacklog(compactRev, currentRev int64) int64 {
+	return safeCompactRev(currentRev, currentRev, s.compactMinRetain) - compactRev
+}
+
+// compactDelay returns the time to wait before the next compaction.
+func (s *SQLLog) compactDelay() time.Duration {
+	if s.compactBursting.Load() {
+		return s.compactBurstInterval
 	}
+	return s.compactIntervalWithJitter()
+}
+
+// compactIntervalWithJitter returns the current compact interval, with jitter applied.
+func (s *SQLLog) compactIntervalWithJitter() time.Duration {
+	interval := time.Duration(s.compactInterval.Load())
+	maxJitter := float64(s.compactIntervalJitter) / 100.0 * float64(interval)
+	return interval + time.Duration(rand.Float64()*2*maxJitter-maxJitter)
+}
+
+// CompactConfig returns the current compact interval and batch size.
+func (s *SQLLog) CompactConfig() (time.Duration, int64) {
+	return time.Duration(s.compactInterval.Load()), s.compactBatchSize.Load()
 }
 
-func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64) {
+// SetCompactInterval changes the interval between automatic compactions. The compactor
+// is woken up to restart its wait with the new interval. Automatic compaction cannot be
+// enabled or disabled at runtime.
+func (s *SQLLog) SetCompactInterval(interval time.Duration) error {
+	if err := s.validateCompactInterval(interval); err != nil {
+		return err
+	}
+	old := time.Duration(s.compactInterval.Swap(int64(interval)))
+	logrus.Infof("COMPACT interval changed from %s to %s", old, interval)
+	select {
+	case s.compactReset <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetCompactBatchSize changes the number of revisions compacted in a single transaction.
+// The new batch size is used from the next compaction.
+func (s *SQLLog) SetCompactBatchSize(batchSize int64) error {
+	if err := validateCompactBatchSize(batchSize); err != nil {
+		return err
+	}
+	old := s.compactBatchSize.Swap(batchSize)
+	logrus.Infof("COMPACT batch size changed from %d to %d", old, batchSize)
+	return nil
+}
+
+// ValidateCompactConfig returns an error if SetCompactInterval or SetCompactBatchSize would
+// reject the given values, so that both can be checked before either is changed. Zero values
+// are not checked.
+func (s *SQLLog) ValidateCompactConfig(interval time.Duration, batchSize int64) error {
+	if interval != 0 {
+		if err := s.validateCompactInterval(interval); err != nil {
+			return err
+		}
+	}
+	if batchSize != 0 {
+		return validateCompactBatchSize(batchSize)
+	}
+	return nil
+}
+
+func (s *SQLLog) validateCompactInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("compact-interval %s invalid: must be greater than zero", interval)
+	}
+	if s.compactInterval.Load() <= 0 {
+		return errors.New("automatic compaction is disabled")
+	}
+	return nil
+}
+
+func validateCompactBatchSize(batchSize int64) error {
+	if batchSize < minCompactBatchSize {
+		return fmt.Errorf("compact-batch-size %d too small: must be at least %d", batchSize, minCompactBatchSize)
+	}
+	return nil
+}
+
+// compactIter compacts from compactRev to targetCompactRev in batches, and returns the
+// compact revision and the revision to compact to next time. Errors are logged and
+// counted; any error other than ErrCompacted is also returned.
+func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64, error) {
 	logrus.Tracef("COMPACT running compactRev=%d targetCompactRev=%d", compactRev, targetCompactRev)
 	// Break up the compaction into smaller batches to avoid locking the database with excessively
 	// long transactions. When things are working normally deletes should proceed quite quickly, but if
@@ -153,12 +338,14 @@ func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64)
 		iterCompactRev int64
 		iterStart      time.Time
 		iterCount      int64
+		deletedRows    int64
 		compactedRev   int64
 		currentRev     int64
 		err            error
 	)
 
 	resultLabel = metrics.ResultSuccess
+	batchSize := s.compactBatchSize.Load()
 	iterCompactRev = compactRev
 	compactedRev = compactRev
 	iterStart = time.Now()
@@ -168,18 +355,19 @@ func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64)
 		// Set move iteration target compactBatchSize revisions forward, or
 		// just as far as we need to hit the compaction target if that would
 		// overshoot it.
-		iterCompactRev += s.compactBatchSize
+		iterCompactRev += batchSize
 		if iterCompactRev > targetCompactRev {
 			iterCompactRev = targetCompactRev
 		}
 
 		// only update the compacted and current revisions if they are valid,
 		// but break out of the loop on any error.
-		compacted, current, cerr := s.compact(compactedRev, iterCompactRev)
+		compacted, current, deleted, cerr := s.compact(compactedRev, iterCompactRev)
 		if compacted != 0 && current != 0 {
 			compactedRev = compacted
 			currentRev = current
 		}
+		deletedRows += deleted
 		if cerr != nil {
 			err = cerr
 			break
@@ -194,6 +382,7 @@ func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64)
 		if perr := s.postCompact(); perr != nil {
 			logrus.Errorf("Post-compact operations failed: %v", perr)
 		}
+		s.analyzeAfterCompact(deletedRows)
 	}
 
 	// Only store the final results for this compact interval if currentRev is
@@ -204,17 +393,20 @@ func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64)
 	if currentRev > 0 {
 		compactRev = compactedRev
 		targetCompactRev = currentRev
+		s.history.compact(compactRev)
 	}
 
 	// ErrCompacted indicates that no further work is necessary - either compactRev changed since the
 	// last iteration because another client has compacted, or the requested revision has already been compacted.
-	if err != nil && err != server.ErrCompacted {
+	if err == server.ErrCompacted {
+		err = nil
+	} else if err != nil {
 		logrus.Errorf("Compact failed: %v", err)
 		resultLabel = metrics.ResultError
 	}
 	metrics.CompactTotal.WithLabelValues(resultLabel).Inc()
 
-	return compactRev, targetCompactRev
+	return compactRev, targetCompactRev, err
 }
 
 // compact removes deleted or replaced rows from the database, and updates the compact rev key.
@@ -222,36 +414,37 @@ func (s *SQLLog) compactIter(compactRev, targetCompactRev int64) (int64, int64)
 // If compactRev does not match what's in the database, we know that someone else has compacted and we don't need to do it.
 // Deletion of rows and update of the compact rev key is done within a single transaction. The transaction is rolled back on any error.
 //
-// On success, the function returns the revision compacted to, and the revision that we should try to compact to next time (the current revision).
+// On success, the function returns the revision compacted to, the revision that we should try to compact to next time (the current revision),
+// and the number of rows deleted.
 // ErrCompacted is returned if the current revision is stale, or the target revision has already been compacted.
 // In this case the compact and current revisions from the database are returned.
 // On any other error, the returned compact and current revisions should not be used.
 //
 // This logic is cribbed from k8s.io/apiserver/pkg/storage/etcd3/compact.go
-func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64, error) {
+func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64, int64, error) {
 	ctx, cancel := context.WithTimeout(s.ctx, s.compactTimeout)
 	defer cancel()
 
-	t, err := s.d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	t, err := s.d.BeginTx(ctx, &sql.TxOptions{Isolation: txIsolation})
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+		return 0, 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer t.MustRollback()
 
 	currentRev, err := t.CurrentRevision(s.ctx)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get current revision: %w", err)
+		return 0, 0, 0, fmt.Errorf("failed to get current revision: %w", err)
 	}
 
 	dbCompactRev, err := t.GetCompactRevision(s.ctx)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get compact revision: %w", err)
+		return 0, 0, 0, fmt.Errorf("failed to get compact revision: %w", err)
 	}
 
 	// Check to see if another node already compacted. This is normal on a multi-server cluster.
 	if compactRev != dbCompactRev {
 		logrus.Infof("COMPACT compact revision changed since last iteration: %d => %d", compactRev, dbCompactRev)
-		return dbCompactRev, currentRev, server.ErrCompacted
+		return dbCompactRev, currentRev, 0, server.ErrCompacted
 	}
 
 	// Ensure that we never compact the most recent 1000 revisions
@@ -260,19 +453,36 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 	// Don't bother compacting to a revision that has already been compacted
 	if targetCompactRev <= compactRev {
 		logrus.Tracef("COMPACT revision %d has already been compacted", targetCompactRev)
-		return dbCompactRev, currentRev, server.ErrCompacted
+		return dbCompactRev, currentRev, 0, server.ErrCompacted
 	}
 
 	logrus.Infof("COMPACT compactRev=%d targetCompactRev=%d currentRev=%d", compactRev, targetCompactRev, currentRev)
 
+	var externalValues [][]byte
+	if s.values != nil {
+		if externalValues, err = t.CompactValues(s.ctx, compactRev, targetCompactRev); err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to list values to compact to revision %d: %w", targetCompactRev, err)
+		}
+	}
+
+	// verification is best-effort, and never prevents compaction
+	var live liveDigest
+	verify := s.compactVerify
+	if verify {
+		if live.count, live.sum, err = t.LiveDigest(s.ctx, targetCompactRev); err != nil {
+			logrus.Warnf("COMPACT verification of revision %d skipped: failed to read live rows: %v", targetCompactRev, err)
+			verify = false
+		}
+	}
+
 	start := time.Now()
-	deletedRows, err := t.Compact(s.ctx, targetCompactRev)
+	deletedRows, err := t.Compact(s.ctx, compactRev, targetCompactRev)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to compact to revision %d: %w", targetCompactRev, err)
+		return 0, 0, 0, fmt.Errorf("failed to compact to revision %d: %w", targetCompactRev, err)
 	}
 
 	if err := t.SetCompactRevision(s.ctx, targetCompactRev); err != nil {
-		return 0, 0, fmt.Errorf("failed to record compact revision: %w", err)
+		return 0, 0, 0, fmt.Errorf("failed to record compact revision: %w", err)
 	}
 
 	// only commit the transaction if we make it all the way through deleting and
@@ -281,7 +491,19 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 	t.MustCommit()
 	logrus.Infof("COMPACT deleted %d rows from %d revisions in %s - compacted to %d/%d", deletedRows, (targetCompactRev - compactRev), time.Since(start), targetCompactRev, currentRev)
 
-	return targetCompactRev, currentRev, nil
+	// externally stored values are only deleted once the rows referencing them are gone; a
+	// failure here leaves an unreferenced object behind, but never a dangling pointer.
+	for _, value := range externalValues {
+		if err := s.values.Delete(ctx, value); err != nil {
+			logrus.Errorf("COMPACT failed to delete external value: %v", err)
+		}
+	}
+
+	if verify {
+		s.verifyCompact(targetCompactRev, live)
+	}
+
+	return targetCompactRev, currentRev, deletedRows, nil
 }
 
 // postCompact executes any post-compact database cleanup - vacuuming, WAL truncate, etc.
@@ -294,7 +516,7 @@ func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
 	if currRev != 0 {
 		return currRev, nil
 	}
-	lastRev, err := s.d.CurrentRevision(ctx)
+	lastRev, err := s.establish.coalesce(ctx, "current", s.d.CurrentRevision)
 	if err != nil {
 		return lastRev, err
 	}
@@ -305,20 +527,32 @@ func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
 }
 
 func (s *SQLLog) CompactRevision(ctx context.Context) (int64, error) {
-	return s.d.GetCompactRevision(ctx)
+	return s.establish.coalesce(ctx, "compact", s.d.GetCompactRevision)
 }
 
 func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64) (int64, server.Events, error) {
-	if strings.HasSuffix(prefix, "/") {
+	if revision > 0 && limit == 0 {
+		if rev, result, ok := s.history.after(prefix, revision); ok {
+			return rev, result, nil
+		}
+	}
+
+	if isPrefix(prefix) {
 		prefix += "%"
 	}
 
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
 	rows, err := s.d.After(ctx, prefix, revision, limit)
 	if err != nil {
 		return 0, nil, err
 	}
 
 	rev, compact, result, err := RowsToEvents(rows, true, true)
+	if err == nil {
+		err = s.loadValues(ctx, result)
+	}
 
 	if revision > 0 && len(result) == 0 {
 		// a zero length result won't have the compact or current revisions so get them manually
@@ -340,6 +574,9 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 }
 
 func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool) (int64, server.Events, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
 	var (
 		rows *sql.Rows
 		err  error
@@ -356,10 +593,52 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		return 0, nil, err
 	}
 
+	return s.listResult(ctx, rows, revision, keysOnly, s.excludedPattern(prefix))
+}
+
+// ListRange lists keys in the range [startKey, endKey). An empty endKey includes
+// all keys greater than or equal to startKey.
+func (s *SQLLog) ListRange(ctx context.Context, startKey, endKey string, limit, revision int64, includeDeleted, keysOnly bool) (int64, server.Events, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	var (
+		rows *sql.Rows
+		err  error
+	)
+
+	excluded := s.excludedRange(startKey, endKey)
+	prefix := rangePrefix(startKey, endKey)
+	startKey = s.d.TranslateStartKey(startKey)
+
+	if endKey == "" {
+		if revision == 0 {
+			rows, err = s.d.ListCurrent(ctx, prefix, startKey, limit, includeDeleted, keysOnly)
+		} else {
+			rows, err = s.d.List(ctx, prefix, startKey, limit, revision, includeDeleted, keysOnly)
+		}
+	} else {
+		endKey = s.d.TranslateStartKey(endKey)
+		rows, err = s.d.ListRange(ctx, prefix, startKey, endKey, limit, revision, includeDeleted, keysOnly)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return s.listResult(ctx, rows, revision, keysOnly, excluded)
+}
+
+// listResult converts the rows returned by a list query to events, and checks that
+// the requested revision has not been compacted, unless all listed keys are excluded
+// from compaction.
+func (s *SQLLog) listResult(ctx context.Context, rows *sql.Rows, revision int64, keysOnly, excluded bool) (int64, server.Events, error) {
 	rev, compact, result, err := RowsToEvents(rows, !keysOnly, false)
 	if err != nil {
 		return 0, nil, err
 	}
+	if err := s.loadValues(ctx, result); err != nil {
+		return 0, nil, err
+	}
 
 	if revision != 0 && len(result) == 0 {
 		// a zero length result won't have the compact or current revisions so get them manually
@@ -377,7 +656,7 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		return rev, nil, server.ErrFutureRev
 	}
 
-	if revision > 0 && revision < compact {
+	if revision > 0 && revision < compact && !excluded {
 		return rev, nil, server.ErrCompacted
 	}
 
@@ -412,13 +691,17 @@ func RowsToEvents(rows *sql.Rows, val, prev bool) (int64, int64, server.Events,
 }
 
 func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan server.Events {
+	if s.watchSharedDelivery {
+		return s.watchShared(ctx, prefix)
+	}
+
 	res := make(chan server.Events, 100)
 	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
 	if err != nil {
 		return nil
 	}
 
-	checkPrefix := strings.HasSuffix(prefix, "/")
+	checkPrefix := isPrefix(prefix)
 
 	go func() {
 		defer close(res)
@@ -433,6 +716,12 @@ func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan server.Events
 	return res
 }
 
+// isPrefix returns true if a watch on prefix matches all keys that start with it, rather than
+// only the key itself. The empty prefix matches the whole keyspace.
+func isPrefix(prefix string) bool {
+	return prefix == "" || strings.HasSuffix(prefix, "/")
+}
+
 func filter(eventList server.Events, checkPrefix bool, prefix string) (server.Events, bool) {
 	filteredEventList := make(server.Events, 0, len(eventList))
 
@@ -456,33 +745,60 @@ func (s *SQLLog) startWatch() (chan server.Events, error) {
 	if s.compactIntervalJitter < 0 || s.compactIntervalJitter > 100 {
 		panic("jitterPercent must be between 0 and 100")
 	}
-	maxJitter := float64(s.compactIntervalJitter) / 100.0 * float64(s.compactInterval)
-	jitter := time.Duration(rand.Float64()*2*maxJitter - maxJitter)
 
 	// start compaction and polling at the same time to watch starts
 	// at the oldest revision, but compaction doesn't create gaps
-	if s.compactInterval <= 0 {
+	if s.compactInterval.Load() <= 0 {
 		logrus.Debugf("COMPACT disabled; automatic compaction will not occur")
 	} else {
-		go s.compactor(s.compactInterval + jitter)
+		go s.compactor()
 	}
 
 	go s.poll(c, pollStart)
 	return c, nil
 }
 
+// pollRetryWait records a failed poll query and waits for the backoff delay appropriate
+// to the given number of consecutive failures. The poll revision is not advanced
+// on failure, so the retry picks up any events that the failed query would have returned.
+// It returns false if the context was cancelled while waiting.
+func (s *SQLLog) pollRetryWait(failures int) bool {
+	metrics.PollErrorsTotal.Inc()
+
+	delay := s.pollRetryMinBackoff
+	for i := 1; i < failures && delay < s.pollRetryMaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, s.pollRetryMaxBackoff)
+	logrus.Debugf("Retrying poll after %d consecutive failures in %s", failures, delay)
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
 func (s *SQLLog) poll(result chan server.Events, pollStart int64) {
 	var (
 		skip         int64
 		skipTime     time.Time
 		waitForMore  = true
 		pollRevision = pollStart
+		pollFailures int
+		// active counts consecutive polls that returned events
+		active int
 	)
 
 	wait := time.NewTicker(time.Second)
 	defer wait.Stop()
 	defer close(result)
 
+	s.history.reset(pollStart)
+
 	for {
 		if waitForMore {
 			select {
@@ -492,6 +808,9 @@ func (s *SQLLog) poll(result chan server.Events, pollStart int64) {
 				if check <= pollRevision {
 					continue
 				}
+				if s.watchPrefetch > 0 && active >= watchPrefetchActivity && !s.prefetchWait(check, pollRevision) {
+					active = 0
+				}
 			case <-wait.C:
 			}
 		}
@@ -505,23 +824,36 @@ func (s *SQLLog) poll(result chan server.Events, pollStart int64) {
 
 		rows, err := s.d.After(s.ctx, "%", pollRevision, s.pollBatchSize)
 		if err != nil {
-			if !errors.Is(err, context.Canceled) {
-				logrus.Errorf("fail to list latest changes: %v", err)
+			if errors.Is(err, context.Canceled) {
+				continue
 			}
+			logrus.Errorf("fail to list latest changes: %v", err)
+			pollFailures++
+			waitForMore = !s.pollRetryWait(pollFailures)
 			continue
 		}
 
 		_, _, events, err := RowsToEvents(rows, true, true)
+		if err == nil {
+			loadCtx, cancel := context.WithTimeout(s.ctx, pollLoadTimeout)
+			err = s.loadValues(loadCtx, events)
+			cancel()
+		}
 		if err != nil {
 			logrus.Errorf("fail to convert rows changes: %v", err)
+			pollFailures++
+			waitForMore = !s.pollRetryWait(pollFailures)
 			continue
 		}
+		pollFailures = 0
 
 		logrus.Tracef("POLL AFTER %d, limit=%d, events=%d", pollRevision, s.pollBatchSize, len(events))
 
 		if len(events) == 0 {
+			active = 0
 			continue
 		}
+		active++
 
 		waitForMore = len(events) < 100
 
@@ -589,6 +921,9 @@ func (s *SQLLog) poll(result chan server.Events, pollStart int64) {
 		if saveLast {
 			s.currentRev.CompareAndSwap(pollRevision, rev)
 			pollRevision = rev
+			// events must be recorded before they are sent, so that any event missing
+			// from the history is sent to watchers that read the history.
+			s.history.append(sequential, rev)
 			if len(sequential) > 0 {
 				result <- sequential
 			}
@@ -601,6 +936,9 @@ func canSkipRevision(rev, skip int64, skipTime time.Time) bool {
 }
 
 func (s *SQLLog) Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
 	if strings.HasSuffix(prefix, "/") {
 		prefix += "%"
 	}
@@ -610,7 +948,86 @@ func (s *SQLLog) Count(ctx context.Context, prefix, startKey string, revision in
 	if revision == 0 {
 		return s.d.CountCurrent(ctx, prefix, startKey)
 	}
-	return s.d.Count(ctx, prefix, startKey, revision)
+	rev, count, err := s.d.Count(ctx, prefix, startKey, revision)
+	if err != nil {
+		return 0, 0, err
+	}
+	return s.countResult(ctx, rev, count, revision)
+}
+
+// countResult checks that the requested revision of a count is not in the future. The revision
+// returned by a count query is zero if no rows are counted, in which case the current revision
+// is read separately.
+func (s *SQLLog) countResult(ctx context.Context, rev, count, revision int64) (int64, int64, error) {
+	if revision > rev {
+		current, err := s.CurrentRevision(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if revision > current {
+			return current, 0, server.ErrFutureRev
+		}
+	}
+	return rev, count, nil
+}
+
+// CountSerializable counts current keys using the cached current revision, instead of
+// reading the latest revision from the datastore alongside the count.
+func (s *SQLLog) CountSerializable(ctx context.Context, prefix, startKey string) (int64, int64, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	if strings.HasSuffix(prefix, "/") {
+		prefix += "%"
+	}
+
+	startKey = s.d.TranslateStartKey(startKey)
+
+	rev, err := s.CurrentRevision(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := s.d.CountCurrentKeys(ctx, prefix, startKey)
+	return rev, count, err
+}
+
+// CountRange counts keys in the range [startKey, endKey). An empty endKey includes
+// all keys greater than or equal to startKey.
+func (s *SQLLog) CountRange(ctx context.Context, startKey, endKey string, revision int64) (int64, int64, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	prefix := rangePrefix(startKey, endKey)
+	startKey = s.d.TranslateStartKey(startKey)
+
+	var (
+		rev, count int64
+		err        error
+	)
+	if endKey == "" {
+		if revision == 0 {
+			return s.d.CountCurrent(ctx, prefix, startKey)
+		}
+		rev, count, err = s.d.Count(ctx, prefix, startKey, revision)
+	} else {
+		rev, count, err = s.d.CountRange(ctx, prefix, startKey, s.d.TranslateStartKey(endKey), revision)
+	}
+	if err != nil || revision == 0 {
+		return rev, count, err
+	}
+	return s.countResult(ctx, rev, count, revision)
+}
+
+// rangePrefix returns a LIKE pattern matching all keys in the range [startKey, endKey),
+// based on the common prefix of the start and end keys.
+func rangePrefix(startKey, endKey string) string {
+	var i int
+	if endKey != "" {
+		for i < len(startKey) && i < len(endKey) && startKey[i] == endKey[i] {
+			i++
+		}
+	}
+	return strings.ReplaceAll(startKey[:i], `_`, `^_`) + "%"
 }
 
 func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error) {
@@ -622,16 +1039,24 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 		e.PrevKV = &server.KeyValue{}
 	}
 
-	rev, err := s.d.Insert(ctx, e.KV.Key,
+	value, prevValue, stored, err := s.storeValues(ctx, &e)
+	if err != nil {
+		return 0, err
+	}
+
+	insertCtx, cancel := s.writeContext(ctx)
+	rev, err := s.d.Insert(insertCtx, e.KV.Key,
 		e.Create,
 		e.Delete,
 		e.KV.CreateRevision,
 		e.PrevKV.ModRevision,
 		e.KV.Lease,
-		e.KV.Value,
-		e.PrevKV.Value,
+		value,
+		prevValue,
 	)
+	cancel()
 	if err != nil {
+		s.deleteValues(ctx, stored...)
 		return 0, err
 	}
 	s.currentRev.Store(rev)
@@ -642,6 +1067,167 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 	return rev, nil
 }
 
+// AppendAll appends events in a single transaction, and returns their revisions. Either all
+// of the events are appended, or none are.
+func (s *SQLLog) AppendAll(ctx context.Context, events []*server.Event) ([]int64, error) {
+	var stored [][]byte
+	rows := make([]server.InsertRow, 0, len(events))
+	for _, event := range events {
+		e := *event
+		if e.KV == nil {
+			e.KV = &server.KeyValue{}
+		}
+		if e.PrevKV == nil {
+			e.PrevKV = &server.KeyValue{}
+		}
+
+		value, prevValue, objects, err := s.storeValues(ctx, &e)
+		if err != nil {
+			s.deleteValues(ctx, stored...)
+			return nil, err
+		}
+		stored = append(stored, objects...)
+		rows = append(rows, server.InsertRow{
+			Key:              e.KV.Key,
+			Create:           e.Create,
+			Delete:           e.Delete,
+			CreateRevision:   e.KV.CreateRevision,
+			PreviousRevision: e.PrevKV.ModRevision,
+			Lease:            e.KV.Lease,
+			Value:            value,
+			PrevValue:        prevValue,
+		})
+	}
+
+	insertCtx, cancel := s.writeContext(ctx)
+	revs, err := s.d.InsertAll(insertCtx, rows)
+	cancel()
+	if err != nil {
+		s.deleteValues(ctx, stored...)
+		return nil, err
+	}
+	if len(revs) > 0 {
+		rev := revs[len(revs)-1]
+		s.currentRev.Store(rev)
+		select {
+		case s.notify <- rev:
+		default:
+		}
+	}
+	return revs, nil
+}
+
+// storeValues returns the value and previous value to insert into the row for an event, storing
+// them externally if they are too large, along with any newly stored objects, which must be
+// deleted if the row is not inserted. A row for a create or update references its own objects,
+// so that they can be deleted along with the row; the same object is referenced for both if they
+// are equal. A row for a delete instead references the object already stored for the row that it
+// deletes, as the two rows are always compacted together.
+func (s *SQLLog) storeValues(ctx context.Context, e *server.Event) ([]byte, []byte, [][]byte, error) {
+	value, prevValue := e.KV.Value, e.PrevKV.Value
+	if s.values == nil {
+		return value, prevValue, nil, nil
+	}
+	if e.Delete && bytes.Equal(value, prevValue) && s.values.IsExternal(value) {
+		pointer, err := s.storedValue(ctx, e.KV.Key, e.PrevKV.ModRevision)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if pointer != nil {
+			return pointer, pointer, nil, nil
+		}
+	}
+
+	stored, err := s.values.Store(ctx, value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if bytes.Equal(value, prevValue) {
+		return stored, stored, [][]byte{stored}, nil
+	}
+	storedPrev, err := s.values.Store(ctx, prevValue)
+	if err != nil {
+		s.deleteValues(ctx, stored)
+		return nil, nil, nil, err
+	}
+	return stored, storedPrev, [][]byte{stored, storedPrev}, nil
+}
+
+// storedValue returns the value stored in the datastore for the row of key at revision, without
+// loading it if it is a pointer to an externally stored value. Nil is returned if there is no
+// such row, or if it does not reference an externally stored value.
+func (s *SQLLog) storedValue(ctx context.Context, key string, revision int64) ([]byte, error) {
+	if revision == 0 {
+		return nil, nil
+	}
+	rows, err := s.d.List(ctx, key, s.d.TranslateStartKey(key), 1, revision, true, false)
+	if err != nil {
+		return nil, err
+	}
+	_, _, events, err := RowsToEvents(rows, true, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) != 1 || events[0].KV.Key != key || events[0].KV.ModRevision != revision {
+		return nil, nil
+	}
+	if _, ok := valuestore.IsPointer(events[0].KV.Value); !ok {
+		return nil, nil
+	}
+	return events[0].KV.Value, nil
+}
+
+// deleteValues deletes the external objects for values that were not inserted.
+func (s *SQLLog) deleteValues(ctx context.Context, values ...[]byte) {
+	if s.values == nil {
+		return
+	}
+	for _, value := range values {
+		if err := s.values.Delete(context.WithoutCancel(ctx), value); err != nil {
+			logrus.Errorf("Failed to delete external value: %v", err)
+		}
+	}
+}
+
+// loadValues replaces any pointers to externally stored values in events with the values. Each
+// referenced object is loaded once, with up to maxValueLoads objects loaded concurrently.
+func (s *SQLLog) loadValues(ctx context.Context, events server.Events) error {
+	if s.values == nil {
+		return nil
+	}
+	pointers := map[string][]*server.KeyValue{}
+	for _, event := range events {
+		for _, kv := range []*server.KeyValue{event.KV, event.PrevKV} {
+			if kv == nil {
+				continue
+			}
+			if _, ok := valuestore.IsPointer(kv.Value); ok {
+				pointers[string(kv.Value)] = append(pointers[string(kv.Value)], kv)
+			}
+		}
+	}
+	if len(pointers) == 0 {
+		return nil
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(maxValueLoads)
+	for pointer, kvs := range pointers {
+		eg.Go(func() error {
+			value, err := s.values.Load(ctx, []byte(pointer))
+			if err != nil {
+				return err
+			}
+			// each key value is only referenced by this goroutine
+			for _, kv := range kvs {
+				kv.Value = value
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
 func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event, val, prev bool) error {
 	event.KV = &server.KeyValue{}
 	event.PrevKV = &server.KeyValue{}
@@ -671,6 +1257,8 @@ func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event, val,
 		return err
 	}
 
+	// a create row is the first revision of the key, including when the key is created
+	// again after being deleted, so its create revision is always its own revision
 	if event.Create {
 		event.KV.CreateRevision = event.KV.ModRevision
 		event.PrevKV = nil
@@ -700,15 +1288,72 @@ func (s *SQLLog) DbSize(ctx context.Context) (int64, error) {
 	return s.d.GetSize(ctx)
 }
 
+func (s *SQLLog) StorageStats(ctx context.Context) (*server.StorageStats, error) {
+	return s.d.GetStats(ctx)
+}
+
+func (s *SQLLog) DriverConfig() *server.DriverConfig {
+	config := s.d.DriverConfig()
+	config.TxIsolation = txIsolation.String()
+	config.CompactTimeout = s.compactTimeout.String()
+	if s.readTimeout > 0 {
+		config.ReadTimeout = s.readTimeout.String()
+	}
+	if s.writeTimeout > 0 {
+		config.WriteTimeout = s.writeTimeout.String()
+	}
+	return config
+}
+
+func (s *SQLLog) Statements() map[string]string {
+	return s.d.Statements()
+}
+
+func (s *SQLLog) PoolStats() []server.PoolStats {
+	return s.d.PoolStats()
+}
+
+func (s *SQLLog) SetKeyMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	return s.d.SetKeyMetadata(ctx, key, metadata)
+}
+
+func (s *SQLLog) GetKeyMetadata(ctx context.Context, key string) (map[string]string, error) {
+	return s.d.GetKeyMetadata(ctx, key)
+}
+
+func (s *SQLLog) ListKeyMetadata(ctx context.Context, prefix string) (map[string]map[string]string, error) {
+	return s.d.ListKeyMetadata(ctx, prefix)
+}
+
 func (s *SQLLog) Compact(ctx context.Context, targetCompactRev int64) (int64, error) {
-	if s.compactInterval <= 0 {
+	if s.compactInterval.Load() <= 0 {
 		// manual compact is a no-op unless automatic compaction is disabled
 		compactRev, _ := s.d.GetCompactRevision(s.ctx)
-		s.compactIter(compactRev, targetCompactRev)
+		s.compactThrottled(compactRev, targetCompactRev, true)
 	}
 	return s.CurrentRevision(ctx)
 }
 
+func (s *SQLLog) CompactTo(ctx context.Context, revision int64) (int64, error) {
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if revision > currentRev {
+		return 0, server.ErrFutureRev
+	}
+	if revision <= 0 {
+		revision = currentRev
+	}
+
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	compactRev, _, err = s.compactThrottled(compactRev, revision, true)
+	return compactRev, err
+}
+
 func (s *SQLLog) WaitForSyncTo(revision int64) {
 	s.polled.L.Lock()
 	for s.polledRev.Load() < revision {
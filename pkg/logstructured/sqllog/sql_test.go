@@ -0,0 +1,898 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/valuestore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	_ "modernc.org/sqlite"
+)
+
+// fakeDialect implements only the dialect methods needed by the compactor;
+// calling any other method will panic.
+type fakeDialect struct {
+	server.Dialect
+	beginTx atomic.Int64
+}
+
+func (d *fakeDialect) GetCompactRevision(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (d *fakeDialect) CurrentRevision(ctx context.Context) (int64, error) {
+	return 10000, nil
+}
+
+func (d *fakeDialect) BeginTx(ctx context.Context, opts *sql.TxOptions) (server.Transaction, error) {
+	d.beginTx.Add(1)
+	return nil, errors.New("not implemented")
+}
+
+func TestSetCompactInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &fakeDialect{}
+	s := New(d, time.Hour, 0, time.Second, 0, 1000, 500)
+	s.ctx = ctx
+	go s.compactor()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := d.beginTx.Load(); n != 0 {
+		t.Fatalf("expected no compactions before interval change, got %d", n)
+	}
+
+	if err := s.SetCompactInterval(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := d.beginTx.Load(); n == 0 {
+		t.Fatal("expected compactions after interval change")
+	}
+
+	interval, batchSize := s.CompactConfig()
+	if interval != 10*time.Millisecond || batchSize != 1000 {
+		t.Fatalf("unexpected compact config interval=%s batchSize=%d", interval, batchSize)
+	}
+}
+
+func TestSetCompactConfigValidation(t *testing.T) {
+	s := New(&fakeDialect{}, time.Minute, 0, time.Second, 0, 1000, 500)
+	if err := s.SetCompactInterval(0); err == nil {
+		t.Fatal("expected error for zero interval")
+	}
+	if err := s.SetCompactBatchSize(minCompactBatchSize - 1); err == nil {
+		t.Fatal("expected error for batch size below minimum")
+	}
+	if err := s.ValidateCompactConfig(time.Hour, minCompactBatchSize-1); err == nil {
+		t.Fatal("expected validation error for batch size below minimum")
+	}
+	if err := s.ValidateCompactConfig(time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCompactBatchSize(5000); err != nil {
+		t.Fatal(err)
+	}
+	if interval, batchSize := s.CompactConfig(); interval != time.Minute || batchSize != 5000 {
+		t.Fatalf("expected validation to leave the config unchanged, got interval=%s batchSize=%d", interval, batchSize)
+	}
+
+	disabled := New(&fakeDialect{}, 0, 0, time.Second, 0, 1000, 500)
+	if err := disabled.SetCompactInterval(time.Minute); err == nil {
+		t.Fatal("expected error when automatic compaction is disabled")
+	}
+	if err := disabled.ValidateCompactConfig(time.Minute, 0); err == nil {
+		t.Fatal("expected validation error when automatic compaction is disabled")
+	}
+}
+
+// backlogDialect implements only the dialect methods needed to compact successfully;
+// calling any other method will panic.
+type backlogDialect struct {
+	server.Dialect
+	currentRev int64
+	compactRev atomic.Int64
+	compacts   atomic.Int64
+	// deletes is the number of rows that each compaction batch reports as deleted
+	deletes  int64
+	analyzes atomic.Int64
+}
+
+func (d *backlogDialect) GetCompactRevision(ctx context.Context) (int64, error) {
+	return d.compactRev.Load(), nil
+}
+
+func (d *backlogDialect) CurrentRevision(ctx context.Context) (int64, error) {
+	return d.currentRev, nil
+}
+
+func (d *backlogDialect) BeginTx(ctx context.Context, opts *sql.TxOptions) (server.Transaction, error) {
+	return &backlogTx{d: d}, nil
+}
+
+func (d *backlogDialect) PostCompact(ctx context.Context) error {
+	return nil
+}
+
+func (d *backlogDialect) Analyze(ctx context.Context) error {
+	d.analyzes.Add(1)
+	return nil
+}
+
+// backlogTx implements only the transaction methods needed to compact successfully;
+// calling any other method will panic.
+type backlogTx struct {
+	server.Transaction
+	d *backlogDialect
+}
+
+func (t *backlogTx) GetCompactRevision(ctx context.Context) (int64, error) {
+	return t.d.GetCompactRevision(ctx)
+}
+
+func (t *backlogTx) SetCompactRevision(ctx context.Context, revision int64) error {
+	t.d.compactRev.Store(revision)
+	return nil
+}
+
+func (t *backlogTx) CurrentRevision(ctx context.Context) (int64, error) {
+	return t.d.CurrentRevision(ctx)
+}
+
+func (t *backlogTx) Compact(ctx context.Context, start, revision int64) (int64, error) {
+	t.d.compacts.Add(1)
+	return t.d.deletes, nil
+}
+
+func (t *backlogTx) MustCommit()   {}
+func (t *backlogTx) MustRollback() {}
+
+func TestCompactBurst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &backlogDialect{currentRev: 50000}
+	s := New(d, time.Hour, 0, time.Second, 1000, 1000, 500)
+	s.SetCompactBurstThreshold(10000)
+	s.compactBurstInterval = 10 * time.Millisecond
+	s.ctx = ctx
+	go s.compactor()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.compactRev.Load() != 49000 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected burst compaction to revision 49000, got %d", d.compactRev.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := d.compacts.Load(); n != 49 {
+		t.Fatalf("expected backlog to be compacted in 49 batches, got %d", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if s.compactBursting.Load() {
+		t.Fatal("expected compactor to return to normal interval after catching up")
+	}
+	if n := d.compacts.Load(); n != 49 {
+		t.Fatalf("expected no further compactions at normal interval, got %d batches", n)
+	}
+}
+
+func TestCompactBurstBelowThreshold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &backlogDialect{currentRev: 5000}
+	s := New(d, time.Hour, 0, time.Second, 1000, 1000, 500)
+	s.SetCompactBurstThreshold(10000)
+	s.compactBurstInterval = 10 * time.Millisecond
+	s.ctx = ctx
+	go s.compactor()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := d.compacts.Load(); n != 0 {
+		t.Fatalf("expected no compactions below burst threshold, got %d", n)
+	}
+}
+
+func TestCompactAnalyze(t *testing.T) {
+	d := &backlogDialect{currentRev: 10000, deletes: 10}
+	s := New(d, time.Hour, 0, time.Second, 1000, 1000, 500)
+	s.SetCompactAnalyze(50, time.Hour)
+	s.ctx = context.Background()
+
+	// a compaction deleting fewer rows than the threshold does not refresh statistics
+	compactRev, _, err := s.compactIter(0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.analyzes.Load(); n != 0 {
+		t.Fatalf("expected no analyze after deleting 20 rows, got %d", n)
+	}
+
+	// rows deleted by earlier compactions count towards the threshold
+	if compactRev, _, err = s.compactIter(compactRev, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.analyzes.Load(); n != 1 {
+		t.Fatalf("expected one analyze after deleting 50 rows, got %d", n)
+	}
+
+	// further refreshes are throttled to the interval
+	if _, _, err = s.compactIter(compactRev, 9000); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.analyzes.Load(); n != 1 {
+		t.Fatalf("expected analyze to be throttled, got %d", n)
+	}
+	s.compactAnalyzeTime = time.Time{}
+	s.analyzeAfterCompact(10)
+	if n := d.analyzes.Load(); n != 2 {
+		t.Fatalf("expected analyze once the interval has elapsed, got %d", n)
+	}
+}
+
+func TestCompactMinInterval(t *testing.T) {
+	ctx := context.Background()
+	d := &backlogDialect{currentRev: 10000}
+	// automatic compaction is disabled, so that compact requests are run on demand
+	s := New(d, 0, 0, time.Second, 1000, 1000, 500)
+	s.SetCompactMinInterval(time.Hour, false)
+	s.ctx = ctx
+
+	if _, err := s.Compact(ctx, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.compacts.Load(); n != 2 {
+		t.Fatalf("expected first compaction to run in 2 batches, got %d", n)
+	}
+
+	// triggers within the minimum interval, including those that arrive together, are coalesced
+	// into the compaction that has already run
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Compact(ctx, 5000); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, rev := d.compacts.Load(), d.compactRev.Load(); n != 2 || rev != 2000 {
+		t.Fatalf("expected no further compactions within the minimum interval, got %d batches to revision %d", n, rev)
+	}
+
+	// compactions requested on demand may bypass the minimum interval
+	s.SetCompactMinInterval(time.Hour, true)
+	if _, err := s.Compact(ctx, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if rev := d.compactRev.Load(); rev != 5000 {
+		t.Fatalf("expected bypassed compaction to revision 5000, got %d", rev)
+	}
+}
+
+// flakyPollDialect implements only the dialect methods needed by the poll loop;
+// calling any other method will panic. The first failures calls to After return an
+// error, and later calls return a single event at revision 1 from an in-memory database.
+type flakyPollDialect struct {
+	server.Dialect
+	db       *sql.DB
+	failures atomic.Int64
+}
+
+func (d *flakyPollDialect) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+	if d.failures.Add(-1) >= 0 {
+		return nil, errors.New("database is unavailable")
+	}
+	return d.db.QueryContext(ctx, `
+		SELECT 1, 0, 1, '/registry/test', 1, 0, 1, 0, 0, x'76', x''
+		WHERE ? < 1`, rev)
+}
+
+func (d *flakyPollDialect) IsFill(key string) bool {
+	return false
+}
+
+func TestPollRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	d := &flakyPollDialect{db: db}
+	d.failures.Store(3)
+	s := New(d, 0, 0, time.Second, 0, 1000, 500)
+	s.ctx = ctx
+	s.pollRetryMinBackoff = time.Millisecond
+	s.pollRetryMaxBackoff = 10 * time.Millisecond
+
+	errorsBefore := testutil.ToFloat64(metrics.PollErrorsTotal)
+	result := make(chan server.Events)
+	go s.poll(result, 0)
+	s.notify <- 1
+
+	select {
+	case events := <-result:
+		if len(events) != 1 || events[0].KV.ModRevision != 1 || events[0].KV.Key != "/registry/test" {
+			t.Fatalf("unexpected events after poll retry: %v", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for events after poll retry")
+	}
+
+	if n := testutil.ToFloat64(metrics.PollErrorsTotal) - errorsBefore; n != 3 {
+		t.Fatalf("expected 3 poll errors, got %v", n)
+	}
+}
+
+// historyDialect implements only the dialect methods needed by the poll loop and After;
+// calling any other method will panic. Rows are read from an in-memory database holding
+// the given number of revisions.
+type historyDialect struct {
+	server.Dialect
+	db    *sql.DB
+	after atomic.Int64
+}
+
+func newHistoryDialect(t *testing.T, revisions int) *historyDialect {
+	// a file is used rather than an in-memory database, so that all pooled connections share the same database
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(`CREATE TABLE kine (id INTEGER PRIMARY KEY, name TEXT, created INTEGER, deleted INTEGER, create_revision INTEGER, prev_revision INTEGER, lease INTEGER, value BLOB, old_value BLOB)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO kine
+		WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+		SELECT i, '/registry/a/' || i, 1, 0, i, 0, 0, x'76', x'' FROM seq`, revisions); err != nil {
+		t.Fatal(err)
+	}
+	return &historyDialect{db: db}
+}
+
+func (d *historyDialect) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+	d.after.Add(1)
+	if limit <= 0 {
+		limit = -1
+	}
+	return d.db.QueryContext(ctx, `
+		SELECT (SELECT MAX(id) FROM kine), 0, id, name, created, deleted, create_revision, prev_revision, lease, value, old_value
+		FROM kine
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?`, rev, limit)
+}
+
+func (d *historyDialect) IsFill(key string) bool {
+	return false
+}
+
+func TestWatchHistory(t *testing.T) {
+	for _, test := range []struct {
+		size int
+		hit  bool
+	}{
+		{size: 0, hit: false},
+		{size: 2, hit: false},
+		{size: 10, hit: true},
+	} {
+		t.Run(fmt.Sprintf("size-%d", test.size), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			d := newHistoryDialect(t, 5)
+			s := New(d, 0, 0, time.Second, 0, 1000, 500)
+			s.SetWatchHistorySize(test.size)
+			s.ctx = ctx
+
+			result := make(chan server.Events)
+			go s.poll(result, 0)
+			s.notify <- 1
+			select {
+			case events := <-result:
+				if len(events) != 5 {
+					t.Fatalf("expected 5 polled events, got %d", len(events))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for polled events")
+			}
+
+			// catch up a reconnecting watch from revision 2
+			queries := d.after.Load()
+			rev, events, err := s.After(ctx, "/registry/a/", 2, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != 5 || len(events) != 3 || events[0].KV.ModRevision != 3 {
+				t.Fatalf("expected events 3 through 5 at revision 5, got %d events at revision %d", len(events), rev)
+			}
+			if hit := d.after.Load() == queries; hit != test.hit {
+				t.Fatalf("expected served from history %v, got %v", test.hit, hit)
+			}
+		})
+	}
+}
+
+func TestWatchHistoryWindow(t *testing.T) {
+	const window = 10
+	h := &eventHistory{size: 1000, window: window}
+	h.reset(0)
+
+	// /b is written once, and /a is then updated at every revision
+	rev := int64(0)
+	write := func(key string) {
+		rev++
+		h.append(server.Events{{KV: &server.KeyValue{Key: key, ModRevision: rev}}}, rev)
+	}
+	write("/registry/b")
+	for i := 0; i < 500; i++ {
+		write("/registry/a")
+	}
+
+	// older /a events are dropped once superseded, leaving /b and the events within the window
+	if n := len(h.events); n > window+2 {
+		t.Fatalf("expected at most %d held events, got %d", window+2, n)
+	}
+
+	// a reconnect within the window receives every event after its revision
+	from := rev - window
+	end, events, ok := h.after("/registry/", from)
+	if !ok {
+		t.Fatalf("expected watch from revision %d to be served from history", from)
+	}
+	if end != rev || len(events) != window {
+		t.Fatalf("expected %d events up to revision %d, got %d up to %d", window, rev, len(events), end)
+	}
+	for i, event := range events {
+		if event.KV.ModRevision != from+int64(i)+1 {
+			t.Fatalf("expected event at revision %d, got %d", from+int64(i)+1, event.KV.ModRevision)
+		}
+	}
+
+	// a reconnect before the window would miss dropped /a events, but a watch on /b would not
+	if _, _, ok := h.after("/registry/", 1); ok {
+		t.Fatal("expected watch from revision 1 on /registry/ not to be served from history")
+	}
+	if _, events, ok := h.after("/registry/b", 0); !ok || len(events) != 1 {
+		t.Fatalf("expected watch from revision 0 on /registry/b to be served from history, got %v %d", ok, len(events))
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	const revisions = 5000
+
+	d := newHistoryDialect(t, revisions)
+	s := New(d, 0, 0, time.Second, 0, 1000, 500)
+	// expire cursors quickly so that backfill must resume with new cursors
+	s.backfillCursorTimeout = 100 * time.Millisecond
+
+	var (
+		batches int
+		last    int64
+	)
+	err := s.Backfill(context.Background(), "/registry/a/", 0, func(rev int64, events server.Events) error {
+		if len(events) == 0 || len(events) > s.backfillBatchSize {
+			t.Fatalf("expected batches of at most %d events, got %d", s.backfillBatchSize, len(events))
+		}
+		for _, event := range events {
+			if event.KV.ModRevision != last+1 {
+				t.Fatalf("expected event at revision %d, got %d", last+1, event.KV.ModRevision)
+			}
+			last = event.KV.ModRevision
+		}
+		batches++
+		// simulate a slow watcher
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != revisions {
+		t.Fatalf("expected backfill through revision %d, got %d", revisions, last)
+	}
+	if batches < revisions/s.backfillBatchSize {
+		t.Fatalf("expected at least %d batches, got %d", revisions/s.backfillBatchSize, batches)
+	}
+	if n := d.after.Load(); n < 2 {
+		t.Fatalf("expected backfill to resume after cursor timeout, got %d queries", n)
+	}
+}
+
+// establishDialect implements only the dialect methods needed to establish watches, with each
+// query taking long enough for concurrent watches to overlap; calling any other method will panic.
+type establishDialect struct {
+	*historyDialect
+	compact atomic.Int64
+}
+
+func (d *establishDialect) GetCompactRevision(ctx context.Context) (int64, error) {
+	d.compact.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return 0, nil
+}
+
+func (d *establishDialect) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+	time.Sleep(50 * time.Millisecond)
+	return d.historyDialect.After(ctx, prefix, rev, limit)
+}
+
+func TestWatchEstablishment(t *testing.T) {
+	const watches = 50
+
+	d := &establishDialect{historyDialect: newHistoryDialect(t, 20)}
+	s := New(d, 0, 0, time.Second, 0, 1000, 500)
+
+	var wg sync.WaitGroup
+	errs := make([]error, watches)
+	for i := range watches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// watches start from revisions that overlap with each other
+			revision := int64(i % 5)
+			if _, err := s.CompactRevision(context.Background()); err != nil {
+				errs[i] = err
+				return
+			}
+			last := revision
+			errs[i] = s.Backfill(context.Background(), "/registry/a/", revision, func(rev int64, events server.Events) error {
+				for _, event := range events {
+					if event.KV.ModRevision != last+1 {
+						return fmt.Errorf("expected event at revision %d, got %d", last+1, event.KV.ModRevision)
+					}
+					last = event.KV.ModRevision
+				}
+				return nil
+			})
+			if errs[i] == nil && last != 20 {
+				errs[i] = fmt.Errorf("expected backfill from revision %d through revision 20, got %d", revision, last)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("watch %d: %v", i, err)
+		}
+	}
+	if n := d.compact.Load(); n > watches/5 {
+		t.Fatalf("expected far fewer than %d compact revision queries, got %d", watches, n)
+	}
+	if n := d.after.Load(); n > watches/5 {
+		t.Fatalf("expected far fewer than %d backfill queries, got %d", watches, n)
+	}
+}
+
+func TestWatchPrefetch(t *testing.T) {
+	const writes = 200
+
+	// queriesPerEvent returns the number of poll queries per event for a sustained sequence
+	// of writes, each notified to the poll loop as it is written.
+	queriesPerEvent := func(t *testing.T, prefetch int64) float64 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		d := newHistoryDialect(t, 1)
+		s := New(d, 0, 0, time.Second, 0, 1000, 500)
+		s.ctx = ctx
+		s.SetWatchPrefetch(prefetch)
+		// a long window, so that the test does not depend on how quickly rows are written
+		s.watchPrefetchDelay = 200 * time.Millisecond
+
+		result := make(chan server.Events, writes)
+		go s.poll(result, 1)
+		go func() {
+			for rev := 2; rev <= writes+1; rev++ {
+				if _, err := d.db.Exec(`INSERT INTO kine VALUES (?, '/registry/a/' || ?, 1, 0, ?, 0, 0, x'76', x'')`, rev, rev, rev); err != nil {
+					t.Error(err)
+					return
+				}
+				s.notify <- int64(rev)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		for received := 0; received < writes; {
+			select {
+			case events := <-result:
+				received += len(events)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for polled events; received %d", received)
+			}
+		}
+		return float64(d.after.Load()) / writes
+	}
+
+	without := queriesPerEvent(t, 0)
+	with := queriesPerEvent(t, 10)
+	t.Logf("queries per event: %.2f without read-ahead, %.2f with read-ahead", without, with)
+	if with >= without/2 {
+		t.Fatalf("expected read-ahead to at least halve queries per event, got %.2f without and %.2f with", without, with)
+	}
+}
+
+// slowDialect implements only the dialect methods needed by Append and List, each of which
+// takes the given delay unless its context is done first; calling any other method will panic.
+type slowDialect struct {
+	server.Dialect
+	delay time.Duration
+}
+
+func (d *slowDialect) wait(ctx context.Context) error {
+	select {
+	case <-time.After(d.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *slowDialect) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error) {
+	if err := d.wait(ctx); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (d *slowDialect) ListCurrent(ctx context.Context, prefix, startKey string, limit int64, includeDeleted, keysOnly bool) (*sql.Rows, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("unexpected list")
+}
+
+func (d *slowDialect) TranslateStartKey(startKey string) string {
+	return startKey
+}
+
+func TestQueryTimeouts(t *testing.T) {
+	ctx := context.Background()
+	s := New(&slowDialect{delay: 100 * time.Millisecond}, 0, 0, time.Second, 0, 1000, 500)
+	s.SetQueryTimeouts(10*time.Millisecond, 5*time.Second)
+
+	// a slow write within the write timeout succeeds
+	event := &server.Event{Create: true, KV: &server.KeyValue{Key: "/a", Value: []byte("v")}}
+	if _, err := s.Append(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slow read beyond the read timeout fails
+	if _, _, err := s.List(ctx, "/", "", 0, 0, false, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v from list, got %v", context.DeadlineExceeded, err)
+	}
+
+	// a caller deadline shorter than the write timeout is respected
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.Append(shortCtx, event); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v from append, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+// newFanoutLog returns a log whose watches receive the batches sent on the returned channel,
+// rather than from the poll loop.
+func newFanoutLog(ctx context.Context, shared bool) (*SQLLog, chan server.Events, error) {
+	s := New(&fakeDialect{}, 0, 0, time.Second, 0, 1000, 500)
+	s.ctx = ctx
+	s.SetWatchSharedDelivery(shared)
+	input := make(chan server.Events)
+	// the broadcaster is started by its first subscription, and later subscriptions share it
+	if _, err := s.broadcaster.Subscribe(ctx, func() (chan server.Events, error) { return input, nil }); err != nil {
+		return nil, nil, err
+	}
+	return s, input, nil
+}
+
+func fanoutBatch(n int) server.Events {
+	events := make(server.Events, n)
+	for i := range events {
+		prefix := "/registry/leases/"
+		if i%2 == 1 {
+			prefix = "/registry/pods/"
+		}
+		events[i] = &server.Event{KV: &server.KeyValue{Key: fmt.Sprintf("%snode-%d", prefix, i), ModRevision: int64(i + 1)}}
+	}
+	return events
+}
+
+func TestWatchSharedDelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, input, err := newFanoutLog(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx1, cancel1 := context.WithCancel(ctx)
+	w1 := s.Watch(ctx1, "/registry/leases/")
+	w2 := s.Watch(ctx, "/registry/leases/")
+	w3 := s.Watch(ctx, "/registry/pods/")
+
+	input <- fanoutBatch(4)
+	e1, e2, e3 := <-w1, <-w2, <-w3
+	if len(e1) != 2 || len(e3) != 2 {
+		t.Fatalf("expected each prefix to receive 2 events, got %d and %d", len(e1), len(e3))
+	}
+	if &e1[0] != &e2[0] {
+		t.Fatal("expected watches on the same prefix to share a single filtered batch")
+	}
+
+	// a cancelled watch is closed, and the other watches on its prefix are unaffected
+	cancel1()
+	for range w1 {
+	}
+	input <- fanoutBatch(4)
+	if events := <-w2; len(events) != 2 {
+		t.Fatalf("expected remaining watch to receive 2 events, got %d", len(events))
+	}
+	<-w3
+
+	s.fanoutMu.Lock()
+	n := len(s.fanouts)
+	s.fanoutMu.Unlock()
+	if n != 2 {
+		t.Fatalf("expected a fanout for each watched prefix, got %d", n)
+	}
+}
+
+// BenchmarkWatchFanout delivers batches of events to many watches on a single prefix, with
+// and without shared delivery. Half of each batch matches the prefix.
+func BenchmarkWatchFanout(b *testing.B) {
+	const (
+		watches   = 1000
+		batchSize = 100
+	)
+	for _, shared := range []bool{false, true} {
+		b.Run(fmt.Sprintf("shared=%v", shared), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s, input, err := newFanoutLog(ctx, shared)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var received sync.WaitGroup
+			for i := 0; i < watches; i++ {
+				w := s.Watch(ctx, "/registry/leases/")
+				go func() {
+					for range w {
+						received.Done()
+					}
+				}()
+			}
+
+			batch := fanoutBatch(batchSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				received.Add(watches)
+				input <- batch
+				received.Wait()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batchSize), "ns/event")
+		})
+	}
+}
+
+func TestFilterPrefix(t *testing.T) {
+	events := server.Events{
+		{KV: &server.KeyValue{Key: "/registry/a"}},
+		{KV: &server.KeyValue{Key: "/registry/b"}},
+		{KV: &server.KeyValue{Key: "compact_rev_key"}},
+	}
+	for _, test := range []struct {
+		prefix string
+		want   int
+	}{
+		{"", 3},
+		{"/registry/", 2},
+		{"/registry/a", 1},
+		{"/", 2},
+		{"compact_rev_key", 1},
+	} {
+		filtered, ok := filter(events, isPrefix(test.prefix), test.prefix)
+		if len(filtered) != test.want || ok != (test.want > 0) {
+			t.Errorf("expected %d events matching %q, got %d", test.want, test.prefix, len(filtered))
+		}
+	}
+}
+
+// loadStore is an external value store whose gets wait until two are in progress at once.
+type loadStore struct {
+	sync.Mutex
+	objects map[string][]byte
+	gets    map[string]int
+	started sync.WaitGroup
+}
+
+func (m *loadStore) Put(ctx context.Context, name string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.objects[name] = data
+	return nil
+}
+
+func (m *loadStore) Get(ctx context.Context, name string) ([]byte, error) {
+	m.Lock()
+	m.gets[name]++
+	data := m.objects[name]
+	m.Unlock()
+
+	m.started.Done()
+	done := make(chan struct{})
+	go func() {
+		m.started.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *loadStore) Delete(ctx context.Context, name string) error {
+	return nil
+}
+
+func TestLoadValues(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	store := &loadStore{objects: map[string][]byte{}, gets: map[string]int{}}
+	store.started.Add(2)
+	values := valuestore.NewWithStore(store, "kine", 1)
+	s := &SQLLog{values: values}
+
+	a, err := values.Store(ctx, []byte("value a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := values.Store(ctx, []byte("value b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a tombstone references the same object as the row it deletes
+	events := server.Events{
+		{KV: &server.KeyValue{Value: a}, PrevKV: &server.KeyValue{}},
+		{KV: &server.KeyValue{Value: b}, PrevKV: &server.KeyValue{Value: a}},
+		{Delete: true, KV: &server.KeyValue{Value: b}, PrevKV: &server.KeyValue{Value: b}},
+	}
+	if err := s.loadValues(ctx, events); err != nil {
+		t.Fatalf("expected values to be loaded concurrently: %v", err)
+	}
+
+	for i, want := range [][2]string{{"value a", ""}, {"value b", "value a"}, {"value b", "value b"}} {
+		if got := [2]string{string(events[i].KV.Value), string(events[i].PrevKV.Value)}; got != want {
+			t.Errorf("expected event %d to have values %q, got %q", i, want, got)
+		}
+	}
+	for name, gets := range store.gets {
+		if gets != 1 {
+			t.Errorf("expected %s to be loaded once, got %d", name, gets)
+		}
+	}
+}
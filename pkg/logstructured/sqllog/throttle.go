@@ -0,0 +1,36 @@
+package sqllog
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetCompactMinInterval sets the minimum time between the end of one compaction and the start of
+// the next. Compactions requested within the interval, whether by the compactor or on demand, are
+// skipped, so that triggers arriving together or while a compaction is running are coalesced
+// into a single pass. If manualBypass is set, compactions requested on demand are always run.
+// An interval of zero or less disables the minimum. This must be called before the log is started.
+func (s *SQLLog) SetCompactMinInterval(interval time.Duration, manualBypass bool) {
+	s.compactMinInterval = interval
+	s.compactManualBypass = manualBypass
+}
+
+// compactThrottled compacts from compactRev to targetCompactRev, as compactIter does, unless the
+// last compaction finished within the minimum compact interval, in which case the given revisions
+// are returned unchanged. Only one compaction is run at a time; manual is set for compactions
+// requested on demand.
+func (s *SQLLog) compactThrottled(compactRev, targetCompactRev int64, manual bool) (int64, int64, error) {
+	s.compactRunMu.Lock()
+	defer s.compactRunMu.Unlock()
+
+	if s.compactMinInterval > 0 && !(manual && s.compactManualBypass) {
+		if since := time.Since(s.compactLastRun); since < s.compactMinInterval {
+			logrus.Debugf("COMPACT skipped: last compaction finished %s ago, within minimum interval %s", since.Round(time.Millisecond), s.compactMinInterval)
+			return compactRev, targetCompactRev, nil
+		}
+	}
+
+	defer func() { s.compactLastRun = time.Now() }()
+	return s.compactIter(compactRev, targetCompactRev)
+}
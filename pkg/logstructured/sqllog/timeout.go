@@ -0,0 +1,33 @@
+package sqllog
+
+import (
+	"context"
+	"time"
+)
+
+// SetQueryTimeouts configures the time allowed for each read, such as a list or count, and for
+// each append. Writes can be given longer than the reads that serve clients listing and watching
+// keys. A timeout of zero or less leaves the caller's deadline, if any, as the only limit; a
+// caller deadline that is shorter than the timeout is always respected.
+// This must be called before the log is started.
+func (s *SQLLog) SetQueryTimeouts(read, write time.Duration) {
+	s.readTimeout = read
+	s.writeTimeout = write
+}
+
+// readContext returns a context for a read, limited by the read timeout.
+func (s *SQLLog) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.readTimeout)
+}
+
+// writeContext returns a context for an append, limited by the write timeout.
+func (s *SQLLog) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.writeTimeout)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
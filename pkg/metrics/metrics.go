@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/util"
@@ -9,10 +11,16 @@ import (
 )
 
 const (
-	ResultSuccess = "success"
-	ResultError   = "error"
+	ResultSuccess   = "success"
+	ResultError     = "error"
+	ResultHit       = "hit"
+	ResultMiss      = "miss"
+	ResultViolation = "violation"
 )
 
+var sqlTimeBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0,
+	1.5, 2.0, 2.5, 3.0, 3.5, 4.0, 4.5, 5, 6, 7, 8, 9, 10, 15, 20, 25, 30}
+
 var (
 	SQLTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kine_sql_total",
@@ -20,21 +28,96 @@ var (
 	}, []string{"error_code"})
 
 	SQLTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "kine_sql_time_seconds",
-		Help: "Length of time per SQL operation",
-		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0,
-			1.5, 2.0, 2.5, 3.0, 3.5, 4.0, 4.5, 5, 6, 7, 8, 9, 10, 15, 20, 25, 30},
+		Name:    "kine_sql_time_seconds",
+		Help:    "Length of time per SQL operation",
+		Buckets: sqlTimeBuckets,
 	}, []string{"error_code"})
 
+	SQLAcquireTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kine_sql_acquire_time_seconds",
+		Help:    "Length of time spent waiting for a connection from the pool per SQL operation, if acquire tracing is enabled",
+		Buckets: sqlTimeBuckets,
+	})
+
 	CompactTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kine_compact_total",
 		Help: "Total number of compactions",
 	}, []string{"result"})
 
+	CompactVerifyTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_compact_verify_total",
+		Help: "Total number of post-compaction verifications, by whether they passed (success), found a violation, or failed to complete (error)",
+	}, []string{"result"})
+
 	InsertErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kine_insert_errors_total",
 		Help: "Total number of insert retries due to unique constraint violations",
 	}, []string{"retriable"})
+
+	PollErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_poll_errors_total",
+		Help: "Total number of failed watch poll queries",
+	})
+
+	ConnectionErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_connection_errors_total",
+		Help: "Total number of datastore connection errors by class",
+	}, []string{"class"})
+
+	ConnectionBackoffTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_connection_backoff_total",
+		Help: "Total number of datastore statements delayed because the datastore was rejecting connections with too many connections open",
+	})
+
+	WatchHistoryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_watch_history_total",
+		Help: "Total number of watch starts that were (hit) or were not (miss) served from the in-memory event history",
+	}, []string{"result"})
+
+	WatchOrderViolationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_watch_order_violations_total",
+		Help: "Total number of events received by watches at or below the revision of an event received before them",
+	})
+
+	WatchPrefetchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_watch_prefetch_total",
+		Help: "Total number of poll read-ahead windows that were (hit) or were not (miss) filled before timing out",
+	}, []string{"result"})
+
+	PrefixWritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_prefix_writes_total",
+		Help: "Total number of successful writes by key prefix",
+	}, []string{"prefix", "operation"})
+
+	PrefixKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kine_prefix_keys",
+		Help: "Number of keys by key prefix, as of the last periodic count",
+	}, []string{"prefix"})
+
+	LastReadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_last_read_timestamp_seconds",
+		Help: "Time of the last successful read, in seconds since the epoch",
+	})
+
+	LastWriteTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_last_write_timestamp_seconds",
+		Help: "Time of the last successful write, in seconds since the epoch",
+	})
+
+	StandbyLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_standby_lag_revisions",
+		Help: "Number of revisions that the warm standby is behind the primary",
+	})
+
+	StandbyDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_standby_dropped_total",
+		Help: "Total number of events that were not replicated to the warm standby",
+	})
+
+	StandbyResyncTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_standby_resync_total",
+		Help: "Total number of times that all keys were copied to the warm standby again after events were not replicated",
+	})
 )
 
 var (
@@ -42,17 +125,34 @@ var (
 	// This can be directly modified to override the default value when kine is used as a library.
 	SlowSQLThreshold        = time.Second
 	SlowSQLWarningThreshold = 5 * time.Second
+
+	// SlowSQLLogArgs enables logging of bind arguments with slow SQL. Values written to keys
+	// under SlowSQLRedactPrefixes are redacted according to SlowSQLRedactMode, which must be
+	// util.RedactHash or util.RedactElide. Otherwise, arguments are only logged at trace level,
+	// with values summarized by their length.
+	SlowSQLLogArgs        = false
+	SlowSQLRedactPrefixes = []string{"/registry/secrets/"}
+	SlowSQLRedactMode     = util.RedactHash
 )
 
-func ObserveSQL(start time.Time, errCode string, sql util.Stripped, args any) {
+// ObserveSQL records the result and duration of a SQL operation, and logs slow operations.
+// If ctx carries a request id, it is attached to the duration as an exemplar, and to the slow SQL log.
+func ObserveSQL(ctx context.Context, start time.Time, errCode string, sql util.Stripped, args any) {
 	SQLTotal.WithLabelValues(errCode).Inc()
 	duration := time.Since(start)
-	SQLTime.WithLabelValues(errCode).Observe(duration.Seconds())
+	requestID := util.RequestID(ctx)
+	if eo, ok := SQLTime.WithLabelValues(errCode).(prometheus.ExemplarObserver); ok && requestID != "" {
+		eo.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"request_id": requestID})
+	} else {
+		SQLTime.WithLabelValues(errCode).Observe(duration.Seconds())
+	}
 	if SlowSQLThreshold > 0 && duration >= SlowSQLThreshold {
-		instrumentedLogger := logrus.WithField("duration", duration)
+		instrumentedLogger := util.RequestLogger(ctx).WithField("duration", duration)
 
-		if logrus.GetLevel() == logrus.TraceLevel {
-			instrumentedLogger.WithField("args", args)
+		if SlowSQLLogArgs {
+			instrumentedLogger = instrumentedLogger.WithField("args", redactArgs(args))
+		} else if logrus.GetLevel() == logrus.TraceLevel {
+			instrumentedLogger = instrumentedLogger.WithField("args", summarizeArgs(args))
 		}
 
 		if duration < SlowSQLWarningThreshold {
@@ -62,3 +162,31 @@ func ObserveSQL(start time.Time, errCode string, sql util.Stripped, args any) {
 		}
 	}
 }
+
+// ObserveSQLAcquire records the time spent waiting for a connection from the pool for a SQL
+// operation, and logs slow waits, which indicate that the pool is too small for the load.
+func ObserveSQLAcquire(ctx context.Context, start time.Time, sql util.Stripped) {
+	wait := time.Since(start)
+	SQLAcquireTime.Observe(wait.Seconds())
+	if SlowSQLThreshold > 0 && wait >= SlowSQLThreshold {
+		util.RequestLogger(ctx).WithField("acquire", wait).Infof("Slow SQL connection acquire (started: %v) (total time: %v): %s", start, wait, sql)
+	}
+}
+
+// summarizeArgs wraps SQL bind arguments for logging, with values replaced by their length.
+func summarizeArgs(args any) fmt.Stringer {
+	a, ok := args.([]any)
+	if !ok {
+		a = []any{args}
+	}
+	return util.Summarize(a)
+}
+
+// redactArgs wraps SQL bind arguments for logging, with secret values redacted.
+func redactArgs(args any) fmt.Stringer {
+	a, ok := args.([]any)
+	if !ok {
+		a = []any{args}
+	}
+	return util.Redacted{Args: a, Prefixes: SlowSQLRedactPrefixes, Mode: SlowSQLRedactMode}
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestObserveSQLRedactsArgs(t *testing.T) {
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	defer func(threshold time.Duration, logArgs bool, mode string) {
+		SlowSQLThreshold, SlowSQLLogArgs, SlowSQLRedactMode = threshold, logArgs, mode
+	}(SlowSQLThreshold, SlowSQLLogArgs, SlowSQLRedactMode)
+	SlowSQLThreshold = time.Nanosecond
+	SlowSQLLogArgs = true
+
+	for _, mode := range []string{util.RedactHash, util.RedactElide} {
+		SlowSQLRedactMode = mode
+		hook.Reset()
+
+		ObserveSQL(context.Background(), time.Now().Add(-time.Millisecond), "", "INSERT INTO kine", []any{"/registry/secrets/default/token", 1, []byte("hunter2")})
+		ObserveSQL(context.Background(), time.Now().Add(-time.Millisecond), "", "INSERT INTO kine", []any{"/registry/configmaps/default/config", 1, []byte("visible")})
+
+		entries := hook.AllEntries()
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 slow SQL log entries, got %d", len(entries))
+		}
+
+		secret := fmt.Sprint(entries[0].Data["args"])
+		if strings.Contains(secret, "hunter2") || !strings.Contains(secret, "/registry/secrets/default/token") {
+			t.Fatalf("expected secret value to be redacted with key visible for mode %s, got %s", mode, secret)
+		}
+		if other := fmt.Sprint(entries[1].Data["args"]); !strings.Contains(other, "visible") {
+			t.Fatalf("expected non-secret value to be logged, got %s", other)
+		}
+	}
+
+	// without SlowSQLLogArgs, values are only summarized at trace level
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.TraceLevel)
+	SlowSQLLogArgs = false
+	hook.Reset()
+
+	ObserveSQL(context.Background(), time.Now().Add(-time.Millisecond), "", "INSERT INTO kine", []any{"/registry/configmaps/default/config", 1, []byte("visible")})
+	if args := fmt.Sprint(hook.LastEntry().Data["args"]); strings.Contains(args, "visible") || !strings.Contains(args, "[7]byte(...)") {
+		t.Fatalf("expected value to be summarized at trace level, got %s", args)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "kine_test_handler_total"})
+	Registry.MustRegister(counter)
+	defer Registry.Unregister(counter)
+	counter.Add(3)
+
+	// mount the handler on an embedder's mux, at a path of its choosing
+	mux := http.NewServeMux()
+	mux.Handle("/kine/metrics", Handler())
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/kine/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "kine_test_handler_total 3") {
+		t.Fatalf("expected scraped metrics to include kine_test_handler_total, got %s", body)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+	for _, test := range []struct {
+		method   string
+		loopback bool
+		tls      *tls.ConnectionState
+		status   int
+	}{
+		{http.MethodGet, false, nil, http.StatusOK},
+		{http.MethodPost, false, nil, http.StatusForbidden},
+		{http.MethodPut, false, &tls.ConnectionState{}, http.StatusForbidden},
+		{http.MethodPut, false, verified, http.StatusOK},
+		{http.MethodPost, true, nil, http.StatusOK},
+	} {
+		req := httptest.NewRequest(test.method, "/admin/readonly", nil)
+		req.TLS = test.tls
+		rec := httptest.NewRecorder()
+		adminHandler(admin, test.loopback).ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("expected status %d for %s with loopback=%v, verified=%v, got %d", test.status, test.method, test.loopback, test.tls == verified, rec.Code)
+		}
+	}
+}
@@ -2,9 +2,13 @@ package metrics
 
 import (
 	"context"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
 
 	"github.com/k3s-io/kine/pkg/tls"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,13 +19,41 @@ type Config struct {
 	ServerAddress   string
 	ServerTLSConfig tls.Config
 	EnableProfiling bool
+	AdminHandler    http.Handler
+	HealthHandler   http.Handler
 }
 
 const (
 	defaultBindAddress = ":8080"
 	metricsPath        = "/metrics"
+	adminPath          = "/admin/"
+	healthPath         = "/health"
+
+	// ProfilingPath is the path that the handler returned by ProfilingHandler must be mounted at.
+	ProfilingPath = "/debug/pprof/"
 )
 
+// Handler returns a handler that serves the metrics in Registry, for processes that embed
+// kine and serve metrics from their own HTTP server instead of calling Serve.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
+		ErrorHandling:     promhttp.HTTPErrorOnError,
+		EnableOpenMetrics: true,
+	})
+}
+
+// ProfilingHandler returns a handler that serves the net/http/pprof endpoints. It must be
+// mounted at ProfilingPath.
+func ProfilingHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ProfilingPath, pprof.Index)
+	mux.HandleFunc(ProfilingPath+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(ProfilingPath+"profile", pprof.Profile)
+	mux.HandleFunc(ProfilingPath+"symbol", pprof.Symbol)
+	mux.HandleFunc(ProfilingPath+"trace", pprof.Trace)
+	return mux
+}
+
 func Serve(ctx context.Context, config Config) {
 	if config.ServerAddress == "" {
 		config.ServerAddress = defaultBindAddress
@@ -36,23 +68,43 @@ func Serve(ctx context.Context, config Config) {
 		logrus.Fatalf("error creating the metrics listener: %v", err)
 	}
 
-	handler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
-		ErrorHandling: promhttp.HTTPErrorOnError,
-	})
 	mux := http.NewServeMux()
-	mux.Handle(metricsPath, handler)
+	mux.Handle(metricsPath, Handler())
 
 	if config.EnableProfiling {
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle(ProfilingPath, ProfilingHandler())
+	}
+
+	loopback := false
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		loopback = addr.IP.IsLoopback()
+	}
+	clientCAs, err := loadClientCAs(config.ServerTLSConfig)
+	if err != nil {
+		logrus.Fatalf("error loading the metrics client CA: %v", err)
+	}
+
+	if config.AdminHandler != nil {
+		if !loopback && clientCAs == nil {
+			logrus.Warnf("Admin requests that change state will be refused: the metrics bind address %s is not a loopback address, and no client CA is configured to verify client certificates", config.ServerAddress)
+		}
+		mux.Handle(adminPath, adminHandler(config.AdminHandler, loopback))
+	}
+
+	if config.HealthHandler != nil {
+		mux.Handle(healthPath, config.HealthHandler)
 	}
 
 	server := http.Server{
 		Handler: mux,
 	}
+	if clientCAs != nil {
+		// client certificates are optional, so that metrics can still be scraped without one
+		server.TLSConfig = &cryptotls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: cryptotls.VerifyClientCertIfGiven,
+		}
+	}
 
 	go func() {
 		logrus.Infof("starting metrics server path %s", metricsPath)
@@ -72,3 +124,36 @@ func Serve(ctx context.Context, config Config) {
 		logrus.Fatalf("error shutting down the metrics server: %v", err)
 	}
 }
+
+// loadClientCAs returns the pool of CAs used to verify metrics client certificates, or nil if
+// the metrics server is not serving TLS or no client CA is configured.
+func loadClientCAs(config tls.Config) (*x509.CertPool, error) {
+	if config.CertFile == "" || config.KeyFile == "" || config.TrustedCAFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(config.TrustedCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.TrustedCAFile)
+	}
+	return pool, nil
+}
+
+// adminHandler only passes requests that change state to the admin handler if the metrics
+// server is bound to a loopback address, or the client presented a verified certificate, as
+// the metrics server does not otherwise authenticate clients. Read-only requests are always
+// passed.
+func adminHandler(handler http.Handler, loopback bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+		verified := r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+		if !readOnly && !loopback && !verified {
+			http.Error(w, "admin requests that change state require a verified client certificate, or a loopback metrics bind address", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+)
+
+// activity records when the backend last successfully served a read and a write, so that a
+// server that has silently stopped serving requests can be detected.
+type activity struct {
+	lastRead  atomic.Int64
+	lastWrite atomic.Int64
+}
+
+func (a *activity) read() {
+	now := time.Now()
+	a.lastRead.Store(now.UnixNano())
+	metrics.LastReadTimestamp.Set(float64(now.UnixNano()) / 1e9)
+}
+
+func (a *activity) write() {
+	now := time.Now()
+	a.lastWrite.Store(now.UnixNano())
+	metrics.LastWriteTimestamp.Set(float64(now.UnixNano()) / 1e9)
+}
+
+// LastRead returns the time of the last successful read, or the zero time if there has been none.
+func (k *KVServerBridge) LastRead() time.Time {
+	return unixTime(k.limited.activity.lastRead.Load())
+}
+
+// LastWrite returns the time of the last successful write, or the zero time if there has been none.
+func (k *KVServerBridge) LastWrite() time.Time {
+	return unixTime(k.limited.activity.lastWrite.Load())
+}
+
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RegisterAdmin registers runtime administration handlers on the provided mux.
+// All handlers are registered under the /admin/ path.
+func (k *KVServerBridge) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/compact", k.getCompactConfig)
+	mux.HandleFunc("POST /admin/compact", k.setCompactConfig)
+	mux.HandleFunc("GET /admin/revision", k.getRevision)
+	mux.HandleFunc("GET /admin/stats", k.getStats)
+	mux.HandleFunc("GET /admin/config", k.getDriverConfig)
+	mux.HandleFunc("GET /admin/metadata", k.getKeyMetadata)
+	mux.HandleFunc("PUT /admin/metadata", k.setKeyMetadata)
+	mux.HandleFunc("POST /admin/delete-prefix", k.deletePrefix)
+	mux.HandleFunc("GET /admin/diagnostics", k.getDiagnostics)
+	mux.HandleFunc("GET /admin/readonly", k.getReadOnly)
+	mux.HandleFunc("PUT /admin/readonly", k.setReadOnly)
+
+	recentErrorsOnce.Do(func() { logrus.AddHook(recentErrors) })
+}
+
+type keyMetadata struct {
+	Key         string            `json:"key"`
+	ModRevision int64             `json:"modRevision"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// getKeyMetadata returns the mod revision and metadata of the key given by the "key" form value or,
+// if a "prefix" form value is given instead, the metadata of each key matching the prefix.
+// Listed keys may be filtered by metadata with one or more "match" form values of the form
+// name=value.
+func (k *KVServerBridge) getKeyMetadata(w http.ResponseWriter, r *http.Request) {
+	s, ok := k.limited.backend.(KeyMetadataStore)
+	if !ok {
+		http.Error(w, "key metadata is not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	if key := r.FormValue("key"); key != "" {
+		_, kv, err := k.limited.backend.Get(r.Context(), key, "", 1, 0, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if kv == nil {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		metadata, err := s.GetKeyMetadata(r.Context(), key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, keyMetadata{Key: kv.Key, ModRevision: kv.ModRevision, Metadata: metadata})
+		return
+	}
+
+	prefix := r.FormValue("prefix")
+	if prefix == "" {
+		http.Error(w, "one of key or prefix is required", http.StatusBadRequest)
+		return
+	}
+	filter := map[string]string{}
+	for _, match := range r.Form["match"] {
+		name, value, ok := strings.Cut(match, "=")
+		if !ok {
+			http.Error(w, "invalid match "+strconv.Quote(match)+": must be of the form name=value", http.StatusBadRequest)
+			return
+		}
+		filter[name] = value
+	}
+	metadata, err := s.ListKeyMetadata(r.Context(), prefix, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, metadata)
+}
+
+// setKeyMetadata replaces the metadata of the key given by the "key" form value with the
+// JSON object of name/value pairs in the request body.
+func (k *KVServerBridge) setKeyMetadata(w http.ResponseWriter, r *http.Request) {
+	s, ok := k.limited.backend.(KeyMetadataStore)
+	if !ok {
+		http.Error(w, "key metadata is not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	if k.ReadOnly() {
+		http.Error(w, "server is in read-only mode", http.StatusServiceUnavailable)
+		return
+	}
+
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	metadata := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		http.Error(w, "invalid metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.SetKeyMetadata(r.Context(), key, metadata); err != nil {
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+			http.Error(w, "key not found", http.StatusNotFound)
+		case errors.Is(err, ErrInvalidKeyMetadata):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, metadata)
+}
+
+// deletePrefix deletes every key under the "prefix" form value, in batches of the "batch-size"
+// form value, waiting the "interval" form value between batches.
+func (k *KVServerBridge) deletePrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("prefix")
+	if !strings.HasSuffix(prefix, "/") {
+		http.Error(w, "prefix is required, and must end with /", http.StatusBadRequest)
+		return
+	}
+
+	var batchSize int64
+	if v := r.FormValue("batch-size"); v != "" {
+		var err error
+		if batchSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid batch-size: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var interval time.Duration
+	if v := r.FormValue("interval"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid interval: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := k.DeletePrefix(r.Context(), prefix, batchSize, interval)
+	if err != nil {
+		if errors.Is(err, ErrReadOnly) {
+			http.Error(w, "server is in read-only mode", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// getDriverConfig returns the configuration that the datastore driver is running with.
+func (k *KVServerBridge) getDriverConfig(w http.ResponseWriter, r *http.Request) {
+	c, ok := k.limited.backend.(ConfigReporter)
+	if !ok {
+		http.Error(w, "driver configuration is not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, c.DriverConfig())
+}
+
+// getStats returns aggregate storage statistics for capacity planning.
+func (k *KVServerBridge) getStats(w http.ResponseWriter, r *http.Request) {
+	s, ok := k.limited.backend.(StatsReporter)
+	if !ok {
+		http.Error(w, "storage statistics are not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	stats, err := s.StorageStats(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+type revision struct {
+	Current int64 `json:"current"`
+	Min     int64 `json:"min"`
+}
+
+// getRevision returns the current revision, and the oldest revision that can be read.
+func (k *KVServerBridge) getRevision(w http.ResponseWriter, r *http.Request) {
+	m, ok := k.limited.backend.(MinRevisioner)
+	if !ok {
+		http.Error(w, "minimum revision is not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	current, err := k.limited.backend.CurrentRevision(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	minRev, err := m.MinRevision(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, revision{Current: current, Min: minRev})
+}
+
+type readOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+func (k *KVServerBridge) getReadOnly(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, readOnlyState{ReadOnly: k.ReadOnly()})
+}
+
+// setReadOnly enables or disables read-only mode from the "enabled" form value.
+func (k *KVServerBridge) setReadOnly(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if enabled != k.ReadOnly() {
+		if enabled {
+			logrus.Warnf("Read-only mode enabled; write requests will be rejected")
+		} else {
+			logrus.Warnf("Read-only mode disabled; write requests will be accepted")
+		}
+	}
+	k.SetReadOnly(enabled)
+	writeJSON(w, readOnlyState{ReadOnly: enabled})
+}
+
+type compactConfig struct {
+	Interval  string `json:"interval"`
+	BatchSize int64  `json:"batchSize"`
+}
+
+func (k *KVServerBridge) getCompactConfig(w http.ResponseWriter, r *http.Request) {
+	c, ok := k.limited.backend.(CompactConfigurer)
+	if !ok {
+		http.Error(w, "compaction settings are not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	writeCompactConfig(w, c)
+}
+
+// setCompactConfig updates the compact interval and/or batch size from the
+// "interval" and "batch-size" form values. Both values are validated before either is
+// applied, so that a rejected request leaves the configuration unchanged.
+func (k *KVServerBridge) setCompactConfig(w http.ResponseWriter, r *http.Request) {
+	c, ok := k.limited.backend.(CompactConfigurer)
+	if !ok {
+		http.Error(w, "compaction settings are not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	var (
+		interval  time.Duration
+		batchSize int64
+		err       error
+	)
+	if v := r.FormValue("interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid interval: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if interval <= 0 {
+			http.Error(w, "invalid interval: must be greater than zero", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("batch-size"); v != "" {
+		if batchSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid batch-size: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if batchSize <= 0 {
+			http.Error(w, "invalid batch-size: must be greater than zero", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := c.ValidateCompactConfig(interval, batchSize); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if interval != 0 {
+		if err := c.SetCompactInterval(interval); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if batchSize != 0 {
+		if err := c.SetCompactBatchSize(batchSize); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeCompactConfig(w, c)
+}
+
+func writeCompactConfig(w http.ResponseWriter, c CompactConfigurer) {
+	interval, batchSize := c.CompactConfig()
+	writeJSON(w, compactConfig{Interval: interval.String(), BatchSize: batchSize})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("Failed to write admin response: %v", err)
+	}
+}
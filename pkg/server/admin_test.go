@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// compactConfigBackend implements only the compaction settings of a backend, rejecting
+// batch sizes below 100; calling any other method will panic.
+type compactConfigBackend struct {
+	Backend
+	interval  time.Duration
+	batchSize int64
+}
+
+func (b *compactConfigBackend) CompactConfig() (time.Duration, int64) {
+	return b.interval, b.batchSize
+}
+
+func (b *compactConfigBackend) SetCompactInterval(interval time.Duration) error {
+	if err := b.ValidateCompactConfig(interval, 0); err != nil {
+		return err
+	}
+	b.interval = interval
+	return nil
+}
+
+func (b *compactConfigBackend) SetCompactBatchSize(batchSize int64) error {
+	if err := b.ValidateCompactConfig(0, batchSize); err != nil {
+		return err
+	}
+	b.batchSize = batchSize
+	return nil
+}
+
+func (b *compactConfigBackend) ValidateCompactConfig(interval time.Duration, batchSize int64) error {
+	if batchSize != 0 && batchSize < 100 {
+		return fmt.Errorf("compact-batch-size %d too small", batchSize)
+	}
+	return nil
+}
+
+func TestSetCompactConfig(t *testing.T) {
+	backend := &compactConfigBackend{interval: 5 * time.Minute, batchSize: 1000}
+	mux := http.NewServeMux()
+	New(backend, "unix", 0, "").RegisterAdmin(mux)
+
+	for _, test := range []struct {
+		query     string
+		status    int
+		interval  time.Duration
+		batchSize int64
+	}{
+		// a rejected value leaves the other value unchanged, even if it is valid
+		{"interval=1m&batch-size=1", http.StatusBadRequest, 5 * time.Minute, 1000},
+		{"interval=1m&batch-size=x", http.StatusBadRequest, 5 * time.Minute, 1000},
+		{"interval=0s&batch-size=500", http.StatusBadRequest, 5 * time.Minute, 1000},
+		{"interval=1m&batch-size=500", http.StatusOK, time.Minute, 500},
+		{"batch-size=200", http.StatusOK, time.Minute, 200},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/compact?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.query, test.status, w.Code, w.Body)
+		}
+		if interval, batchSize := backend.CompactConfig(); interval != test.interval || batchSize != test.batchSize {
+			t.Errorf("%s: expected interval %s and batch size %d, got %s and %d", test.query, test.interval, test.batchSize, interval, batchSize)
+		}
+	}
+}
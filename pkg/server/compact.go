@@ -15,8 +15,28 @@ var (
 	compactRevAPI = "compact_rev_key_apiserver" // key used by kine to store the apiserver's compact_rev_key value
 )
 
+// checkWriteKey returns an error if key may not be written by a transaction. The compact
+// rev key is reserved: kine stores its own compaction state under this name, so clients
+// may only update it through the apiserver's compact transaction or a put, which are
+// redirected to a substitute key.
+func checkWriteKey(key string) error {
+	switch key {
+	case "":
+		return ErrEmptyKey
+	case compactRevKey:
+		return ErrReservedKey
+	}
+	return nil
+}
+
 func (l *LimitedServer) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	if l.readOnly.Load() {
+		return nil, ErrReadOnly
+	}
 	rev, err := l.backend.Compact(ctx, r.Revision)
+	if err == nil {
+		l.activity.write()
+	}
 	return &etcdserverpb.CompactionResponse{
 		Header: &etcdserverpb.ResponseHeader{
 			Revision: rev,
@@ -26,6 +26,8 @@ func (l *LimitedServer) create(ctx context.Context, put *etcdserverpb.PutRequest
 		return nil, unsupported("ignoreValue")
 	} else if put.PrevKv {
 		return nil, unsupported("prevKv")
+	} else if err := checkWriteKey(string(put.Key)); err != nil {
+		return nil, err
 	}
 
 	rev, err := l.backend.Create(ctx, string(put.Key), put.Value, put.Lease)
@@ -37,6 +39,7 @@ func (l *LimitedServer) create(ctx context.Context, put *etcdserverpb.PutRequest
 	} else if err != nil {
 		return nil, err
 	}
+	l.prefixMetrics.observeWrite(string(put.Key), "create")
 
 	return &etcdserverpb.TxnResponse{
 		Header: txnHeader(rev),
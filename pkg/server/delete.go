@@ -28,6 +28,10 @@ func isDelete(txn *etcdserverpb.TxnRequest) (int64, string, bool) {
 }
 
 func (l *LimitedServer) delete(ctx context.Context, key string, revision int64) (*etcdserverpb.TxnResponse, error) {
+	if err := checkWriteKey(key); err != nil {
+		return nil, err
+	}
+
 	rev, kv, ok, err := l.backend.Delete(ctx, key, revision)
 	if err != nil {
 		return nil, err
@@ -52,6 +56,7 @@ func (l *LimitedServer) delete(ctx context.Context, key string, revision int64)
 		}, nil
 	}
 
+	l.prefixMetrics.observeWrite(key, "delete")
 	return &etcdserverpb.TxnResponse{
 		Header: txnHeader(rev),
 		Responses: []*etcdserverpb.ResponseOp{
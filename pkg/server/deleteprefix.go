@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDeletePrefixBatchSize is the number of keys deleted in each batch of a prefix delete,
+// if no batch size is given.
+const DefaultDeletePrefixBatchSize = 100
+
+// DeletePrefixResult describes the outcome of a prefix delete.
+type DeletePrefixResult struct {
+	// Revision is the revision at which the keys to delete were listed.
+	Revision int64 `json:"revision"`
+	// Deleted is the number of keys deleted.
+	Deleted int64 `json:"deleted"`
+	// Skipped is the number of keys that were not deleted, because they were modified or
+	// deleted by another client after Revision.
+	Skipped int64 `json:"skipped"`
+}
+
+// DeletePrefix deletes every key under prefix, which must end with "/", as of the current
+// revision. Keys are listed at that revision and deleted in batches of batchSize, waiting
+// interval between batches to limit the load on the datastore. Each delete creates a tombstone
+// and a watch event, as for a delete requested by a client. Keys created after the listed
+// revision are left in place, and keys modified since are skipped rather than deleted.
+func (k *KVServerBridge) DeletePrefix(ctx context.Context, prefix string, batchSize int64, interval time.Duration) (*DeletePrefixResult, error) {
+	return k.limited.deletePrefix(ctx, prefix, batchSize, interval)
+}
+
+func (l *LimitedServer) deletePrefix(ctx context.Context, prefix string, batchSize int64, interval time.Duration) (*DeletePrefixResult, error) {
+	if l.readOnly.Load() {
+		return nil, ErrReadOnly
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return nil, errors.New("prefix must end with /")
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultDeletePrefixBatchSize
+	}
+
+	revision, err := l.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &DeletePrefixResult{Revision: revision}
+
+	start := ""
+	for {
+		_, kvs, err := l.backend.List(ctx, prefix, start, batchSize, revision, true)
+		if err != nil {
+			return result, err
+		}
+		for _, kv := range kvs {
+			if checkWriteKey(kv.Key) != nil {
+				continue
+			}
+			// the delete only succeeds if the key has not been modified since the listed revision
+			_, _, ok, err := l.backend.Delete(ctx, kv.Key, kv.ModRevision)
+			if err != nil {
+				return result, err
+			}
+			if !ok {
+				result.Skipped++
+				continue
+			}
+			result.Deleted++
+			l.prefixMetrics.observeWrite(kv.Key, "delete")
+			l.activity.write()
+		}
+		if int64(len(kvs)) < batchSize {
+			break
+		}
+		start = kvs[len(kvs)-1].Key + "\x00"
+
+		if interval > 0 {
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+	}
+
+	logrus.Infof("Deleted %d keys under %s as of revision %d, skipped %d modified since", result.Deleted, prefix, revision, result.Skipped)
+	return result, nil
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recentErrorsSize is the number of recent warning and error log messages held for diagnostics.
+const recentErrorsSize = 50
+
+var (
+	recentErrors     = &errorHistory{}
+	recentErrorsOnce sync.Once
+)
+
+// Diagnostics is a snapshot of the state of the server and its backend, for diagnosing faults.
+type Diagnostics struct {
+	Time            time.Time `json:"time"`
+	CurrentRevision int64     `json:"currentRevision"`
+	// LastRead and LastWrite are the times of the last successful read and write, if any.
+	LastRead  time.Time `json:"lastRead,omitzero"`
+	LastWrite time.Time `json:"lastWrite,omitzero"`
+	// Backend is the internal state of the backend, if it reports any.
+	Backend *BackendDiagnostics `json:"backend,omitempty"`
+	// DriverConfig is the configuration of the datastore driver, with secrets redacted.
+	DriverConfig *DriverConfig      `json:"driverConfig,omitempty"`
+	Watches      []WatchDiagnostics `json:"watches"`
+	RecentErrors []LogMessage       `json:"recentErrors"`
+}
+
+// WatchDiagnostics describes an active watch.
+type WatchDiagnostics struct {
+	// Server is the id of the watch stream that the watch was created on.
+	Server        int64     `json:"server"`
+	ID            int64     `json:"id"`
+	Key           string    `json:"key"`
+	StartRevision int64     `json:"startRevision"`
+	Created       time.Time `json:"created"`
+	// LastRevision is the revision of the last event sent to the client, or 0 if none has been sent.
+	LastRevision int64 `json:"lastRevision"`
+}
+
+// LogMessage is a warning or error logged by the process.
+type LogMessage struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// getDiagnostics returns a snapshot of the state of the server and its backend. Parts of the
+// snapshot that the backend does not support are omitted, and parts that fail are logged and
+// omitted, so that a dump can be taken from a server that is misbehaving.
+func (k *KVServerBridge) getDiagnostics(w http.ResponseWriter, r *http.Request) {
+	backend := k.limited.backend
+	diagnostics := Diagnostics{
+		Time:         time.Now(),
+		LastRead:     k.LastRead(),
+		LastWrite:    k.LastWrite(),
+		Watches:      k.watches.list(),
+		RecentErrors: recentErrors.list(),
+	}
+
+	var err error
+	if diagnostics.CurrentRevision, err = backend.CurrentRevision(r.Context()); err != nil {
+		logrus.Warnf("Failed to get current revision for diagnostics: %v", err)
+	}
+	if d, ok := backend.(Diagnoser); ok {
+		if diagnostics.Backend, err = d.Diagnostics(r.Context()); err != nil {
+			logrus.Warnf("Failed to get backend diagnostics: %v", err)
+		}
+	}
+	if c, ok := backend.(ConfigReporter); ok {
+		diagnostics.DriverConfig = c.DriverConfig()
+	}
+	writeJSON(w, diagnostics)
+}
+
+// watchRegistry tracks the active watches of a server, for diagnostics.
+type watchRegistry struct {
+	sync.Mutex
+	watches map[int64]*watchState
+}
+
+type watchState struct {
+	WatchDiagnostics
+	lastRevision atomic.Int64
+}
+
+func newWatchRegistry() *watchRegistry {
+	return &watchRegistry{watches: map[int64]*watchState{}}
+}
+
+// add records an active watch. A nil registry records nothing.
+func (r *watchRegistry) add(server, id int64, key string, startRevision int64) *watchState {
+	if r == nil {
+		return nil
+	}
+	state := &watchState{WatchDiagnostics: WatchDiagnostics{
+		Server:        server,
+		ID:            id,
+		Key:           key,
+		StartRevision: startRevision,
+		Created:       time.Now(),
+	}}
+	r.Lock()
+	defer r.Unlock()
+	r.watches[id] = state
+	return state
+}
+
+func (r *watchRegistry) remove(id int64) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	delete(r.watches, id)
+}
+
+// list returns the active watches, ordered by id.
+func (r *watchRegistry) list() []WatchDiagnostics {
+	watches := []WatchDiagnostics{}
+	if r == nil {
+		return watches
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, state := range r.watches {
+		watch := state.WatchDiagnostics
+		watch.LastRevision = state.lastRevision.Load()
+		watches = append(watches, watch)
+	}
+	slices.SortFunc(watches, func(a, b WatchDiagnostics) int { return cmp.Compare(a.ID, b.ID) })
+	return watches
+}
+
+// delivered records the revision of the last event sent to the client.
+func (s *watchState) delivered(revision int64) {
+	if s != nil {
+		s.lastRevision.Store(revision)
+	}
+}
+
+// errorHistory is a logrus hook that holds the most recent warning and error messages.
+type errorHistory struct {
+	sync.Mutex
+	messages []LogMessage
+	next     int
+}
+
+func (h *errorHistory) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (h *errorHistory) Fire(entry *logrus.Entry) error {
+	h.Lock()
+	defer h.Unlock()
+	message := LogMessage{Time: entry.Time, Level: entry.Level.String(), Message: entry.Message}
+	if len(h.messages) < recentErrorsSize {
+		h.messages = append(h.messages, message)
+	} else {
+		h.messages[h.next] = message
+	}
+	h.next = (h.next + 1) % recentErrorsSize
+	return nil
+}
+
+// list returns the held messages, oldest first.
+func (h *errorHistory) list() []LogMessage {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.messages) < recentErrorsSize {
+		return append([]LogMessage{}, h.messages...)
+	}
+	return append(slices.Clone(h.messages[h.next:]), h.messages[:h.next]...)
+}
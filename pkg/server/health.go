@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	healthKey     = "/registry/health"
+	healthTimeout = 5 * time.Second
+)
+
+type healthStatus struct {
+	Health string `json:"health"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RegisterHealth registers the health handler on mux at /health.
+func (k *KVServerBridge) RegisterHealth(mux *http.ServeMux) {
+	mux.Handle("GET /health", k.HealthHandler())
+}
+
+// HealthHandler returns a handler that reports whether the backend can serve reads, in the
+// same format as etcd's /health endpoint. It responds with 503 Service Unavailable if the
+// health check key cannot be read.
+func (k *KVServerBridge) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+
+		status, code := healthStatus{Health: "true"}, http.StatusOK
+		if _, _, err := k.limited.backend.Get(ctx, healthKey, "", 1, 0, false); err != nil {
+			status, code = healthStatus{Health: "false", Reason: err.Error()}, http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			logrus.Errorf("Failed to write health response: %v", err)
+		}
+	})
+}
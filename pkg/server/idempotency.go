@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// IdempotencyKeyMetadataKey is the request metadata key that a client may set on a write
+// request, so that a retry of the request with the same idempotency key returns the result of
+// the original request instead of being applied again. Results are held in memory by the kine
+// instance that served the original request, for the configured idempotency window: a retry
+// served by a different instance, or by the same instance after a restart, is applied again.
+const IdempotencyKeyMetadataKey = "kine-idempotency-key"
+
+// maxIdempotentResults is the maximum number of results held; beyond that, the oldest results
+// are discarded before they expire, so that a flood of unique keys cannot exhaust memory.
+const maxIdempotentResults = 100000
+
+// ErrIdempotencyKeyReused is returned if an idempotency key is reused for a different request
+// within the idempotency window.
+var ErrIdempotencyKeyReused = status.Errorf(codes.InvalidArgument, "etcdserver: %s was already used for a different request", IdempotencyKeyMetadataKey)
+
+// idempotencyCache holds the results of write requests by idempotency key.
+type idempotencyCache struct {
+	sync.Mutex
+	window     time.Duration
+	maxResults int
+	results    map[string]*idempotentResult
+	// queue holds results in the order they were added, which is also the order in
+	// which they expire.
+	queue []*idempotentResult
+}
+
+// idempotentResult is the result of a request; done is closed once the request has completed.
+type idempotentResult struct {
+	key     string
+	hash    []byte
+	expires time.Time
+	done    chan struct{}
+	resp    any
+	err     error
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:     window,
+		maxResults: maxIdempotentResults,
+		results:    map[string]*idempotentResult{},
+	}
+}
+
+// idempotent calls f to apply the request, unless the request carries an idempotency key that
+// has already been used, in which case the original result is returned instead. A retry that
+// arrives while the original request is still in progress waits for its result. Failed requests
+// are not recorded, so that they can be retried.
+func idempotent[Resp any](ctx context.Context, c *idempotencyCache, req interface{ Marshal() ([]byte, error) }, f func() (Resp, error)) (Resp, error) {
+	if c == nil {
+		return f()
+	}
+	key := idempotencyKey(ctx)
+	if key == "" {
+		return f()
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return f()
+	}
+	// the request type is included in the hash, so that a key reused across request types
+	// is not mistaken for a retry
+	h := sha256.New()
+	fmt.Fprintf(h, "%T\n", req)
+	h.Write(data)
+	hash := h.Sum(nil)
+
+	for {
+		r, ok := c.get(key, hash)
+		if !ok {
+			resp, err := f()
+			c.complete(r, resp, err)
+			return resp, err
+		}
+		if !bytes.Equal(r.hash, hash) {
+			var zero Resp
+			return zero, ErrIdempotencyKeyReused
+		}
+
+		select {
+		case <-ctx.Done():
+			var zero Resp
+			return zero, ctx.Err()
+		case <-r.done:
+		}
+		if r.err == nil {
+			util.RequestLogger(ctx).Debugf("Returning original result for request with idempotency key %s", key)
+			return r.resp.(Resp), nil
+		}
+		// the original request failed and was not recorded; try again
+	}
+}
+
+// get returns the result recorded for key, or records and returns a new pending result if there
+// is none, along with false to indicate that the caller must complete it.
+func (c *idempotencyCache) get(key string, hash []byte) (*idempotentResult, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for len(c.queue) > 0 && (now.After(c.queue[0].expires) || len(c.queue) >= c.maxResults) {
+		if expired := c.queue[0]; c.results[expired.key] == expired {
+			delete(c.results, expired.key)
+		}
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+	}
+
+	if r, ok := c.results[key]; ok {
+		return r, true
+	}
+	r := &idempotentResult{
+		key:     key,
+		hash:    hash,
+		expires: now.Add(c.window),
+		done:    make(chan struct{}),
+	}
+	c.results[key] = r
+	c.queue = append(c.queue, r)
+	return r, false
+}
+
+func (c *idempotencyCache) complete(r *idempotentResult, resp any, err error) {
+	c.Lock()
+	r.resp, r.err = resp, err
+	if err != nil && c.results[r.key] == r {
+		delete(c.results, r.key)
+	}
+	c.Unlock()
+	close(r.done)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(IdempotencyKeyMetadataKey); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
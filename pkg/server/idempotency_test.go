@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/metadata"
+)
+
+// createBackend implements only the backend methods needed to create keys;
+// calling any other method will panic.
+type createBackend struct {
+	Backend
+	mu   sync.Mutex
+	rows map[string]int64
+	rev  int64
+}
+
+func (b *createBackend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rev++
+	if _, ok := b.rows[key]; ok {
+		return b.rev, ErrKeyExists
+	}
+	b.rows[key] = b.rev
+	return b.rev, nil
+}
+
+func createTxn(key string) *etcdserverpb.TxnRequest {
+	return &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte(key),
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 0},
+		}},
+		Success: []*etcdserverpb.RequestOp{{
+			Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte("v")}},
+		}},
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	backend := &createBackend{rows: map[string]int64{}}
+	l := &LimitedServer{backend: backend, idempotency: newIdempotencyCache(time.Minute)}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(IdempotencyKeyMetadataKey, "create-a"))
+
+	first, err := l.Txn(ctx, createTxn("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a retry with the same idempotency key returns the original result, rather than
+	// reporting that the key already exists
+	retry, err := l.Txn(ctx, createTxn("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Succeeded || !reflect.DeepEqual(first, retry) {
+		t.Fatalf("expected retry to return original response %v, got %v", first, retry)
+	}
+	if len(backend.rows) != 1 || backend.rev != 1 {
+		t.Fatalf("expected a single create, got %d rows at revision %d", len(backend.rows), backend.rev)
+	}
+
+	if _, err := l.Txn(ctx, createTxn("/b")); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Fatalf("expected %v for a different request with the same idempotency key, got %v", ErrIdempotencyKeyReused, err)
+	}
+
+	// without an idempotency key, the retry is applied again
+	resp, err := l.Txn(context.Background(), createTxn("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Succeeded {
+		t.Fatal("expected create without an idempotency key to fail as the key exists")
+	}
+}
+
+func TestIdempotencyCacheLimit(t *testing.T) {
+	c := newIdempotencyCache(time.Minute)
+	c.maxResults = 2
+
+	for _, key := range []string{"a", "b", "c"} {
+		r, ok := c.get(key, []byte(key))
+		if ok {
+			t.Fatalf("expected no result recorded for %s", key)
+		}
+		c.complete(r, key, nil)
+	}
+	if len(c.results) != 2 || len(c.queue) != 2 {
+		t.Fatalf("expected 2 results to be held, got %d in %d queued", len(c.results), len(c.queue))
+	}
+	// the oldest result was discarded to make room
+	if _, ok := c.results["a"]; ok {
+		t.Fatal("expected oldest result to be discarded")
+	}
+	if r, ok := c.get("c", []byte("c")); !ok || r.resp != "c" {
+		t.Fatal("expected newest result to be held")
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 
-	"github.com/sirupsen/logrus"
+	"github.com/k3s-io/kine/pkg/util"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 )
@@ -25,7 +25,7 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 		return nil, unsupported("sortTarget")
 	}
 
-	if r.Serializable {
+	if r.Serializable && !r.CountOnly {
 		return nil, unsupported("serializable")
 	}
 
@@ -48,7 +48,7 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 	resp, err := k.limited.Range(ctx, r)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
-			logrus.Errorf("error while range on %s %s: %v", r.Key, r.RangeEnd, err)
+			util.RequestLogger(ctx).Errorf("error while range on %s %s: %v", r.Key, r.RangeEnd, err)
 		}
 		return nil, err
 	}
@@ -57,7 +57,7 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 		More:   resp.More,
 		Count:  resp.Count,
 		Header: resp.Header,
-		Kvs:    toKVs(resp.Kvs...),
+		Kvs:    resp.responseKVs(),
 	}
 
 	return rangeResponse, nil
@@ -102,7 +102,7 @@ func toKV(kv *KeyValue) *mvccpb.KeyValue {
 func (k *KVServerBridge) Put(ctx context.Context, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
 	res, err := k.limited.Put(ctx, r)
 	if err != nil && !errors.Is(err, context.Canceled) {
-		logrus.Errorf("error in put %s: %v", r, err)
+		util.RequestLogger(ctx).Errorf("error in put %s: %v", r, err)
 	}
 	return res, err
 }
@@ -114,7 +114,7 @@ func (k *KVServerBridge) DeleteRange(ctx context.Context, r *etcdserverpb.Delete
 func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
 	res, err := k.limited.Txn(ctx, r)
 	if err != nil && !errors.Is(err, context.Canceled) {
-		logrus.Errorf("error in txn %s: %v", r, err)
+		util.RequestLogger(ctx).Errorf("error in txn %s: %v", r, err)
 	}
 	return res, err
 }
@@ -122,7 +122,7 @@ func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*
 func (k *KVServerBridge) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
 	res, err := k.limited.Compact(ctx, r)
 	if err != nil && !errors.Is(err, context.Canceled) {
-		logrus.Errorf("error in compact %s: %v", r, err)
+		util.RequestLogger(ctx).Errorf("error in compact %s: %v", r, err)
 	}
 	return res, err
 }
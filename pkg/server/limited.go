@@ -2,22 +2,51 @@ package server
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
 type LimitedServer struct {
-	notifyInterval time.Duration
-	backend        Backend
-	scheme         string
+	notifyInterval        time.Duration
+	backend               Backend
+	scheme                string
+	rangePageSize         int64
+	maxRangeBytes         int
+	maxUnboundedRangeKeys int64
+	prefixMetrics         *prefixMetrics
+	idempotency           *idempotencyCache
+	maxWatchLag           int64
+	verifyWatchOrder      bool
+	maxTxnOps             int
+	readOnly              atomic.Bool
+	activity              activity
+	priority              *priorityLimiter
 }
 
 func (l *LimitedServer) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+	if len(r.Key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	// a range holding only key is served as a get, so it is not classed as a list
+	release, err := l.priority.acquire(ctx, string(r.Key), len(r.RangeEnd) != 0 && !isSingleKeyRange(r.Key, r.RangeEnd))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var resp *RangeResponse
 	if len(r.RangeEnd) == 0 {
-		return l.get(ctx, r)
+		resp, err = l.get(ctx, r)
+	} else {
+		resp, err = l.list(ctx, r)
+	}
+	if err == nil {
+		l.activity.read()
 	}
-	return l.list(ctx, r)
+	return resp, err
 }
 
 func txnHeader(rev int64) *etcdserverpb.ResponseHeader {
@@ -27,6 +56,34 @@ func txnHeader(rev int64) *etcdserverpb.ResponseHeader {
 }
 
 func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if l.readOnly.Load() {
+		return nil, ErrReadOnly
+	}
+	// as in etcd, the compares and each branch of operations are limited separately
+	if l.maxTxnOps > 0 && (len(txn.Compare) > l.maxTxnOps || len(txn.Success) > l.maxTxnOps || len(txn.Failure) > l.maxTxnOps) {
+		return nil, ErrTooManyOps
+	}
+	release, err := l.priority.acquire(ctx, txnKey(txn), false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := idempotent(ctx, l.idempotency, txn, func() (*etcdserverpb.TxnResponse, error) {
+		return l.txn(ctx, txn)
+	})
+	if err == nil {
+		// a transaction whose compare fails only reads
+		if resp.Succeeded {
+			l.activity.write()
+		} else {
+			l.activity.read()
+		}
+	}
+	return resp, err
+}
+
+func (l *LimitedServer) txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
 	if put := isCreate(txn); put != nil {
 		return l.create(ctx, put)
 	}
@@ -51,4 +108,15 @@ type RangeResponse struct {
 	Kvs    []*KeyValue
 	More   bool
 	Count  int64
+	// converted holds the keys already converted to their response form, in place of Kvs,
+	// for responses that are assembled page by page.
+	converted []*mvccpb.KeyValue
+}
+
+// responseKVs returns the keys of the response in their response form.
+func (r *RangeResponse) responseKVs() []*mvccpb.KeyValue {
+	if r.converted != nil {
+		return r.converted
+	}
+	return toKVs(r.Kvs...)
 }
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestEmptyKey(t *testing.T) {
+	ctx := context.Background()
+	// the backend is not set, as requests with an empty key must be rejected before reaching it
+	l := &LimitedServer{}
+
+	putOp := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Value: []byte("v")}}}
+	rangeOp := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{}}}
+	deleteOp := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{}}}
+	modCompare := func(rev int64) []*etcdserverpb.Compare {
+		return []*etcdserverpb.Compare{{
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: rev},
+		}}
+	}
+
+	tests := map[string]func() error{
+		"range": func() error {
+			_, err := l.Range(ctx, &etcdserverpb.RangeRequest{})
+			return err
+		},
+		"put": func() error {
+			_, err := l.Put(ctx, &etcdserverpb.PutRequest{Value: []byte("v")})
+			return err
+		},
+		"create": func() error {
+			_, err := l.Txn(ctx, &etcdserverpb.TxnRequest{Compare: modCompare(0), Success: []*etcdserverpb.RequestOp{putOp}})
+			return err
+		},
+		"update": func() error {
+			_, err := l.Txn(ctx, &etcdserverpb.TxnRequest{Compare: modCompare(1), Success: []*etcdserverpb.RequestOp{putOp}, Failure: []*etcdserverpb.RequestOp{rangeOp}})
+			return err
+		},
+		"delete": func() error {
+			_, err := l.Txn(ctx, &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{rangeOp, deleteOp}})
+			return err
+		},
+	}
+	for name, f := range tests {
+		if err := f(); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("%s: expected %v, got %v", name, ErrEmptyKey, err)
+		}
+	}
+}
+
+func TestReservedKey(t *testing.T) {
+	ctx := context.Background()
+	backend := &createBackend{rows: map[string]int64{}}
+	l := &LimitedServer{backend: backend}
+
+	key := []byte(compactRevKey)
+	putOp := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: key, Value: []byte("v")}}}
+	rangeOp := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{Key: key}}}
+	deleteOp := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{Key: key}}}
+	modCompare := func(rev int64) []*etcdserverpb.Compare {
+		return []*etcdserverpb.Compare{{
+			Key:         key,
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: rev},
+		}}
+	}
+	txns := map[string]*etcdserverpb.TxnRequest{
+		"create": {Compare: modCompare(0), Success: []*etcdserverpb.RequestOp{putOp}},
+		"update": {Compare: modCompare(1), Success: []*etcdserverpb.RequestOp{putOp}, Failure: []*etcdserverpb.RequestOp{rangeOp}},
+		"delete": {Success: []*etcdserverpb.RequestOp{rangeOp, deleteOp}},
+	}
+	for name, txn := range txns {
+		if _, err := l.Txn(ctx, txn); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("%s: expected %v, got %v", name, ErrReservedKey, err)
+		}
+	}
+
+	// puts are redirected to a substitute key, so that they do not touch the compaction state
+	if _, err := l.Put(ctx, &etcdserverpb.PutRequest{Key: key, Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.rows[compactRevAPI]; !ok || len(backend.rows) != 1 {
+		t.Fatalf("expected put to create only %s, got %v", compactRevAPI, backend.rows)
+	}
+}
+
+func TestMaxTxnOps(t *testing.T) {
+	ctx := context.Background()
+	backend := &createBackend{rows: map[string]int64{}}
+	l := &LimitedServer{backend: backend, maxTxnOps: 1}
+
+	// an extra operation in the success branch exceeds the limit, and nothing is applied
+	txn := createTxn("/a")
+	txn.Success = append(txn.Success, createTxn("/b").Success...)
+	if _, err := l.Txn(ctx, txn); err != ErrTooManyOps {
+		t.Fatalf("expected %v, got %v", ErrTooManyOps, err)
+	}
+	if len(backend.rows) != 0 {
+		t.Fatalf("expected no keys to be created, got %v", backend.rows)
+	}
+
+	// a create has a single compare and operation, which is at the limit
+	resp, err := l.Txn(ctx, createTxn("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Succeeded || backend.rows["/a"] != resp.Header.Revision {
+		t.Fatalf("expected /a to be created at revision %d, got %v", resp.Header.Revision, backend.rows)
+	}
+}
+
+// getBackend extends createBackend with point reads and a fixed database size.
+type getBackend struct {
+	*createBackend
+}
+
+func (b *getBackend) Get(ctx context.Context, key, rangeEnd string, limit, revision int64, keysOnly bool) (int64, *KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rev, ok := b.rows[key]
+	if !ok {
+		return b.rev, nil, nil
+	}
+	return b.rev, &KeyValue{Key: key, CreateRevision: rev, ModRevision: rev, Value: []byte("v")}, nil
+}
+
+func (b *getBackend) DbSize(ctx context.Context) (int64, error) {
+	return 1, nil
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	backend := &getBackend{createBackend: &createBackend{rows: map[string]int64{"/a": 1}, rev: 1}}
+	k := New(backend, "", time.Second, "3.5.13")
+
+	k.SetReadOnly(true)
+	if _, err := k.Put(ctx, &etcdserverpb.PutRequest{Key: []byte("/b"), Value: []byte("v")}); err != ErrReadOnly {
+		t.Fatalf("expected %v from put, got %v", ErrReadOnly, err)
+	}
+	if _, err := k.Txn(ctx, createTxn("/b")); err != ErrReadOnly {
+		t.Fatalf("expected %v from txn, got %v", ErrReadOnly, err)
+	}
+	if _, err := k.Compact(ctx, &etcdserverpb.CompactionRequest{Revision: 1}); err != ErrReadOnly {
+		t.Fatalf("expected %v from compact, got %v", ErrReadOnly, err)
+	}
+	resp, err := k.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("expected /a to be readable, got %v", resp.Kvs)
+	}
+	status, err := k.Status(ctx, &etcdserverpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Errors) != 1 {
+		t.Fatalf("expected read-only mode to be reported in status errors, got %v", status.Errors)
+	}
+
+	k.SetReadOnly(false)
+	if _, err := k.Put(ctx, &etcdserverpb.PutRequest{Key: []byte("/b"), Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.rows["/b"]; !ok {
+		t.Fatalf("expected /b to be created, got %v", backend.rows)
+	}
+	status, err = k.Status(ctx, &etcdserverpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Errors) != 0 {
+		t.Fatalf("expected no status errors, got %v", status.Errors)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	ctx := context.Background()
+	backend := &getBackend{createBackend: &createBackend{rows: map[string]int64{"/a": 1}, rev: 1}}
+	k := New(backend, "", time.Second, "3.5.13")
+	if !k.LastRead().IsZero() || !k.LastWrite().IsZero() {
+		t.Fatalf("expected no activity, got read=%v write=%v", k.LastRead(), k.LastWrite())
+	}
+
+	start := time.Now()
+	if _, err := k.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a")}); err != nil {
+		t.Fatal(err)
+	}
+	if k.LastRead().Before(start) || !k.LastWrite().IsZero() {
+		t.Fatalf("expected a range to update only the last read, got read=%v write=%v", k.LastRead(), k.LastWrite())
+	}
+
+	if _, err := k.Put(ctx, &etcdserverpb.PutRequest{Key: []byte("/b"), Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if k.LastWrite().Before(k.LastRead()) {
+		t.Fatalf("expected a put to update the last write, got read=%v write=%v", k.LastRead(), k.LastWrite())
+	}
+}
+
+// blockingListBackend extends createBackend with lists that block until released, and gets
+// that never find a key.
+type blockingListBackend struct {
+	*createBackend
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingListBackend) List(ctx context.Context, prefix, startKey string, limit, revision int64, keysOnly bool) (int64, []*KeyValue, error) {
+	b.listing <- struct{}{}
+	<-b.release
+	return b.rev, nil, nil
+}
+
+func (b *blockingListBackend) Get(ctx context.Context, key, rangeEnd string, limit, revision int64, keysOnly bool) (int64, *KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rev, nil, nil
+}
+
+func TestPriorityLimits(t *testing.T) {
+	ctx := context.Background()
+	backend := &blockingListBackend{
+		createBackend: &createBackend{rows: map[string]int64{}},
+		listing:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	k := New(backend, "", time.Second, "3.5.13")
+	k.SetPriorityLimits(1, 1, nil)
+
+	// saturate the low priority budget with a list, and queue a second list behind it
+	list := &etcdserverpb.RangeRequest{Key: []byte("/a/"), RangeEnd: []byte("/a0")}
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := k.Range(ctx, list)
+			errs <- err
+		}()
+	}
+	<-backend.listing
+	select {
+	case <-backend.listing:
+		t.Fatal("expected second list to wait for the low priority budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a write is high priority, and proceeds while lists are waiting
+	done := make(chan error, 1)
+	go func() {
+		_, err := k.Txn(ctx, createTxn("/b"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for high priority write")
+	}
+
+	// a range holding a single key is served as a get, and is not held by the list budget
+	go func() {
+		_, err := k.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a"), RangeEnd: []byte("/a\x00")})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for single key range")
+	}
+
+	// a list marked high priority also bypasses the low priority budget, and reaches the
+	// backend while the second list is still waiting
+	hctx := metadata.NewIncomingContext(ctx, metadata.Pairs(PriorityMetadataKey, "high"))
+	go func() {
+		_, err := k.Range(hctx, list)
+		done <- err
+	}()
+	select {
+	case <-backend.listing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for high priority list")
+	}
+
+	close(backend.release)
+	// the second list reaches the backend once the first releases the budget
+	go func() { <-backend.listing }()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
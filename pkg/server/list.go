@@ -1,20 +1,56 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"strings"
 
-	"github.com/sirupsen/logrus"
+	"github.com/k3s-io/kine/pkg/util"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+// kvOverheadBytes is the approximate encoded size of a KeyValue, excluding the key and value.
+const kvOverheadBytes = 64
+
+// AllowUnboundedRangeMetadataKey is the request metadata key that a client may set to
+// "true" to opt in to range requests that exceed the configured maximum unbounded range size.
+const AllowUnboundedRangeMetadataKey = "kine-allow-unbounded-range"
+
 func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
 	if len(r.RangeEnd) == 0 {
 		return nil, errors.New("invalid range end length of 0")
 	}
 
-	prefix := string(append(r.RangeEnd[:len(r.RangeEnd)-1], r.RangeEnd[len(r.RangeEnd)-1]-1))
+	// as in etcd, a range whose end is not above its start holds no keys; this includes a
+	// zero-width range with range_end equal to key, which is distinct from a point get.
+	if isEmptyRange(r.Key, r.RangeEnd) {
+		rev, err := l.backend.CurrentRevision(ctx)
+		util.RequestLogger(ctx).Tracef("LIST EMPTY RANGE key=%s, end=%s, currentRev=%d", r.Key, r.RangeEnd, rev)
+		return &RangeResponse{Header: txnHeader(rev)}, err
+	}
+
+	// a range holding only key is served as a point get, instead of listing the prefix
+	// that the key is under.
+	if isSingleKeyRange(r.Key, r.RangeEnd) {
+		resp, err := l.get(ctx, &etcdserverpb.RangeRequest{Key: r.Key, Revision: r.Revision, KeysOnly: r.KeysOnly})
+		if err == nil && r.CountOnly {
+			resp.Kvs = nil
+		}
+		return resp, err
+	}
+
+	if rl, ok := l.backend.(RangeLister); ok && !isPrefixRange(r.Key, r.RangeEnd) {
+		return l.listRange(ctx, rl, r)
+	}
+
+	// the prefix is built in a new buffer, as appending to RangeEnd would modify the request
+	last := len(r.RangeEnd) - 1
+	prefix := string(r.RangeEnd[:last]) + string([]byte{r.RangeEnd[last] - 1})
 	if !strings.HasSuffix(prefix, "/") {
 		prefix = prefix + "/"
 	}
@@ -25,22 +61,42 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 	}
 
 	if r.CountOnly {
+		if sc, ok := l.backend.(SerializableCounter); ok && r.Serializable && revision == 0 {
+			rev, count, err := sc.CountSerializable(ctx, prefix, start)
+			util.RequestLogger(ctx).Tracef("LIST COUNT SERIALIZABLE key=%s, end=%s, currentRev=%d count=%d", r.Key, r.RangeEnd, rev, count)
+			return &RangeResponse{
+				Header: txnHeader(rev),
+				Count:  count,
+			}, err
+		}
+
 		rev, count, err := l.backend.Count(ctx, prefix, start, revision)
 		resp := &RangeResponse{
 			Header: txnHeader(rev),
 			Count:  count,
 		}
-		logrus.Tracef("LIST COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, count)
+		util.RequestLogger(ctx).Tracef("LIST COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, count)
 		return resp, err
 	}
 
+	if err := l.checkUnboundedRange(ctx, r, func() (int64, error) {
+		_, count, err := l.backend.Count(ctx, prefix, start, revision)
+		return count, err
+	}); err != nil {
+		return nil, err
+	}
+
+	if l.rangePageSize > 0 && (r.Limit <= 0 || r.Limit > l.rangePageSize) {
+		return l.listPaged(ctx, r, prefix, start, revision)
+	}
+
 	limit := r.Limit
 	if limit > 0 {
 		limit++
 	}
 
 	rev, kvs, err := l.backend.List(ctx, prefix, start, limit, revision, r.KeysOnly)
-	logrus.Tracef("LIST key=%s, end=%s, revision=%d, currentRev=%d count=%d, limit=%d, keysOnly=%v", r.Key, r.RangeEnd, revision, rev, len(kvs), r.Limit, r.KeysOnly)
+	util.RequestLogger(ctx).Tracef("LIST key=%s, end=%s, revision=%d, currentRev=%d count=%d, limit=%d, keysOnly=%v", r.Key, r.RangeEnd, revision, rev, len(kvs), r.Limit, r.KeysOnly)
 	resp := &RangeResponse{
 		Header: txnHeader(rev),
 		Count:  int64(len(kvs)),
@@ -57,9 +113,189 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 		}
 
 		rev, resp.Count, err = l.backend.Count(ctx, prefix, start, revision)
-		logrus.Tracef("LIST COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, resp.Count)
+		util.RequestLogger(ctx).Tracef("LIST COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, resp.Count)
 		resp.Header = txnHeader(rev)
 	}
 
 	return resp, err
 }
+
+// listPaged lists keys in pages of at most rangePageSize keys, so that large
+// results are read from the backend incrementally instead of in a single query.
+// All pages are read at the revision of the first page. Each page is converted to
+// its response form as it is read, so that at most one page is held alongside the
+// response being assembled. The response is bounded by maxRangeBytes: if it would
+// be exceeded, a request with a limit is truncated and More is set, so that the
+// client can continue from the last returned key; a request without a limit fails
+// with ErrRangeTooLarge, as such clients do not continue from a partial response.
+func (l *LimitedServer) listPaged(ctx context.Context, r *etcdserverpb.RangeRequest, prefix, start string, revision int64) (*RangeResponse, error) {
+	var (
+		kvs  []*mvccpb.KeyValue
+		size int
+		more bool
+		rev  int64
+	)
+
+	pageStart := start
+	for {
+		pageLimit := l.rangePageSize
+		if r.Limit > 0 {
+			// request one more key than the client limit, to determine if there are more keys
+			pageLimit = min(pageLimit, r.Limit+1-int64(len(kvs)))
+		}
+
+		pageRev, page, err := l.backend.List(ctx, prefix, pageStart, pageLimit, revision, r.KeysOnly)
+		util.RequestLogger(ctx).Tracef("LIST PAGE key=%s, end=%s, start=%s, revision=%d, currentRev=%d count=%d, limit=%d, keysOnly=%v", r.Key, r.RangeEnd, pageStart, revision, pageRev, len(page), pageLimit, r.KeysOnly)
+		if err != nil {
+			return nil, err
+		}
+		if revision == 0 {
+			revision = pageRev
+		}
+		rev = pageRev
+
+		for _, kv := range page {
+			size += len(kv.Key) + len(kv.Value) + kvOverheadBytes
+			if l.maxRangeBytes > 0 && size > l.maxRangeBytes && len(kvs) > 0 {
+				if r.Limit <= 0 {
+					util.RequestLogger(ctx).Warnf("Rejecting list of %s without a limit: response would exceed %d bytes", prefix, l.maxRangeBytes)
+					return nil, ErrRangeTooLarge
+				}
+				util.RequestLogger(ctx).Warnf("Truncating list of %s at %d keys: response would exceed %d bytes", prefix, len(kvs), l.maxRangeBytes)
+				more = true
+				break
+			}
+			kvs = append(kvs, toKV(kv))
+		}
+
+		if more || int64(len(page)) < pageLimit {
+			break
+		}
+		if r.Limit > 0 && int64(len(kvs)) > r.Limit {
+			more = true
+			kvs = kvs[:r.Limit]
+			break
+		}
+		pageStart = page[len(page)-1].Key + "\x00"
+	}
+
+	resp := &RangeResponse{
+		Header:    txnHeader(rev),
+		Count:     int64(len(kvs)),
+		More:      more,
+		converted: kvs,
+	}
+
+	// if there are more keys than were returned, count the keys remaining that follow the start key
+	if more {
+		var err error
+		rev, resp.Count, err = l.backend.Count(ctx, prefix, start, revision)
+		util.RequestLogger(ctx).Tracef("LIST COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, resp.Count)
+		resp.Header = txnHeader(rev)
+		return resp, err
+	}
+
+	return resp, nil
+}
+
+// listRange handles range requests for arbitrary [key, range_end) ranges that
+// cannot be expressed as a prefix.
+func (l *LimitedServer) listRange(ctx context.Context, rl RangeLister, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+	start := string(r.Key)
+	end := string(r.RangeEnd)
+	// a range_end of \x00 requests all keys greater than or equal to key
+	if end == "\x00" {
+		end = ""
+	}
+	revision := r.Revision
+
+	if r.CountOnly {
+		rev, count, err := rl.CountRange(ctx, start, end, revision)
+		util.RequestLogger(ctx).Tracef("LIST RANGE COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, count)
+		return &RangeResponse{
+			Header: txnHeader(rev),
+			Count:  count,
+		}, err
+	}
+
+	if err := l.checkUnboundedRange(ctx, r, func() (int64, error) {
+		_, count, err := rl.CountRange(ctx, start, end, revision)
+		return count, err
+	}); err != nil {
+		return nil, err
+	}
+
+	limit := r.Limit
+	if limit > 0 {
+		limit++
+	}
+
+	rev, kvs, err := rl.ListRange(ctx, start, end, limit, revision, r.KeysOnly)
+	util.RequestLogger(ctx).Tracef("LIST RANGE key=%s, end=%s, revision=%d, currentRev=%d count=%d, limit=%d, keysOnly=%v", r.Key, r.RangeEnd, revision, rev, len(kvs), r.Limit, r.KeysOnly)
+	resp := &RangeResponse{
+		Header: txnHeader(rev),
+		Count:  int64(len(kvs)),
+		Kvs:    kvs,
+	}
+
+	if limit > 0 && resp.Count > r.Limit {
+		resp.More = true
+		resp.Kvs = kvs[0 : limit-1]
+
+		if revision == 0 {
+			revision = rev
+		}
+
+		rev, resp.Count, err = rl.CountRange(ctx, start, end, revision)
+		util.RequestLogger(ctx).Tracef("LIST RANGE COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, resp.Count)
+		resp.Header = txnHeader(rev)
+	}
+
+	return resp, err
+}
+
+// isEmptyRange returns true if the range [key, rangeEnd) holds no keys. A rangeEnd of \x00
+// requests all keys greater than or equal to key, and is never empty.
+func isEmptyRange(key, rangeEnd []byte) bool {
+	return !bytes.Equal(rangeEnd, []byte{0}) && bytes.Compare(key, rangeEnd) >= 0
+}
+
+// isSingleKeyRange returns true if the range [key, rangeEnd) holds only key.
+func isSingleKeyRange(key, rangeEnd []byte) bool {
+	return len(rangeEnd) == len(key)+1 && rangeEnd[len(key)] == 0 && bytes.HasPrefix(rangeEnd, key)
+}
+
+// isPrefixRange returns true if the range [key, rangeEnd) contains only keys
+// under a common directory prefix, in which case it can be served by a prefix list.
+func isPrefixRange(key, rangeEnd []byte) bool {
+	last := len(rangeEnd) - 1
+	if last < 0 || rangeEnd[last] == 0 {
+		return false
+	}
+	prefix := string(rangeEnd[:last]) + string([]byte{rangeEnd[last] - 1})
+	return strings.HasSuffix(prefix, "/") && strings.HasPrefix(string(key), prefix)
+}
+
+// checkUnboundedRange rejects range requests without a limit, or with a limit greater than
+// maxUnboundedRangeKeys, if count reports that the range holds more than maxUnboundedRangeKeys
+// keys. Clients may opt in to such requests by setting AllowUnboundedRangeMetadataKey.
+func (l *LimitedServer) checkUnboundedRange(ctx context.Context, r *etcdserverpb.RangeRequest, count func() (int64, error)) error {
+	if l.maxUnboundedRangeKeys <= 0 || (r.Limit > 0 && r.Limit <= l.maxUnboundedRangeKeys) {
+		return nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(AllowUnboundedRangeMetadataKey); len(v) > 0 && v[0] == "true" {
+			return nil
+		}
+	}
+
+	n, err := count()
+	if err != nil {
+		return err
+	}
+	if n > l.maxUnboundedRangeKeys {
+		util.RequestLogger(ctx).Warnf("Rejecting range request for key=%s, end=%s: %d keys exceeds maximum of %d without a limit", r.Key, r.RangeEnd, n, l.maxUnboundedRangeKeys)
+		return status.Errorf(codes.InvalidArgument, "etcdserver: range holds %d keys, more than the maximum of %d allowed without a limit; set a limit and paginate, or set the %s request metadata to true", n, l.maxUnboundedRangeKeys, AllowUnboundedRangeMetadataKey)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"sort"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// pagedBackend implements only the backend methods needed to list keys;
+// calling any other method will panic.
+type pagedBackend struct {
+	Backend
+	kvs       []*KeyValue
+	calls     int
+	maxLimit  int64
+	unbounded bool
+}
+
+func newPagedBackend(n, valueSize int) *pagedBackend {
+	b := &pagedBackend{}
+	for i := 0; i < n; i++ {
+		b.kvs = append(b.kvs, &KeyValue{Key: fmt.Sprintf("/registry/pods/%05d", i), Value: make([]byte, valueSize)})
+	}
+	return b
+}
+
+func (b *pagedBackend) start(startKey string) int {
+	return sort.Search(len(b.kvs), func(i int) bool { return b.kvs[i].Key >= startKey })
+}
+
+func (b *pagedBackend) List(ctx context.Context, prefix, startKey string, limit, revision int64, keysOnly bool) (int64, []*KeyValue, error) {
+	b.calls++
+	b.maxLimit = max(b.maxLimit, limit)
+	b.unbounded = b.unbounded || limit <= 0
+	i := b.start(startKey)
+	end := len(b.kvs)
+	if limit > 0 {
+		end = min(i+int(limit), end)
+	}
+	return 100, b.kvs[i:end], nil
+}
+
+func (b *pagedBackend) Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error) {
+	return 100, int64(len(b.kvs) - b.start(startKey)), nil
+}
+
+func (b *pagedBackend) Get(ctx context.Context, key, rangeEnd string, limit, revision int64, keysOnly bool) (int64, *KeyValue, error) {
+	if i := b.start(key); i < len(b.kvs) && b.kvs[i].Key == key {
+		return 100, b.kvs[i], nil
+	}
+	return 100, nil, nil
+}
+
+func (b *pagedBackend) CurrentRevision(ctx context.Context) (int64, error) {
+	return 100, nil
+}
+
+func listPods(t *testing.T, l *LimitedServer, limit int64) *RangeResponse {
+	resp, err := l.Range(context.Background(), &etcdserverpb.RangeRequest{
+		Key:      []byte("/registry/pods/"),
+		RangeEnd: []byte("/registry/pods0"),
+		Limit:    limit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestListPaged(t *testing.T) {
+	b := newPagedBackend(1050, 0)
+	l := &LimitedServer{backend: b, rangePageSize: 100}
+
+	resp := listPods(t, l, 0)
+	kvs := resp.responseKVs()
+	if len(kvs) != 1050 || resp.Count != 1050 || resp.More {
+		t.Fatalf("expected all 1050 keys, got %d (count %d, more %v)", len(kvs), resp.Count, resp.More)
+	}
+	for i := 1; i < len(kvs); i++ {
+		if string(kvs[i-1].Key) >= string(kvs[i].Key) {
+			t.Fatalf("keys out of order or duplicated at %d: %s, %s", i, kvs[i-1].Key, kvs[i].Key)
+		}
+	}
+	if b.unbounded || b.maxLimit > 100 || b.calls != 11 {
+		t.Fatalf("expected 11 pages of at most 100 keys, got %d calls with max limit %d (unbounded %v)", b.calls, b.maxLimit, b.unbounded)
+	}
+
+	resp = listPods(t, l, 250)
+	if kvs := resp.responseKVs(); len(kvs) != 250 || resp.Count != 1050 || !resp.More {
+		t.Fatalf("expected 250 of 1050 keys with more, got %d (count %d, more %v)", len(kvs), resp.Count, resp.More)
+	}
+}
+
+func TestListPagedMaxBytes(t *testing.T) {
+	const maxBytes = 50 * 1024
+	b := newPagedBackend(1000, 1024)
+	l := &LimitedServer{backend: b, rangePageSize: 100, maxRangeBytes: maxBytes}
+
+	// a paginating client receives a truncated response, and continues from the last key
+	resp := listPods(t, l, 500)
+	kvs := resp.responseKVs()
+	if !resp.More || resp.Count != 1000 || len(kvs) == 0 {
+		t.Fatalf("expected truncated response with more, got %d keys (count %d, more %v)", len(kvs), resp.Count, resp.More)
+	}
+
+	var size int
+	for _, kv := range kvs {
+		size += len(kv.Key) + len(kv.Value) + kvOverheadBytes
+	}
+	if size > maxBytes {
+		t.Fatalf("response size %d exceeds maximum %d", size, maxBytes)
+	}
+	if b.calls != 1 {
+		t.Fatalf("expected listing to stop after the first page, got %d calls", b.calls)
+	}
+
+	// a client that does not paginate would not continue from a partial response, so
+	// the request fails instead of being truncated
+	_, err := l.Range(context.Background(), &etcdserverpb.RangeRequest{
+		Key:      []byte("/registry/pods/"),
+		RangeEnd: []byte("/registry/pods0"),
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted for an oversized list without a limit, got %v", err)
+	}
+}
+
+// generatedBackend implements only the backend methods needed to list keys, allocating
+// the keys of each page as it is listed; calling any other method will panic. The live
+// heap is sampled on each call.
+type generatedBackend struct {
+	Backend
+	n, valueSize int
+	peakHeap     uint64
+}
+
+func (b *generatedBackend) List(ctx context.Context, prefix, startKey string, limit, revision int64, keysOnly bool) (int64, []*KeyValue, error) {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	b.peakHeap = max(b.peakHeap, stats.HeapAlloc)
+
+	var kvs []*KeyValue
+	for i := 0; i < b.n && (limit <= 0 || int64(len(kvs)) < limit); i++ {
+		if key := fmt.Sprintf("/registry/pods/%05d", i); key >= startKey {
+			kvs = append(kvs, &KeyValue{Key: key, Value: make([]byte, b.valueSize)})
+		}
+	}
+	return 100, kvs, nil
+}
+
+func (b *generatedBackend) Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error) {
+	return 100, int64(b.n), nil
+}
+
+func TestListPagedPeakMemory(t *testing.T) {
+	const (
+		maxBytes  = 16 << 20
+		valueSize = 1 << 20
+		pageSize  = 4
+	)
+	// the range holds 1GiB of values, far more than the response may hold
+	b := &generatedBackend{n: 1024, valueSize: valueSize}
+	l := &LimitedServer{backend: b, rangePageSize: pageSize, maxRangeBytes: maxBytes}
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	resp := listPods(t, l, 1024)
+	if !resp.More || len(resp.responseKVs()) >= 16 {
+		t.Fatalf("expected a truncated response of less than 16 keys, got %d keys (more %v)", len(resp.responseKVs()), resp.More)
+	}
+	// the live heap while listing is bounded by the response size and one page
+	if peak := b.peakHeap - min(base, b.peakHeap); peak > maxBytes+2*pageSize*valueSize {
+		t.Fatalf("expected peak heap growth of at most %d bytes, got %d", maxBytes+2*pageSize*valueSize, peak)
+	}
+}
+
+func TestMaxUnboundedRangeKeys(t *testing.T) {
+	b := newPagedBackend(1050, 0)
+	l := &LimitedServer{backend: b, maxUnboundedRangeKeys: 1000}
+	r := &etcdserverpb.RangeRequest{
+		Key:      []byte("/registry/pods/"),
+		RangeEnd: []byte("/registry/pods0"),
+	}
+
+	_, err := l.Range(context.Background(), r)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected unbounded range over 1050 keys to be rejected, got %v", err)
+	}
+	if b.calls != 0 {
+		t.Fatalf("expected rejected range not to list keys, got %d list calls", b.calls)
+	}
+
+	// a range with a limit within the maximum is not checked
+	if resp := listPods(t, l, 500); len(resp.Kvs) != 500 || !resp.More {
+		t.Fatalf("expected 500 keys with more, got %d (more %v)", len(resp.Kvs), resp.More)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(AllowUnboundedRangeMetadataKey, "true"))
+	resp, err := l.Range(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1050 {
+		t.Fatalf("expected opted-in unbounded range to return all 1050 keys, got %d", len(resp.Kvs))
+	}
+}
+
+func TestRangeZeroWidth(t *testing.T) {
+	b := newPagedBackend(10, 0)
+	l := &LimitedServer{backend: b}
+	key := []byte("/registry/pods/00005")
+
+	tests := []struct {
+		name     string
+		rangeEnd []byte
+		want     int
+	}{
+		{"point get", nil, 1},
+		{"zero-width range", key, 0},
+		{"range end below key", []byte("/registry/pods/00001"), 0},
+		{"single key range", append(slices.Clone(key), 0), 1},
+		{"all keys from key", []byte{0}, 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := l.Range(context.Background(), &etcdserverpb.RangeRequest{Key: key, RangeEnd: test.rangeEnd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Kvs) != test.want || resp.Count != int64(test.want) || resp.Header.Revision != 100 {
+				t.Fatalf("expected %d keys at revision 100, got %d (count %d) at revision %d", test.want, len(resp.Kvs), resp.Count, resp.Header.Revision)
+			}
+			if test.want > 0 && resp.Kvs[0].Key != string(key) {
+				t.Fatalf("expected first key %s, got %s", key, resp.Kvs[0].Key)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/status"
 )
 
 // explicit interface check
@@ -19,11 +20,15 @@ func (s *KVServerBridge) Status(ctx context.Context, r *etcdserverpb.StatusReque
 	if err != nil {
 		return nil, err
 	}
-	return &etcdserverpb.StatusResponse{
+	resp := &etcdserverpb.StatusResponse{
 		Header:  &etcdserverpb.ResponseHeader{},
 		DbSize:  size,
 		Version: s.emulatedETCDVersion,
-	}, nil
+	}
+	if s.ReadOnly() {
+		resp.Errors = append(resp.Errors, status.Convert(ErrReadOnly).Message())
+	}
+	return resp, nil
 }
 
 func (s *KVServerBridge) Defragment(context.Context, *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
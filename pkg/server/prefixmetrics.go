@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// prefixMetrics tracks write rates and key counts by key prefix. The prefix is
+// made up of the first depth path segments of the key, which bounds the number
+// of distinct label values.
+type prefixMetrics struct {
+	depth    int
+	mu       sync.Mutex
+	prefixes map[string]struct{}
+}
+
+// StartPrefixMetrics enables per-prefix write and key count metrics, with keys
+// grouped by their first depth path segments. Key counts are refreshed for all
+// prefixes that have been written to at the provided interval.
+func (k *KVServerBridge) StartPrefixMetrics(ctx context.Context, depth int, interval time.Duration) {
+	if depth <= 0 {
+		return
+	}
+	pm := &prefixMetrics{
+		depth:    depth,
+		prefixes: map[string]struct{}{},
+	}
+	k.limited.prefixMetrics = pm
+	go pm.run(ctx, k.limited.backend, interval)
+}
+
+func (pm *prefixMetrics) observeWrite(key, operation string) {
+	if pm == nil {
+		return
+	}
+	prefix := keyPrefix(key, pm.depth)
+	metrics.PrefixWritesTotal.WithLabelValues(prefix, operation).Inc()
+
+	pm.mu.Lock()
+	pm.prefixes[prefix] = struct{}{}
+	pm.mu.Unlock()
+}
+
+func (pm *prefixMetrics) run(ctx context.Context, backend Backend, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			pm.updateCounts(ctx, backend)
+		}
+	}
+}
+
+func (pm *prefixMetrics) updateCounts(ctx context.Context, backend Backend) {
+	pm.mu.Lock()
+	prefixes := make([]string, 0, len(pm.prefixes))
+	for prefix := range pm.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	pm.mu.Unlock()
+
+	for _, prefix := range prefixes {
+		listPrefix := prefix
+		if !strings.HasSuffix(listPrefix, "/") {
+			listPrefix += "/"
+		}
+		_, count, err := backend.Count(ctx, listPrefix, listPrefix, 0)
+		if err != nil {
+			logrus.Errorf("Failed to count keys for prefix %s: %v", prefix, err)
+			continue
+		}
+		metrics.PrefixKeys.WithLabelValues(prefix).Set(float64(count))
+	}
+}
+
+// keyPrefix returns the first depth path segments of the key, excluding the
+// final segment, which is the name of the key itself.
+func keyPrefix(key string, depth int) string {
+	segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	n := min(depth, len(segments)-1)
+	return "/" + strings.Join(segments[:n], "/")
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// prefixBackend implements only the backend methods needed to create and count keys;
+// calling any other method will panic.
+type prefixBackend struct {
+	Backend
+	keys []string
+}
+
+func (b *prefixBackend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	b.keys = append(b.keys, key)
+	return int64(len(b.keys)), nil
+}
+
+func (b *prefixBackend) Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error) {
+	var count int64
+	for _, key := range b.keys {
+		if strings.HasPrefix(key, prefix) {
+			count++
+		}
+	}
+	return int64(len(b.keys)), count, nil
+}
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		key   string
+		depth int
+		want  string
+	}{
+		{"/registry/pods/default/nginx", 2, "/registry/pods"},
+		{"/registry/pods/default/nginx", 1, "/registry"},
+		{"/registry/ranges/serviceips", 2, "/registry/ranges"},
+		{"/registry/health", 2, "/registry"},
+		{"compact_rev_key", 2, "/"},
+	}
+	for _, test := range tests {
+		if got := keyPrefix(test.key, test.depth); got != test.want {
+			t.Errorf("keyPrefix(%q, %d): expected %q, got %q", test.key, test.depth, test.want, got)
+		}
+	}
+}
+
+func TestPrefixMetrics(t *testing.T) {
+	b := &prefixBackend{}
+	pm := &prefixMetrics{depth: 2, prefixes: map[string]struct{}{}}
+	l := &LimitedServer{backend: b, prefixMetrics: pm}
+
+	for _, key := range []string{"/registry/pods/ns/a", "/registry/pods/ns/b", "/registry/secrets/ns/a"} {
+		if _, err := l.create(context.Background(), &etcdserverpb.PutRequest{Key: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pm.updateCounts(context.Background(), b)
+
+	for prefix, want := range map[string]float64{"/registry/pods": 2, "/registry/secrets": 1} {
+		if got := testutil.ToFloat64(metrics.PrefixWritesTotal.WithLabelValues(prefix, "create")); got != want {
+			t.Errorf("expected %v writes for %s, got %v", want, prefix, got)
+		}
+		if got := testutil.ToFloat64(metrics.PrefixKeys.WithLabelValues(prefix)); got != want {
+			t.Errorf("expected %v keys for %s, got %v", want, prefix, got)
+		}
+	}
+}
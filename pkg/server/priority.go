@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/metadata"
+)
+
+// PriorityMetadataKey is the request metadata key that a client may set to "high" or "low" to
+// choose the priority class of a request, overriding the class chosen by the server.
+const PriorityMetadataKey = "kine-priority"
+
+const (
+	priorityHigh = "high"
+	priorityLow  = "low"
+)
+
+// priorityLimiter limits the number of requests of each priority class in progress at once.
+// Each class has its own budget, so that bulk reads cannot starve control-plane writes of
+// access to the backend. A nil semaphore allows an unlimited number of requests of that class.
+type priorityLimiter struct {
+	high        chan struct{}
+	low         chan struct{}
+	lowPrefixes []string
+}
+
+// SetPriorityLimits limits the number of high and low priority requests that are in progress at
+// once; requests over the limit for their class wait for an earlier request of the same class to
+// complete. Lists and requests for keys under one of lowPrefixes are low priority; all other
+// requests are high priority, unless the client sets PriorityMetadataKey. A limit of zero or less
+// allows an unlimited number of requests of that class.
+func (k *KVServerBridge) SetPriorityLimits(maxHigh, maxLow int, lowPrefixes []string) {
+	if maxHigh <= 0 && maxLow <= 0 {
+		return
+	}
+	p := &priorityLimiter{lowPrefixes: lowPrefixes}
+	if maxHigh > 0 {
+		p.high = make(chan struct{}, maxHigh)
+	}
+	if maxLow > 0 {
+		p.low = make(chan struct{}, maxLow)
+	}
+	k.limited.priority = p
+}
+
+// acquire waits for the budget of the class of a request for key to allow another request, and
+// returns a function that releases it. list is set for range requests over more than one key.
+func (p *priorityLimiter) acquire(ctx context.Context, key string, list bool) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+	sem := p.high
+	if p.class(ctx, key, list) == priorityLow {
+		sem = p.low
+	}
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// class returns the priority class of a request for key.
+func (p *priorityLimiter) class(ctx context.Context, key string, list bool) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(PriorityMetadataKey); len(v) > 0 && (v[0] == priorityHigh || v[0] == priorityLow) {
+			return v[0]
+		}
+	}
+	for _, prefix := range p.lowPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return priorityLow
+		}
+	}
+	if list {
+		return priorityLow
+	}
+	return priorityHigh
+}
+
+// txnKey returns the key of the first compare or operation of a transaction.
+func txnKey(txn *etcdserverpb.TxnRequest) string {
+	if len(txn.Compare) > 0 {
+		return string(txn.Compare[0].Key)
+	}
+	for _, op := range txn.Success {
+		switch {
+		case op.GetRequestPut() != nil:
+			return string(op.GetRequestPut().Key)
+		case op.GetRequestRange() != nil:
+			return string(op.GetRequestRange().Key)
+		case op.GetRequestDeleteRange() != nil:
+			return string(op.GetRequestDeleteRange().Key)
+		}
+	}
+	return ""
+}
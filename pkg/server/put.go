@@ -7,12 +7,34 @@ import (
 )
 
 func (l *LimitedServer) Put(ctx context.Context, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
+	if l.readOnly.Load() {
+		return nil, ErrReadOnly
+	}
+	release, err := l.priority.acquire(ctx, string(r.Key), false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := idempotent(ctx, l.idempotency, r, func() (*etcdserverpb.PutResponse, error) {
+		return l.put(ctx, r)
+	})
+	if err == nil {
+		l.activity.write()
+	}
+	return resp, err
+}
+
+func (l *LimitedServer) put(ctx context.Context, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
 	if r.IgnoreValue {
 		return nil, unsupported("ignoreValue")
 	}
 	if r.IgnoreLease {
 		return nil, unsupported("ignoreLease")
 	}
+	if len(r.Key) == 0 {
+		return nil, ErrEmptyKey
+	}
 
 	var kv *KeyValue
 	key := string(r.Key)
@@ -10,22 +10,91 @@ import (
 	"google.golang.org/grpc/reflection"
 )
 
+// DefaultMaxTxnOps is the default maximum number of compares, and of operations in each branch,
+// of a single Txn request. It is the same as etcd's default.
+const DefaultMaxTxnOps = 128
+
 type KVServerBridge struct {
 	emulatedETCDVersion string
 	limited             *LimitedServer
+	watches             *watchRegistry
 }
 
 func New(backend Backend, scheme string, notifyInterval time.Duration, emulatedETCDVersion string) *KVServerBridge {
 	return &KVServerBridge{
 		emulatedETCDVersion: emulatedETCDVersion,
+		watches:             newWatchRegistry(),
 		limited: &LimitedServer{
 			notifyInterval: notifyInterval,
 			backend:        backend,
 			scheme:         scheme,
+			maxTxnOps:      DefaultMaxTxnOps,
 		},
 	}
 }
 
+// SetRangePaging configures large list requests to be read from the backend in
+// pages of at most pageSize keys, instead of in a single query. Assembly of the
+// response stops once it reaches maxBytes: requests with a limit are truncated, with
+// More set so that the client can continue from the last returned key, and requests
+// without a limit fail with ErrRangeTooLarge. A pageSize of zero disables paging.
+func (k *KVServerBridge) SetRangePaging(pageSize int64, maxBytes int) {
+	k.limited.rangePageSize = pageSize
+	k.limited.maxRangeBytes = maxBytes
+}
+
+// SetMaxUnboundedRangeKeys configures range requests without a limit, or with a limit
+// greater than maxKeys, to be rejected if the range holds more than maxKeys keys. The keys
+// are counted before listing, at the cost of an additional query per such request. A maxKeys
+// of zero disables the check.
+func (k *KVServerBridge) SetMaxUnboundedRangeKeys(maxKeys int64) {
+	k.limited.maxUnboundedRangeKeys = maxKeys
+}
+
+// SetIdempotencyWindow configures how long the results of write requests that carry
+// IdempotencyKeyMetadataKey are held, so that retries of those requests return the original
+// result instead of being applied again. Results are held in memory, so only retries served by
+// this instance are deduplicated. A window of zero disables idempotency keys.
+func (k *KVServerBridge) SetIdempotencyWindow(window time.Duration) {
+	if window > 0 {
+		k.limited.idempotency = newIdempotencyCache(window)
+	}
+}
+
+// SetMaxWatchLag configures watches to be cancelled if the oldest event waiting to be sent
+// to the client is more than maxLag revisions behind the current revision, so that slow
+// clients re-establish their watch instead of accumulating a backlog. Events up to the revision
+// at which a watch was created are not counted, so that a watch may resume from further back.
+// A maxLag of zero disables the limit.
+func (k *KVServerBridge) SetMaxWatchLag(maxLag int64) {
+	k.limited.maxWatchLag = maxLag
+}
+
+// SetVerifyWatchOrder enables or disables checking that the events received by each watch
+// from the backend are in strictly increasing revision order. Violations are logged and
+// counted; they are still corrected before the events are sent to the client.
+func (k *KVServerBridge) SetVerifyWatchOrder(verify bool) {
+	k.limited.verifyWatchOrder = verify
+}
+
+// SetMaxTxnOps configures Txn requests with more than maxOps compares, or more than maxOps
+// operations in either branch, to be rejected with ErrTooManyOps. A negative maxOps disables
+// the limit.
+func (k *KVServerBridge) SetMaxTxnOps(maxOps int) {
+	k.limited.maxTxnOps = maxOps
+}
+
+// SetReadOnly enables or disables read-only mode. While enabled, Put, Txn and Compact
+// requests are rejected with ErrReadOnly; range requests and watches are unaffected.
+func (k *KVServerBridge) SetReadOnly(readOnly bool) {
+	k.limited.readOnly.Store(readOnly)
+}
+
+// ReadOnly returns true if read-only mode is enabled.
+func (k *KVServerBridge) ReadOnly() bool {
+	return k.limited.readOnly.Load()
+}
+
 func (k *KVServerBridge) Register(server *grpc.Server) {
 	etcdserverpb.RegisterLeaseServer(server, k)
 	etcdserverpb.RegisterWatchServer(server, k)
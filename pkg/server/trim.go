@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"strconv"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// WatchTrimValuesMetadataKey is the request metadata key that a client may set on a watch
+// stream to a size in bytes, to opt in to trimming of larger values in put events sent on the
+// stream. Trimmed values are replaced with a placeholder noting the size of the value, which
+// the client can fetch in full at the event's revision if needed. Delete events are not trimmed.
+const WatchTrimValuesMetadataKey = "kine-watch-trim-values"
+
+// trimmedValuePrefix is the start of the placeholder that replaces a trimmed value.
+var trimmedValuePrefix = []byte("kine-trimmed-value:size=")
+
+// TrimmedValueSize returns the size of the original value, and true, if value is the
+// placeholder for a value trimmed from a watch event.
+func TrimmedValueSize(value []byte) (int, bool) {
+	rest, ok := bytes.CutPrefix(value, trimmedValuePrefix)
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.Atoi(string(rest))
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// trimEvents replaces values larger than size in put events with a placeholder.
+func trimEvents(events []*mvccpb.Event, size int) {
+	for _, event := range events {
+		if event.Type != mvccpb.PUT {
+			continue
+		}
+		trimValue(event.Kv, size)
+		trimValue(event.PrevKv, size)
+	}
+}
+
+func trimValue(kv *mvccpb.KeyValue, size int) {
+	if kv == nil || len(kv.Value) <= size {
+		return
+	}
+	kv.Value = strconv.AppendInt(bytes.Clone(trimmedValuePrefix), int64(len(kv.Value)), 10)
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc/codes"
@@ -10,13 +11,21 @@ import (
 )
 
 var (
-	ErrNotSupported = status.New(codes.InvalidArgument, "etcdserver: unsupported operations in txn request").Err()
-	ErrInvalidWatch = status.New(codes.InvalidArgument, "etcdserver: unsupported options in watch request").Err()
+	ErrNotSupported       = status.New(codes.InvalidArgument, "etcdserver: unsupported operations in txn request").Err()
+	ErrInvalidWatch       = status.New(codes.InvalidArgument, "etcdserver: unsupported options in watch request").Err()
+	ErrReservedKey        = status.New(codes.InvalidArgument, "etcdserver: key "+compactRevKey+" is reserved").Err()
+	ErrInvalidKeyMetadata = status.New(codes.InvalidArgument, "etcdserver: invalid key metadata").Err()
+	ErrWatchLagging       = status.New(codes.Unavailable, "etcdserver: watch fell too far behind the current revision; retry from the last received revision").Err()
+	ErrReadOnly           = status.New(codes.Unavailable, "etcdserver: server is in read-only mode").Err()
+	ErrRangeTooLarge      = status.New(codes.ResourceExhausted, "etcdserver: range response would exceed the maximum response size; set a limit to paginate").Err()
 
+	ErrEmptyKey      = rpctypes.ErrGRPCEmptyKey
 	ErrKeyExists     = rpctypes.ErrGRPCDuplicateKey
 	ErrCompacted     = rpctypes.ErrGRPCCompacted
 	ErrFutureRev     = rpctypes.ErrGRPCFutureRev
 	ErrGRPCUnhealthy = rpctypes.ErrGRPCUnhealthy
+	ErrKeyNotFound   = rpctypes.ErrGRPCKeyNotFound
+	ErrTooManyOps    = rpctypes.ErrGRPCTooManyOps
 )
 
 type Backend interface {
@@ -34,28 +43,268 @@ type Backend interface {
 	WaitForSyncTo(revision int64)
 }
 
+// CompactConfigurer is implemented by backends that allow compaction settings to be changed at runtime.
+type CompactConfigurer interface {
+	CompactConfig() (interval time.Duration, batchSize int64)
+	SetCompactInterval(interval time.Duration) error
+	SetCompactBatchSize(batchSize int64) error
+	// ValidateCompactConfig returns the error that SetCompactInterval or SetCompactBatchSize
+	// would return for the given values, without applying them. Zero values are not checked.
+	ValidateCompactConfig(interval time.Duration, batchSize int64) error
+}
+
+// RangeLister is implemented by backends that can list and count arbitrary key
+// ranges. Backends that do not implement this interface only support prefix ranges.
+type RangeLister interface {
+	// ListRange lists keys in the range [startKey, endKey). An empty endKey
+	// includes all keys greater than or equal to startKey.
+	ListRange(ctx context.Context, startKey, endKey string, limit, revision int64, keysOnly bool) (int64, []*KeyValue, error)
+	// CountRange counts keys in the range [startKey, endKey).
+	CountRange(ctx context.Context, startKey, endKey string, revision int64) (int64, int64, error)
+}
+
+// MinRevisioner is implemented by backends that can report the oldest revision
+// that has not been compacted.
+type MinRevisioner interface {
+	// MinRevision returns the oldest revision whose history is retained, which is
+	// one greater than the compact revision. Watches may start at this revision.
+	MinRevision(ctx context.Context) (int64, error)
+}
+
+// SerializableCounter is implemented by backends that can count current keys
+// without reading the latest revision from the datastore.
+type SerializableCounter interface {
+	// CountSerializable counts the current keys matching prefix that are greater
+	// than or equal to startKey. The returned revision is the most recent revision
+	// known to this node, and may lag behind the datastore.
+	CountSerializable(ctx context.Context, prefix, startKey string) (int64, int64, error)
+}
+
+// Compactor is implemented by backends that can be compacted on demand, whether
+// or not automatic compaction is enabled.
+type Compactor interface {
+	// CompactTo compacts to the given revision, or to the current revision if revision
+	// is zero, retaining the configured minimum number of revisions. It returns the
+	// revision that the backend has been compacted to.
+	CompactTo(ctx context.Context, revision int64) (int64, error)
+}
+
+// StatsReporter is implemented by backends that can report aggregate storage
+// statistics. Computing the statistics scans the whole table, so it should
+// only be done on demand.
+type StatsReporter interface {
+	StorageStats(ctx context.Context) (*StorageStats, error)
+}
+
+// StorageStats describes the rows stored by the backend, including history that
+// has not yet been compacted.
+type StorageStats struct {
+	// Rows is the total number of rows, including historical revisions.
+	Rows int64 `json:"rows"`
+	// LiveRows is the number of rows that are not deletion records.
+	LiveRows int64 `json:"liveRows"`
+	// DeletedRows is the number of deletion records.
+	DeletedRows int64 `json:"deletedRows"`
+	// Keys is the number of distinct keys with at least one row.
+	Keys int64 `json:"keys"`
+	// ValueBytes is the total size of the values in live rows.
+	ValueBytes int64 `json:"valueBytes"`
+	// AverageValueBytes is the average size of the values in live rows.
+	AverageValueBytes float64 `json:"averageValueBytes"`
+	// RevisionsPerKey is the average number of rows per key.
+	RevisionsPerKey float64 `json:"revisionsPerKey"`
+}
+
+// Renamer is implemented by backends that can move a key to a new name atomically.
+type Renamer interface {
+	// Rename deletes key and creates newKey with the same value and lease, in a single
+	// transaction, so that watchers see the delete of key followed by the create of newKey,
+	// and readers never see both or neither. If revision is not zero, the key is only renamed
+	// if its current mod revision matches. It returns the revision of the create and the new
+	// key if the key was renamed; otherwise the current revision and the current value of key,
+	// if any. ErrKeyExists is returned if newKey exists.
+	Rename(ctx context.Context, key, newKey string, revision int64) (int64, *KeyValue, bool, error)
+}
+
+// KeyMetadataStore is implemented by backends that can store metadata for keys, separately
+// from their values. Metadata is a set of name/value pairs that is not versioned and is not
+// visible through the etcd API, so setting it does not create a new revision of the key.
+type KeyMetadataStore interface {
+	// SetKeyMetadata replaces the metadata of an existing key; empty metadata removes it.
+	SetKeyMetadata(ctx context.Context, key string, metadata map[string]string) error
+	// GetKeyMetadata returns the metadata of a key, which is empty if none has been set.
+	GetKeyMetadata(ctx context.Context, key string) (map[string]string, error)
+	// ListKeyMetadata returns the metadata of each key with the given prefix whose metadata
+	// includes every name/value pair in filter, by key.
+	ListKeyMetadata(ctx context.Context, prefix string, filter map[string]string) (map[string]map[string]string, error)
+}
+
+// ConfigReporter is implemented by backends that can report the configuration
+// that their datastore driver is running with.
+type ConfigReporter interface {
+	DriverConfig() *DriverConfig
+}
+
+// StatementReporter is implemented by backends that can report the SQL statements that their
+// datastore driver runs, so that tooling can inspect them without running them.
+type StatementReporter interface {
+	// Statements returns the driver's SQL statements by name, after placeholder rewriting.
+	Statements() map[string]string
+}
+
+// DriverConfig describes the effective configuration of a datastore driver, after
+// defaults have been applied. Secrets are redacted.
+type DriverConfig struct {
+	// Driver is the name of the database/sql driver.
+	Driver string `json:"driver"`
+	// DataSourceName is the datastore connection string, with any password redacted.
+	DataSourceName string `json:"dataSourceName"`
+	// Pools describes each connection pool; there is more than one pool if
+	// statement affinity is enabled.
+	Pools []PoolConfig `json:"pools"`
+	// CompactPool describes the separate compaction connection pool, if any.
+	CompactPool *PoolConfig `json:"compactPool,omitempty"`
+	// ValidationQuery is the query used to validate connections before reuse, if enabled.
+	ValidationQuery string `json:"validationQuery,omitempty"`
+	// TxIsolation is the isolation level used for transactions.
+	TxIsolation string `json:"txIsolation,omitempty"`
+	// CompactTimeout is the timeout for each compaction transaction.
+	CompactTimeout string `json:"compactTimeout,omitempty"`
+	// ReadTimeout and WriteTimeout are the timeouts for each read and each append, if set.
+	ReadTimeout  string `json:"readTimeout,omitempty"`
+	WriteTimeout string `json:"writeTimeout,omitempty"`
+	// FillRetryDuration is the delay before retrying a gap fill.
+	FillRetryDuration string `json:"fillRetryDuration"`
+	// LockWrites is set if inserts are serialized within this process.
+	LockWrites bool `json:"lockWrites"`
+	// LastInsertID is set if the revision of inserted rows is read with LastInsertId.
+	LastInsertID bool `json:"lastInsertId"`
+	// RevisionBlockSize is the number of revisions reserved at a time for new writes,
+	// or 0 if revisions are assigned by the database.
+	RevisionBlockSize int64 `json:"revisionBlockSize,omitempty"`
+	// AuditLog is set if an audit record is written for each inserted row.
+	AuditLog bool `json:"auditLog,omitempty"`
+}
+
+// Snapshotter is implemented by backends that can read all current keys as of a single revision.
+type Snapshotter interface {
+	// Snapshot calls f with each current key, in key order, as of the current revision, which
+	// is returned. Keys are read in pages, so that the keyspace is not held in memory. Iteration
+	// stops if f returns an error, which is returned. ErrCompacted is returned if the revision
+	// is compacted before all keys have been read.
+	Snapshot(ctx context.Context, f func(kv *KeyValue) error) (int64, error)
+}
+
+// Deltaer is implemented by backends that can report the keys changed between two revisions.
+type Deltaer interface {
+	// Delta calls f, in key order, with the state as of revision to of each key changed after
+	// revision from: the key's latest event, which is a delete if the key no longer exists, with
+	// PrevKV set to the key's state at revision from. Create is set if the key did not exist at
+	// revision from. Keys created and deleted in between are omitted, as they exist at neither
+	// revision. ErrCompacted is returned if from has been compacted, and ErrFutureRev if to is
+	// after the current revision.
+	Delta(ctx context.Context, from, to int64, f func(event *Event) error) error
+}
+
+// Diagnoser is implemented by backends that can report their internal state for
+// diagnosing faults.
+type Diagnoser interface {
+	// Diagnostics returns a snapshot of the backend's state, without blocking writes.
+	Diagnostics(ctx context.Context) (*BackendDiagnostics, error)
+}
+
+// BackendDiagnostics is a snapshot of the internal state of a backend.
+type BackendDiagnostics struct {
+	// CompactRevision is the revision that the datastore has been compacted to.
+	CompactRevision int64 `json:"compactRevision"`
+	// Pools describes the current use of each connection pool.
+	Pools []PoolStats `json:"pools,omitempty"`
+	// Leases lists the keys with a lease that are waiting to expire.
+	Leases []LeaseDiagnostics `json:"leases"`
+}
+
+// PoolStats describes the current use of a database connection pool.
+type PoolStats struct {
+	Name string `json:"name"`
+	// Open is the number of open connections, both in use and idle.
+	Open int `json:"open"`
+	// InUse is the number of connections in use.
+	InUse int `json:"inUse"`
+	// Idle is the number of idle connections.
+	Idle int `json:"idle"`
+	// WaitCount is the total number of times a connection was waited for.
+	WaitCount int64 `json:"waitCount"`
+	// WaitDuration is the total time spent waiting for connections.
+	WaitDuration string `json:"waitDuration"`
+}
+
+// LeaseDiagnostics describes a key with a lease that is waiting to expire.
+type LeaseDiagnostics struct {
+	Key         string    `json:"key"`
+	Lease       int64     `json:"lease"`
+	ModRevision int64     `json:"modRevision"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// PoolConfig describes the limits applied to a database connection pool.
+type PoolConfig struct {
+	Name string `json:"name"`
+	// MaxOpen is the maximum number of open connections; 0 means unlimited.
+	MaxOpen int `json:"maxOpen"`
+	// MaxIdle is the maximum number of idle connections.
+	MaxIdle int `json:"maxIdle"`
+	// MaxLifetime is the maximum amount of time a connection may be reused; 0s means forever.
+	MaxLifetime string `json:"maxLifetime"`
+}
+
 type Dialect interface {
 	ListCurrent(ctx context.Context, prefix, startKey string, limit int64, includeDeleted, keysOnly bool) (*sql.Rows, error)
 	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted, keysOnly bool) (*sql.Rows, error)
 	CountCurrent(ctx context.Context, prefix, startKey string) (int64, int64, error)
 	Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error)
+	ListRange(ctx context.Context, prefix, startKey, endKey string, limit, revision int64, includeDeleted, keysOnly bool) (*sql.Rows, error)
+	CountRange(ctx context.Context, prefix, startKey, endKey string, revision int64) (int64, int64, error)
+	CountCurrentKeys(ctx context.Context, prefix, startKey string) (int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
 	After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error)
 	//nolint:revive
 	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
+	InsertAll(ctx context.Context, rows []InsertRow) ([]int64, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	GetCompactRevision(ctx context.Context) (int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
-	Compact(ctx context.Context, revision int64) (int64, error)
+	Compact(ctx context.Context, start, revision int64) (int64, error)
 	PostCompact(ctx context.Context) error
+	Analyze(ctx context.Context) error
+	LiveDigest(ctx context.Context, revision int64) (int64, int64, error)
+	CountCompactable(ctx context.Context, revision int64) (int64, error)
 	Fill(ctx context.Context, revision int64) error
 	IsFill(key string) bool
 	BeginTx(ctx context.Context, opts *sql.TxOptions) (Transaction, error)
 	GetSize(ctx context.Context) (int64, error)
+	GetStats(ctx context.Context) (*StorageStats, error)
+	DriverConfig() *DriverConfig
+	Statements() map[string]string
+	PoolStats() []PoolStats
+	SetKeyMetadata(ctx context.Context, key string, metadata map[string]string) error
+	GetKeyMetadata(ctx context.Context, key string) (map[string]string, error)
+	ListKeyMetadata(ctx context.Context, prefix string) (map[string]map[string]string, error)
 	FillRetryDelay(ctx context.Context)
 	TranslateStartKey(startKey string) string
 }
 
+// InsertRow holds the columns of a row inserted by Dialect.InsertAll.
+type InsertRow struct {
+	Key              string
+	Create           bool
+	Delete           bool
+	CreateRevision   int64
+	PreviousRevision int64
+	Lease            int64
+	Value            []byte
+	PrevValue        []byte
+}
+
 type Transaction interface {
 	Commit() error
 	MustCommit()
@@ -63,7 +312,9 @@ type Transaction interface {
 	MustRollback()
 	GetCompactRevision(ctx context.Context) (int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
-	Compact(ctx context.Context, revision int64) (int64, error)
+	Compact(ctx context.Context, start, revision int64) (int64, error)
+	CompactValues(ctx context.Context, start, revision int64) ([][]byte, error)
+	LiveDigest(ctx context.Context, revision int64) (int64, int64, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	CurrentRevision(ctx context.Context) (int64, error)
 }
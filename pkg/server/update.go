@@ -30,6 +30,10 @@ func (l *LimitedServer) update(ctx context.Context, rev int64, key string, value
 		err error
 	)
 
+	if err := checkWriteKey(key); err != nil {
+		return nil, err
+	}
+
 	if rev == 0 {
 		rev, err = l.backend.Create(ctx, key, value, lease)
 		if err == ErrKeyExists {
@@ -50,6 +54,7 @@ func (l *LimitedServer) update(ctx context.Context, rev int64, key string, value
 	}
 
 	if ok {
+		l.prefixMetrics.observeWrite(key, "update")
 		resp.Responses = []*etcdserverpb.ResponseOp{
 			{
 				Response: &etcdserverpb.ResponseOp_ResponsePut{
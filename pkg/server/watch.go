@@ -1,17 +1,24 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"math/rand"
+	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/util"
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -35,13 +42,28 @@ func (s *KVServerBridge) getProgressReportInterval() time.Duration {
 }
 
 func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
+	var trimValues int
+	if md, ok := metadata.FromIncomingContext(ws.Context()); ok {
+		if v := md.Get(WatchTrimValuesMetadataKey); len(v) > 0 {
+			size, err := strconv.Atoi(v[0])
+			if err != nil || size < 0 {
+				return status.Errorf(codes.InvalidArgument, "etcdserver: invalid %s request metadata %q: must be a size in bytes", WatchTrimValuesMetadataKey, v[0])
+			}
+			trimValues = size
+		}
+	}
+
 	id := atomic.AddInt64(&serverID, 1)
 	w := watcher{
-		id:       id,
-		server:   &server{ws: ws},
-		backend:  s.limited.backend,
-		watches:  map[int64]func(){},
-		progress: map[int64]chan<- int64{},
+		id:         id,
+		server:     &server{ws: ws},
+		backend:    s.limited.backend,
+		maxLag:     s.limited.maxWatchLag,
+		verify:     s.limited.verifyWatchOrder,
+		trimValues: trimValues,
+		registry:   s.watches,
+		watches:    map[int64]func(){},
+		progress:   map[int64]chan<- int64{},
 	}
 	defer w.Close()
 
@@ -95,9 +117,15 @@ type watcher struct {
 	wg       sync.WaitGroup
 	backend  Backend
 	server   *server
+	maxLag   int64
+	registry *watchRegistry
 	watches  map[int64]func()
 	progress map[int64]chan<- int64
 	notify   atomic.Bool
+	// trimValues is the size above which values in put events are trimmed, if greater than zero
+	trimValues int
+	// verify enables checking that events are received from the backend in revision order
+	verify bool
 }
 
 func (w *watcher) Create(ctx context.Context, r *etcdserverpb.WatchCreateRequest) {
@@ -155,6 +183,13 @@ func (w *watcher) watch(ctx context.Context, key string, id, startRevision int64
 		return
 	}
 
+	// events at or below the revision that the watch was created at are its backfill from the
+	// start revision, which are not counted towards the lag limit
+	var createdRevision int64
+	if w.maxLag > 0 {
+		createdRevision, _ = w.backend.CurrentRevision(ctx)
+	}
+
 	wr := w.backend.Watch(ctx, key, startRevision)
 
 	// If the watch result has a non-zero CompactRevision, then the watch request failed due to
@@ -165,6 +200,10 @@ func (w *watcher) watch(ctx context.Context, key string, id, startRevision int64
 		return
 	}
 
+	state := w.registry.add(w.id, id, key, startRevision)
+	defer w.registry.remove(id)
+
+	var lastRevision, receivedRevision int64
 	outer := true
 	for outer {
 		var reads int
@@ -191,9 +230,36 @@ func (w *watcher) watch(ctx context.Context, key string, id, startRevision int64
 					inner = false
 				}
 			}
-			// get max revision from collected events
+			if w.verify {
+				receivedRevision = w.verifyOrder(id, key, events, receivedRevision)
+			}
+			// enforce delivery order, and get max revision from collected events
+			var missed bool
+			events, missed = orderEvents(events, lastRevision)
+			if missed {
+				// an event below the last delivered revision cannot be sent without breaking
+				// revision order, so the watch is cancelled as compacted at the last delivered
+				// revision, which causes clients to re-list instead of resuming the watch.
+				current, err := w.backend.CurrentRevision(ctx)
+				if err != nil {
+					current = lastRevision
+				}
+				logrus.Errorf("WATCH OUT OF ORDER server=%d, id=%d, key=%s, lastRevision=%d; cancelling watch", w.id, id, key, lastRevision)
+				w.Cancel(id, current, lastRevision, ErrCompacted)
+				for range wr.Events {
+				}
+				return
+			}
 			if len(events) > 0 {
 				revision = events[len(events)-1].KV.ModRevision
+				if current, oldest, lagging := w.lagging(ctx, events, createdRevision); lagging {
+					logrus.Warnf("WATCH LAGGING server=%d, id=%d, key=%s, revision=%d, currentRevision=%d, maxLag=%d; cancelling watch", w.id, id, key, oldest, current, w.maxLag)
+					w.Cancel(id, current, 0, ErrWatchLagging)
+					// the backend watch must still be drained until it is closed
+					for range wr.Events {
+					}
+					return
+				}
 			}
 		case revision = <-progressCh:
 			// have been requested to send progress with no events
@@ -208,6 +274,9 @@ func (w *watcher) watch(ctx context.Context, key string, id, startRevision int64
 				WatchId: id,
 				Events:  toEvents(events...),
 			}
+			if w.trimValues > 0 {
+				trimEvents(wr.Events, w.trimValues)
+			}
 			if trace {
 				keys := make([]string, len(wr.Events))
 				for i, event := range wr.Events {
@@ -218,6 +287,10 @@ func (w *watcher) watch(ctx context.Context, key string, id, startRevision int64
 			if err := w.server.Send(wr); err != nil {
 				w.Cancel(id, 0, 0, err)
 			}
+			if len(events) > 0 {
+				lastRevision = revision
+				state.delivered(revision)
+			}
 		}
 	}
 
@@ -230,6 +303,69 @@ func (w *watcher) watch(ctx context.Context, key string, id, startRevision int64
 	logrus.Tracef("WATCH CLOSE server=%d, id=%d, key=%s", w.id, id, key)
 }
 
+// lagging returns the current revision and the revision of the oldest unsent event that is above
+// createdRevision, and true if the watch is more than maxLag revisions behind the current revision.
+// Every event before the oldest unsent event has already been sent, so the watch is considered to
+// have caught up to the revision before it. Events at or below createdRevision are the watch's
+// backfill, so a watch that resumes from further back than maxLag is not cancelled while it catches up.
+func (w *watcher) lagging(ctx context.Context, events []*Event, createdRevision int64) (int64, int64, bool) {
+	if w.maxLag <= 0 {
+		return 0, 0, false
+	}
+	i := slices.IndexFunc(events, func(e *Event) bool { return e.KV.ModRevision > createdRevision })
+	if i < 0 {
+		return 0, 0, false
+	}
+	revision := events[i].KV.ModRevision
+	current, err := w.backend.CurrentRevision(ctx)
+	if err != nil {
+		return 0, 0, false
+	}
+	return current, revision, current-(revision-1) > w.maxLag
+}
+
+// verifyOrder logs and counts any event that is not above the revision of the events received
+// before it, and returns the highest revision received.
+func (w *watcher) verifyOrder(id int64, key string, events []*Event, receivedRevision int64) int64 {
+	for _, event := range events {
+		if event.KV.ModRevision <= receivedRevision {
+			logrus.Errorf("WATCH ORDER VIOLATION server=%d, id=%d, key=%s, revision=%d, receivedRevision=%d", w.id, id, key, event.KV.ModRevision, receivedRevision)
+			metrics.WatchOrderViolationsTotal.Inc()
+			continue
+		}
+		receivedRevision = event.KV.ModRevision
+	}
+	return receivedRevision
+}
+
+// orderEvents ensures that events are delivered to the client in strictly ascending
+// revision order. Every kine revision is a write to a single key - multi-key transactions
+// are not supported - so events never share a revision. Events collected out of order
+// are sorted, and repeated events at the same revision are dropped. If any event is below
+// the last delivered revision, it can no longer be delivered in order, and missed is true.
+func orderEvents(events []*Event, lastRevision int64) (ordered []*Event, missed bool) {
+	if !slices.IsSortedFunc(events, compareEvents) {
+		events = slices.Clone(events)
+		slices.SortStableFunc(events, compareEvents)
+	}
+
+	ordered = make([]*Event, 0, len(events))
+	for _, event := range events {
+		switch {
+		case event.KV.ModRevision < lastRevision:
+			missed = true
+		case event.KV.ModRevision > lastRevision:
+			ordered = append(ordered, event)
+			lastRevision = event.KV.ModRevision
+		}
+	}
+	return ordered, missed
+}
+
+func compareEvents(a, b *Event) int {
+	return cmp.Compare(a.KV.ModRevision, b.KV.ModRevision)
+}
+
 func toEvents(events ...*Event) []*mvccpb.Event {
 	ret := make([]*mvccpb.Event, 0, len(events))
 	for _, e := range events {
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func revEvents(revs ...int64) []*Event {
+	events := make([]*Event, 0, len(revs))
+	for _, rev := range revs {
+		events = append(events, &Event{KV: &KeyValue{Key: "/a", ModRevision: rev}})
+	}
+	return events
+}
+
+func eventRevs(events []*Event) []int64 {
+	revs := make([]int64, 0, len(events))
+	for _, event := range events {
+		revs = append(revs, event.KV.ModRevision)
+	}
+	return revs
+}
+
+func TestOrderEvents(t *testing.T) {
+	tests := []struct {
+		name         string
+		in           []int64
+		lastRevision int64
+		want         []int64
+		missed       bool
+	}{
+		{"empty", nil, 0, []int64{}, false},
+		{"sorted", []int64{1, 2, 3}, 0, []int64{1, 2, 3}, false},
+		{"unsorted", []int64{3, 1, 2}, 0, []int64{1, 2, 3}, false},
+		{"duplicates", []int64{1, 2, 2, 3}, 0, []int64{1, 2, 3}, false},
+		{"last delivered repeated", []int64{5, 6}, 5, []int64{6}, false},
+		{"below last delivered", []int64{4, 5, 6}, 5, []int64{6}, true},
+		{"all delivered", []int64{4, 5}, 5, []int64{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ordered, missed := orderEvents(revEvents(test.in...), test.lastRevision)
+			if missed != test.missed {
+				t.Fatalf("expected missed=%v, got %v", test.missed, missed)
+			}
+			got := eventRevs(ordered)
+			if len(got) != len(test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("expected %v, got %v", test.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderEventsDoesNotModifyInput(t *testing.T) {
+	events := revEvents(3, 1, 2)
+	orderEvents(events, 0)
+	if got := eventRevs(events); got[0] != 3 || got[1] != 1 || got[2] != 2 {
+		t.Fatalf("input events were reordered: %v", got)
+	}
+}
+
+func TestMultiKeyTxnNotSupported(t *testing.T) {
+	l := &LimitedServer{}
+	put := func(key string) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(key)}}}
+	}
+	_, err := l.Txn(context.Background(), &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{},
+		}},
+		Success: []*etcdserverpb.RequestOp{put("/a"), put("/b")},
+	})
+	if err != ErrNotSupported {
+		t.Fatalf("expected %v, got %v", ErrNotSupported, err)
+	}
+}
+
+// lagBackend implements only the backend methods needed to watch keys;
+// calling any other method will panic.
+type lagBackend struct {
+	Backend
+	current atomic.Int64
+	events  chan []*Event
+}
+
+func (b *lagBackend) CurrentRevision(ctx context.Context) (int64, error) {
+	return b.current.Load(), nil
+}
+
+func (b *lagBackend) Watch(ctx context.Context, key string, revision int64) WatchResult {
+	return WatchResult{Events: b.events, Errorc: make(chan error)}
+}
+
+// stalledStream implements only the stream methods needed to send watch responses;
+// calling any other method will panic. Sends of responses with events block until
+// released, to simulate a client that is not reading.
+type stalledStream struct {
+	etcdserverpb.Watch_WatchServer
+	stalled   chan struct{}
+	release   chan struct{}
+	responses chan *etcdserverpb.WatchResponse
+}
+
+func (s *stalledStream) Send(wr *etcdserverpb.WatchResponse) error {
+	if len(wr.Events) > 0 {
+		s.stalled <- struct{}{}
+		<-s.release
+	}
+	s.responses <- wr
+	return nil
+}
+
+func TestMaxWatchLag(t *testing.T) {
+	backend := &lagBackend{events: make(chan []*Event, 10)}
+	stream := &stalledStream{
+		stalled:   make(chan struct{}),
+		release:   make(chan struct{}),
+		responses: make(chan *etcdserverpb.WatchResponse, 10),
+	}
+	w := &watcher{
+		server:   &server{ws: stream},
+		backend:  backend,
+		maxLag:   10,
+		watches:  map[int64]func(){},
+		progress: map[int64]chan<- int64{},
+	}
+	defer w.Close()
+
+	receive := func() *etcdserverpb.WatchResponse {
+		select {
+		case wr := <-stream.responses:
+			return wr
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watch response")
+			return nil
+		}
+	}
+
+	backend.current.Store(1)
+	w.Create(context.Background(), &etcdserverpb.WatchCreateRequest{Key: []byte("/a"), WatchId: clientv3.AutoWatchID})
+	if wr := receive(); !wr.Created {
+		t.Fatalf("expected created response, got %v", wr)
+	}
+
+	// the first event is sent while the watch is within the lag limit, but the client stalls
+	// while the current revision moves well beyond the limit
+	backend.events <- revEvents(1)
+	<-stream.stalled
+	backend.current.Store(100)
+	backend.events <- revEvents(50)
+	stream.release <- struct{}{}
+	if wr := receive(); len(wr.Events) != 1 || wr.Events[0].Kv.ModRevision != 1 {
+		t.Fatalf("expected event at revision 1, got %v", wr)
+	}
+
+	close(backend.events)
+	wr := receive()
+	if !wr.Canceled || wr.CancelReason != ErrWatchLagging.Error() || wr.Header.Revision != 100 {
+		t.Fatalf("expected watch to be cancelled for lagging at revision 100, got %v", wr)
+	}
+}
+
+func TestMaxWatchLagBackfill(t *testing.T) {
+	backend := &lagBackend{events: make(chan []*Event, 10)}
+	stream := &stalledStream{
+		stalled:   make(chan struct{}),
+		release:   make(chan struct{}),
+		responses: make(chan *etcdserverpb.WatchResponse, 10),
+	}
+	w := &watcher{
+		server:   &server{ws: stream},
+		backend:  backend,
+		maxLag:   10,
+		watches:  map[int64]func(){},
+		progress: map[int64]chan<- int64{},
+	}
+	defer w.Close()
+
+	receive := func() *etcdserverpb.WatchResponse {
+		select {
+		case wr := <-stream.responses:
+			return wr
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watch response")
+			return nil
+		}
+	}
+
+	// the watch resumes from well beyond the lag limit; its backfill up to the revision it was
+	// created at is delivered rather than cancelling the watch
+	backend.current.Store(100)
+	w.Create(context.Background(), &etcdserverpb.WatchCreateRequest{Key: []byte("/a"), StartRevision: 2, WatchId: clientv3.AutoWatchID})
+	if wr := receive(); !wr.Created {
+		t.Fatalf("expected created response, got %v", wr)
+	}
+	backend.events <- revEvents(2, 50, 100)
+	<-stream.stalled
+	stream.release <- struct{}{}
+	if wr := receive(); wr.Canceled || len(wr.Events) != 3 {
+		t.Fatalf("expected backfill events to be sent, got %v", wr)
+	}
+
+	// once caught up, events after the creation revision are still subject to the limit
+	backend.current.Store(200)
+	backend.events <- revEvents(101)
+	close(backend.events)
+	wr := receive()
+	if !wr.Canceled || wr.CancelReason != ErrWatchLagging.Error() || wr.Header.Revision != 200 {
+		t.Fatalf("expected watch to be cancelled for lagging at revision 200, got %v", wr)
+	}
+}
+
+func TestWatchTrimValues(t *testing.T) {
+	backend := &lagBackend{events: make(chan []*Event, 10)}
+	stream := &stalledStream{
+		stalled:   make(chan struct{}),
+		release:   make(chan struct{}),
+		responses: make(chan *etcdserverpb.WatchResponse, 10),
+	}
+	w := &watcher{
+		server:     &server{ws: stream},
+		backend:    backend,
+		trimValues: 10,
+		watches:    map[int64]func(){},
+		progress:   map[int64]chan<- int64{},
+	}
+	defer w.Close()
+
+	receive := func() *etcdserverpb.WatchResponse {
+		select {
+		case wr := <-stream.responses:
+			return wr
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watch response")
+			return nil
+		}
+	}
+
+	w.Create(context.Background(), &etcdserverpb.WatchCreateRequest{Key: []byte("/"), WatchId: clientv3.AutoWatchID})
+	if wr := receive(); !wr.Created {
+		t.Fatalf("expected created response, got %v", wr)
+	}
+
+	large := bytes.Repeat([]byte("x"), 100)
+	backend.events <- []*Event{
+		{KV: &KeyValue{Key: "/large", ModRevision: 1, Value: large}},
+		{KV: &KeyValue{Key: "/small", ModRevision: 2, Value: []byte("v")}},
+		{Delete: true, KV: &KeyValue{Key: "/deleted", ModRevision: 3, Value: large}},
+	}
+	<-stream.stalled
+	stream.release <- struct{}{}
+	wr := receive()
+	if len(wr.Events) != 3 {
+		t.Fatalf("expected 3 events, got %v", wr)
+	}
+	if size, ok := TrimmedValueSize(wr.Events[0].Kv.Value); !ok || size != len(large) {
+		t.Fatalf("expected placeholder for value of size %d, got %q", len(large), wr.Events[0].Kv.Value)
+	}
+	if string(wr.Events[1].Kv.Value) != "v" {
+		t.Fatalf("expected small value to be sent in full, got %q", wr.Events[1].Kv.Value)
+	}
+	if !bytes.Equal(wr.Events[2].Kv.Value, large) {
+		t.Fatalf("expected delete to be sent in full, got %q", wr.Events[2].Kv.Value)
+	}
+	close(backend.events)
+}
+
+func TestVerifyWatchOrder(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		t.Run(fmt.Sprintf("verify=%v", verify), func(t *testing.T) {
+			backend := &lagBackend{events: make(chan []*Event, 10)}
+			stream := &stalledStream{
+				stalled:   make(chan struct{}),
+				release:   make(chan struct{}),
+				responses: make(chan *etcdserverpb.WatchResponse, 10),
+			}
+			w := &watcher{
+				server:   &server{ws: stream},
+				backend:  backend,
+				verify:   verify,
+				watches:  map[int64]func(){},
+				progress: map[int64]chan<- int64{},
+			}
+			defer w.Close()
+
+			receive := func() *etcdserverpb.WatchResponse {
+				select {
+				case wr := <-stream.responses:
+					return wr
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for watch response")
+					return nil
+				}
+			}
+
+			w.Create(context.Background(), &etcdserverpb.WatchCreateRequest{Key: []byte("/a"), WatchId: clientv3.AutoWatchID})
+			if wr := receive(); !wr.Created {
+				t.Fatalf("expected created response, got %v", wr)
+			}
+
+			before := testutil.ToFloat64(metrics.WatchOrderViolationsTotal)
+			backend.events <- revEvents(2, 3)
+			<-stream.stalled
+			stream.release <- struct{}{}
+			receive()
+
+			// an event below the revision of one already received is out of order, and
+			// cancels the watch as compacted at the last delivered revision
+			backend.events <- revEvents(1, 4)
+			if wr := receive(); !wr.Canceled || wr.CompactRevision != 3 {
+				t.Fatalf("expected watch to be cancelled as compacted at revision 3, got %v", wr)
+			}
+
+			want := before
+			if verify {
+				want++
+			}
+			if got := testutil.ToFloat64(metrics.WatchOrderViolationsTotal); got != want {
+				t.Fatalf("expected %v order violations, got %v", want-before, got-before)
+			}
+			close(backend.events)
+		})
+	}
+}
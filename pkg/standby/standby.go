@@ -0,0 +1,348 @@
+// Package standby replicates writes from the kine backend to a warm standby backend.
+package standby
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBufferSize = 1000
+	// watchPrefix watches the whole keyspace, including keys outside of /
+	watchPrefix   = ""
+	syncPageSize  = 500
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 5 * time.Second
+	// maxApplyAttempts is the number of times an event is applied to the standby before
+	// replication is restarted, so that a single event the standby rejects does not stall
+	// replication.
+	maxApplyAttempts = 5
+)
+
+type Config struct {
+	// Endpoint is the datastore endpoint of the standby backend. Writes are not
+	// replicated if it is empty.
+	Endpoint string
+	// BufferSize is the maximum number of events held in memory while the standby
+	// is unavailable or falling behind. When the buffer is full, replication is
+	// restarted by copying all keys to the standby again.
+	BufferSize int
+}
+
+// Start copies all keys from the primary backend to the standby backend, and then applies every
+// later event to the standby. Replication is asynchronous and best-effort: writes to the primary
+// are never blocked by the standby. If the standby falls too far behind, or an event cannot be
+// applied, replication is restarted by copying all keys again, so that the standby does not
+// remain out of date.
+func Start(ctx context.Context, wg *sync.WaitGroup, primary, standby server.Backend, config Config) {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultBufferSize
+	}
+
+	r := &replicator{
+		primary:    primary,
+		standby:    standby,
+		bufferSize: config.BufferSize,
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.run(ctx)
+	}()
+}
+
+type replicator struct {
+	primary    server.Backend
+	standby    server.Backend
+	bufferSize int
+
+	mu      sync.Mutex
+	watched int64
+	applied int64
+}
+
+// run copies all keys to the standby, and then replicates events from the revision copied
+// until an event is missed, at which point all keys are copied again.
+func (r *replicator) run(ctx context.Context) {
+	delay := minRetryDelay
+	for ctx.Err() == nil {
+		rev, err := r.sync(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Errorf("Standby replication failed to copy keys to standby, retrying in %s: %v", delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxRetryDelay)
+			continue
+		}
+		delay = minRetryDelay
+
+		r.replicate(ctx, rev)
+		if ctx.Err() == nil {
+			logrus.Warnf("Standby replication missed events after revision %d; copying all keys to standby again", r.appliedRevision())
+			metrics.StandbyResyncTotal.Inc()
+		}
+	}
+}
+
+// sync copies the primary's keys as of its current revision to the standby, and deletes any
+// keys from the standby that do not exist on the primary. The revision copied is returned.
+func (r *replicator) sync(ctx context.Context) (int64, error) {
+	keys := map[string]bool{}
+	rev, err := listAll(ctx, r.primary, 0, false, func(kv *server.KeyValue) error {
+		keys[kv.Key] = true
+		return r.applyKV(ctx, kv.Key, kv.Value, kv.Lease, false)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var stale []string
+	if _, err := listAll(ctx, r.standby, 0, true, func(kv *server.KeyValue) error {
+		if !keys[kv.Key] {
+			stale = append(stale, kv.Key)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	for _, key := range stale {
+		if err := r.applyKV(ctx, key, nil, 0, true); err != nil {
+			return 0, err
+		}
+	}
+
+	logrus.Infof("Standby replication copied %d keys to standby at revision %d", len(keys), rev)
+	r.setRevisions(rev, rev)
+	return rev, nil
+}
+
+// listAll calls f for each key on a backend at the given revision, or the current revision if
+// zero, in pages, returning the revision listed. Keys outside of / are only listed if the backend
+// can list arbitrary key ranges.
+func listAll(ctx context.Context, backend server.Backend, revision int64, keysOnly bool, f func(kv *server.KeyValue) error) (int64, error) {
+	rl, isRangeLister := backend.(server.RangeLister)
+	startKey := ""
+	for {
+		var (
+			rev int64
+			kvs []*server.KeyValue
+			err error
+		)
+		if isRangeLister {
+			rev, kvs, err = rl.ListRange(ctx, startKey+"\x00", "", syncPageSize, revision, keysOnly)
+		} else {
+			rev, kvs, err = backend.List(ctx, "/", startKey, syncPageSize, revision, keysOnly)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if revision == 0 {
+			revision = rev
+		}
+
+		var listed int
+		for _, kv := range kvs {
+			// prefix lists include the start key, which was already listed
+			if kv.Key <= startKey && startKey != "" {
+				continue
+			}
+			if err := f(kv); err != nil {
+				return 0, err
+			}
+			startKey = kv.Key
+			listed++
+		}
+		if listed == 0 {
+			return revision, nil
+		}
+	}
+}
+
+// replicate watches the primary from the revision after rev, and applies events to the standby
+// in order, until the context is done or an event is missed: because the buffer was full,
+// because it was compacted before it was watched, or because the standby did not accept it.
+func (r *replicator) replicate(ctx context.Context, rev int64) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan *server.Event, r.bufferSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		r.apply(ctx, events)
+	}()
+
+	r.watch(ctx, events, rev)
+	cancel()
+	<-done
+}
+
+// watch feeds events from the primary into the buffer, restarting the watch from the last
+// seen revision if it is closed. It returns once the context is done, or an event is missed.
+func (r *replicator) watch(ctx context.Context, events chan<- *server.Event, rev int64) {
+	for ctx.Err() == nil {
+		logrus.Infof("Standby replication watching from revision %d", rev+1)
+		wr := r.primary.Watch(ctx, watchPrefix, rev+1)
+		if wr.CompactRevision != 0 {
+			logrus.Warnf("Standby replication missed events between revision %d and %d due to compaction", rev, wr.CompactRevision)
+			metrics.StandbyDroppedTotal.Inc()
+			return
+		}
+		var ok bool
+		if rev, ok = r.forward(ctx, wr.Events, events, rev); !ok {
+			return
+		}
+		select {
+		case err := <-wr.Errorc:
+			logrus.Errorf("Standby replication watch failed: %v", err)
+		default:
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// forward pushes events into the buffer until the channel is closed or the context is done,
+// returning the revision of the last event received. False is returned if the buffer is full.
+func (r *replicator) forward(ctx context.Context, eventsCh <-chan []*server.Event, events chan<- *server.Event, rev int64) (int64, bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return rev, true
+		case batch, ok := <-eventsCh:
+			if !ok {
+				return rev, true
+			}
+			for _, event := range batch {
+				if event.KV.ModRevision <= rev {
+					continue
+				}
+				select {
+				case events <- event:
+				default:
+					logrus.Warnf("Standby replication buffer full; dropped event for %s at revision %d", event.KV.Key, event.KV.ModRevision)
+					metrics.StandbyDroppedTotal.Inc()
+					return rev, false
+				}
+				rev = event.KV.ModRevision
+				r.setRevisions(rev, -1)
+			}
+		}
+	}
+}
+
+// apply applies buffered events to the standby in order. Failed events are retried with
+// backoff, up to maxApplyAttempts times; apply returns if an event still fails, or the context
+// is done.
+func (r *replicator) apply(ctx context.Context, events <-chan *server.Event) {
+	for {
+		var event *server.Event
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-events:
+		}
+
+		delay := minRetryDelay
+		for attempt := 1; ; attempt++ {
+			err := r.applyKV(ctx, event.KV.Key, event.KV.Value, event.KV.Lease, event.Delete)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+				return
+			}
+			if attempt >= maxApplyAttempts {
+				logrus.Errorf("Standby replication failed to apply event for %s at revision %d after %d attempts: %v", event.KV.Key, event.KV.ModRevision, attempt, err)
+				metrics.StandbyDroppedTotal.Inc()
+				return
+			}
+			logrus.Errorf("Standby replication failed to apply event for %s at revision %d, retrying in %s: %v", event.KV.Key, event.KV.ModRevision, delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxRetryDelay)
+		}
+		r.setRevisions(-1, event.KV.ModRevision)
+	}
+}
+
+// applyKV writes a key to the standby, or deletes it. The standby has its own revision history,
+// so the write is made against whatever revision of the key the standby currently holds, and is
+// skipped if the standby already holds the same value.
+func (r *replicator) applyKV(ctx context.Context, key string, value []byte, lease int64, del bool) error {
+	_, current, err := r.standby.Get(ctx, key, "", 1, 0, del)
+	if err != nil {
+		return err
+	}
+
+	if del {
+		if current == nil {
+			return nil
+		}
+		_, _, _, err := r.standby.Delete(ctx, key, 0)
+		return err
+	}
+
+	if current == nil {
+		_, err := r.standby.Create(ctx, key, value, lease)
+		if err == server.ErrKeyExists {
+			return errors.New("key was created concurrently on standby")
+		}
+		return err
+	}
+	if current.Lease == lease && bytes.Equal(current.Value, value) {
+		return nil
+	}
+
+	_, _, ok, err := r.standby.Update(ctx, key, value, current.ModRevision, lease)
+	if err == nil && !ok {
+		return errors.New("key was updated concurrently on standby")
+	}
+	return err
+}
+
+// setRevisions records the latest revision watched on the primary and the latest revision
+// applied to the standby, and updates the lag metric. Negative values are left unchanged.
+func (r *replicator) setRevisions(watched, applied int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if watched >= 0 {
+		r.watched = watched
+	}
+	if applied >= 0 {
+		r.applied = applied
+	}
+	metrics.StandbyLag.Set(float64(r.lag()))
+}
+
+func (r *replicator) appliedRevision() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.applied
+}
+
+// lag returns the number of revisions that the standby is behind the primary. It must be
+// called with the lock held.
+func (r *replicator) lag() int64 {
+	return max(r.watched-r.applied, 0)
+}
@@ -0,0 +1,259 @@
+package standby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// memBackend is an in-memory backend that holds the latest value of each key, and the events
+// that led to them, for watches. All requests fail while it is down. Calling any method that is
+// not needed for replication will panic.
+type memBackend struct {
+	server.Backend
+	mu       sync.Mutex
+	down     bool
+	revision int64
+	keys     map[string]*server.KeyValue
+	events   []*server.Event
+	// changed is closed and replaced on each write, to wake watches
+	changed chan struct{}
+}
+
+var errDown = errors.New("backend is down")
+
+func newMemBackend() *memBackend {
+	return &memBackend{keys: map[string]*server.KeyValue{}, changed: make(chan struct{})}
+}
+
+func (b *memBackend) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = down
+}
+
+// state returns the value of each key.
+func (b *memBackend) state() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := map[string]string{}
+	for key, kv := range b.keys {
+		state[key] = string(kv.Value)
+	}
+	return state
+}
+
+// put sets a key to a value, ignoring whether the backend is down.
+func (b *memBackend) put(key, value string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.write(key, []byte(value), 0, false)
+}
+
+// del deletes a key, ignoring whether the backend is down.
+func (b *memBackend) del(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.write(key, nil, 0, true)
+}
+
+// write records a change to a key. It must be called with the lock held.
+func (b *memBackend) write(key string, value []byte, lease int64, del bool) *server.KeyValue {
+	b.revision++
+	prev := b.keys[key]
+	kv := &server.KeyValue{Key: key, Value: value, Lease: lease, CreateRevision: b.revision, ModRevision: b.revision}
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+	}
+	if del {
+		delete(b.keys, key)
+	} else {
+		b.keys[key] = kv
+	}
+	b.events = append(b.events, &server.Event{Create: prev == nil, Delete: del, KV: kv, PrevKV: prev})
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return kv
+}
+
+func (b *memBackend) CurrentRevision(ctx context.Context) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.revision, nil
+}
+
+func (b *memBackend) Get(ctx context.Context, key, rangeEnd string, limit, revision int64, keysOnly bool) (int64, *server.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return 0, nil, errDown
+	}
+	return b.revision, b.keys[key], nil
+}
+
+func (b *memBackend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return 0, errDown
+	}
+	if b.keys[key] != nil {
+		return b.revision, server.ErrKeyExists
+	}
+	return b.write(key, value, lease, false).ModRevision, nil
+}
+
+func (b *memBackend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return 0, nil, false, errDown
+	}
+	if kv := b.keys[key]; kv == nil || kv.ModRevision != revision {
+		return b.revision, kv, false, nil
+	}
+	kv := b.write(key, value, lease, false)
+	return kv.ModRevision, kv, true, nil
+}
+
+func (b *memBackend) Delete(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return 0, nil, false, errDown
+	}
+	kv := b.keys[key]
+	if kv == nil {
+		return b.revision, nil, false, nil
+	}
+	b.write(key, nil, 0, true)
+	return b.revision, kv, true, nil
+}
+
+// ListRange lists the current keys; listing at an earlier revision is not supported.
+func (b *memBackend) ListRange(ctx context.Context, startKey, endKey string, limit, revision int64, keysOnly bool) (int64, []*server.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return 0, nil, errDown
+	}
+	if revision != 0 && revision != b.revision {
+		return 0, nil, fmt.Errorf("cannot list at revision %d", revision)
+	}
+	var kvs []*server.KeyValue
+	for key, kv := range b.keys {
+		if key >= startKey && (endKey == "" || key < endKey) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	if limit > 0 && int64(len(kvs)) > limit {
+		kvs = kvs[:limit]
+	}
+	return b.revision, kvs, nil
+}
+
+func (b *memBackend) CountRange(ctx context.Context, startKey, endKey string, revision int64) (int64, int64, error) {
+	panic("not implemented")
+}
+
+// Watch sends every event from the given revision on, one at a time, until the context is done.
+func (b *memBackend) Watch(ctx context.Context, key string, revision int64) server.WatchResult {
+	events := make(chan []*server.Event)
+	go func() {
+		defer close(events)
+		next := revision
+		for {
+			b.mu.Lock()
+			var pending []*server.Event
+			for _, event := range b.events {
+				if event.KV.ModRevision >= next {
+					pending = append(pending, event)
+				}
+			}
+			changed := b.changed
+			b.mu.Unlock()
+
+			for _, event := range pending {
+				select {
+				case <-ctx.Done():
+					return
+				case events <- []*server.Event{event}:
+				}
+				next = event.KV.ModRevision + 1
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+		}
+	}()
+	return server.WatchResult{Events: events, Errorc: make(chan error)}
+}
+
+func waitForState(t *testing.T, standby *memBackend, want map[string]string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !maps.Equal(standby.state(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for standby to hold %v, got %v", want, standby.state())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicateToStandby(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	primary := newMemBackend()
+	standby := newMemBackend()
+
+	// keys written before replication starts, including those outside of /, are copied, and
+	// keys that only exist on the standby are deleted
+	primary.put("/a", "1")
+	primary.put("/b", "1")
+	primary.put("outside", "1")
+	standby.put("/stale", "1")
+	Start(ctx, wg, primary, standby, Config{BufferSize: 2})
+	waitForState(t, standby, primary.state())
+
+	primary.put("/a", "2")
+	primary.del("/b")
+	primary.put("outside", "2")
+	waitForState(t, standby, map[string]string{"/a": "2", "outside": "2"})
+
+	// While the standby is down, writes to the primary are never blocked; the buffer fills,
+	// and once the standby is back all keys are copied to it again.
+	resyncs := testutil.ToFloat64(metrics.StandbyResyncTotal)
+	standby.setDown(true)
+	for i := 0; i < 10; i++ {
+		primary.put(fmt.Sprintf("/c/%d", i), "down")
+		primary.put("/a", fmt.Sprint(i))
+	}
+	primary.del("/c/0")
+	deadline := time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(metrics.StandbyResyncTotal) == resyncs {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for replication to restart after missing events")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	standby.setDown(false)
+	waitForState(t, standby, primary.state())
+
+	primary.put("/d", "up")
+	waitForState(t, standby, primary.state())
+}
@@ -2,6 +2,10 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
 
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 )
@@ -12,6 +16,28 @@ type Config struct {
 	KeyFile       string
 	SkipVerify    bool
 	TrustedCAFile string
+	// SNICertificates are served in place of the certificate in CertFile and KeyFile to clients
+	// that request a server name that they are valid for.
+	SNICertificates []KeyPair
+}
+
+// KeyPair is a certificate file and the file holding its private key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ParseKeyPairs parses key pairs of the form cert-file:key-file.
+func ParseKeyPairs(values []string) ([]KeyPair, error) {
+	var pairs []KeyPair
+	for _, value := range values {
+		certFile, keyFile, ok := strings.Cut(value, ":")
+		if !ok || certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("invalid certificate %q: must be of the form cert-file:key-file", value)
+		}
+		pairs = append(pairs, KeyPair{CertFile: certFile, KeyFile: keyFile})
+	}
+	return pairs, nil
 }
 
 func (c Config) ClientConfig() (*tls.Config, error) {
@@ -35,6 +61,9 @@ func (c Config) ClientConfig() (*tls.Config, error) {
 
 func (c Config) ServerConfig() (*tls.Config, error) {
 	if c.CertFile == "" && c.KeyFile == "" {
+		if len(c.SNICertificates) > 0 {
+			return nil, errors.New("SNI certificates require a default server certificate and key")
+		}
 		return nil, nil
 	}
 
@@ -48,5 +77,42 @@ func (c Config) ServerConfig() (*tls.Config, error) {
 		return nil, err
 	}
 
+	if len(c.SNICertificates) > 0 {
+		if tlsConfig.GetCertificate, err = sniGetCertificate(c.SNICertificates, tlsConfig.GetCertificate); err != nil {
+			return nil, err
+		}
+	}
+
 	return tlsConfig, nil
 }
+
+// sniGetCertificate returns a GetCertificate function that serves the first of the given
+// certificates that is valid for the server name requested by the client, falling back to
+// defaultCert. Unlike the default certificate, which is reloaded for each connection, SNI
+// certificates are loaded once.
+func sniGetCertificate(pairs []KeyPair, defaultCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	certs := make([]*tls.Certificate, 0, len(pairs))
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SNI certificate %s: %w", pair.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, fmt.Errorf("failed to parse SNI certificate %s: %w", pair.CertFile, err)
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName != "" {
+			for _, cert := range certs {
+				if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+					return cert, nil
+				}
+			}
+		}
+		return defaultCert(hello)
+	}, nil
+}
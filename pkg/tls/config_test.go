@@ -0,0 +1,110 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for the given DNS name, and its key, to dir.
+func writeKeyPair(t *testing.T, dir, name string) KeyPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := KeyPair{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestSNICertificates(t *testing.T) {
+	dir := t.TempDir()
+	defaultPair := writeKeyPair(t, dir, "default.example")
+	config := Config{
+		CertFile: defaultPair.CertFile,
+		KeyFile:  defaultPair.KeyFile,
+		SNICertificates: []KeyPair{
+			writeKeyPair(t, dir, "a.example"),
+			writeKeyPair(t, dir, "b.example"),
+		},
+	}
+	serverConfig, err := config.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	for serverName, want := range map[string]string{
+		"a.example":     "a.example",
+		"b.example":     "b.example",
+		"other.example": "default.example",
+		"":              "default.example",
+	} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("failed to connect with server name %q: %v", serverName, err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if got != want {
+			t.Errorf("expected certificate for %s with server name %q, got %s", want, serverName, got)
+		}
+	}
+}
+
+func TestSNICertificatesRequireDefault(t *testing.T) {
+	config := Config{SNICertificates: []KeyPair{writeKeyPair(t, t.TempDir(), "a.example")}}
+	if _, err := config.ServerConfig(); err == nil {
+		t.Fatal("expected error for SNI certificates without a default certificate")
+	}
+}
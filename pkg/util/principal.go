@@ -0,0 +1,30 @@
+package util
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx that carries the given principal.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the identity of the client making the request carried by ctx: the principal
+// set with WithPrincipal, or else the common name of the client's verified TLS certificate. It
+// returns an empty string for unauthenticated clients, and for requests made by kine itself.
+func Principal(ctx context.Context) string {
+	if principal, ok := ctx.Value(principalKey{}).(string); ok {
+		return principal
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 && len(info.State.VerifiedChains[0]) > 0 {
+			return info.State.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+	return ""
+}
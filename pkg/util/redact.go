@@ -0,0 +1,103 @@
+package util
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// redacted replaces passwords in connection strings and errors.
+const redacted = "xxxxx"
+
+var (
+	// matches the password in scheme://user:password@ URLs, such as those used by postgres
+	urlPasswordRegexp = regexp.MustCompile(`^[^:/?]+://([^:@/]*):([^@/]*)@`)
+	// matches the password in user:password@ prefixed connection strings, such as those used by mysql
+	userPasswordRegexp = regexp.MustCompile(`^([^:@/]*):([^@]*)@`)
+	// matches password parameters in key=value connection strings, such as those used by postgres,
+	// and the _auth_pass parameter used by sqlite user authentication
+	passwordParamRegexp = regexp.MustCompile(`(?i)((?:password|_auth_pass)\s*=\s*)('[^']*'|[^\s&]+)`)
+)
+
+// RedactDataSourceName replaces any password in a datastore connection string,
+// whether it is a URL, a user:password@ prefixed DSN, or a set of key=value parameters.
+func RedactDataSourceName(dataSourceName string) string {
+	if u, err := url.Parse(dataSourceName); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		dataSourceName = u.String()
+	} else if urlPasswordRegexp.MatchString(dataSourceName) {
+		dataSourceName = urlPasswordRegexp.ReplaceAllStringFunc(dataSourceName, func(s string) string {
+			return s[:strings.LastIndex(s, ":")+1] + redacted + "@"
+		})
+	} else {
+		dataSourceName = userPasswordRegexp.ReplaceAllString(dataSourceName, "${1}:"+redacted+"@")
+	}
+	return passwordParamRegexp.ReplaceAllString(dataSourceName, "${1}"+redacted)
+}
+
+// RedactError returns an error with the same message as err, except that the
+// datastore connection string and any password it contains are redacted. Errors
+// from database drivers and URL parsing may include the connection string they
+// were given, and must be redacted before they are returned or logged. The
+// original error can still be inspected with errors.Is and errors.As.
+func RedactError(err error, dataSourceName string) error {
+	if err == nil {
+		return nil
+	}
+	passwords := dataSourcePasswords(dataSourceName)
+	if len(passwords) == 0 {
+		return err
+	}
+
+	msg := strings.ReplaceAll(err.Error(), dataSourceName, RedactDataSourceName(dataSourceName))
+	for _, password := range passwords {
+		msg = strings.ReplaceAll(msg, password, redacted)
+	}
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+// dataSourcePasswords returns the passwords in a datastore connection string, in
+// both their literal and unescaped forms.
+func dataSourcePasswords(dataSourceName string) []string {
+	var passwords []string
+	if m := urlPasswordRegexp.FindStringSubmatch(dataSourceName); m != nil {
+		passwords = append(passwords, m[2])
+	} else if m := userPasswordRegexp.FindStringSubmatch(dataSourceName); m != nil {
+		passwords = append(passwords, m[2])
+	}
+	for _, m := range passwordParamRegexp.FindAllStringSubmatch(dataSourceName, -1) {
+		passwords = append(passwords, m[2], strings.Trim(m[2], "'"))
+	}
+
+	var result []string
+	for _, password := range passwords {
+		if unescaped, err := url.QueryUnescape(password); err == nil && unescaped != password {
+			result = append(result, unescaped)
+		}
+		result = append(result, password)
+	}
+	// empty passwords cannot be redacted, and longer passwords are replaced first so that
+	// an unescaped password that is a substring of its escaped form is not partially replaced
+	result = slices.DeleteFunc(result, func(password string) bool { return password == "" })
+	slices.SortFunc(result, func(a, b string) int { return len(b) - len(a) })
+	return result
+}
+
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"regexp"
+	"strings"
 )
 
 var whitespace = regexp.MustCompile("[\n\t ]+")
@@ -20,16 +22,80 @@ type Summarize []any
 func (s Summarize) String() string {
 	ret := make([]any, len(s))
 	for i := range s {
-		switch v := s[i].(type) {
-		case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64, complex64, complex128, uintptr, bool:
-			ret[i] = v
-		case string:
-			ret[i] = fmt.Sprintf("'%s'", v)
+		ret[i] = summarize(s[i])
+	}
+	return fmt.Sprint(ret)
+}
+
+func summarize(arg any) any {
+	switch v := arg.(type) {
+	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64, complex64, complex128, uintptr, bool:
+		return v
+	case string:
+		return fmt.Sprintf("'%s'", v)
+	case []byte:
+		return fmt.Sprintf("[%d]byte(...)", len(v))
+	default:
+		return fmt.Sprintf("%T{...}", v)
+	}
+}
+
+const (
+	// RedactHash replaces redacted values with a truncated hash of their contents.
+	RedactHash = "hash"
+	// RedactElide replaces redacted values with their length.
+	RedactElide = "elide"
+
+	// maxRedactedValueBytes is the maximum number of bytes of a non-secret value to print.
+	maxRedactedValueBytes = 256
+)
+
+// Redacted wraps a slice of SQL bind arguments, and when stringed prints their values.
+// If any string argument starts with one of Prefixes, all byte slice arguments are
+// considered secret and are redacted according to Mode. String arguments, which hold
+// keys, are never redacted.
+type Redacted struct {
+	Args     []any
+	Prefixes []string
+	Mode     string
+}
+
+func (r Redacted) String() string {
+	var secret bool
+	for _, arg := range r.Args {
+		if s, ok := arg.(string); ok && hasAnyPrefix(s, r.Prefixes) {
+			secret = true
+			break
+		}
+	}
+
+	ret := make([]any, len(r.Args))
+	for i := range r.Args {
+		switch v := r.Args[i].(type) {
 		case []byte:
-			ret[i] = fmt.Sprintf("[%d]byte(...)", len(v))
+			switch {
+			case !secret && len(v) > maxRedactedValueBytes:
+				ret[i] = fmt.Sprintf("%q...", v[:maxRedactedValueBytes])
+			case !secret:
+				ret[i] = fmt.Sprintf("%q", v)
+			case r.Mode == RedactHash:
+				sum := sha256.Sum256(v)
+				ret[i] = fmt.Sprintf("sha256:%x", sum[:8])
+			default:
+				ret[i] = fmt.Sprintf("[%d]byte(redacted)", len(v))
+			}
 		default:
-			ret[i] = fmt.Sprintf("%T{...}", v)
+			ret[i] = summarize(v)
 		}
 	}
 	return fmt.Sprint(ret)
 }
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
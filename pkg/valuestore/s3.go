@@ -0,0 +1,90 @@
+package valuestore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultS3Endpoint = "s3.amazonaws.com"
+
+// s3Store is an object store using the S3 API. Credentials are found in the same places as
+// the AWS CLI looks for them: the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables, the shared credentials file, and finally web
+// identity, ECS task or EC2 instance roles.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+// newS3Store returns an S3 store for a URL of the form s3://bucket/prefix. The endpoint and
+// region query parameters select an S3-compatible service other than AWS S3; objects are
+// addressed by path on such endpoints, and by virtual host on AWS S3.
+func newS3Store(u *url.URL) (*s3Store, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("external value store %q does not specify a bucket", u.Redacted())
+	}
+
+	options := &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		}),
+		Secure:       true,
+		Region:       u.Query().Get("region"),
+		BucketLookup: minio.BucketLookupDNS,
+	}
+
+	host := defaultS3Endpoint
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil || e.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		host = e.Host
+		options.Secure = e.Scheme != "http"
+		options.BucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(host, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client for external value store: %w", err)
+	}
+	return &s3Store{client: client, bucket: u.Host}, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, name, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	return err
+}
+
+func (s *s3Store) Get(ctx context.Context, name string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return data, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	return s3Error(s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}))
+}
+
+// s3Error wraps errors for objects that do not exist in ErrNotFound.
+func s3Error(err error) error {
+	if err != nil && minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package valuestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+)
+
+// DefaultThreshold is the size in bytes above which values are stored externally, if no
+// threshold is configured.
+const DefaultThreshold = 256 * 1024
+
+// pointerPrefix begins each pointer to an externally stored value. Values that begin with the
+// prefix are always stored externally, regardless of their size, so that any stored value that
+// begins with the prefix is known to be a pointer.
+var pointerPrefix = []byte("\x00kine-external-value\x00")
+
+// MaxPointerLength is the maximum length of a pointer; longer stored values are never pointers,
+// so the datastore may skip reading them when looking for pointers.
+const MaxPointerLength = 1024
+
+// ErrNotFound is returned by a Store if an object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Store is an object store that holds values too large to store inline in the datastore.
+type Store interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// Values stores values larger than a threshold in an object store, and stores a pointer to the
+// object in the datastore in place of the value. Each stored value is written to a new object,
+// so that an object is only referenced by a single row, and can be deleted with the row.
+type Values struct {
+	store     Store
+	prefix    string
+	threshold int
+}
+
+// New returns Values that store values larger than threshold in the object store at storeURL.
+// The only supported scheme is s3, in the form s3://bucket/prefix; see newS3Store for options.
+func New(storeURL string, threshold int) (*Values, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external value store %q: %w", storeURL, err)
+	}
+
+	var store Store
+	switch u.Scheme {
+	case "s3":
+		if store, err = newS3Store(u); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported external value store scheme %q", u.Scheme)
+	}
+	return NewWithStore(store, u.Path, threshold), nil
+}
+
+// NewWithStore returns Values that store values larger than threshold in the given object store,
+// under the given object name prefix.
+func NewWithStore(store Store, prefix string, threshold int) *Values {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	return &Values{
+		store:     store,
+		prefix:    path.Clean("/" + prefix)[1:],
+		threshold: threshold,
+	}
+}
+
+// Store returns the value to store in the datastore for value: either the value itself, or a
+// pointer to a new object holding the value.
+func (v *Values) Store(ctx context.Context, value []byte) ([]byte, error) {
+	if !v.IsExternal(value) {
+		return value, nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	name := path.Join(v.prefix, hex.EncodeToString(id))
+	if err := v.store.Put(ctx, name, value); err != nil {
+		return nil, fmt.Errorf("failed to store value externally: %w", err)
+	}
+	return append(bytes.Clone(pointerPrefix), name...), nil
+}
+
+// IsExternal returns true if Store would store the value externally.
+func (v *Values) IsExternal(value []byte) bool {
+	return len(value) > v.threshold || bytes.HasPrefix(value, pointerPrefix)
+}
+
+// Load returns the value for a value read from the datastore, fetching it from the object
+// store if it is a pointer.
+func (v *Values) Load(ctx context.Context, stored []byte) ([]byte, error) {
+	name, ok := IsPointer(stored)
+	if !ok {
+		return stored, nil
+	}
+	value, err := v.store.Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load externally stored value %s: %w", name, err)
+	}
+	return value, nil
+}
+
+// Delete deletes the object referenced by a value read from the datastore, if it is a pointer.
+// Objects that no longer exist are ignored.
+func (v *Values) Delete(ctx context.Context, stored []byte) error {
+	name, ok := IsPointer(stored)
+	if !ok {
+		return nil
+	}
+	if err := v.store.Delete(ctx, name); err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to delete externally stored value %s: %w", name, err)
+	}
+	return nil
+}
+
+// IsPointer returns the object name if a value read from the datastore is a pointer.
+func IsPointer(stored []byte) (string, bool) {
+	if len(stored) > MaxPointerLength || !bytes.HasPrefix(stored, pointerPrefix) {
+		return "", false
+	}
+	return string(stored[len(pointerPrefix):]), true
+}